@@ -0,0 +1,387 @@
+// Package archive writes raw tweets to compressed, newline delimited JSON files for data lakes.
+package archive
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fallenstedt/twitter-stream/compliance"
+	"github.com/fallenstedt/twitter-stream/internal/fileutil"
+	"github.com/fallenstedt/twitter-stream/stream"
+)
+
+// Compression is how archive files are compressed when they are closed.
+type Compression int
+
+const (
+	// CompressionGzip compresses files with gzip, with the .ndjson.gz extension.
+	CompressionGzip Compression = iota
+	// CompressionZstd compresses files with zstd, with the .ndjson.zst extension.
+	CompressionZstd
+	// CompressionNone leaves files uncompressed, with the .ndjson extension.
+	CompressionNone
+)
+
+// ErrNoRaw is stream.ErrNoRaw, returned for messages whose raw payload is not available.
+var ErrNoRaw = stream.ErrNoRaw
+
+type (
+	// IArchive is the interface the archive struct implements.
+	IArchive interface {
+		stream.Handler
+		compliance.Purger
+		Serve(ctx context.Context, s stream.IStream) error
+		Rotate() error
+		Close() error
+	}
+
+	// Options configures an archive.
+	Options struct {
+		// Dir is the directory partitions are created in.
+		Dir string
+		// Partition returns the directory of a tweet, relative to Dir. DefaultPartition is used if nil.
+		Partition func(tag string, receivedAt time.Time) string
+		// Compression is applied when a file is closed. Files are gzip compressed by default.
+		Compression Compression
+		// MaxBytes closes a file once this many uncompressed bytes were written to it. It is 128 MiB if 0.
+		MaxBytes int64
+		// MaxAge closes a file this long after it was opened. It is 1 hour if 0.
+		MaxAge time.Duration
+		// MaxIdle closes a file that was not written to for this long. It is 5 minutes if 0.
+		MaxIdle time.Duration
+		// PurgeInterval is how often purged tweets are removed from the archive files. It is 1 minute if 0.
+		PurgeInterval time.Duration
+		// OnError is called with the errors of closing expired files and applying purges in the background.
+		// If nil, the first of them is returned by Close.
+		OnError func(err error)
+	}
+
+	// Manifest describes a closed archive file. It is written next to the file, with the .manifest.json extension.
+	Manifest struct {
+		// File is the path of the file, relative to Dir.
+		File         string `json:"file"`
+		Partition    string `json:"partition"`
+		Compression  string `json:"compression"`
+		Count        int    `json:"count"`
+		FirstTweetID string `json:"first_tweet_id"`
+		LastTweetID  string `json:"last_tweet_id"`
+		// MinTweetID, MaxTweetID and AuthorIDs let purges skip the files that do not hold the purged tweets.
+		MinTweetID string    `json:"min_tweet_id,omitempty"`
+		MaxTweetID string    `json:"max_tweet_id,omitempty"`
+		AuthorIDs  []string  `json:"author_ids,omitempty"`
+		Bytes      int64     `json:"bytes"`
+		CreatedAt  time.Time `json:"created_at"`
+		ClosedAt   time.Time `json:"closed_at"`
+	}
+
+	// payload holds the fields of a tweet the archive needs.
+	payload struct {
+		Data struct {
+			ID       string `json:"id"`
+			AuthorID string `json:"author_id"`
+		} `json:"data"`
+		MatchingRules []struct {
+			Tag string `json:"tag"`
+		} `json:"matching_rules"`
+	}
+
+	archive struct {
+		opts Options
+
+		mu    sync.Mutex
+		files map[string]*file
+		seq   uint64
+		err   error
+		stop  chan struct{}
+		done  chan struct{}
+		// index summarizes the committed files by the File of their manifest.
+		index map[string]summary
+		// pending are the purges that were not applied yet, also appended to purges.
+		pending map[tombstone]bool
+		purges  *fileutil.Appender
+
+		// purgeMu serializes the purges of committed files.
+		purgeMu sync.Mutex
+	}
+)
+
+// DefaultPartition partitions tweets by the tag of their first matching rule and the hour they were received, in UTC,
+// such as tag=cats/date=2021-06-01/hour=13. Tweets without a tag go to tag=none.
+func DefaultPartition(tag string, receivedAt time.Time) string {
+	if tag == "" {
+		tag = "none"
+	}
+	receivedAt = receivedAt.UTC()
+	return filepath.Join("tag="+url.PathEscape(tag), "date="+receivedAt.Format("2006-01-02"), "hour="+receivedAt.Format("15"))
+}
+
+// NewArchive creates an archive in opts.Dir. Files left open by a previous process that crashed are closed first.
+//
+// Tweets are appended to a hidden temporary file in their partition. When the file is closed, it is compressed
+// to another temporary file that is synced and renamed, then its manifest is written the same way. A file is
+// complete once its manifest exists.
+func NewArchive(opts Options) (IArchive, error) {
+	if opts.Partition == nil {
+		opts.Partition = DefaultPartition
+	}
+	if opts.MaxBytes <= 0 {
+		opts.MaxBytes = 128 << 20
+	}
+	if opts.MaxAge <= 0 {
+		opts.MaxAge = time.Hour
+	}
+	if opts.MaxIdle <= 0 {
+		opts.MaxIdle = 5 * time.Minute
+	}
+	if opts.PurgeInterval <= 0 {
+		opts.PurgeInterval = time.Minute
+	}
+	if err := os.MkdirAll(opts.Dir, 0755); err != nil {
+		return nil, err
+	}
+
+	a := &archive{
+		opts:    opts,
+		files:   map[string]*file{},
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+		index:   map[string]summary{},
+		pending: map[tombstone]bool{},
+	}
+	if err := a.recover(); err != nil {
+		return nil, err
+	}
+	if err := a.loadPurges(); err != nil {
+		return nil, err
+	}
+	go a.closeExpired()
+	return a, nil
+}
+
+// Handle appends the raw payload of message to the file of its partition. Stream errors are ignored.
+// Messages are not acknowledged, so use Serve to acknowledge them once their file is complete.
+func (a *archive) Handle(ctx context.Context, message stream.StreamMessage) error {
+	if message.Err != nil {
+		return nil
+	}
+	return a.write(message, nil)
+}
+
+// Serve archives the messages of s until its messages channel is closed or ctx is done. Every message is
+// acknowledged once the file it was written to is complete, so a spool or checkpoint store redelivers tweets
+// that were written to files that were not closed. Serve does not close the archive.
+func (a *archive) Serve(ctx context.Context, s stream.IStream) error {
+	return stream.Serve(ctx, s, stream.HandlerFunc(func(ctx context.Context, message stream.StreamMessage) error {
+		if message.Err != nil {
+			return nil
+		}
+		err := a.write(message, message.Ack)
+		message.Release()
+		return err
+	}))
+}
+
+// Rotate closes every open file.
+func (a *archive) Rotate() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.closeFilesLocked(func(f *file) bool { return true })
+}
+
+// Close closes every open file, applies the pending purges and stops closing expired files. Without OnError, it
+// returns the first error that happened in the background if there was no other.
+func (a *archive) Close() error {
+	a.mu.Lock()
+	select {
+	case <-a.stop:
+		a.mu.Unlock()
+		return nil
+	default:
+		close(a.stop)
+	}
+	a.mu.Unlock()
+	<-a.done
+	if err := a.Rotate(); err != nil {
+		return err
+	}
+	if err := a.applyPurges(); err != nil {
+		return err
+	}
+	if err := a.purges.Close(); err != nil {
+		return err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.err
+}
+
+func (a *archive) write(message stream.StreamMessage, ack func()) error {
+	raw := message.Payload()
+	if raw == nil {
+		return ErrNoRaw
+	}
+	var p payload
+	json.Unmarshal(raw, &p)
+	tag := ""
+	if len(p.MatchingRules) > 0 {
+		tag = p.MatchingRules[0].Tag
+	}
+	receivedAt := message.ReceivedAt
+	if receivedAt.IsZero() {
+		receivedAt = time.Now()
+	}
+	partition := a.opts.Partition(tag, receivedAt)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	f := a.files[partition]
+	if f == nil {
+		var err error
+		a.seq++
+		if f, err = createFile(a.opts.Dir, partition, a.seq); err != nil {
+			return err
+		}
+		a.files[partition] = f
+	}
+	if err := f.write(raw, p.Data.ID, p.Data.AuthorID, ack); err != nil {
+		return err
+	}
+	if f.bytes >= a.opts.MaxBytes {
+		delete(a.files, partition)
+		return a.commitLocked(f)
+	}
+	return nil
+}
+
+// closeExpired closes files that are too old or idle, and applies the pending purges, until the archive is closed.
+func (a *archive) closeExpired() {
+	defer close(a.done)
+
+	interval := a.opts.MaxAge
+	if a.opts.MaxIdle < interval {
+		interval = a.opts.MaxIdle
+	}
+	interval /= 2
+	if interval < 10*time.Millisecond {
+		interval = 10 * time.Millisecond
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	purges := time.NewTicker(a.opts.PurgeInterval)
+	defer purges.Stop()
+
+	for {
+		select {
+		case <-a.stop:
+			return
+		case <-purges.C:
+			if err := a.applyPurges(); err != nil {
+				a.backgroundError(err)
+			}
+		case now := <-ticker.C:
+			a.mu.Lock()
+			err := a.closeFilesLocked(func(f *file) bool {
+				return now.Sub(f.createdAt) >= a.opts.MaxAge || now.Sub(f.writtenAt) >= a.opts.MaxIdle
+			})
+			a.mu.Unlock()
+			if err != nil {
+				a.backgroundError(err)
+			}
+		}
+	}
+}
+
+// backgroundError passes err to OnError, or keeps it for Close if it is the first one.
+func (a *archive) backgroundError(err error) {
+	if a.opts.OnError != nil {
+		a.opts.OnError(err)
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.err == nil {
+		a.err = err
+	}
+}
+
+// closeFilesLocked commits the open files expired returns true for. a.mu must be held.
+func (a *archive) closeFilesLocked(expired func(f *file) bool) error {
+	var firstErr error
+	for partition, f := range a.files {
+		if !expired(f) {
+			continue
+		}
+		delete(a.files, partition)
+		if err := a.commitLocked(f); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// commitLocked commits f and adds it to the index. a.mu must be held.
+func (a *archive) commitLocked(f *file) error {
+	manifest, err := f.commit(a.opts.Dir, a.opts.Compression)
+	if err != nil {
+		return err
+	}
+	a.index[manifest.File] = summarize(manifest)
+	return nil
+}
+
+// recover commits the open files left by a process that did not close the archive, and indexes the committed files.
+func (a *archive) recover() error {
+	var open, temporary, manifests []string
+	err := filepath.Walk(a.opts.Dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		switch {
+		case isOpenFile(info.Name()):
+			open = append(open, path)
+		case isTemporary(info.Name()):
+			temporary = append(temporary, path)
+		case isManifest(info.Name()):
+			manifests = append(manifests, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Temporary files were being compressed or rewritten, and are written again from their source.
+	for _, path := range temporary {
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+	}
+	for _, path := range manifests {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		var manifest Manifest
+		if err := json.Unmarshal(b, &manifest); err != nil {
+			return fmt.Errorf("could not read %s: %w", path, err)
+		}
+		a.index[manifest.File] = summarize(manifest)
+	}
+	for _, path := range open {
+		f, err := reopenFile(a.opts.Dir, path)
+		if err == nil {
+			err = a.commitLocked(f)
+		}
+		if err != nil {
+			return fmt.Errorf("could not recover %s: %w", path, err)
+		}
+	}
+	return nil
+}
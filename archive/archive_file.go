@@ -0,0 +1,308 @@
+package archive
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fallenstedt/twitter-stream/internal/fileutil"
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	extension         = ".ndjson"
+	openSuffix        = ".open"
+	temporarySuffix   = ".tmp"
+	manifestExtension = ".manifest.json"
+)
+
+// file is an archive file that is being written. It is kept uncompressed in a hidden file until it is committed.
+type file struct {
+	partition string
+	// name is the name of the file without its extension.
+	name      string
+	path      string
+	f         *os.File
+	w         *bufio.Writer
+	bytes     int64
+	count     int
+	first     string
+	last      string
+	summary   summary
+	createdAt time.Time
+	writtenAt time.Time
+	acks      []func()
+}
+
+// createFile opens a new file in partition.
+func createFile(dir, partition string, seq uint64) (*file, error) {
+	if err := os.MkdirAll(filepath.Join(dir, partition), 0755); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	name := fmt.Sprintf("part-%s-%06d", now.UTC().Format("20060102T150405.000000000Z"), seq)
+	path := filepath.Join(dir, partition, "."+name+extension+openSuffix)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &file{partition: partition, name: name, path: path, f: f, w: bufio.NewWriter(f), summary: newSummary(), createdAt: now, writtenAt: now}, nil
+}
+
+// reopenFile reads the open file at path left by a previous process. A partially written last line is discarded.
+func reopenFile(dir, path string) (*file, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if i := bytes.LastIndexByte(b, '\n'); i+1 != len(b) {
+		b = b[:i+1]
+		if err := ioutil.WriteFile(path, b, 0644); err != nil {
+			return nil, err
+		}
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	partition, err := filepath.Rel(dir, filepath.Dir(path))
+	if err != nil {
+		return nil, err
+	}
+	base := filepath.Base(path)
+	f := &file{
+		partition: partition,
+		name:      strings.TrimSuffix(strings.TrimPrefix(base, "."), extension+openSuffix),
+		path:      path,
+		summary:   newSummary(),
+		createdAt: info.ModTime(),
+	}
+	err = scanLines(bytes.NewReader(b), func(line []byte) error {
+		var p payload
+		json.Unmarshal(line, &p)
+		f.count++
+		f.bytes += int64(len(line)) + 1
+		f.track(p.Data.ID, p.Data.AuthorID)
+		return nil
+	})
+	return f, err
+}
+
+// write appends raw as a line. ack is called once the file is committed.
+func (f *file) write(raw []byte, id, authorID string, ack func()) error {
+	if _, err := f.w.Write(raw); err != nil {
+		return err
+	}
+	if err := f.w.WriteByte('\n'); err != nil {
+		return err
+	}
+	f.bytes += int64(len(raw)) + 1
+	f.count++
+	f.track(id, authorID)
+	f.writtenAt = time.Now()
+	if ack != nil {
+		f.acks = append(f.acks, ack)
+	}
+	return nil
+}
+
+func (f *file) track(id, authorID string) {
+	f.summary.add(id, authorID)
+	if id == "" {
+		return
+	}
+	if f.first == "" {
+		f.first = id
+	}
+	f.last = id
+}
+
+// commit compresses the file into its final path, writes its manifest and acknowledges its messages.
+// It returns the manifest.
+func (f *file) commit(dir string, compression Compression) (Manifest, error) {
+	if f.f != nil {
+		if err := f.w.Flush(); err != nil {
+			return Manifest{}, err
+		}
+		if err := f.f.Close(); err != nil {
+			return Manifest{}, err
+		}
+		f.f = nil
+	}
+
+	final := filepath.Join(dir, f.partition, f.name+extension+compression.extension())
+	if _, err := os.Stat(final); os.IsNotExist(err) {
+		if err := compressFile(f.path, final, compression); err != nil {
+			return Manifest{}, err
+		}
+	}
+
+	manifest := Manifest{
+		File:         filepath.ToSlash(filepath.Join(f.partition, filepath.Base(final))),
+		Partition:    filepath.ToSlash(f.partition),
+		Compression:  compression.String(),
+		Count:        f.count,
+		FirstTweetID: f.first,
+		LastTweetID:  f.last,
+		Bytes:        f.bytes,
+		CreatedAt:    f.createdAt,
+		ClosedAt:     time.Now(),
+	}
+	f.summary.describe(&manifest)
+	if err := writeManifest(final, manifest); err != nil {
+		return Manifest{}, err
+	}
+	if err := os.Remove(f.path); err != nil && !os.IsNotExist(err) {
+		return Manifest{}, err
+	}
+
+	for _, ack := range f.acks {
+		ack()
+	}
+	f.acks = nil
+	return manifest, nil
+}
+
+// compressFile writes src to dst with compression, through a temporary file that is synced and renamed.
+func compressFile(src, dst string, compression Compression) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	return fileutil.WriteAtomic(dst, func(w io.Writer) error {
+		cw, err := compressor(w, compression)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(cw, in); err != nil {
+			cw.Close()
+			return err
+		}
+		return cw.Close()
+	})
+}
+
+func writeManifest(final string, manifest Manifest) error {
+	b, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	return fileutil.WriteAtomic(final+manifestExtension, func(w io.Writer) error {
+		_, err := w.Write(b)
+		return err
+	})
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+func compressor(w io.Writer, compression Compression) (io.WriteCloser, error) {
+	switch compression {
+	case CompressionZstd:
+		return zstd.NewWriter(w)
+	case CompressionNone:
+		return nopWriteCloser{w}, nil
+	default:
+		return gzip.NewWriter(w), nil
+	}
+}
+
+// decompressor returns a reader of the archive file at path, decompressed according to its extension.
+func decompressor(r io.Reader, path string) (io.ReadCloser, error) {
+	switch {
+	case strings.HasSuffix(path, CompressionZstd.extension()):
+		d, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return d.IOReadCloser(), nil
+	case strings.HasSuffix(path, CompressionGzip.extension()):
+		return gzip.NewReader(r)
+	default:
+		return ioutil.NopCloser(r), nil
+	}
+}
+
+func (c Compression) extension() string {
+	switch c {
+	case CompressionZstd:
+		return ".zst"
+	case CompressionNone:
+		return ""
+	default:
+		return ".gz"
+	}
+}
+
+// String returns the name of the compression.
+func (c Compression) String() string {
+	switch c {
+	case CompressionZstd:
+		return "zstd"
+	case CompressionNone:
+		return "none"
+	default:
+		return "gzip"
+	}
+}
+
+// scanLines calls fn with every non-empty line of r.
+func scanLines(r io.Reader, fn func(line []byte) error) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		if err := fn(scanner.Bytes()); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+func tweetID(line []byte) string {
+	var p payload
+	json.Unmarshal(line, &p)
+	return p.Data.ID
+}
+
+func isOpenFile(name string) bool {
+	return strings.HasPrefix(name, ".") && strings.HasSuffix(name, extension+openSuffix)
+}
+
+func isManifest(name string) bool {
+	return !strings.HasPrefix(name, ".") && strings.HasSuffix(name, manifestExtension)
+}
+
+func isTemporary(name string) bool {
+	return strings.HasPrefix(name, ".") && strings.HasSuffix(name, temporarySuffix)
+}
+
+// isArchiveFile reports whether name is a complete archive file.
+func isArchiveFile(name string) bool {
+	if strings.HasPrefix(name, ".") {
+		return false
+	}
+	for _, c := range []Compression{CompressionGzip, CompressionZstd, CompressionNone} {
+		if strings.HasSuffix(name, extension+c.extension()) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,307 @@
+package archive
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/fallenstedt/twitter-stream/internal/fileutil"
+)
+
+const (
+	// purgesFile is the hidden file in Dir that keeps the purges that were not applied yet.
+	purgesFile = ".purges.ndjson"
+
+	kindTweet = "tweet"
+	kindUser  = "user"
+)
+
+type (
+	// tombstone is a purge that was not applied yet. Kind is tweet or user.
+	tombstone struct {
+		Kind string `json:"kind"`
+		ID   string `json:"id"`
+	}
+
+	// summary describes the tweets of a file, so purges only rewrite the files that may hold purged tweets.
+	// A summary that is not known, read from a manifest written before summaries, matches every purge.
+	summary struct {
+		known   bool
+		minID   string
+		maxID   string
+		authors map[string]bool
+	}
+)
+
+// PurgeTweets records that the tweets with ids must be removed from the archive files. Purges are applied in
+// batches every PurgeInterval and when the archive is closed, and only rewrite the files that may hold the tweets.
+// The ids are appended to a file in Dir first, so a purge is not lost if the process stops before it is applied.
+// As the tweets are removed later, the number returned is always 0.
+func (a *archive) PurgeTweets(ctx context.Context, ids []string) (int, error) {
+	return 0, a.queuePurge(kindTweet, ids)
+}
+
+// PurgeUsers records that the tweets authored by the users with ids must be removed from the archive files,
+// like PurgeTweets.
+func (a *archive) PurgeUsers(ctx context.Context, ids []string) (int, error) {
+	return 0, a.queuePurge(kindUser, ids)
+}
+
+func (a *archive) queuePurge(kind string, ids []string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, id := range ids {
+		t := tombstone{Kind: kind, ID: id}
+		if a.pending[t] {
+			continue
+		}
+		if err := a.purges.Append(t); err != nil {
+			return err
+		}
+		a.pending[t] = true
+	}
+	return nil
+}
+
+// loadPurges reads the purges a previous process did not apply, and opens the purges file.
+func (a *archive) loadPurges() error {
+	path := filepath.Join(a.opts.Dir, purgesFile)
+	b, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	err = scanLines(bytes.NewReader(b), func(line []byte) error {
+		var t tombstone
+		if json.Unmarshal(line, &t) == nil {
+			a.pending[t] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	a.purges, err = fileutil.OpenAppender(path, true)
+	return err
+}
+
+// applyPurges removes the tweets of the pending purges from the files whose summary matches them. Open files that
+// match are committed first.
+func (a *archive) applyPurges() error {
+	a.purgeMu.Lock()
+	defer a.purgeMu.Unlock()
+
+	a.mu.Lock()
+	if len(a.pending) == 0 {
+		a.mu.Unlock()
+		return nil
+	}
+	pending := make(map[tombstone]bool, len(a.pending))
+	for t := range a.pending {
+		pending[t] = true
+	}
+	err := a.closeFilesLocked(func(f *file) bool { return f.summary.matches(pending) })
+	var names []string
+	for name, s := range a.index {
+		if s.matches(pending) {
+			names = append(names, name)
+		}
+	}
+	a.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	sort.Strings(names)
+	for _, name := range names {
+		manifest, err := purgeFile(filepath.Join(a.opts.Dir, filepath.FromSlash(name)), pending)
+		if err != nil {
+			return err
+		}
+		a.mu.Lock()
+		a.index[name] = summarize(manifest)
+		a.mu.Unlock()
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for t := range pending {
+		delete(a.pending, t)
+	}
+	return a.rewritePurgesLocked()
+}
+
+// rewritePurgesLocked replaces the purges file with the purges that are still pending. a.mu must be held.
+func (a *archive) rewritePurgesLocked() error {
+	path := filepath.Join(a.opts.Dir, purgesFile)
+	if err := a.purges.Close(); err != nil {
+		return err
+	}
+	err := fileutil.WriteAtomic(path, func(w io.Writer) error {
+		enc := json.NewEncoder(w)
+		for t := range a.pending {
+			if err := enc.Encode(t); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	a.purges, err = fileutil.OpenAppender(path, true)
+	return err
+}
+
+// purgeFile rewrites the archive file at path without the tweets of pending, updates its manifest, and returns it.
+// A file without such tweets is not rewritten.
+func purgeFile(path string, pending map[tombstone]bool) (Manifest, error) {
+	var manifest Manifest
+	if b, err := ioutil.ReadFile(path + manifestExtension); err == nil {
+		json.Unmarshal(b, &manifest)
+	}
+
+	b, err := readArchiveFile(path)
+	if err != nil {
+		return manifest, err
+	}
+
+	var kept bytes.Buffer
+	removed := 0
+	f := &file{summary: newSummary()}
+	err = scanLines(bytes.NewReader(b), func(line []byte) error {
+		var p payload
+		json.Unmarshal(line, &p)
+		if pending[tombstone{Kind: kindTweet, ID: p.Data.ID}] || pending[tombstone{Kind: kindUser, ID: p.Data.AuthorID}] {
+			removed++
+			return nil
+		}
+		kept.Write(line)
+		kept.WriteByte('\n')
+		f.count++
+		f.bytes += int64(len(line)) + 1
+		f.track(p.Data.ID, p.Data.AuthorID)
+		return nil
+	})
+	if err != nil {
+		return manifest, err
+	}
+	manifest.Count, manifest.Bytes, manifest.FirstTweetID, manifest.LastTweetID = f.count, f.bytes, f.first, f.last
+	f.summary.describe(&manifest)
+	if removed == 0 {
+		return manifest, nil
+	}
+
+	compression := compressionOf(path)
+	err = fileutil.WriteAtomic(path, func(w io.Writer) error {
+		cw, err := compressor(w, compression)
+		if err != nil {
+			return err
+		}
+		if _, err := cw.Write(kept.Bytes()); err != nil {
+			cw.Close()
+			return err
+		}
+		return cw.Close()
+	})
+	if err != nil {
+		return manifest, err
+	}
+	return manifest, writeManifest(path, manifest)
+}
+
+func newSummary() summary {
+	return summary{known: true, authors: map[string]bool{}}
+}
+
+// summarize returns the summary described by manifest.
+func summarize(manifest Manifest) summary {
+	if manifest.MinTweetID == "" && manifest.Count > 0 {
+		return summary{}
+	}
+	s := newSummary()
+	s.minID, s.maxID = manifest.MinTweetID, manifest.MaxTweetID
+	for _, id := range manifest.AuthorIDs {
+		s.authors[id] = true
+	}
+	return s
+}
+
+func (s *summary) add(id, authorID string) {
+	if id != "" {
+		if s.minID == "" || lessID(id, s.minID) {
+			s.minID = id
+		}
+		if s.maxID == "" || lessID(s.maxID, id) {
+			s.maxID = id
+		}
+	}
+	if authorID != "" {
+		s.authors[authorID] = true
+	}
+}
+
+// describe sets the fields of manifest that summarize its file.
+func (s summary) describe(manifest *Manifest) {
+	manifest.MinTweetID, manifest.MaxTweetID, manifest.AuthorIDs = s.minID, s.maxID, nil
+	for id := range s.authors {
+		manifest.AuthorIDs = append(manifest.AuthorIDs, id)
+	}
+	sort.Strings(manifest.AuthorIDs)
+}
+
+// matches reports whether the file may hold a tweet of pending.
+func (s summary) matches(pending map[tombstone]bool) bool {
+	if !s.known {
+		return true
+	}
+	for t := range pending {
+		switch t.Kind {
+		case kindTweet:
+			if s.minID != "" && !lessID(t.ID, s.minID) && !lessID(s.maxID, t.ID) {
+				return true
+			}
+		case kindUser:
+			if s.authors[t.ID] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// lessID reports whether the tweet id a is older than b. Tweet ids grow over time, so longer ids are newer.
+func lessID(a, b string) bool {
+	if len(a) != len(b) {
+		return len(a) < len(b)
+	}
+	return a < b
+}
+
+func readArchiveFile(path string) ([]byte, error) {
+	in, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+
+	r, err := decompressor(in, path)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+func compressionOf(path string) Compression {
+	for _, c := range []Compression{CompressionGzip, CompressionZstd} {
+		if filepath.Ext(path) == c.extension() {
+			return c
+		}
+	}
+	return CompressionNone
+}
@@ -0,0 +1,369 @@
+package archive
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fallenstedt/twitter-stream/internal/streamtest"
+	"github.com/fallenstedt/twitter-stream/stream"
+)
+
+var receivedAt = time.Date(2021, 6, 1, 13, 30, 0, 0, time.UTC)
+
+func givenTweet(id, authorID, tag string) stream.StreamMessage {
+	raw := fmt.Sprintf(`{"data":{"id":%q,"author_id":%q,"text":"hi"},"matching_rules":[{"id":"1","tag":%q}]}`, id, authorID, tag)
+	return stream.StreamMessage{Data: []byte(raw), ReceivedAt: receivedAt}
+}
+
+func givenArchive(t *testing.T, opts Options) (*archive, string) {
+	dir, _ := ioutil.TempDir("", "archive")
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	opts.Dir = dir
+	a, err := NewArchive(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { a.Close() })
+	return a.(*archive), dir
+}
+
+// readArchive returns the manifests in dir and the ids of the tweets in their files.
+func readArchive(t *testing.T, dir string) ([]Manifest, []string) {
+	var manifests []Manifest
+	var ids []string
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !strings.HasSuffix(path, manifestExtension) {
+			return err
+		}
+		var manifest Manifest
+		b, _ := ioutil.ReadFile(path)
+		json.Unmarshal(b, &manifest)
+		manifests = append(manifests, manifest)
+
+		raw, err := readArchiveFile(filepath.Join(dir, filepath.FromSlash(manifest.File)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, line := range strings.Split(strings.TrimSpace(string(raw)), "\n") {
+			if line != "" {
+				ids = append(ids, tweetID([]byte(line)))
+			}
+		}
+		return nil
+	})
+	sort.Slice(manifests, func(i, j int) bool { return manifests[i].File < manifests[j].File })
+	sort.Strings(ids)
+	return manifests, ids
+}
+
+func TestDefaultPartition(t *testing.T) {
+	var tests = []struct {
+		tag    string
+		result string
+	}{
+		{"cats", "tag=cats/date=2021-06-01/hour=13"},
+		{"", "tag=none/date=2021-06-01/hour=13"},
+		{"cats/dogs", "tag=cats%2Fdogs/date=2021-06-01/hour=13"},
+	}
+
+	for i, tt := range tests {
+		testName := fmt.Sprintf("TestDefaultPartition (%d)", i)
+		t.Run(testName, func(t *testing.T) {
+			result := filepath.ToSlash(DefaultPartition(tt.tag, receivedAt.In(time.FixedZone("PST", -8*3600))))
+			if result != tt.result {
+				t.Errorf("got %s, want %s", result, tt.result)
+			}
+		})
+	}
+}
+
+func TestArchiveCompression(t *testing.T) {
+	var tests = []struct {
+		compression Compression
+		extension   string
+	}{
+		{CompressionGzip, ".ndjson.gz"},
+		{CompressionZstd, ".ndjson.zst"},
+		{CompressionNone, ".ndjson"},
+	}
+
+	for i, tt := range tests {
+		testName := fmt.Sprintf("TestArchiveCompression (%d)", i)
+		t.Run(testName, func(t *testing.T) {
+			a, dir := givenArchive(t, Options{Compression: tt.compression})
+			for _, message := range []stream.StreamMessage{givenTweet("1", "10", "cats"), givenTweet("2", "10", "cats"), givenTweet("3", "20", "dogs")} {
+				if err := a.Handle(context.Background(), message); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := a.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			manifests, ids := readArchive(t, dir)
+			if len(manifests) != 2 || fmt.Sprint(ids) != "[1 2 3]" {
+				t.Fatalf("got %d manifests with %v", len(manifests), ids)
+			}
+			cats := manifests[0]
+			if !strings.HasPrefix(cats.File, "tag=cats/date=2021-06-01/hour=13/part-") || !strings.HasSuffix(cats.File, tt.extension) {
+				t.Errorf("got file %s", cats.File)
+			}
+			if cats.Count != 2 || cats.FirstTweetID != "1" || cats.LastTweetID != "2" || cats.Compression != tt.compression.String() {
+				t.Errorf("got manifest %+v", cats)
+			}
+		})
+	}
+}
+
+func TestArchiveRotation(t *testing.T) {
+	var tests = []struct {
+		opts      Options
+		wait      time.Duration
+		manifests int
+	}{
+		// every tweet fills a file
+		{Options{MaxBytes: 1}, 0, 3},
+		{Options{MaxBytes: 1 << 20}, 0, 0},
+		{Options{MaxIdle: 20 * time.Millisecond}, 200 * time.Millisecond, 1},
+		{Options{MaxAge: 20 * time.Millisecond}, 200 * time.Millisecond, 1},
+	}
+
+	for i, tt := range tests {
+		testName := fmt.Sprintf("TestArchiveRotation (%d)", i)
+		t.Run(testName, func(t *testing.T) {
+			a, dir := givenArchive(t, tt.opts)
+			for _, id := range []string{"1", "2", "3"} {
+				if err := a.Handle(context.Background(), givenTweet(id, "10", "cats")); err != nil {
+					t.Fatal(err)
+				}
+			}
+			time.Sleep(tt.wait)
+
+			if manifests, _ := readArchive(t, dir); len(manifests) != tt.manifests {
+				t.Errorf("got %d manifests, want %d", len(manifests), tt.manifests)
+			}
+		})
+	}
+}
+
+func TestArchiveBackgroundErrors(t *testing.T) {
+	var tests = []struct {
+		onError bool
+	}{
+		{true},
+		// the error is returned by Close
+		{false},
+	}
+
+	for i, tt := range tests {
+		testName := fmt.Sprintf("TestArchiveBackgroundErrors (%d)", i)
+		t.Run(testName, func(t *testing.T) {
+			errs := make(chan error, 1)
+			opts := Options{MaxIdle: 20 * time.Millisecond}
+			if tt.onError {
+				opts.OnError = func(err error) { errs <- err }
+			}
+			a, _ := givenArchive(t, opts)
+			a.Handle(context.Background(), givenTweet("1", "10", "cats"))
+			a.mu.Lock()
+			for _, f := range a.files {
+				os.Remove(f.path)
+			}
+			a.mu.Unlock()
+
+			if tt.onError {
+				select {
+				case <-errs:
+				case <-time.After(time.Second):
+					t.Fatal("expected OnError to be called when the expired file cannot be closed")
+				}
+			} else {
+				time.Sleep(200 * time.Millisecond)
+			}
+			if err := a.Handle(context.Background(), givenTweet("2", "10", "cats")); err != nil {
+				t.Errorf("expected the background error not to be returned by the next write, got %v", err)
+			}
+			if err := a.Close(); (err != nil) == tt.onError {
+				t.Errorf("got err %v from Close", err)
+			}
+		})
+	}
+}
+
+func TestArchiveAck(t *testing.T) {
+	a, _ := givenArchive(t, Options{})
+	acked := 0
+	for _, id := range []string{"1", "2"} {
+		if err := a.write(givenTweet(id, "10", "cats"), func() { acked++ }); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if acked != 0 {
+		t.Errorf("expected no acks before the file is closed, got %d", acked)
+	}
+	a.Rotate()
+	if acked != 2 {
+		t.Errorf("expected 2 acks after the file is closed, got %d", acked)
+	}
+}
+
+func TestArchiveServe(t *testing.T) {
+	a, dir := givenArchive(t, Options{})
+	s := streamtest.NewFakeStream(givenTweet("1", "10", "cats"), stream.StreamMessage{Err: fmt.Errorf("EOF")}, givenTweet("2", "10", "cats"))
+	if err := a.Serve(context.Background(), s); err != nil {
+		t.Fatal(err)
+	}
+	a.Close()
+
+	if _, ids := readArchive(t, dir); fmt.Sprint(ids) != "[1 2]" {
+		t.Errorf("got %v", ids)
+	}
+
+	if err := a.Handle(context.Background(), stream.StreamMessage{Data: struct{}{}}); err != ErrNoRaw {
+		t.Errorf("expected ErrNoRaw, got %v", err)
+	}
+}
+
+func TestArchiveRecover(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "archive")
+	defer os.RemoveAll(dir)
+
+	partition := filepath.Join(dir, "tag=cats", "date=2021-06-01", "hour=13")
+	os.MkdirAll(partition, 0755)
+	open := `{"data":{"id":"1"}}` + "\n" + `{"data":{"id":"2"}}` + "\n" + `{"data":{"id":"3"`
+	ioutil.WriteFile(filepath.Join(partition, ".part-1.ndjson.open"), []byte(open), 0644)
+	ioutil.WriteFile(filepath.Join(partition, ".part-0.ndjson.gz.tmp"), []byte("partial"), 0644)
+
+	a, err := NewArchive(Options{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.Close()
+
+	manifests, ids := readArchive(t, dir)
+	if len(manifests) != 1 || fmt.Sprint(ids) != "[1 2]" {
+		t.Fatalf("got %d manifests with %v", len(manifests), ids)
+	}
+	if manifest := manifests[0]; manifest.File != "tag=cats/date=2021-06-01/hour=13/part-1.ndjson.gz" || manifest.Count != 2 || manifest.LastTweetID != "2" {
+		t.Errorf("got manifest %+v", manifest)
+	}
+	names, _ := ioutil.ReadDir(partition)
+	if len(names) != 2 {
+		t.Errorf("expected the open and temporary files to be removed, got %d files", len(names))
+	}
+}
+
+func TestArchivePurge(t *testing.T) {
+	var tests = []struct {
+		users     bool
+		ids       []string
+		committed string
+		open      int
+		result    string
+	}{
+		{false, []string{"2"}, "[1]", 2, "[1 3 4]"},
+		{false, []string{"5"}, "[1 2]", 2, "[1 2 3 4]"},
+		{true, []string{"10"}, "[]", 2, "[3 4]"},
+		// the open file that may hold the tweet is closed before purging
+		{false, []string{"3"}, "[1 2]", 1, "[1 2 4]"},
+	}
+
+	for i, tt := range tests {
+		testName := fmt.Sprintf("TestArchivePurge (%d)", i)
+		t.Run(testName, func(t *testing.T) {
+			a, dir := givenArchive(t, Options{Compression: CompressionZstd})
+			a.Handle(context.Background(), givenTweet("1", "10", "cats"))
+			a.Handle(context.Background(), givenTweet("2", "10", "cats"))
+			a.Rotate()
+			a.Handle(context.Background(), givenTweet("3", "20", "cats"))
+			a.Handle(context.Background(), givenTweet("4", "20", "dogs"))
+
+			purge := a.PurgeTweets
+			if tt.users {
+				purge = a.PurgeUsers
+			}
+			if _, err := purge(context.Background(), tt.ids); err != nil {
+				t.Fatal(err)
+			}
+			if _, ids := readArchive(t, dir); fmt.Sprint(ids) != "[1 2]" {
+				t.Errorf("expected purges to wait for the next batch, got %v", ids)
+			}
+
+			if err := a.applyPurges(); err != nil {
+				t.Fatal(err)
+			}
+			if _, ids := readArchive(t, dir); fmt.Sprint(ids) != tt.committed {
+				t.Errorf("got %v, want %s", ids, tt.committed)
+			}
+			if len(a.files) != tt.open {
+				t.Errorf("got %d open files, want %d", len(a.files), tt.open)
+			}
+
+			if err := a.Close(); err != nil {
+				t.Fatal(err)
+			}
+			manifests, ids := readArchive(t, dir)
+			if fmt.Sprint(ids) != tt.result {
+				t.Errorf("got %v, want %s", ids, tt.result)
+			}
+			count := 0
+			for _, manifest := range manifests {
+				count += manifest.Count
+				if manifest.CreatedAt.IsZero() {
+					t.Errorf("expected CreatedAt to be kept, got %+v", manifest)
+				}
+			}
+			if count != len(ids) {
+				t.Errorf("got a count of %d in manifests, want %d", count, len(ids))
+			}
+		})
+	}
+}
+
+func TestArchivePurgeSurvivesRestart(t *testing.T) {
+	a, dir := givenArchive(t, Options{})
+	a.Handle(context.Background(), givenTweet("1", "10", "cats"))
+	a.Handle(context.Background(), givenTweet("2", "20", "cats"))
+	a.Rotate()
+	a.PurgeUsers(context.Background(), []string{"20"})
+
+	// the purge was not applied when the process stopped
+	restarted, err := NewArchive(Options{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := restarted.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ids := readArchive(t, dir); fmt.Sprint(ids) != "[1]" {
+		t.Errorf("got %v, want [1]", ids)
+	}
+}
+
+func TestArchivePurgeInterval(t *testing.T) {
+	a, dir := givenArchive(t, Options{PurgeInterval: 10 * time.Millisecond})
+	a.Handle(context.Background(), givenTweet("1", "10", "cats"))
+	a.Handle(context.Background(), givenTweet("2", "10", "cats"))
+	a.Rotate()
+	a.PurgeTweets(context.Background(), []string{"1"})
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		_, ids := readArchive(t, dir)
+		if fmt.Sprint(ids) == "[2]" {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the purge to be applied, got %v", ids)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
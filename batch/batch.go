@@ -0,0 +1,223 @@
+// Package batch groups stream messages into batches, for sinks that are faster when they write in bulk.
+package batch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fallenstedt/twitter-stream/stream"
+)
+
+type (
+	// Batch is a group of messages in the order they were received. Messages carrying a stream error are
+	// kept in place, so a batch is never split by an error.
+	Batch []stream.StreamMessage
+
+	// IBatcher is the interface the batcher struct implements.
+	IBatcher interface {
+		GetBatches() <-chan Batch
+		Stop()
+	}
+
+	// Options configures a batcher.
+	Options struct {
+		// Size emits a batch once it holds this many messages. It is 100 if 0.
+		Size int
+		// Wait emits a batch this long after its first message was received, even if it is not full.
+		// It is 1 second if 0.
+		Wait time.Duration
+		// OnError is called by Serve when a handler fails. err is an ItemErrors if only some messages failed.
+		OnError func(batch Batch, err error)
+	}
+
+	// Handler processes a batch. A handler that fails for some messages of a batch returns an ItemErrors.
+	Handler interface {
+		HandleBatch(ctx context.Context, batch Batch) error
+	}
+
+	// HandlerFunc allows an ordinary function to be used as a Handler.
+	HandlerFunc func(ctx context.Context, batch Batch) error
+
+	// ItemErrors holds the errors of the messages of a batch that failed, by their index in the batch.
+	ItemErrors map[int]error
+
+	batcher struct {
+		opts     Options
+		messages <-chan stream.StreamMessage
+		batches  chan Batch
+		stop     chan struct{}
+		stopOnce sync.Once
+	}
+)
+
+// NewBatcher groups the messages of a messages channel, such as the one returned by GetMessages, into batches.
+// The batch being filled is emitted when the messages channel is closed, then the batches channel is closed.
+func NewBatcher(messages <-chan stream.StreamMessage, opts Options) IBatcher {
+	if opts.Size <= 0 {
+		opts.Size = 100
+	}
+	if opts.Wait <= 0 {
+		opts.Wait = time.Second
+	}
+	b := &batcher{opts: opts, messages: messages, batches: make(chan Batch), stop: make(chan struct{})}
+	go b.run()
+	return b
+}
+
+// GetBatches returns the channel batches are sent to. Keep reading it until it is closed, or call Stop.
+func (b *batcher) GetBatches() <-chan Batch {
+	return b.batches
+}
+
+// Stop stops reading messages and closes the batches channel. The batches that were not read yet are released
+// without being acknowledged, so a spool delivers their messages again.
+func (b *batcher) Stop() {
+	b.stopOnce.Do(func() { close(b.stop) })
+}
+
+func (b *batcher) run() {
+	defer close(b.batches)
+
+	var batch Batch
+	// The batch being filled when Stop is called is not read by anyone, so it is released.
+	defer func() { batch.Release() }()
+	var timer *time.Timer
+	var expired <-chan time.Time
+	// flush emits the batch being filled. It returns false if Stop was called first.
+	flush := func() bool {
+		if timer != nil {
+			timer.Stop()
+			timer, expired = nil, nil
+		}
+		if len(batch) == 0 {
+			return true
+		}
+		select {
+		case <-b.stop:
+			return false
+		case b.batches <- batch:
+			batch = nil
+			return true
+		}
+	}
+
+	for {
+		select {
+		case <-b.stop:
+			return
+		case <-expired:
+			if !flush() {
+				return
+			}
+		case message, ok := <-b.messages:
+			if !ok {
+				flush()
+				return
+			}
+			batch = append(batch, message)
+			if len(batch) == 1 {
+				timer = time.NewTimer(b.opts.Wait)
+				expired = timer.C
+			}
+			if len(batch) >= b.opts.Size && !flush() {
+				return
+			}
+		}
+	}
+}
+
+// Serve passes the messages of s to handler in batches, until its messages channel is closed or ctx is done.
+// The messages of a batch are acknowledged once handler returns, except the ones it failed for, then released,
+// so handler must copy the payloads it keeps. It returns the error that stopped the stream, or ctx's error.
+// Serve does not stop the stream.
+func Serve(ctx context.Context, s stream.IStream, handler Handler, opts Options) error {
+	b := NewBatcher(s.GetMessages(), opts)
+	batches := b.GetBatches()
+	for {
+		select {
+		case <-ctx.Done():
+			b.Stop()
+			// The remaining batch is not handled nor acknowledged, so a spool delivers it again.
+			for batch := range batches {
+				batch.Release()
+			}
+			return ctx.Err()
+		case batch, ok := <-batches:
+			if !ok {
+				return stream.ErrOf(s)
+			}
+			err := handler.HandleBatch(ctx, batch)
+			if err != nil && opts.OnError != nil {
+				opts.OnError(batch, err)
+			}
+			batch.ack(err)
+			batch.Release()
+		}
+	}
+}
+
+// Ack acknowledges every message of the batch.
+func (b Batch) Ack() {
+	for _, message := range b {
+		message.Ack()
+	}
+}
+
+// Release releases the pooled payloads of the messages of the batch. See stream.StreamMessage.Release.
+func (b Batch) Release() {
+	for _, message := range b {
+		message.Release()
+	}
+}
+
+// Errors returns the stream errors carried by messages of the batch.
+func (b Batch) Errors() []error {
+	var errs []error
+	for _, message := range b {
+		if message.Err != nil {
+			errs = append(errs, message.Err)
+		}
+	}
+	return errs
+}
+
+// ack acknowledges the messages the handler did not fail for.
+func (b Batch) ack(err error) {
+	if err == nil {
+		b.Ack()
+		return
+	}
+	var failed ItemErrors
+	if !errors.As(err, &failed) {
+		return
+	}
+	for i, message := range b {
+		if failed[i] == nil {
+			message.Ack()
+		}
+	}
+}
+
+// HandleBatch calls f(ctx, batch).
+func (f HandlerFunc) HandleBatch(ctx context.Context, batch Batch) error {
+	return f(ctx, batch)
+}
+
+func (e ItemErrors) Error() string {
+	indexes := make([]int, 0, len(e))
+	for i := range e {
+		indexes = append(indexes, i)
+	}
+	sort.Ints(indexes)
+
+	messages := make([]string, len(indexes))
+	for j, i := range indexes {
+		messages[j] = fmt.Sprintf("%d: %v", i, e[i])
+	}
+	return fmt.Sprintf("%d messages of the batch failed: %s", len(e), strings.Join(messages, "; "))
+}
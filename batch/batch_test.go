@@ -0,0 +1,165 @@
+package batch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/fallenstedt/twitter-stream/internal/streamtest"
+	"github.com/fallenstedt/twitter-stream/stream"
+)
+
+func givenMessages(count int) []stream.StreamMessage {
+	messages := make([]stream.StreamMessage, count)
+	for i := range messages {
+		messages[i] = stream.StreamMessage{Data: i}
+	}
+	return messages
+}
+
+// describe returns the data of the messages of every batch, with stream errors as "err".
+func describe(batches []Batch) string {
+	var result [][]interface{}
+	for _, batch := range batches {
+		var items []interface{}
+		for _, message := range batch {
+			if message.Err != nil {
+				items = append(items, "err")
+			} else {
+				items = append(items, message.Data)
+			}
+		}
+		result = append(result, items)
+	}
+	return fmt.Sprint(result)
+}
+
+func collect(b IBatcher) []Batch {
+	var batches []Batch
+	for batch := range b.GetBatches() {
+		batches = append(batches, batch)
+	}
+	return batches
+}
+
+func TestBatcherSize(t *testing.T) {
+	var tests = []struct {
+		messages []stream.StreamMessage
+		size     int
+		result   string
+	}{
+		{givenMessages(5), 2, "[[0 1] [2 3] [4]]"},
+		{givenMessages(4), 2, "[[0 1] [2 3]]"},
+		{givenMessages(3), 10, "[[0 1 2]]"},
+		{nil, 10, "[]"},
+		// errors are kept in place
+		{append(givenMessages(2), stream.StreamMessage{Err: errors.New("EOF")}, stream.StreamMessage{Data: 3}), 3, "[[0 1 err] [3]]"},
+	}
+
+	for i, tt := range tests {
+		testName := fmt.Sprintf("TestBatcherSize (%d)", i)
+		t.Run(testName, func(t *testing.T) {
+			b := NewBatcher(streamtest.NewFakeStream(tt.messages...).GetMessages(), Options{Size: tt.size, Wait: time.Minute})
+			if result := describe(collect(b)); result != tt.result {
+				t.Errorf("got %s, want %s", result, tt.result)
+			}
+		})
+	}
+}
+
+func TestBatcherWait(t *testing.T) {
+	messages := make(chan stream.StreamMessage)
+	b := NewBatcher(messages, Options{Size: 10, Wait: 20 * time.Millisecond})
+
+	messages <- stream.StreamMessage{Data: 0}
+	messages <- stream.StreamMessage{Data: 1}
+	select {
+	case batch := <-b.GetBatches():
+		if result := describe([]Batch{batch}); result != "[[0 1]]" {
+			t.Errorf("got %s", result)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected a batch after Wait")
+	}
+
+	// the batch being filled is dropped on stop
+	messages <- stream.StreamMessage{Data: 2}
+	b.Stop()
+	b.Stop()
+	if result := describe(collect(b)); result != "[]" {
+		t.Errorf("got %s after Stop", result)
+	}
+}
+
+func TestBatcherStopWithoutReader(t *testing.T) {
+	b := NewBatcher(streamtest.NewFakeStream(givenMessages(1)...).GetMessages(), Options{Size: 1})
+	time.Sleep(10 * time.Millisecond)
+	b.Stop()
+	time.Sleep(10 * time.Millisecond)
+	if batch, ok := <-b.GetBatches(); ok {
+		t.Errorf("expected Stop to drop the batch nobody read, got %s", describe([]Batch{batch}))
+	}
+}
+
+func TestServe(t *testing.T) {
+	var tests = []struct {
+		err    error
+		failed string
+		acked  string
+	}{
+		{nil, "", "[0 1 2]"},
+		{ItemErrors{1: errors.New("conflict"), 0: errors.New("timeout")}, "2 messages of the batch failed: 0: timeout; 1: conflict", "[]"},
+		{errors.New("connection refused"), "connection refused", "[]"},
+		{fmt.Errorf("bulk: %w", ItemErrors{0: errors.New("timeout")}), "bulk: 1 messages of the batch failed: 0: timeout", "[1]"},
+	}
+
+	for i, tt := range tests {
+		testName := fmt.Sprintf("TestServe (%d)", i)
+		t.Run(testName, func(t *testing.T) {
+			var handled []Batch
+			handler := HandlerFunc(func(ctx context.Context, batch Batch) error {
+				handled = append(handled, batch)
+				return tt.err
+			})
+			var failed []string
+			opts := Options{Size: 2, OnError: func(batch Batch, err error) { failed = append(failed, err.Error()) }}
+			var acked []int
+			messages := givenMessages(3)
+			for i := range messages {
+				i := i
+				messages[i] = messages[i].WithAck(func() { acked = append(acked, i) })
+			}
+
+			if err := Serve(context.Background(), streamtest.NewFakeStream(messages...), handler, opts); err != nil {
+				t.Fatal(err)
+			}
+			if result := fmt.Sprint(acked); result != tt.acked {
+				t.Errorf("got acked %s, want %s", result, tt.acked)
+			}
+			if result := describe(handled); result != "[[0 1] [2]]" {
+				t.Errorf("got %s", result)
+			}
+			if tt.err != nil && (len(failed) != 2 || failed[0] != tt.failed) {
+				t.Errorf("got errors %q, want %s", failed, tt.failed)
+			}
+		})
+	}
+}
+
+func TestServeContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	s := &streamtest.FakeStream{Messages: make(chan stream.StreamMessage)}
+	if err := Serve(ctx, s, HandlerFunc(func(ctx context.Context, batch Batch) error { return nil }), Options{}); err != context.Canceled {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+}
+
+func TestBatchErrors(t *testing.T) {
+	batch := Batch{{Data: 0}, {Err: errors.New("EOF")}, {Data: 2}}
+	if errs := batch.Errors(); len(errs) != 1 || errs[0].Error() != "EOF" {
+		t.Errorf("got %v", errs)
+	}
+}
@@ -0,0 +1,100 @@
+// Package checkpoint provides stream.CheckpointStore implementations.
+package checkpoint
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"github.com/fallenstedt/twitter-stream/internal/fileutil"
+	"github.com/fallenstedt/twitter-stream/stream"
+)
+
+type (
+	// IMemoryStore is the interface the memoryStore struct implements.
+	IMemoryStore interface {
+		stream.CheckpointStore
+		Saves() int
+	}
+
+	// fileStore keeps the checkpoint in a JSON file.
+	fileStore struct {
+		mu   sync.Mutex
+		path string
+	}
+
+	// memoryStore keeps the checkpoint in memory.
+	memoryStore struct {
+		mu         sync.Mutex
+		checkpoint stream.Checkpoint
+		saves      int
+	}
+)
+
+// NewFileStore creates a store that keeps the checkpoint in the JSON file at path. The file is replaced
+// atomically on every save, so a crash never leaves a partially written checkpoint.
+func NewFileStore(path string) stream.CheckpointStore {
+	return &fileStore{path: path}
+}
+
+// Load reads the checkpoint from the file. A missing file is a zero checkpoint.
+func (f *fileStore) Load() (stream.Checkpoint, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var checkpoint stream.Checkpoint
+	b, err := ioutil.ReadFile(f.path)
+	if os.IsNotExist(err) {
+		return checkpoint, nil
+	}
+	if err != nil {
+		return checkpoint, err
+	}
+	err = json.Unmarshal(b, &checkpoint)
+	return checkpoint, err
+}
+
+// Save writes checkpoint to a temporary file and renames it over the file.
+func (f *fileStore) Save(checkpoint stream.Checkpoint) error {
+	b, err := json.Marshal(checkpoint)
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return fileutil.WriteAtomic(f.path, func(w io.Writer) error {
+		_, err := w.Write(b)
+		return err
+	})
+}
+
+// NewMemoryStore creates a store that keeps the checkpoint in memory. It is meant for tests.
+func NewMemoryStore(checkpoint stream.Checkpoint) IMemoryStore {
+	return &memoryStore{checkpoint: checkpoint}
+}
+
+// Load returns the checkpoint.
+func (m *memoryStore) Load() (stream.Checkpoint, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.checkpoint, nil
+}
+
+// Save keeps checkpoint.
+func (m *memoryStore) Save(checkpoint stream.Checkpoint) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.checkpoint = checkpoint
+	m.saves++
+	return nil
+}
+
+// Saves returns how many times the checkpoint was saved.
+func (m *memoryStore) Saves() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.saves
+}
@@ -0,0 +1,53 @@
+package checkpoint
+
+import (
+	"encoding/json"
+
+	"github.com/fallenstedt/twitter-stream/stream"
+	bolt "go.etcd.io/bbolt"
+)
+
+var boltBucket = []byte("checkpoints")
+
+// boltStore keeps checkpoints in a bbolt database, keyed by name.
+type boltStore struct {
+	db  *bolt.DB
+	key []byte
+}
+
+// NewBoltStore creates a store that keeps the checkpoint under key in db. Several streams can share a database
+// by using different keys. The database is not closed by the store.
+func NewBoltStore(db *bolt.DB, key string) (stream.CheckpointStore, error) {
+	err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(boltBucket)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &boltStore{db: db, key: []byte(key)}, nil
+}
+
+// Load reads the checkpoint. A missing key is a zero checkpoint.
+func (b *boltStore) Load() (stream.Checkpoint, error) {
+	var checkpoint stream.Checkpoint
+	err := b.db.View(func(tx *bolt.Tx) error {
+		value := tx.Bucket(boltBucket).Get(b.key)
+		if value == nil {
+			return nil
+		}
+		return json.Unmarshal(value, &checkpoint)
+	})
+	return checkpoint, err
+}
+
+// Save writes checkpoint in a transaction.
+func (b *boltStore) Save(checkpoint stream.Checkpoint) error {
+	value, err := json.Marshal(checkpoint)
+	if err != nil {
+		return err
+	}
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBucket).Put(b.key, value)
+	})
+}
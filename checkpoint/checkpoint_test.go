@@ -0,0 +1,63 @@
+package checkpoint
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fallenstedt/twitter-stream/stream"
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestStores(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "checkpoint")
+	defer os.RemoveAll(dir)
+
+	db, err := bolt.Open(filepath.Join(dir, "checkpoints.db"), 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	var tests = []struct {
+		store func() (stream.CheckpointStore, error)
+	}{
+		{func() (stream.CheckpointStore, error) {
+			return NewFileStore(filepath.Join(dir, "checkpoint.json")), nil
+		}},
+		{func() (stream.CheckpointStore, error) { return NewBoltStore(db, "search") }},
+		{func() (stream.CheckpointStore, error) { return NewMemoryStore(stream.Checkpoint{}), nil }},
+	}
+
+	for i, tt := range tests {
+		testName := fmt.Sprintf("TestStores (%d)", i)
+		t.Run(testName, func(t *testing.T) {
+			store, err := tt.store()
+			if err != nil {
+				t.Fatalf("got err %v", err)
+			}
+
+			checkpoint, err := store.Load()
+			if err != nil || checkpoint.TweetID != "" || !checkpoint.ReceivedAt.IsZero() {
+				t.Errorf("expected a zero checkpoint before saving, got %+v %v", checkpoint, err)
+			}
+
+			saved := stream.Checkpoint{TweetID: "1400000000000000000", ReceivedAt: time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)}
+			if err := store.Save(saved); err != nil {
+				t.Fatalf("got err when saving %v", err)
+			}
+
+			checkpoint, err = store.Load()
+			if err != nil || checkpoint.TweetID != saved.TweetID || !checkpoint.ReceivedAt.Equal(saved.ReceivedAt) {
+				t.Errorf("got %+v %v, want %+v", checkpoint, err, saved)
+			}
+		})
+	}
+
+	if matches, _ := filepath.Glob(filepath.Join(dir, "*.tmp*")); len(matches) != 0 {
+		t.Errorf("expected temporary files to be removed, got %v", matches)
+	}
+}
@@ -0,0 +1,137 @@
+// Package compliance consumes Twitter's v2 compliance streams, so stored tweets and users can be updated
+// when they are deleted, withheld or suspended.
+package compliance
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/fallenstedt/twitter-stream/httpclient"
+	"github.com/fallenstedt/twitter-stream/stream"
+)
+
+// EventType is the kind of a compliance event.
+type EventType string
+
+const (
+	// EventDelete is a deleted tweet.
+	EventDelete EventType = "delete"
+	// EventWithheld is a tweet withheld in some countries.
+	EventWithheld EventType = "withheld"
+	// EventDrop is a tweet that must no longer be displayed, such as when its author became protected.
+	EventDrop EventType = "drop"
+	// EventUndrop is a dropped tweet that can be displayed again.
+	EventUndrop EventType = "undrop"
+
+	// EventUserDelete is a deleted account.
+	EventUserDelete EventType = "user_delete"
+	// EventUserUndelete is a deleted account that was restored.
+	EventUserUndelete EventType = "user_undelete"
+	// EventUserSuspend is a suspended account.
+	EventUserSuspend EventType = "user_suspend"
+	// EventUserUnsuspend is a suspended account that was restored.
+	EventUserUnsuspend EventType = "user_unsuspend"
+	// EventUserProtect is an account whose tweets became protected.
+	EventUserProtect EventType = "user_protect"
+	// EventUserUnprotect is an account whose tweets became public again.
+	EventUserUnprotect EventType = "user_unprotect"
+	// EventUserWithheld is an account withheld in some countries.
+	EventUserWithheld EventType = "user_withheld"
+	// EventUserProfileModification is an account whose profile changed.
+	EventUserProfileModification EventType = "user_profile_modification"
+	// EventScrubGeo is an account that removed the location of its tweets, up to UpToTweetID.
+	EventScrubGeo EventType = "scrub_geo"
+)
+
+// ErrUnknownEvent is returned by UnmarshalEvent for payloads that are not compliance events.
+var ErrUnknownEvent = errors.New("not a compliance event")
+
+type (
+	// Tweet is the tweet a compliance event is about.
+	Tweet struct {
+		ID       string `json:"id"`
+		AuthorID string `json:"author_id"`
+	}
+
+	// User is the account a compliance event is about.
+	User struct {
+		ID string `json:"id"`
+	}
+
+	// Event is a compliance event. Tweet is set for tweet events, and User for user events.
+	Event struct {
+		Type    EventType
+		EventAt time.Time
+		Tweet   *Tweet
+		User    *User
+		// WithheldInCountries is set for withheld events.
+		WithheldInCountries []string
+		// UpToTweetID is set for scrub_geo events.
+		UpToTweetID string
+	}
+
+	eventPayload struct {
+		Tweet               *Tweet    `json:"tweet"`
+		User                *User     `json:"user"`
+		EventAt             time.Time `json:"event_at"`
+		WithheldInCountries []string  `json:"withheld_in_countries"`
+		UpToTweetID         string    `json:"up_to_tweet_id"`
+	}
+)
+
+// NewTweetStream creates a stream of tweet compliance events. Messages carry an *Event as Data.
+// Start it with a partition from 1 to 4, set with `AddPartition` on the StreamQueryParamsBuilder.
+func NewTweetStream(httpClient httpclient.IHttpClient) *stream.Stream {
+	s := stream.NewTweetComplianceStream(httpClient, stream.NewStreamResponseBodyReader())
+	s.SetUnmarshalHook(UnmarshalEvent)
+	return s
+}
+
+// NewUserStream creates a stream of user compliance events. Messages carry an *Event as Data.
+// Start it with a partition from 1 to 4, set with `AddPartition` on the StreamQueryParamsBuilder.
+func NewUserStream(httpClient httpclient.IHttpClient) *stream.Stream {
+	s := stream.NewUserComplianceStream(httpClient, stream.NewStreamResponseBodyReader())
+	s.SetUnmarshalHook(UnmarshalEvent)
+	return s
+}
+
+// UnmarshalEvent is an UnmarshalHook that unmarshals a compliance stream payload into an *Event.
+func UnmarshalEvent(b []byte) (interface{}, error) {
+	var payload struct {
+		Data map[string]json.RawMessage `json:"data"`
+	}
+	if err := json.Unmarshal(b, &payload); err != nil {
+		return nil, err
+	}
+	if len(payload.Data) != 1 {
+		return nil, ErrUnknownEvent
+	}
+
+	for eventType, raw := range payload.Data {
+		var fields eventPayload
+		if err := json.Unmarshal(raw, &fields); err != nil {
+			return nil, fmt.Errorf("could not unmarshal %s event: %w", eventType, err)
+		}
+		return &Event{
+			Type:                EventType(eventType),
+			EventAt:             fields.EventAt,
+			Tweet:               fields.Tweet,
+			User:                fields.User,
+			WithheldInCountries: fields.WithheldInCountries,
+			UpToTweetID:         fields.UpToTweetID,
+		}, nil
+	}
+	return nil, ErrUnknownEvent
+}
+
+// IsTweetEvent reports whether the event is about a tweet.
+func (e *Event) IsTweetEvent() bool {
+	return e.Tweet != nil
+}
+
+// IsUserEvent reports whether the event is about an account.
+func (e *Event) IsUserEvent() bool {
+	return e.Tweet == nil && e.User != nil
+}
@@ -0,0 +1,65 @@
+package compliance
+
+import (
+	"sync"
+
+	"github.com/fallenstedt/twitter-stream/internal/fileutil"
+)
+
+type (
+	// IFileAuditLog is the interface the fileAuditLog struct implements.
+	IFileAuditLog interface {
+		AuditLog
+		Close() error
+	}
+
+	// IMemoryAuditLog is the interface the memoryAuditLog struct implements.
+	IMemoryAuditLog interface {
+		AuditLog
+		Entries() []AuditEntry
+	}
+
+	fileAuditLog struct {
+		*fileutil.Appender
+	}
+
+	memoryAuditLog struct {
+		mu      sync.Mutex
+		entries []AuditEntry
+	}
+)
+
+// NewFileAuditLog opens an audit log that appends entries to the file at path as newline delimited JSON.
+// The file is created if it does not exist.
+func NewFileAuditLog(path string) (IFileAuditLog, error) {
+	appender, err := fileutil.OpenAppender(path, true)
+	if err != nil {
+		return nil, err
+	}
+	return &fileAuditLog{appender}, nil
+}
+
+// Record appends entry to the file and syncs it, so the audit log survives a crash.
+func (f *fileAuditLog) Record(entry AuditEntry) error {
+	return f.Append(entry)
+}
+
+// NewMemoryAuditLog creates an audit log that keeps entries in memory. It is meant for tests.
+func NewMemoryAuditLog() IMemoryAuditLog {
+	return &memoryAuditLog{}
+}
+
+// Record keeps entry.
+func (m *memoryAuditLog) Record(entry AuditEntry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.entries = append(m.entries, entry)
+	return nil
+}
+
+// Entries returns the entries recorded so far.
+func (m *memoryAuditLog) Entries() []AuditEntry {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]AuditEntry(nil), m.entries...)
+}
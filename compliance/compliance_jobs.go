@@ -0,0 +1,348 @@
+package compliance
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/fallenstedt/twitter-stream/httpclient"
+)
+
+// JobType is the kind of ids a batch compliance job checks.
+type JobType string
+
+const (
+	// JobTypeTweets checks tweet ids.
+	JobTypeTweets JobType = "tweets"
+	// JobTypeUsers checks user ids.
+	JobTypeUsers JobType = "users"
+)
+
+// JobStatus is the status of a batch compliance job.
+type JobStatus string
+
+const (
+	// JobStatusCreated is a job waiting for ids to be uploaded.
+	JobStatusCreated JobStatus = "created"
+	// JobStatusInProgress is a job checking the uploaded ids.
+	JobStatusInProgress JobStatus = "in_progress"
+	// JobStatusComplete is a job whose results can be downloaded.
+	JobStatusComplete JobStatus = "complete"
+	// JobStatusFailed is a job that could not check the uploaded ids.
+	JobStatusFailed JobStatus = "failed"
+	// JobStatusExpired is a job whose upload URL expired before ids were uploaded.
+	JobStatusExpired JobStatus = "expired"
+)
+
+const (
+	// DefaultWaitInterval is how often Wait polls a job when its interval is not greater than 0.
+	DefaultWaitInterval = time.Minute
+	// transferAttempts is how many times ids are uploaded or results downloaded before giving up.
+	transferAttempts = 3
+)
+
+var (
+	// ErrJobFailed is returned by Wait when a job failed.
+	ErrJobFailed = errors.New("compliance job failed")
+	// ErrJobExpired is returned by Wait when a job expired before ids were uploaded.
+	ErrJobExpired = errors.New("compliance job expired")
+)
+
+type (
+	// IJobs is the interface the jobs struct implements.
+	IJobs interface {
+		Create(jobType JobType, name string, resumable bool) (*Job, error)
+		Get(id string) (*Job, error)
+		List(jobType JobType, status JobStatus) ([]Job, error)
+		Upload(job *Job, ids io.Reader) error
+		Wait(ctx context.Context, id string, interval time.Duration) (*Job, error)
+		Download(job *Job, fn func(record Record) error) error
+	}
+
+	// JobStateError is returned by Upload and Download for a job whose status or URL does not allow them.
+	JobStateError struct {
+		ID     string
+		Status JobStatus
+		// Action is upload or download.
+		Action string
+	}
+
+	// Job is a batch compliance job.
+	Job struct {
+		ID                string    `json:"id"`
+		Type              JobType   `json:"type"`
+		Name              string    `json:"name"`
+		Resumable         bool      `json:"resumable"`
+		Status            JobStatus `json:"status"`
+		UploadURL         string    `json:"upload_url"`
+		UploadExpiresAt   time.Time `json:"upload_expires_at"`
+		DownloadURL       string    `json:"download_url"`
+		DownloadExpiresAt time.Time `json:"download_expires_at"`
+		CreatedAt         time.Time `json:"created_at"`
+		Error             string    `json:"error"`
+	}
+
+	// Record is a result of a batch compliance job, for a tweet or user that is no longer compliant.
+	Record struct {
+		ID string `json:"id"`
+		// Action is delete for tweets and users that must be removed.
+		Action     string    `json:"action"`
+		CreatedAt  time.Time `json:"created_at"`
+		RedactedAt time.Time `json:"redacted_at"`
+		// Reason is why the tweet or user must be removed, such as deleted, suspended or protected.
+		Reason string `json:"reason"`
+	}
+
+	jobs struct {
+		httpClient httpclient.IHttpClient
+		files      *http.Client
+		backoff    time.Duration
+	}
+)
+
+// NewJobs creates a client for batch compliance jobs. Requests to the API go through httpClient.
+// The ids are uploaded and the results downloaded with files, which is http.DefaultClient if nil,
+// because the upload and download URLs are signed and must not carry the Bearer token. Transfers that fail with a
+// network error or a 5xx status are tried up to 3 times.
+// Read more at https://developer.twitter.com/en/docs/twitter-api/compliance/batch-compliance/introduction.
+func NewJobs(httpClient httpclient.IHttpClient, files *http.Client) IJobs {
+	if files == nil {
+		files = http.DefaultClient
+	}
+	return &jobs{httpClient: httpClient, files: files, backoff: time.Second}
+}
+
+// Create creates a job for jobType. A resumable job lets an interrupted upload be resumed.
+func (j *jobs) Create(jobType JobType, name string, resumable bool) (*Job, error) {
+	body, err := json.Marshal(struct {
+		Type      JobType `json:"type"`
+		Name      string  `json:"name,omitempty"`
+		Resumable bool    `json:"resumable,omitempty"`
+	}{jobType, name, resumable})
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := j.httpClient.CreateComplianceJob(string(body))
+	if err != nil {
+		return nil, err
+	}
+	return decodeJob(res)
+}
+
+// Get returns the job with id.
+func (j *jobs) Get(id string) (*Job, error) {
+	res, err := j.httpClient.GetComplianceJob(id)
+	if err != nil {
+		return nil, err
+	}
+	return decodeJob(res)
+}
+
+// List returns the jobs of jobType. If status is empty, jobs of every status are returned.
+func (j *jobs) List(jobType JobType, status JobStatus) ([]Job, error) {
+	query := url.Values{}
+	query.Set("type", string(jobType))
+	if status != "" {
+		query.Set("status", string(status))
+	}
+
+	res, err := j.httpClient.GetComplianceJobs(&query)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	var data struct {
+		Data []Job `json:"data"`
+	}
+	err = json.NewDecoder(res.Body).Decode(&data)
+	return data.Data, err
+}
+
+// Upload uploads ids, one tweet or user id per line, to the upload URL of a created job. A failed upload is only
+// tried again if ids is an io.Seeker, such as an *os.File. ids is not closed.
+func (j *jobs) Upload(job *Job, ids io.Reader) error {
+	if job.Status != JobStatusCreated || job.UploadURL == "" {
+		return &JobStateError{ID: job.ID, Status: job.Status, Action: "upload"}
+	}
+
+	seeker, retry := ids.(io.Seeker)
+	var start, size int64
+	if retry {
+		var err error
+		if start, size, err = remaining(seeker); err != nil {
+			retry = false
+		}
+	}
+	// The client closes request bodies, so closers are wrapped to leave ids open.
+	body := ids
+	if _, ok := ids.(io.Closer); ok {
+		body = ioutil.NopCloser(ids)
+	}
+	res, err := j.transfer("upload ids", retry, func() (*http.Request, error) {
+		if retry {
+			if _, err := seeker.Seek(start, io.SeekStart); err != nil {
+				return nil, err
+			}
+		}
+		req, err := http.NewRequest(http.MethodPut, job.UploadURL, body)
+		if err != nil {
+			return nil, err
+		}
+		if retry {
+			req.ContentLength = size
+		}
+		req.Header.Set("Content-Type", "text/plain")
+		return req, nil
+	})
+	if err != nil {
+		return err
+	}
+	return res.Body.Close()
+}
+
+// remaining returns the offset of seeker and the number of bytes left after it.
+func remaining(seeker io.Seeker) (int64, int64, error) {
+	start, err := seeker.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, 0, err
+	}
+	end, err := seeker.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, 0, err
+	}
+	if _, err := seeker.Seek(start, io.SeekStart); err != nil {
+		return 0, 0, err
+	}
+	return start, end - start, nil
+}
+
+// Wait polls the job with id every interval until it is complete. It returns ErrJobFailed or ErrJobExpired,
+// along with the job, if the job did not complete, or the context error if ctx is done first.
+// An interval that is not greater than 0 is replaced by DefaultWaitInterval.
+func (j *jobs) Wait(ctx context.Context, id string, interval time.Duration) (*Job, error) {
+	if interval <= 0 {
+		interval = DefaultWaitInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		job, err := j.Get(id)
+		if err != nil {
+			return nil, err
+		}
+		switch job.Status {
+		case JobStatusComplete:
+			return job, nil
+		case JobStatusFailed:
+			return job, fmt.Errorf("%w: %s", ErrJobFailed, job.Error)
+		case JobStatusExpired:
+			return job, ErrJobExpired
+		}
+
+		select {
+		case <-ctx.Done():
+			return job, ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Download downloads the results of a complete job and calls fn with every record, in the order they were written.
+// It stops and returns the error if fn returns one.
+func (j *jobs) Download(job *Job, fn func(record Record) error) error {
+	if job.Status != JobStatusComplete || job.DownloadURL == "" {
+		return &JobStateError{ID: job.ID, Status: job.Status, Action: "download"}
+	}
+
+	res, err := j.transfer("download results", true, func() (*http.Request, error) {
+		return http.NewRequest(http.MethodGet, job.DownloadURL, nil)
+	})
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	return ParseResults(res.Body, fn)
+}
+
+// transfer sends the request returned by newRequest. If retry is true, a network error or a 5xx status is tried
+// again, up to transferAttempts times, with a backoff that doubles.
+func (j *jobs) transfer(action string, retry bool, newRequest func() (*http.Request, error)) (*http.Response, error) {
+	backoff := j.backoff
+	for attempt := 1; ; attempt++ {
+		req, err := newRequest()
+		if err != nil {
+			return nil, err
+		}
+		res, err := j.files.Do(req)
+		if err == nil {
+			if err = checkFileResponse(res, action); err == nil {
+				return res, nil
+			}
+			res.Body.Close()
+			if res.StatusCode < 500 {
+				return nil, err
+			}
+		}
+		if !retry || attempt == transferAttempts {
+			return nil, err
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// ParseResults parses the newline delimited JSON results of a job from r and calls fn with every record.
+func ParseResults(r io.Reader, fn func(record Record) error) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	line := 0
+	for scanner.Scan() {
+		line++
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var record Record
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+		if err := fn(record); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+func decodeJob(res *http.Response) (*Job, error) {
+	defer res.Body.Close()
+
+	var data struct {
+		Data Job `json:"data"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&data); err != nil {
+		return nil, err
+	}
+	return &data.Data, nil
+}
+
+func (e *JobStateError) Error() string {
+	return fmt.Sprintf("cannot %s compliance job %s with status %q", e.Action, e.ID, e.Status)
+}
+
+func checkFileResponse(res *http.Response, action string) error {
+	if res.StatusCode < 300 {
+		return nil
+	}
+	body, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1024))
+	return fmt.Errorf("could not %s: status %d: %s", action, res.StatusCode, body)
+}
@@ -0,0 +1,279 @@
+package compliance
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fallenstedt/twitter-stream/httpclient"
+)
+
+func jsonResponse(body string) *http.Response {
+	return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(bytes.NewReader([]byte(body)))}
+}
+
+func TestJobs(t *testing.T) {
+	var uploaded string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodPut && r.URL.Path == "/upload":
+			if r.Header.Get("Content-Type") != "text/plain" || r.Header.Get("Authorization") != "" {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			b, _ := ioutil.ReadAll(r.Body)
+			uploaded = string(b)
+		case r.Method == http.MethodGet && r.URL.Path == "/download":
+			fmt.Fprintln(w, `{"id":"1","action":"delete","created_at":"2021-01-01T00:00:00.000Z","redacted_at":"2021-06-01T00:00:00.000Z","reason":"deleted"}`)
+			fmt.Fprintln(w)
+			fmt.Fprintln(w, `{"id":"3","action":"delete","created_at":"2021-01-02T00:00:00.000Z","redacted_at":"2021-06-02T00:00:00.000Z","reason":"suspended"}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	var created string
+	polls := 0
+	client := httpclient.NewHttpClientMock("foobar")
+	client.MockCreateComplianceJob = func(body string) (*http.Response, error) {
+		created = body
+		return jsonResponse(`{"data":{"id":"42","type":"tweets","name":"nightly","status":"created","upload_url":"` + server.URL + `/upload"}}`), nil
+	}
+	client.MockGetComplianceJob = func(id string) (*http.Response, error) {
+		polls++
+		if polls < 3 {
+			return jsonResponse(`{"data":{"id":"` + id + `","status":"in_progress"}}`), nil
+		}
+		return jsonResponse(`{"data":{"id":"` + id + `","status":"complete","download_url":"` + server.URL + `/download"}}`), nil
+	}
+
+	jobs := NewJobs(client, server.Client())
+	job, err := jobs.Create(JobTypeTweets, "nightly", false)
+	if err != nil {
+		t.Fatalf("got err %v when creating the job", err)
+	}
+	if created != `{"type":"tweets","name":"nightly"}` {
+		t.Errorf("got request body %s", created)
+	}
+
+	if err := jobs.Upload(job, strings.NewReader("1\n2\n3\n")); err != nil {
+		t.Fatalf("got err %v when uploading", err)
+	}
+	if uploaded != "1\n2\n3\n" {
+		t.Errorf("got uploaded ids %q", uploaded)
+	}
+
+	job, err = jobs.Wait(context.Background(), job.ID, time.Millisecond)
+	if err != nil || job.Status != JobStatusComplete || polls != 3 {
+		t.Fatalf("got job %+v err %v after %d polls", job, err, polls)
+	}
+
+	var records []string
+	err = jobs.Download(job, func(record Record) error {
+		records = append(records, fmt.Sprintf("%s %s %s %s", record.ID, record.Action, record.Reason, record.RedactedAt.Format("2006-01-02")))
+		return nil
+	})
+	result := fmt.Sprint(records)
+	expected := "[1 delete deleted 2021-06-01 3 delete suspended 2021-06-02]"
+	if err != nil || result != expected {
+		t.Errorf("got %s %v, want %s", result, err, expected)
+	}
+
+	job.DownloadURL = server.URL + "/missing"
+	if err := jobs.Download(job, func(record Record) error { return nil }); err == nil {
+		t.Errorf("expected an error when the download fails")
+	}
+}
+
+func TestJobsWait(t *testing.T) {
+	var tests = []struct {
+		status string
+		err    error
+	}{
+		{`"status":"failed","error":"invalid ids"`, ErrJobFailed},
+		{`"status":"expired"`, ErrJobExpired},
+		{`"status":"in_progress"`, context.DeadlineExceeded},
+	}
+
+	for i, tt := range tests {
+		testName := fmt.Sprintf("TestJobsWait (%d)", i)
+		t.Run(testName, func(t *testing.T) {
+			client := httpclient.NewHttpClientMock("foobar")
+			client.MockGetComplianceJob = func(id string) (*http.Response, error) {
+				return jsonResponse(`{"data":{"id":"` + id + `",` + tt.status + `}}`), nil
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+			defer cancel()
+			job, err := NewJobs(client, nil).Wait(ctx, "42", time.Millisecond)
+			if !errors.Is(err, tt.err) {
+				t.Errorf("got err %v, want %v", err, tt.err)
+			}
+			if job == nil || job.ID != "42" {
+				t.Errorf("expected the job to be returned, got %+v", job)
+			}
+		})
+	}
+}
+
+func TestJobsWaitDefaultsInterval(t *testing.T) {
+	polls := 0
+	client := httpclient.NewHttpClientMock("foobar")
+	client.MockGetComplianceJob = func(id string) (*http.Response, error) {
+		polls++
+		return jsonResponse(`{"data":{"id":"` + id + `","status":"in_progress"}}`), nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err := NewJobs(client, nil).Wait(ctx, "42", 0)
+	if err != context.DeadlineExceeded || polls != 1 {
+		t.Errorf("expected one poll before the deadline, got %d polls and %v", polls, err)
+	}
+}
+
+func TestJobsTransferState(t *testing.T) {
+	var tests = []struct {
+		job      Job
+		download bool
+	}{
+		{Job{ID: "42", Status: JobStatusInProgress, UploadURL: "http://example.com/upload"}, false},
+		{Job{ID: "42", Status: JobStatusCreated}, false},
+		{Job{ID: "42", Status: JobStatusInProgress, DownloadURL: "http://example.com/download"}, true},
+		{Job{ID: "42", Status: JobStatusComplete}, true},
+	}
+
+	for i, tt := range tests {
+		testName := fmt.Sprintf("TestJobsTransferState (%d)", i)
+		t.Run(testName, func(t *testing.T) {
+			jobs := NewJobs(httpclient.NewHttpClientMock("foobar"), nil)
+			var err error
+			if tt.download {
+				err = jobs.Download(&tt.job, func(record Record) error { return nil })
+			} else {
+				err = jobs.Upload(&tt.job, strings.NewReader("1\n"))
+			}
+
+			var stateErr *JobStateError
+			if !errors.As(err, &stateErr) || stateErr.ID != "42" || stateErr.Status != tt.job.Status {
+				t.Errorf("expected a JobStateError, got %v", err)
+			}
+		})
+	}
+}
+
+func TestJobsTransferRetries(t *testing.T) {
+	var tests = []struct {
+		failures   int
+		status     int
+		ids        io.Reader
+		uploads    int
+		uploaded   bool
+		downloads  int
+		downloaded bool
+		length     int64
+	}{
+		{2, http.StatusServiceUnavailable, strings.NewReader("1\n2\n"), 3, true, 3, true, 4},
+		{3, http.StatusServiceUnavailable, strings.NewReader("1\n2\n"), 3, false, 3, false, 4},
+		// 4xx responses are not tried again
+		{1, http.StatusForbidden, strings.NewReader("1\n2\n"), 1, false, 1, false, 4},
+		// ids that cannot be read again are not uploaded again, and their length is unknown
+		{1, http.StatusServiceUnavailable, ioutil.NopCloser(strings.NewReader("1\n2\n")), 1, false, 2, true, -1},
+	}
+
+	for i, tt := range tests {
+		testName := fmt.Sprintf("TestJobsTransferRetries (%d)", i)
+		t.Run(testName, func(t *testing.T) {
+			uploads, downloads := 0, 0
+			var uploaded []string
+			var lengths []int64
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				var attempt int
+				if r.Method == http.MethodPut {
+					uploads++
+					attempt = uploads
+					b, _ := ioutil.ReadAll(r.Body)
+					uploaded = append(uploaded, string(b))
+					lengths = append(lengths, r.ContentLength)
+				} else {
+					downloads++
+					attempt = downloads
+				}
+				if attempt <= tt.failures {
+					w.WriteHeader(tt.status)
+					return
+				}
+				fmt.Fprintln(w, `{"id":"1","action":"delete"}`)
+			}))
+			defer server.Close()
+
+			jobs := NewJobs(httpclient.NewHttpClientMock("foobar"), server.Client()).(*jobs)
+			jobs.backoff = time.Millisecond
+
+			job := &Job{ID: "42", Status: JobStatusCreated, UploadURL: server.URL + "/upload"}
+			err := jobs.Upload(job, tt.ids)
+			if (err == nil) != tt.uploaded || uploads != tt.uploads {
+				t.Errorf("got %d uploads and err %v", uploads, err)
+			}
+			for i, ids := range uploaded {
+				if ids != "1\n2\n" || lengths[i] != tt.length {
+					t.Errorf("expected every upload to send every id with length %d, got %q and %v", tt.length, uploaded, lengths)
+				}
+			}
+
+			records := 0
+			job = &Job{ID: "42", Status: JobStatusComplete, DownloadURL: server.URL + "/download"}
+			err = jobs.Download(job, func(record Record) error {
+				records++
+				return nil
+			})
+			if (err == nil) != tt.downloaded || downloads != tt.downloads || (tt.downloaded && records != 1) {
+				t.Errorf("got %d downloads, %d records and err %v", downloads, records, err)
+			}
+		})
+	}
+}
+
+func TestJobsList(t *testing.T) {
+	var query string
+	client := httpclient.NewHttpClientMock("foobar")
+	client.MockGetComplianceJobs = func(queryParams *url.Values) (*http.Response, error) {
+		query = queryParams.Encode()
+		return jsonResponse(`{"data":[{"id":"1","status":"complete"},{"id":"2","status":"complete"}]}`), nil
+	}
+
+	jobs, err := NewJobs(client, nil).List(JobTypeUsers, JobStatusComplete)
+	if err != nil || len(jobs) != 2 || jobs[1].ID != "2" {
+		t.Errorf("got %+v %v", jobs, err)
+	}
+	if query != "status=complete&type=users" {
+		t.Errorf("got query %s", query)
+	}
+}
+
+func TestParseResults(t *testing.T) {
+	err := ParseResults(strings.NewReader(`{"id":"1","action":"delete"}`+"\n"+`{"id":`), func(record Record) error {
+		return nil
+	})
+	if err == nil || !strings.HasPrefix(err.Error(), "line 2:") {
+		t.Errorf("expected an error on line 2, got %v", err)
+	}
+
+	stop := errors.New("stop")
+	err = ParseResults(strings.NewReader(`{"id":"1"}`+"\n"+`{"id":"2"}`), func(record Record) error {
+		return stop
+	})
+	if err != stop {
+		t.Errorf("expected the error returned by fn, got %v", err)
+	}
+}
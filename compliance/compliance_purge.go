@@ -0,0 +1,270 @@
+package compliance
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fallenstedt/twitter-stream/stream"
+)
+
+type (
+	// Purger is implemented by every place tweets are stored, so they can be removed when Twitter asks.
+	// Purging must be idempotent, because failed purges are retried and the same ids can be purged again.
+	Purger interface {
+		// PurgeTweets removes the tweets with ids and returns how many were removed, or 0 if they are removed later.
+		PurgeTweets(ctx context.Context, ids []string) (int, error)
+		// PurgeUsers removes the tweets authored by the users with ids, and anything stored about the users,
+		// and returns how many tweets were removed.
+		PurgeUsers(ctx context.Context, ids []string) (int, error)
+	}
+
+	// IProcessor is the interface the processor struct implements.
+	IProcessor interface {
+		stream.Handler
+		Register(name string, purger Purger)
+		HandleEvent(ctx context.Context, event *Event) error
+		HandleRecords(ctx context.Context, jobType JobType, records []Record) error
+	}
+
+	// ProcessorOptions configures a processor.
+	ProcessorOptions struct {
+		// Events are the events that purge a tweet or user. DefaultPurgeEvents is used if empty.
+		Events []EventType
+		// Attempts is how many times a purger is called before giving up. It is 3 if 0.
+		Attempts int
+		// Backoff is the delay before the second attempt. It doubles on every attempt after that, up to MaxBackoff.
+		// It is 500ms if 0.
+		Backoff time.Duration
+		// MaxBackoff is the longest delay between attempts. It is 30s if 0.
+		MaxBackoff time.Duration
+	}
+
+	// AuditEntry records what a purger removed, or failed to remove.
+	AuditEntry struct {
+		At     time.Time `json:"at"`
+		Purger string    `json:"purger"`
+		// Kind is tweets or users.
+		Kind JobType  `json:"kind"`
+		IDs  []string `json:"ids"`
+		// Reason is the compliance event type, or the reason of the batch compliance job records.
+		Reason string `json:"reason"`
+		// Removed is the number the purger returned. Purgers that remove tweets later, such as archives, return 0.
+		Removed  int    `json:"removed"`
+		Attempts int    `json:"attempts"`
+		Error    string `json:"error,omitempty"`
+	}
+
+	// AuditLog keeps an AuditEntry for every purge. Implementations are NewFileAuditLog and NewMemoryAuditLog.
+	AuditLog interface {
+		Record(entry AuditEntry) error
+	}
+
+	// PurgeError is returned when some purgers could not purge, after every attempt.
+	PurgeError struct {
+		// Errors are the last error of each purger that failed, by name.
+		Errors map[string]error
+	}
+
+	processor struct {
+		opts    ProcessorOptions
+		audit   AuditLog
+		events  map[EventType]bool
+		mu      sync.Mutex
+		names   []string
+		purgers map[string]Purger
+	}
+)
+
+// DefaultPurgeEvents are the events that purge by default: deleted tweets, and deleted or suspended users.
+var DefaultPurgeEvents = []EventType{EventDelete, EventUserDelete, EventUserSuspend}
+
+// NewProcessor creates a processor that fans purges out to every registered purger. Every purge is recorded
+// in audit, which may be nil. The processor is a stream.Handler for compliance streams: Handle purges the
+// *Event carried by a message and ignores other messages.
+func NewProcessor(audit AuditLog, opts ProcessorOptions) IProcessor {
+	if len(opts.Events) == 0 {
+		opts.Events = DefaultPurgeEvents
+	}
+	if opts.Attempts <= 0 {
+		opts.Attempts = 3
+	}
+	if opts.Backoff <= 0 {
+		opts.Backoff = 500 * time.Millisecond
+	}
+	if opts.MaxBackoff <= 0 {
+		opts.MaxBackoff = 30 * time.Second
+	}
+	p := &processor{opts: opts, audit: audit, events: map[EventType]bool{}, purgers: map[string]Purger{}}
+	for _, eventType := range opts.Events {
+		p.events[eventType] = true
+	}
+	return p
+}
+
+// Register adds purger under name. Registering a name again replaces its purger.
+func (p *processor) Register(name string, purger Purger) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.purgers[name]; !ok {
+		p.names = append(p.names, name)
+	}
+	p.purgers[name] = purger
+}
+
+// Handle purges the event carried by message.
+func (p *processor) Handle(ctx context.Context, message stream.StreamMessage) error {
+	event, ok := message.Data.(*Event)
+	if message.Err != nil || !ok {
+		return nil
+	}
+	return p.HandleEvent(ctx, event)
+}
+
+// HandleEvent purges the tweet or user of event, if its type is one of the purge events.
+func (p *processor) HandleEvent(ctx context.Context, event *Event) error {
+	if !p.events[event.Type] {
+		return nil
+	}
+	switch {
+	case event.IsTweetEvent():
+		return p.purge(ctx, JobTypeTweets, []string{event.Tweet.ID}, string(event.Type))
+	case event.IsUserEvent():
+		return p.purge(ctx, JobTypeUsers, []string{event.User.ID}, string(event.Type))
+	}
+	return nil
+}
+
+// HandleRecords purges the tweets or users of the delete records of a batch compliance job of jobType.
+// Records are purged together, once per reason. A reason that could not be purged does not stop the others: the
+// purgers that failed for any reason are returned in a PurgeError once every reason was purged.
+func (p *processor) HandleRecords(ctx context.Context, jobType JobType, records []Record) error {
+	var reasons []string
+	ids := map[string][]string{}
+	for _, record := range records {
+		if record.Action != "delete" {
+			continue
+		}
+		if _, ok := ids[record.Reason]; !ok {
+			reasons = append(reasons, record.Reason)
+		}
+		ids[record.Reason] = append(ids[record.Reason], record.ID)
+	}
+
+	failed := map[string]error{}
+	for _, reason := range reasons {
+		err := p.purge(ctx, jobType, ids[reason], reason)
+		var purgeErr *PurgeError
+		if !errors.As(err, &purgeErr) {
+			continue
+		}
+		for name, err := range purgeErr.Errors {
+			failed[name] = err
+		}
+	}
+	if len(failed) > 0 {
+		return &PurgeError{Errors: failed}
+	}
+	return nil
+}
+
+// purge calls every purger concurrently with ids and waits for them.
+func (p *processor) purge(ctx context.Context, kind JobType, ids []string, reason string) error {
+	p.mu.Lock()
+	names := append([]string(nil), p.names...)
+	purgers := make([]Purger, len(names))
+	for i, name := range names {
+		purgers[i] = p.purgers[name]
+	}
+	p.mu.Unlock()
+
+	errs := make([]error, len(purgers))
+	var wg sync.WaitGroup
+	for i := range purgers {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = p.purgeWith(ctx, names[i], purgers[i], kind, ids, reason)
+		}(i)
+	}
+	wg.Wait()
+
+	failed := map[string]error{}
+	for i, err := range errs {
+		if err != nil {
+			failed[names[i]] = err
+		}
+	}
+	if len(failed) > 0 {
+		return &PurgeError{Errors: failed}
+	}
+	return nil
+}
+
+// purgeWith calls purger until it succeeds or runs out of attempts, and records the outcome in the audit log.
+func (p *processor) purgeWith(ctx context.Context, name string, purger Purger, kind JobType, ids []string, reason string) error {
+	var removed, attempts int
+	var err error
+	backoff := p.opts.Backoff
+	for attempts < p.opts.Attempts {
+		if attempts > 0 {
+			if !sleep(ctx, backoff) {
+				err = ctx.Err()
+				break
+			}
+			if backoff *= 2; backoff > p.opts.MaxBackoff {
+				backoff = p.opts.MaxBackoff
+			}
+		}
+		attempts++
+		if kind == JobTypeUsers {
+			removed, err = purger.PurgeUsers(ctx, ids)
+		} else {
+			removed, err = purger.PurgeTweets(ctx, ids)
+		}
+		if err == nil {
+			break
+		}
+	}
+
+	if p.audit != nil {
+		entry := AuditEntry{At: time.Now(), Purger: name, Kind: kind, IDs: ids, Reason: reason, Removed: removed, Attempts: attempts}
+		if err != nil {
+			entry.Error = err.Error()
+		}
+		if auditErr := p.audit.Record(entry); auditErr != nil && err == nil {
+			err = fmt.Errorf("could not record audit entry: %w", auditErr)
+		}
+	}
+	return err
+}
+
+// sleep waits for d. It returns false if ctx is done first.
+func sleep(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+func (e *PurgeError) Error() string {
+	names := make([]string, 0, len(e.Errors))
+	for name := range e.Errors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	messages := make([]string, len(names))
+	for i, name := range names {
+		messages[i] = fmt.Sprintf("%s: %v", name, e.Errors[name])
+	}
+	return "could not purge with " + strings.Join(messages, ", ")
+}
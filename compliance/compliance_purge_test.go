@@ -0,0 +1,216 @@
+package compliance
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fallenstedt/twitter-stream/stream"
+)
+
+type fakePurger struct {
+	mu       sync.Mutex
+	failures int
+	purged   []string
+}
+
+func (f *fakePurger) purge(kind string, ids []string) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.failures > 0 {
+		f.failures--
+		return 0, errors.New("database is locked")
+	}
+	f.purged = append(f.purged, kind+"="+strings.Join(ids, ","))
+	return len(ids), nil
+}
+
+func (f *fakePurger) PurgeTweets(ctx context.Context, ids []string) (int, error) {
+	return f.purge("tweets", ids)
+}
+
+func (f *fakePurger) PurgeUsers(ctx context.Context, ids []string) (int, error) {
+	return f.purge("users", ids)
+}
+
+func TestProcessorHandleEvent(t *testing.T) {
+	var tests = []struct {
+		event    *Event
+		failures int
+		purged   string
+		audit    string
+		failed   bool
+	}{
+		{&Event{Type: EventDelete, Tweet: &Tweet{ID: "1", AuthorID: "10"}}, 0, "[tweets=1] [tweets=1]", "[files delete 1/1 index delete 1/1]", false},
+		{&Event{Type: EventUserSuspend, User: &User{ID: "10"}}, 0, "[users=10] [users=10]", "[files user_suspend 1/1 index user_suspend 1/1]", false},
+		{&Event{Type: EventWithheld, Tweet: &Tweet{ID: "1"}, WithheldInCountries: []string{"DE"}}, 0, "[] []", "[]", false},
+		// retried until it succeeds
+		{&Event{Type: EventDelete, Tweet: &Tweet{ID: "2"}}, 2, "[tweets=2] [tweets=2]", "[files delete 1/1 index delete 1/3]", false},
+		// gives up after 3 attempts
+		{&Event{Type: EventDelete, Tweet: &Tweet{ID: "3"}}, 3, "[tweets=3] []", "[files delete 1/1 index delete 0/3 database is locked]", true},
+	}
+
+	for i, tt := range tests {
+		testName := fmt.Sprintf("TestProcessorHandleEvent (%d)", i)
+		t.Run(testName, func(t *testing.T) {
+			files, index := &fakePurger{}, &fakePurger{failures: tt.failures}
+			audit := NewMemoryAuditLog()
+			processor := NewProcessor(audit, ProcessorOptions{Backoff: time.Millisecond})
+			processor.Register("files", files)
+			processor.Register("index", index)
+
+			err := processor.HandleEvent(context.Background(), tt.event)
+			var purgeErr *PurgeError
+			if errors.As(err, &purgeErr) != tt.failed {
+				t.Errorf("got err %v", err)
+			}
+			if purgeErr != nil && purgeErr.Errors["index"] == nil {
+				t.Errorf("expected index to fail, got %v", purgeErr)
+			}
+
+			purged := fmt.Sprint(files.purged, " ", index.purged)
+			if purged != tt.purged {
+				t.Errorf("got purged %s, want %s", purged, tt.purged)
+			}
+			if result := describeAudit(audit.Entries()); result != tt.audit {
+				t.Errorf("got audit %s, want %s", result, tt.audit)
+			}
+		})
+	}
+}
+
+func TestProcessorOptions(t *testing.T) {
+	var tests = []struct {
+		opts     ProcessorOptions
+		expected string
+	}{
+		{ProcessorOptions{}, "3 500ms 30s"},
+		{ProcessorOptions{Attempts: 5, Backoff: time.Second, MaxBackoff: time.Minute}, "5 1s 1m0s"},
+	}
+
+	for i, tt := range tests {
+		testName := fmt.Sprintf("TestProcessorOptions (%d)", i)
+		t.Run(testName, func(t *testing.T) {
+			opts := NewProcessor(nil, tt.opts).(*processor).opts
+			result := fmt.Sprintf("%d %v %v", opts.Attempts, opts.Backoff, opts.MaxBackoff)
+			if result != tt.expected {
+				t.Errorf("got %s, want %s", result, tt.expected)
+			}
+		})
+	}
+}
+
+func TestProcessorHandleRecords(t *testing.T) {
+	purger := &fakePurger{}
+	audit := NewMemoryAuditLog()
+	processor := NewProcessor(audit, ProcessorOptions{})
+	processor.Register("files", purger)
+
+	err := processor.HandleRecords(context.Background(), JobTypeTweets, []Record{
+		{ID: "1", Action: "delete", Reason: "deleted"},
+		{ID: "2", Action: "delete", Reason: "suspended"},
+		{ID: "3", Action: "delete", Reason: "deleted"},
+		{ID: "4", Action: "other", Reason: "deleted"},
+	})
+	if err != nil {
+		t.Fatalf("got err %v", err)
+	}
+
+	result := fmt.Sprint(purger.purged)
+	if result != "[tweets=1,3 tweets=2]" {
+		t.Errorf("got %s", result)
+	}
+	if result := describeAudit(audit.Entries()); result != "[files deleted 2/1 files suspended 1/1]" {
+		t.Errorf("got audit %s", result)
+	}
+}
+
+func TestProcessorHandleRecordsCollectsFailures(t *testing.T) {
+	files, index := &fakePurger{}, &fakePurger{failures: 3}
+	audit := NewMemoryAuditLog()
+	processor := NewProcessor(audit, ProcessorOptions{Backoff: time.Millisecond})
+	processor.Register("files", files)
+	processor.Register("index", index)
+
+	err := processor.HandleRecords(context.Background(), JobTypeTweets, []Record{
+		{ID: "1", Action: "delete", Reason: "deleted"},
+		{ID: "2", Action: "delete", Reason: "suspended"},
+	})
+	var purgeErr *PurgeError
+	if !errors.As(err, &purgeErr) || len(purgeErr.Errors) != 1 || purgeErr.Errors["index"] == nil {
+		t.Fatalf("expected index to fail, got %v", err)
+	}
+
+	purged := fmt.Sprint(files.purged, " ", index.purged)
+	if purged != "[tweets=1 tweets=2] [tweets=2]" {
+		t.Errorf("expected the second reason to be purged after the first failed, got %s", purged)
+	}
+}
+
+func TestProcessorHandle(t *testing.T) {
+	purger := &fakePurger{}
+	processor := NewProcessor(nil, ProcessorOptions{Events: []EventType{EventDrop}})
+	processor.Register("files", purger)
+
+	messages := []stream.StreamMessage{
+		{Data: &Event{Type: EventDrop, Tweet: &Tweet{ID: "1"}}},
+		{Data: &Event{Type: EventDelete, Tweet: &Tweet{ID: "2"}}},
+		{Err: errors.New("EOF")},
+		{Data: []byte("not an event")},
+	}
+	for _, message := range messages {
+		if err := processor.Handle(context.Background(), message); err != nil {
+			t.Errorf("got err %v", err)
+		}
+	}
+
+	if result := fmt.Sprint(purger.purged); result != "[tweets=1]" {
+		t.Errorf("got %s", result)
+	}
+}
+
+func TestFileAuditLog(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "audit")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.ndjson")
+
+	audit, err := NewFileAuditLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	audit.Record(AuditEntry{Purger: "files", Kind: JobTypeTweets, IDs: []string{"1"}, Reason: "delete", Removed: 1, Attempts: 1})
+	audit.Record(AuditEntry{Purger: "index", Kind: JobTypeUsers, IDs: []string{"10"}, Reason: "user_suspend", Attempts: 3, Error: "timeout"})
+	audit.Close()
+
+	if err := audit.Record(AuditEntry{}); err != os.ErrClosed {
+		t.Errorf("expected os.ErrClosed after Close, got %v", err)
+	}
+
+	b, _ := ioutil.ReadFile(path)
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	if len(lines) != 2 || !strings.Contains(lines[0], `"ids":["1"]`) || !strings.Contains(lines[1], `"error":"timeout"`) {
+		t.Errorf("got %s", b)
+	}
+}
+
+func describeAudit(entries []AuditEntry) string {
+	var result []string
+	for _, entry := range entries {
+		line := fmt.Sprintf("%s %s %d/%d", entry.Purger, entry.Reason, entry.Removed, entry.Attempts)
+		if entry.Error != "" {
+			line += " " + entry.Error
+		}
+		result = append(result, line)
+	}
+	// purgers run concurrently, so their entries are recorded in any order
+	sort.Strings(result)
+	return fmt.Sprint(result)
+}
@@ -0,0 +1,126 @@
+package compliance
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/fallenstedt/twitter-stream/httpclient"
+	"github.com/fallenstedt/twitter-stream/stream"
+)
+
+func TestUnmarshalEvent(t *testing.T) {
+	var tests = []struct {
+		payload string
+		result  string
+		err     error
+	}{
+		{
+			`{"data":{"delete":{"tweet":{"id":"1","author_id":"10"},"event_at":"2021-07-06T18:40:40.000Z"}}}`,
+			"delete tweet=1 author=10 at=2021-07-06T18:40:40Z",
+			nil,
+		},
+		{
+			`{"data":{"withheld":{"tweet":{"id":"2","author_id":"10"},"event_at":"2021-07-06T18:40:40.000Z","withheld_in_countries":["DE","FR"]}}}`,
+			"withheld tweet=2 author=10 at=2021-07-06T18:40:40Z countries=[DE FR]",
+			nil,
+		},
+		{
+			`{"data":{"user_suspend":{"user":{"id":"10"},"event_at":"2021-07-06T18:40:40.000Z"}}}`,
+			"user_suspend user=10 at=2021-07-06T18:40:40Z",
+			nil,
+		},
+		{
+			`{"data":{"scrub_geo":{"user":{"id":"10"},"up_to_tweet_id":"5","event_at":"2021-07-06T18:40:40.000Z"}}}`,
+			"scrub_geo user=10 at=2021-07-06T18:40:40Z up_to=5",
+			nil,
+		},
+		{`{"data":{"id":"1","text":"hello"}}`, "", ErrUnknownEvent},
+		{`{"data":{}}`, "", ErrUnknownEvent},
+	}
+
+	for i, tt := range tests {
+		testName := fmt.Sprintf("TestUnmarshalEvent (%d)", i)
+		t.Run(testName, func(t *testing.T) {
+			data, err := UnmarshalEvent([]byte(tt.payload))
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("got err %v, want %v", err, tt.err)
+			}
+			if err != nil {
+				return
+			}
+
+			result := describe(data.(*Event))
+			if result != tt.result {
+				t.Errorf("got %s, want %s", result, tt.result)
+			}
+		})
+	}
+}
+
+func TestStreams(t *testing.T) {
+	var tests = []struct {
+		newStream func(httpClient httpclient.IHttpClient) *stream.Stream
+		payload   string
+		result    string
+	}{
+		{NewTweetStream, `{"data":{"drop":{"tweet":{"id":"3","author_id":"11"},"event_at":"2021-07-06T18:40:40.000Z"}}}`, "tweets partition=2 drop tweet=3 author=11 at=2021-07-06T18:40:40Z"},
+		{NewUserStream, `{"data":{"user_delete":{"user":{"id":"11"},"event_at":"2021-07-06T18:40:40.000Z"}}}`, "users partition=2 user_delete user=11 at=2021-07-06T18:40:40Z"},
+	}
+
+	for i, tt := range tests {
+		testName := fmt.Sprintf("TestStreams (%d)", i)
+		t.Run(testName, func(t *testing.T) {
+			var request string
+			respond := func(endpoint string) func(queryParams *url.Values) (*http.Response, error) {
+				return func(queryParams *url.Values) (*http.Response, error) {
+					request = endpoint + " " + queryParams.Encode()
+					return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(bytes.NewReader([]byte(tt.payload + "\r\n")))}, nil
+				}
+			}
+			client := httpclient.NewHttpClientMock("foobar")
+			client.MockGetTweetComplianceStream = respond("tweets")
+			client.MockGetUserComplianceStream = respond("users")
+
+			api := tt.newStream(client)
+			api.StartStream(stream.NewStreamQueryParamsBuilder().AddPartition(2).Build())
+
+			var events []*Event
+			for message := range api.GetMessages() {
+				if message.Err == nil {
+					events = append(events, message.Data.(*Event))
+				}
+			}
+
+			if len(events) != 1 {
+				t.Fatalf("got %d events, want 1", len(events))
+			}
+			result := request + " " + describe(events[0])
+			if result != tt.result {
+				t.Errorf("got %s, want %s", result, tt.result)
+			}
+		})
+	}
+}
+
+func describe(event *Event) string {
+	result := string(event.Type)
+	if event.IsTweetEvent() {
+		result += fmt.Sprintf(" tweet=%s author=%s", event.Tweet.ID, event.Tweet.AuthorID)
+	}
+	if event.IsUserEvent() {
+		result += fmt.Sprintf(" user=%s", event.User.ID)
+	}
+	result += " at=" + event.EventAt.Format("2006-01-02T15:04:05Z07:00")
+	if len(event.WithheldInCountries) > 0 {
+		result += fmt.Sprintf(" countries=%v", event.WithheldInCountries)
+	}
+	if event.UpToTweetID != "" {
+		result += " up_to=" + event.UpToTweetID
+	}
+	return result
+}
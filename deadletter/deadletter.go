@@ -0,0 +1,178 @@
+// Package deadletter provides sinks for stream payloads that could not be decoded, and a way to replay them.
+package deadletter
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/fallenstedt/twitter-stream/internal/fileutil"
+	"github.com/fallenstedt/twitter-stream/stream"
+)
+
+type (
+	// IFileSink is the interface the fileSink struct implements.
+	IFileSink interface {
+		stream.DeadLetterSink
+		Close() error
+	}
+
+	// IMemorySink is the interface the memorySink struct implements.
+	IMemorySink interface {
+		stream.DeadLetterSink
+		Letters() []stream.DeadLetter
+		Reset()
+	}
+
+	// ReplayResult counts the dead letters seen by Replay.
+	ReplayResult struct {
+		// Replayed is the number of dead letters the hook decoded.
+		Replayed int
+		// Failed is the number of dead letters the hook still returned an error for, or panicked on.
+		Failed int
+	}
+
+	// record is a dead letter as it is stored in a file. Raw payloads that are not valid UTF-8
+	// are stored base64 encoded in RawBase64 so they can be replayed byte for byte.
+	record struct {
+		Raw          string    `json:"raw,omitempty"`
+		RawBase64    []byte    `json:"raw_base64,omitempty"`
+		Error        string    `json:"error"`
+		ReceivedAt   time.Time `json:"received_at"`
+		ConnectionID uint64    `json:"connection_id,omitempty"`
+	}
+
+	fileSink struct {
+		*fileutil.Appender
+	}
+
+	memorySink struct {
+		mu      sync.Mutex
+		letters []stream.DeadLetter
+	}
+)
+
+// NewFileSink opens a sink that appends dead letters to the file at path as newline delimited JSON.
+// The file is created if it does not exist.
+func NewFileSink(path string) (IFileSink, error) {
+	appender, err := fileutil.OpenAppender(path, false)
+	if err != nil {
+		return nil, err
+	}
+	return &fileSink{appender}, nil
+}
+
+// Write appends letter to the file. Every letter is flushed to the file before Write returns.
+func (f *fileSink) Write(letter stream.DeadLetter) error {
+	return f.Append(newRecord(letter))
+}
+
+// NewMemorySink creates a sink that keeps dead letters in memory. It is meant for tests.
+func NewMemorySink() IMemorySink {
+	return &memorySink{}
+}
+
+// Write keeps letter.
+func (m *memorySink) Write(letter stream.DeadLetter) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.letters = append(m.letters, letter)
+	return nil
+}
+
+// Letters returns the letters written so far.
+func (m *memorySink) Letters() []stream.DeadLetter {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]stream.DeadLetter(nil), m.letters...)
+}
+
+// Reset discards the letters written so far.
+func (m *memorySink) Reset() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.letters = nil
+}
+
+// Replay runs hook over every dead letter in the file at path, such as a corrected version of the
+// UnmarshalHook that failed. fn is called with the decoded data of every letter the hook decodes.
+// Replay stops at the first error returned by fn.
+func Replay(path string, hook stream.UnmarshalHook, fn func(data interface{}, letter stream.DeadLetter) error) (ReplayResult, error) {
+	var result ReplayResult
+
+	file, err := os.Open(path)
+	if err != nil {
+		return result, err
+	}
+	defer file.Close()
+
+	r := bufio.NewReader(file)
+	for {
+		line, err := r.ReadBytes('\n')
+		if len(line) > 0 {
+			var rec record
+			if jsonErr := json.Unmarshal(line, &rec); jsonErr != nil {
+				return result, jsonErr
+			}
+
+			letter := rec.letter()
+			data, hookErr := replay(hook, letter.Raw)
+			if hookErr != nil {
+				result.Failed++
+			} else {
+				result.Replayed++
+				if err := fn(data, letter); err != nil {
+					return result, err
+				}
+			}
+		}
+
+		if err == io.EOF {
+			return result, nil
+		}
+		if err != nil {
+			return result, err
+		}
+	}
+}
+
+// replay runs hook, treating a panic like an error.
+func replay(hook stream.UnmarshalHook, raw []byte) (data interface{}, err error) {
+	defer func() {
+		if value := recover(); value != nil {
+			err = stream.NewPanicError(value, raw)
+		}
+	}()
+	return hook(raw)
+}
+
+func newRecord(letter stream.DeadLetter) record {
+	rec := record{ReceivedAt: letter.ReceivedAt, ConnectionID: letter.ConnectionID}
+	if letter.Err != nil {
+		rec.Error = letter.Err.Error()
+	}
+	if utf8.Valid(letter.Raw) {
+		rec.Raw = string(letter.Raw)
+	} else {
+		rec.RawBase64 = letter.Raw
+	}
+	return rec
+}
+
+func (r record) letter() stream.DeadLetter {
+	raw := r.RawBase64
+	if raw == nil {
+		raw = []byte(r.Raw)
+	}
+	return stream.DeadLetter{
+		Raw:          raw,
+		Err:          errors.New(r.Error),
+		ReceivedAt:   r.ReceivedAt,
+		ConnectionID: r.ConnectionID,
+	}
+}
@@ -0,0 +1,121 @@
+package deadletter
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fallenstedt/twitter-stream/stream"
+)
+
+func givenLetters() []stream.DeadLetter {
+	receivedAt := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	return []stream.DeadLetter{
+		{Raw: []byte(`{"data":{"id":"1","text":"hello"}}`), Err: errors.New("bad hook"), ReceivedAt: receivedAt, ConnectionID: 1},
+		{Raw: []byte{'{', 0xff, 0xfe}, Err: errors.New("invalid character"), ReceivedAt: receivedAt, ConnectionID: 1},
+		{Raw: []byte(`{"data":{"id":"2","text":"world"}}`), Err: errors.New("bad hook"), ReceivedAt: receivedAt, ConnectionID: 2},
+	}
+}
+
+func TestFileSinkReplay(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "deadletter")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "dead.ndjson")
+
+	sink, err := NewFileSink(path)
+	if err != nil {
+		t.Fatalf("got err %v", err)
+	}
+	for _, letter := range givenLetters() {
+		if err := sink.Write(letter); err != nil {
+			t.Fatalf("got err when writing %v", err)
+		}
+	}
+	sink.Close()
+
+	if err := sink.Write(givenLetters()[0]); err != os.ErrClosed {
+		t.Errorf("expected os.ErrClosed after Close, got %v", err)
+	}
+
+	var texts []string
+	var letters []stream.DeadLetter
+	result, err := Replay(path, func(b []byte) (interface{}, error) {
+		data := struct {
+			Data struct {
+				Text string `json:"text"`
+			} `json:"data"`
+		}{}
+		err := json.Unmarshal(b, &data)
+		return data.Data.Text, err
+	}, func(data interface{}, letter stream.DeadLetter) error {
+		texts = append(texts, data.(string))
+		letters = append(letters, letter)
+		return nil
+	})
+
+	if err != nil {
+		t.Fatalf("got err when replaying %v", err)
+	}
+	if result.Replayed != 2 || result.Failed != 1 {
+		t.Errorf("got result %+v", result)
+	}
+	if strings.Join(texts, " ") != "hello world" {
+		t.Errorf("got texts %v", texts)
+	}
+	if letters[1].ConnectionID != 2 || letters[1].Err.Error() != "bad hook" || !letters[1].ReceivedAt.Equal(givenLetters()[2].ReceivedAt) {
+		t.Errorf("got letter %+v", letters[1])
+	}
+}
+
+func TestReplayPreservesRawBytes(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "deadletter")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "dead.ndjson")
+
+	sink, _ := NewFileSink(path)
+	for _, letter := range givenLetters() {
+		sink.Write(letter)
+	}
+	sink.Close()
+
+	var raws []string
+	result, err := Replay(path, func(b []byte) (interface{}, error) {
+		raws = append(raws, string(b))
+		if string(b) == "{\xff\xfe" {
+			panic("still broken")
+		}
+		return nil, nil
+	}, func(data interface{}, letter stream.DeadLetter) error {
+		return nil
+	})
+
+	if err != nil || result.Replayed != 2 || result.Failed != 1 {
+		t.Errorf("got result %+v, err %v", result, err)
+	}
+	for i, letter := range givenLetters() {
+		if raws[i] != string(letter.Raw) {
+			t.Errorf("got raw %q, want %q", raws[i], letter.Raw)
+		}
+	}
+}
+
+func TestMemorySink(t *testing.T) {
+	sink := NewMemorySink()
+	for _, letter := range givenLetters() {
+		sink.Write(letter)
+	}
+
+	if len(sink.Letters()) != 3 || string(sink.Letters()[2].Raw) != string(givenLetters()[2].Raw) {
+		t.Errorf("got letters %v", sink.Letters())
+	}
+
+	sink.Reset()
+	if len(sink.Letters()) != 0 {
+		t.Errorf("expected no letters after Reset, got %d", len(sink.Letters()))
+	}
+}
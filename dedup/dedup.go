@@ -0,0 +1,102 @@
+// Package dedup provides stream.Deduplicator implementations that remember tweet ids within a bounded window.
+package dedup
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/fallenstedt/twitter-stream/stream"
+)
+
+type (
+	// ILRU is the interface the lru struct implements.
+	ILRU interface {
+		stream.Deduplicator
+		Forget(id string)
+		Len() int
+	}
+
+	// lru remembers the most recently seen ids, up to a size and for up to a ttl.
+	lru struct {
+		mu    sync.Mutex
+		size  int
+		ttl   time.Duration
+		order *list.List
+		ids   map[string]*list.Element
+		now   func() time.Time
+	}
+
+	entry struct {
+		id     string
+		seenAt time.Time
+	}
+)
+
+// NewLRU creates a deduplicator that remembers up to size ids. Once full, the id seen the longest time ago
+// is forgotten. If ttl is greater than 0, ids are also forgotten once they were last seen more than ttl ago.
+// Twitter backfills at most 5 minutes, so a ttl a little longer than that is usually enough.
+func NewLRU(size int, ttl time.Duration) ILRU {
+	return &lru{
+		size:  size,
+		ttl:   ttl,
+		order: list.New(),
+		ids:   make(map[string]*list.Element),
+		now:   time.Now,
+	}
+}
+
+// Seen reports whether id was seen within the window, and remembers it.
+func (l *lru) Seen(id string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	l.expire(now)
+
+	if element, ok := l.ids[id]; ok {
+		element.Value.(*entry).seenAt = now
+		l.order.MoveToFront(element)
+		return true
+	}
+
+	l.ids[id] = l.order.PushFront(&entry{id: id, seenAt: now})
+	for l.size > 0 && l.order.Len() > l.size {
+		l.remove(l.order.Back())
+	}
+	return false
+}
+
+// Forget forgets id, so it is not a duplicate the next time it is seen. The stream calls it for tweets it did not deliver.
+func (l *lru) Forget(id string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if element, ok := l.ids[id]; ok {
+		l.remove(element)
+	}
+}
+
+// Len returns the number of remembered ids.
+func (l *lru) Len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.expire(l.now())
+	return l.order.Len()
+}
+
+func (l *lru) expire(now time.Time) {
+	if l.ttl <= 0 {
+		return
+	}
+	for element := l.order.Back(); element != nil; element = l.order.Back() {
+		if now.Sub(element.Value.(*entry).seenAt) <= l.ttl {
+			return
+		}
+		l.remove(element)
+	}
+}
+
+func (l *lru) remove(element *list.Element) {
+	l.order.Remove(element)
+	delete(l.ids, element.Value.(*entry).id)
+}
@@ -0,0 +1,120 @@
+package dedup
+
+import (
+	"hash/fnv"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/fallenstedt/twitter-stream/stream"
+)
+
+// DefaultFalsePositiveRate is the false positive rate NewBloom uses when the rate it is given is not between 0 and 1.
+const DefaultFalsePositiveRate = 0.001
+
+type (
+	// bloom remembers ids in two Bloom filters. New ids are added to the current filter, which replaces the
+	// previous one once it holds capacity ids or is older than window. An id is remembered for at least
+	// one full generation.
+	bloom struct {
+		mu        sync.Mutex
+		capacity  int
+		window    time.Duration
+		bits      uint64
+		hashes    uint64
+		current   []uint64
+		previous  []uint64
+		count     int
+		rotatedAt time.Time
+		now       func() time.Time
+	}
+)
+
+// NewBloom creates a deduplicator for very high volumes that uses a fixed amount of memory.
+// capacity is the number of ids each generation holds, falsePositiveRate the chance that a new tweet is
+// mistaken for a duplicate and suppressed, and window how long a generation lasts at most. A window of 0
+// rotates generations only when they are full. A falsePositiveRate outside of (0, 1) is replaced
+// by DefaultFalsePositiveRate. A Bloom filter cannot forget ids, so a tweet the stream's overflow policy dropped
+// is suppressed if it is delivered again.
+func NewBloom(capacity int, falsePositiveRate float64, window time.Duration) stream.Deduplicator {
+	if capacity < 1 {
+		capacity = 1
+	}
+	if !(falsePositiveRate > 0 && falsePositiveRate < 1) {
+		falsePositiveRate = DefaultFalsePositiveRate
+	}
+	bits := uint64(math.Ceil(-float64(capacity) * math.Log(falsePositiveRate) / (math.Ln2 * math.Ln2)))
+	if bits < 64 {
+		bits = 64
+	}
+	hashes := uint64(math.Round(float64(bits) / float64(capacity) * math.Ln2))
+	if hashes < 1 {
+		hashes = 1
+	}
+
+	b := &bloom{
+		capacity: capacity,
+		window:   window,
+		bits:     bits,
+		hashes:   hashes,
+		now:      time.Now,
+	}
+	b.current = b.newFilter()
+	b.previous = b.newFilter()
+	b.rotatedAt = b.now()
+	return b
+}
+
+// Seen reports whether id was probably seen before, and remembers it.
+func (b *bloom) Seen(id string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := b.now()
+	if b.count >= b.capacity || (b.window > 0 && now.Sub(b.rotatedAt) >= b.window) {
+		b.previous, b.current = b.current, b.previous
+		for i := range b.current {
+			b.current[i] = 0
+		}
+		b.count = 0
+		b.rotatedAt = now
+	}
+
+	h1, h2 := hash(id)
+	if b.contains(b.current, h1, h2) {
+		return true
+	}
+
+	b.add(h1, h2)
+	b.count++
+	return b.contains(b.previous, h1, h2)
+}
+
+func (b *bloom) newFilter() []uint64 {
+	return make([]uint64, (b.bits+63)/64)
+}
+
+func (b *bloom) contains(filter []uint64, h1, h2 uint64) bool {
+	for i := uint64(0); i < b.hashes; i++ {
+		bit := (h1 + i*h2) % b.bits
+		if filter[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (b *bloom) add(h1, h2 uint64) {
+	for i := uint64(0); i < b.hashes; i++ {
+		bit := (h1 + i*h2) % b.bits
+		b.current[bit/64] |= 1 << (bit % 64)
+	}
+}
+
+// hash returns the two hashes used to derive the bit positions of id.
+func hash(id string) (uint64, uint64) {
+	a, b := fnv.New64a(), fnv.New64()
+	a.Write([]byte(id))
+	b.Write([]byte(id))
+	return a.Sum64(), b.Sum64() | 1
+}
@@ -0,0 +1,126 @@
+package dedup
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time { return c.now }
+
+func TestLRU(t *testing.T) {
+	var tests = []struct {
+		size   int
+		ttl    time.Duration
+		ids    []string
+		result string
+	}{
+		{3, 0, []string{"1", "2", "1", "3", "2"}, "[false false true false true]"},
+		// "1" is forgotten when "4" fills the window
+		{3, 0, []string{"1", "2", "3", "4", "1"}, "[false false false false false]"},
+		// Seeing "1" again keeps it in the window
+		{3, 0, []string{"1", "2", "3", "1", "4", "1"}, "[false false false true false true]"},
+		// Every id is seen a minute after the previous one, so "1" expires three minutes after it was last seen
+		{100, 150 * time.Second, []string{"1", "2", "1", "3", "4", "1"}, "[false false true false false false]"},
+		// "-1" forgets "1"
+		{3, 0, []string{"1", "2", "-1", "1", "2"}, "[false false false true]"},
+	}
+
+	for i, tt := range tests {
+		testName := fmt.Sprintf("TestLRU (%d)", i)
+		t.Run(testName, func(t *testing.T) {
+			clock := &fakeClock{now: time.Now()}
+			l := NewLRU(tt.size, tt.ttl).(*lru)
+			l.now = clock.Now
+
+			var results []bool
+			for _, id := range tt.ids {
+				if strings.HasPrefix(id, "-") {
+					l.Forget(id[1:])
+					continue
+				}
+				results = append(results, l.Seen(id))
+				clock.now = clock.now.Add(time.Minute)
+			}
+
+			if fmt.Sprint(results) != tt.result {
+				t.Errorf("got %v, want %s", results, tt.result)
+			}
+			if l.Len() > tt.size {
+				t.Errorf("expected at most %d ids, got %d", tt.size, l.Len())
+			}
+		})
+	}
+}
+
+func TestBloom(t *testing.T) {
+	b := NewBloom(10000, 0.001, 0)
+
+	falsePositives := 0
+	for i := 0; i < 10000; i++ {
+		if b.Seen(fmt.Sprint(i)) {
+			falsePositives++
+		}
+	}
+	if falsePositives > 50 {
+		t.Errorf("expected about 10 false positives, got %d", falsePositives)
+	}
+
+	for i := 0; i < 10000; i++ {
+		if !b.Seen(fmt.Sprint(i)) {
+			t.Fatalf("expected %d to be seen", i)
+		}
+	}
+}
+
+func TestBloomFalsePositiveRate(t *testing.T) {
+	var tests = []struct {
+		rate float64
+	}{
+		{0},
+		{-1},
+		{1},
+		{2},
+		{math.NaN()},
+		{DefaultFalsePositiveRate},
+	}
+
+	want := NewBloom(1000, DefaultFalsePositiveRate, 0).(*bloom)
+	for i, tt := range tests {
+		testName := fmt.Sprintf("TestBloomFalsePositiveRate (%d)", i)
+		t.Run(testName, func(t *testing.T) {
+			b := NewBloom(1000, tt.rate, 0).(*bloom)
+			if b.bits != want.bits || b.hashes != want.hashes {
+				t.Errorf("got %d bits and %d hashes, want %d and %d", b.bits, b.hashes, want.bits, want.hashes)
+			}
+		})
+	}
+}
+
+func TestBloomRotatesGenerations(t *testing.T) {
+	clock := &fakeClock{now: time.Now()}
+	b := NewBloom(100, 0.001, time.Minute).(*bloom)
+	b.now = clock.Now
+
+	b.Seen("1")
+	clock.now = clock.now.Add(time.Minute)
+	// "2" starts a new generation, "1" is still remembered by the previous one.
+	b.Seen("2")
+	if !b.Seen("1") {
+		t.Errorf("expected 1 to be remembered for one more generation")
+	}
+
+	clock.now = clock.now.Add(time.Minute)
+	b.Seen("3")
+	clock.now = clock.now.Add(time.Minute)
+	b.Seen("4")
+	if b.Seen("2") {
+		t.Errorf("expected 2 to be forgotten after two generations")
+	}
+}
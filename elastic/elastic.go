@@ -0,0 +1,285 @@
+// Package elastic indexes tweets in Elasticsearch or OpenSearch through the _bulk API.
+package elastic
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fallenstedt/twitter-stream/batch"
+	"github.com/fallenstedt/twitter-stream/compliance"
+	"github.com/fallenstedt/twitter-stream/stream"
+	"github.com/fallenstedt/twitter-stream/tweets"
+)
+
+// ErrNoTweet is returned for messages that are neither decoded with tweets.UnmarshalHook nor carry their raw payload.
+var ErrNoTweet = tweets.ErrNoTweet
+
+type (
+	// IIndexer is the interface the indexer struct implements.
+	IIndexer interface {
+		stream.Handler
+		batch.Handler
+		compliance.Purger
+		Serve(ctx context.Context, s stream.IStream) error
+		Index(ctx context.Context, data []*tweets.StreamData) error
+		InstallTemplate(ctx context.Context) error
+	}
+
+	// Options configures an indexer.
+	Options struct {
+		// URL is the address of the cluster, such as http://localhost:9200.
+		URL string
+		// Client sends the requests. A client with a 30 second timeout is used if nil.
+		Client *http.Client
+		// Username and Password are sent with basic authentication if set.
+		Username string
+		Password string
+		// Header is added to every request.
+		Header http.Header
+		// Prefix starts the name of every index, and names the index template. It is "tweets" if empty.
+		Prefix string
+		// Index returns the index of a tweet. Tweets are indexed per tag and per day, such as
+		// tweets-golang-2021.06.01, if nil. A tweet that matched several rules is indexed once, with the
+		// first of their tags in sorted order, so it goes to the same index whatever the order of its rules.
+		// The day is read from the tweet id when created_at was not requested.
+		// IndexPattern must match every index it returns.
+		Index func(data *tweets.StreamData) string
+		// IndexPattern matches the indexes of tweets, for the index template and purges. It is Prefix-* if empty.
+		IndexPattern string
+		// Template is the body of the index template. DefaultTemplate is used if nil.
+		Template func(pattern string) interface{}
+		// Attempts is how many times a failed bulk request, or a failed tweet of a bulk request, is sent before
+		// giving up. Requests rejected with 429 Too Many Requests are retried until the context is done.
+		// It is 5 if 0.
+		Attempts int
+		// Backoff is the delay before the second attempt. It doubles on every attempt after that, up to MaxBackoff.
+		// It is 500 milliseconds and 30 seconds if 0.
+		Backoff    time.Duration
+		MaxBackoff time.Duration
+		// BatchSize and BatchWait configure the batches of Serve. They are 500 and 1 second if 0.
+		BatchSize int
+		BatchWait time.Duration
+		// OnError is called by Serve when tweets could not be indexed.
+		OnError func(batch batch.Batch, err error)
+	}
+
+	// Document is the document indexed for a tweet.
+	Document struct {
+		ID                  string                   `json:"id"`
+		Text                string                   `json:"text"`
+		AuthorID            string                   `json:"author_id,omitempty"`
+		AuthorUsername      string                   `json:"author_username,omitempty"`
+		ConversationID      string                   `json:"conversation_id,omitempty"`
+		Lang                string                   `json:"lang,omitempty"`
+		CreatedAt           time.Time                `json:"created_at"`
+		Tags                []string                 `json:"tags,omitempty"`
+		RuleIDs             []string                 `json:"rule_ids,omitempty"`
+		Hashtags            []string                 `json:"hashtags,omitempty"`
+		Mentions            []string                 `json:"mentions,omitempty"`
+		URLs                []string                 `json:"urls,omitempty"`
+		MediaTypes          []string                 `json:"media_types,omitempty"`
+		EditHistoryTweetIDs []string                 `json:"edit_history_tweet_ids,omitempty"`
+		ReferencedTweets    []tweets.ReferencedTweet `json:"referenced_tweets,omitempty"`
+		RetweetCount        int                      `json:"retweet_count"`
+		ReplyCount          int                      `json:"reply_count"`
+		LikeCount           int                      `json:"like_count"`
+		QuoteCount          int                      `json:"quote_count"`
+	}
+
+	indexer struct {
+		opts Options
+	}
+)
+
+// NewIndexer creates an indexer for the cluster at opts.URL. Call InstallTemplate before indexing the first
+// tweet, so the indexes it creates get the mappings of the template.
+func NewIndexer(opts Options) (IIndexer, error) {
+	if opts.URL == "" {
+		return nil, errors.New("elastic: URL is required")
+	}
+	opts.URL = strings.TrimSuffix(opts.URL, "/")
+	if opts.Client == nil {
+		opts.Client = &http.Client{Timeout: 30 * time.Second}
+	}
+	if opts.Prefix == "" {
+		opts.Prefix = "tweets"
+	}
+	if opts.Index == nil {
+		prefix := opts.Prefix
+		opts.Index = func(data *tweets.StreamData) string {
+			return IndexName(prefix, firstTag(data), createdAt(data))
+		}
+	}
+	if opts.IndexPattern == "" {
+		opts.IndexPattern = opts.Prefix + "-*"
+	}
+	if opts.Template == nil {
+		opts.Template = DefaultTemplate
+	}
+	if opts.Attempts <= 0 {
+		opts.Attempts = 5
+	}
+	if opts.Backoff <= 0 {
+		opts.Backoff = 500 * time.Millisecond
+	}
+	if opts.MaxBackoff <= 0 {
+		opts.MaxBackoff = 30 * time.Second
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = 500
+	}
+	if opts.BatchWait <= 0 {
+		opts.BatchWait = time.Second
+	}
+	return &indexer{opts: opts}, nil
+}
+
+// Handle indexes the tweet of message. Stream errors are ignored. Use Serve to index tweets in bulk.
+func (i *indexer) Handle(ctx context.Context, message stream.StreamMessage) error {
+	if message.Err != nil {
+		return nil
+	}
+	data, err := tweets.FromMessage(message)
+	if err != nil {
+		return err
+	}
+	err = i.Index(ctx, []*tweets.StreamData{data})
+	var failed batch.ItemErrors
+	if errors.As(err, &failed) {
+		return failed[0]
+	}
+	return err
+}
+
+// HandleBatch indexes the tweets of b in a bulk request. It returns a batch.ItemErrors for the messages
+// that could not be decoded or indexed. Stream errors are ignored.
+func (i *indexer) HandleBatch(ctx context.Context, b batch.Batch) error {
+	failed := batch.ItemErrors{}
+	var data []*tweets.StreamData
+	var positions []int
+	for n, message := range b {
+		if message.Err != nil {
+			continue
+		}
+		d, err := tweets.FromMessage(message)
+		if err != nil {
+			failed[n] = err
+			continue
+		}
+		data = append(data, d)
+		positions = append(positions, n)
+	}
+
+	err := i.Index(ctx, data)
+	var indexErrors batch.ItemErrors
+	if errors.As(err, &indexErrors) {
+		for n, err := range indexErrors {
+			failed[positions[n]] = err
+		}
+	} else if err != nil {
+		return err
+	}
+	if len(failed) > 0 {
+		return failed
+	}
+	return nil
+}
+
+// Serve indexes the tweets of s in bulk, in batches of BatchSize tweets or BatchWait, until its messages channel
+// is closed or ctx is done. Every message is acknowledged once it was indexed. Serve does not stop the stream.
+func (i *indexer) Serve(ctx context.Context, s stream.IStream) error {
+	return batch.Serve(ctx, s, i, batch.Options{Size: i.opts.BatchSize, Wait: i.opts.BatchWait, OnError: i.opts.OnError})
+}
+
+// IndexName returns the index of the tweets that matched a rule with tag on day, such as tweets-golang-2021.06.01.
+// The tag is lowercased and characters that are not allowed in index names are replaced. Tweets without a tag
+// go to prefix-none.
+func IndexName(prefix, tag string, day time.Time) string {
+	tag = invalidIndexChars.ReplaceAllString(strings.ToLower(tag), "_")
+	if tag == "" {
+		tag = "none"
+	}
+	if day.IsZero() {
+		day = time.Now()
+	}
+	return fmt.Sprintf("%s-%s-%s", prefix, tag, day.UTC().Format("2006.01.02"))
+}
+
+var invalidIndexChars = regexp.MustCompile(`[^a-z0-9_]+`)
+
+// firstTag returns the first tag of the rules data matched in sorted order, ignoring rules without a tag.
+func firstTag(data *tweets.StreamData) string {
+	first := ""
+	for _, tag := range data.Tags() {
+		if tag != "" && (first == "" || tag < first) {
+			first = tag
+		}
+	}
+	return first
+}
+
+// twitterEpoch is the time tweet ids count from, in milliseconds since the Unix epoch.
+const twitterEpoch = 1288834974657
+
+// createdAt returns when the tweet of data was created. Without created_at, it is read from the tweet id,
+// whose upper bits are the milliseconds since twitterEpoch.
+func createdAt(data *tweets.StreamData) time.Time {
+	if !data.Data.CreatedAt.IsZero() {
+		return data.Data.CreatedAt
+	}
+	id, err := strconv.ParseInt(data.Data.ID, 10, 64)
+	if err != nil || id <= 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, ((id>>22)+twitterEpoch)*int64(time.Millisecond))
+}
+
+// NewDocument returns the document indexed for the tweet of data.
+func NewDocument(data *tweets.StreamData) Document {
+	tweet := data.Data
+	doc := Document{
+		ID:                  tweet.ID,
+		Text:                tweet.Text,
+		AuthorID:            tweet.AuthorID,
+		ConversationID:      tweet.ConversationID,
+		Lang:                tweet.Lang,
+		CreatedAt:           tweet.CreatedAt,
+		Tags:                data.Tags(),
+		EditHistoryTweetIDs: tweet.EditHistoryTweetIDs,
+		ReferencedTweets:    tweet.ReferencedTweets,
+	}
+	if author := data.Author(); author != nil {
+		doc.AuthorUsername = author.Username
+	}
+	for _, rule := range data.MatchingRules {
+		doc.RuleIDs = append(doc.RuleIDs, rule.ID)
+	}
+	if entities := tweet.Entities; entities != nil {
+		for _, hashtag := range entities.Hashtags {
+			doc.Hashtags = append(doc.Hashtags, strings.ToLower(hashtag.Tag))
+		}
+		for _, mention := range entities.Mentions {
+			doc.Mentions = append(doc.Mentions, mention.Username)
+		}
+		for _, url := range entities.URLs {
+			doc.URLs = append(doc.URLs, url.ExpandedURL)
+		}
+	}
+	if tweet.Attachments != nil {
+		for _, key := range tweet.Attachments.MediaKeys {
+			if media := data.Includes.MediaByKey(key); media != nil {
+				doc.MediaTypes = append(doc.MediaTypes, media.Type)
+			}
+		}
+	}
+	if metrics := tweet.PublicMetrics; metrics != nil {
+		doc.RetweetCount, doc.ReplyCount, doc.LikeCount, doc.QuoteCount = metrics.RetweetCount, metrics.ReplyCount, metrics.LikeCount, metrics.QuoteCount
+	}
+	return doc
+}
@@ -0,0 +1,306 @@
+package elastic
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/fallenstedt/twitter-stream/batch"
+	"github.com/fallenstedt/twitter-stream/tweets"
+)
+
+type (
+	// BulkError is returned for a tweet the cluster could not index.
+	BulkError struct {
+		Index  string
+		ID     string
+		Status int
+		Type   string
+		Reason string
+	}
+
+	// StatusError is returned when the cluster responds to a request with a status that is not 2xx.
+	StatusError struct {
+		StatusCode int
+		Body       string
+	}
+
+	bulkResponse struct {
+		Errors bool                  `json:"errors"`
+		Items  []map[string]bulkItem `json:"items"`
+	}
+
+	bulkItem struct {
+		Index  string `json:"_index"`
+		ID     string `json:"_id"`
+		Status int    `json:"status"`
+		Error  *struct {
+			Type   string `json:"type"`
+			Reason string `json:"reason"`
+		} `json:"error"`
+	}
+)
+
+// Index indexes the tweets of data in bulk requests. Tweets that fail with 429 or 5xx are sent again with the
+// tweets that are still pending, until they succeed or run out of attempts. Requests that are too large are
+// split. It returns a batch.ItemErrors for the tweets that could not be indexed, by their index in data.
+func (i *indexer) Index(ctx context.Context, data []*tweets.StreamData) error {
+	failed := batch.ItemErrors{}
+	actions := make([][]byte, len(data))
+	var pending []int
+	for n, d := range data {
+		if d.Data.ID == "" {
+			failed[n] = errors.New("elastic: tweet has no id")
+			continue
+		}
+		action, err := json.Marshal(map[string]map[string]string{"index": {"_index": i.opts.Index(d), "_id": d.Data.ID}})
+		if err != nil {
+			return err
+		}
+		doc, err := json.Marshal(NewDocument(d))
+		if err != nil {
+			return err
+		}
+		actions[n] = append(append(append(action, '\n'), doc...), '\n')
+		pending = append(pending, n)
+	}
+
+	attempts := make([]int, len(data))
+	backoff := i.opts.Backoff
+	for len(pending) > 0 {
+		results := i.bulk(ctx, actions, pending)
+		var retry []int
+		for j, n := range pending {
+			err := results[j]
+			if err == nil {
+				continue
+			}
+			code := statusCode(err)
+			switch {
+			case code == http.StatusTooManyRequests:
+				// The cluster is overloaded, so tweets wait for it without using their attempts.
+				retry = append(retry, n)
+			case code == 0 || code >= 500:
+				if attempts[n]++; attempts[n] < i.opts.Attempts {
+					retry = append(retry, n)
+				} else {
+					failed[n] = err
+				}
+			default:
+				failed[n] = err
+			}
+		}
+
+		pending = retry
+		if len(pending) == 0 {
+			break
+		}
+		if !sleep(ctx, backoff) {
+			return ctx.Err()
+		}
+		if backoff *= 2; backoff > i.opts.MaxBackoff {
+			backoff = i.opts.MaxBackoff
+		}
+	}
+
+	if len(failed) > 0 {
+		return failed
+	}
+	return nil
+}
+
+// bulk sends the actions of pending in a bulk request, and returns the error of each of them. A request the
+// cluster rejects as too large is split in halves that are sent on their own.
+func (i *indexer) bulk(ctx context.Context, actions [][]byte, pending []int) []error {
+	var body bytes.Buffer
+	for _, n := range pending {
+		body.Write(actions[n])
+	}
+
+	results := make([]error, len(pending))
+	var resp bulkResponse
+	if err := i.do(ctx, http.MethodPost, "/_bulk", body.Bytes(), "application/x-ndjson", &resp); err != nil {
+		var statusErr *StatusError
+		if errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusRequestEntityTooLarge && len(pending) > 1 {
+			half := len(pending) / 2
+			return append(i.bulk(ctx, actions, pending[:half]), i.bulk(ctx, actions, pending[half:])...)
+		}
+		for j := range results {
+			results[j] = err
+		}
+		return results
+	}
+	if len(resp.Items) != len(pending) {
+		err := fmt.Errorf("elastic: bulk response has %d items for %d tweets", len(resp.Items), len(pending))
+		for j := range results {
+			results[j] = err
+		}
+		return results
+	}
+
+	for j, item := range resp.Items {
+		for _, result := range item {
+			if result.Status >= 200 && result.Status <= 299 {
+				continue
+			}
+			err := &BulkError{Index: result.Index, ID: result.ID, Status: result.Status}
+			if result.Error != nil {
+				err.Type, err.Reason = result.Error.Type, result.Error.Reason
+			}
+			results[j] = err
+		}
+	}
+	return results
+}
+
+// InstallTemplate creates or replaces the index template named after Prefix, so indexes matching IndexPattern
+// are created with the mappings of Document.
+func (i *indexer) InstallTemplate(ctx context.Context) error {
+	body, err := json.Marshal(i.opts.Template(i.opts.IndexPattern))
+	if err != nil {
+		return err
+	}
+	return i.do(ctx, http.MethodPut, "/_index_template/"+url.PathEscape(i.opts.Prefix), body, "application/json", nil)
+}
+
+// DefaultTemplate returns a composable index template for indexes matching pattern, with the mappings of Document.
+func DefaultTemplate(pattern string) interface{} {
+	keyword := map[string]string{"type": "keyword"}
+	count := map[string]string{"type": "integer"}
+	return map[string]interface{}{
+		"index_patterns": []string{pattern},
+		"template": map[string]interface{}{
+			"mappings": map[string]interface{}{
+				"dynamic": false,
+				"properties": map[string]interface{}{
+					"id":                     keyword,
+					"text":                   map[string]string{"type": "text"},
+					"author_id":              keyword,
+					"author_username":        keyword,
+					"conversation_id":        keyword,
+					"lang":                   keyword,
+					"created_at":             map[string]string{"type": "date"},
+					"tags":                   keyword,
+					"rule_ids":               keyword,
+					"hashtags":               keyword,
+					"mentions":               keyword,
+					"urls":                   keyword,
+					"media_types":            keyword,
+					"edit_history_tweet_ids": keyword,
+					"referenced_tweets": map[string]interface{}{
+						"properties": map[string]interface{}{"type": keyword, "id": keyword},
+					},
+					"retweet_count": count,
+					"reply_count":   count,
+					"like_count":    count,
+					"quote_count":   count,
+				},
+			},
+		},
+	}
+}
+
+// PurgeTweets deletes the tweets with ids, and the edits of them, from every index matching IndexPattern.
+func (i *indexer) PurgeTweets(ctx context.Context, ids []string) (int, error) {
+	return i.deleteByQuery(ctx, map[string]interface{}{
+		"bool": map[string]interface{}{
+			"should": []interface{}{
+				map[string]interface{}{"terms": map[string][]string{"id": ids}},
+				map[string]interface{}{"terms": map[string][]string{"edit_history_tweet_ids": ids}},
+			},
+		},
+	})
+}
+
+// PurgeUsers deletes the tweets authored by the users with ids from every index matching IndexPattern.
+func (i *indexer) PurgeUsers(ctx context.Context, ids []string) (int, error) {
+	return i.deleteByQuery(ctx, map[string]interface{}{"terms": map[string][]string{"author_id": ids}})
+}
+
+func (i *indexer) deleteByQuery(ctx context.Context, query interface{}) (int, error) {
+	body, err := json.Marshal(map[string]interface{}{"query": query})
+	if err != nil {
+		return 0, err
+	}
+	var resp struct {
+		Deleted int `json:"deleted"`
+	}
+	path := "/" + i.opts.IndexPattern + "/_delete_by_query?conflicts=proceed&refresh=true"
+	err = i.do(ctx, http.MethodPost, path, body, "application/json", &resp)
+	return resp.Deleted, err
+}
+
+// do sends a request to the cluster and decodes its JSON response into v, unless v is nil.
+func (i *indexer) do(ctx context.Context, method, path string, body []byte, contentType string, v interface{}) error {
+	req, err := http.NewRequest(method, i.opts.URL+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	for key, values := range i.opts.Header {
+		req.Header[key] = values
+	}
+	req.Header.Set("Content-Type", contentType)
+	if i.opts.Username != "" {
+		req.SetBasicAuth(i.opts.Username, i.opts.Password)
+	}
+
+	resp, err := i.opts.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		if len(b) > 512 {
+			b = b[:512]
+		}
+		return &StatusError{StatusCode: resp.StatusCode, Body: string(b)}
+	}
+	if v == nil {
+		return nil
+	}
+	return json.Unmarshal(b, v)
+}
+
+func (e *BulkError) Error() string {
+	return fmt.Sprintf("elastic: could not index tweet %s in %s: %d %s: %s", e.ID, e.Index, e.Status, e.Type, e.Reason)
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("elastic: cluster responded with status %d: %s", e.StatusCode, e.Body)
+}
+
+// statusCode returns the status of a failed request or tweet, or 0 if the request could not be sent.
+func statusCode(err error) int {
+	var bulkErr *BulkError
+	if errors.As(err, &bulkErr) {
+		return bulkErr.Status
+	}
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode
+	}
+	return 0
+}
+
+// sleep waits for d. It returns false if ctx is done first.
+func sleep(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
@@ -0,0 +1,425 @@
+package elastic
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fallenstedt/twitter-stream/batch"
+	"github.com/fallenstedt/twitter-stream/internal/streamtest"
+	"github.com/fallenstedt/twitter-stream/stream"
+	"github.com/fallenstedt/twitter-stream/tweets"
+)
+
+// cluster is a stand-in for the _bulk, _index_template and _delete_by_query endpoints.
+type cluster struct {
+	*httptest.Server
+	mu sync.Mutex
+	// throttled is how many bulk requests are rejected with 429 before one is accepted.
+	throttled int
+	// maxTweets rejects bulk requests with more tweets with 413 if it is not 0.
+	maxTweets int
+	// statuses are the statuses of the tweets with an id, in order, before they are indexed.
+	statuses map[string][]int
+	docs     map[string]Document
+	indexes  map[string]string
+	bulks    int
+	template string
+	auth     string
+}
+
+func givenCluster() *cluster {
+	c := &cluster{statuses: map[string][]int{}, docs: map[string]Document{}, indexes: map[string]string{}}
+	c.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		body, _ := ioutil.ReadAll(r.Body)
+		c.auth = r.Header.Get("Authorization")
+
+		switch {
+		case r.URL.Path == "/_bulk":
+			c.bulks++
+			if c.throttled > 0 {
+				c.throttled--
+				w.WriteHeader(http.StatusTooManyRequests)
+				return
+			}
+			if c.maxTweets > 0 && bytes.Count(body, []byte("\n")) > 2*c.maxTweets {
+				w.WriteHeader(http.StatusRequestEntityTooLarge)
+				return
+			}
+			json.NewEncoder(w).Encode(c.bulk(body))
+		case strings.HasPrefix(r.URL.Path, "/_index_template/"):
+			c.template = r.URL.Path + " " + string(body)
+		case strings.HasSuffix(r.URL.Path, "/_delete_by_query"):
+			fmt.Fprintf(w, `{"deleted":%d}`, c.deleteByQuery(body))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	return c
+}
+
+func (c *cluster) bulk(body []byte) map[string]interface{} {
+	var items []interface{}
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	for scanner.Scan() {
+		var action map[string]struct {
+			Index string `json:"_index"`
+			ID    string `json:"_id"`
+		}
+		json.Unmarshal(scanner.Bytes(), &action)
+		scanner.Scan()
+		var doc Document
+		json.Unmarshal(scanner.Bytes(), &doc)
+
+		meta := action["index"]
+		status := http.StatusCreated
+		if statuses := c.statuses[meta.ID]; len(statuses) > 0 {
+			status, c.statuses[meta.ID] = statuses[0], statuses[1:]
+		}
+		item := map[string]interface{}{"_index": meta.Index, "_id": meta.ID, "status": status}
+		if status == http.StatusCreated {
+			c.docs[meta.ID], c.indexes[meta.ID] = doc, meta.Index
+		} else {
+			item["error"] = map[string]string{"type": "mapper_parsing_exception", "reason": "failed to parse"}
+		}
+		items = append(items, map[string]interface{}{"index": item})
+	}
+	return map[string]interface{}{"errors": true, "items": items}
+}
+
+func (c *cluster) deleteByQuery(body []byte) int {
+	var query struct {
+		Query struct {
+			Terms struct {
+				AuthorID []string `json:"author_id"`
+			} `json:"terms"`
+			Bool struct {
+				Should []struct {
+					Terms struct {
+						ID          []string `json:"id"`
+						EditHistory []string `json:"edit_history_tweet_ids"`
+					} `json:"terms"`
+				} `json:"should"`
+			} `json:"bool"`
+		} `json:"query"`
+	}
+	json.Unmarshal(body, &query)
+	match := map[string]bool{}
+	for _, id := range query.Query.Terms.AuthorID {
+		match["author:"+id] = true
+	}
+	for _, should := range query.Query.Bool.Should {
+		for _, id := range append(should.Terms.ID, should.Terms.EditHistory...) {
+			match["tweet:"+id] = true
+		}
+	}
+
+	deleted := 0
+	for id, doc := range c.docs {
+		matches := match["author:"+doc.AuthorID] || match["tweet:"+id]
+		for _, edit := range doc.EditHistoryTweetIDs {
+			matches = matches || match["tweet:"+edit]
+		}
+		if matches {
+			delete(c.docs, id)
+			deleted++
+		}
+	}
+	return deleted
+}
+
+func (c *cluster) ids() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var ids []string
+	for id := range c.docs {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return strings.Join(ids, ",")
+}
+
+var day = time.Date(2021, 6, 1, 13, 0, 0, 0, time.UTC)
+
+func givenData(id, authorID, tag string) *tweets.StreamData {
+	return &tweets.StreamData{
+		Data:          tweets.Tweet{ID: id, AuthorID: authorID, Text: "gophers #GoLang", CreatedAt: day},
+		MatchingRules: []tweets.MatchingRule{{ID: "1", Tag: tag}},
+	}
+}
+
+func givenIndexer(t *testing.T, c *cluster, opts Options) IIndexer {
+	opts.URL = c.URL
+	if opts.Backoff == 0 {
+		opts.Backoff = time.Millisecond
+	}
+	i, err := NewIndexer(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return i
+}
+
+func TestIndexName(t *testing.T) {
+	var tests = []struct {
+		tag    string
+		result string
+	}{
+		{"golang", "tweets-golang-2021.06.01"},
+		{"Go Jobs/Remote", "tweets-go_jobs_remote-2021.06.01"},
+		{"", "tweets-none-2021.06.01"},
+	}
+
+	for i, tt := range tests {
+		testName := fmt.Sprintf("TestIndexName (%d)", i)
+		t.Run(testName, func(t *testing.T) {
+			if result := IndexName("tweets", tt.tag, day.In(time.FixedZone("PST", -8*3600))); result != tt.result {
+				t.Errorf("got %s, want %s", result, tt.result)
+			}
+		})
+	}
+}
+
+func TestDefaultIndex(t *testing.T) {
+	var tests = []struct {
+		tags   []string
+		result string
+	}{
+		{[]string{"golang", "cats"}, "tweets-cats-2021.06.01"},
+		{[]string{"cats", "golang"}, "tweets-cats-2021.06.01"},
+		{[]string{"", "golang"}, "tweets-golang-2021.06.01"},
+		{nil, "tweets-none-2021.06.01"},
+	}
+
+	for i, tt := range tests {
+		testName := fmt.Sprintf("TestDefaultIndex (%d)", i)
+		t.Run(testName, func(t *testing.T) {
+			c := givenCluster()
+			defer c.Close()
+			indexer := givenIndexer(t, c, Options{})
+
+			data := givenData("1", "10", "")
+			data.MatchingRules = nil
+			for _, tag := range tt.tags {
+				data.MatchingRules = append(data.MatchingRules, tweets.MatchingRule{Tag: tag})
+			}
+			if err := indexer.Index(context.Background(), []*tweets.StreamData{data}); err != nil {
+				t.Fatal(err)
+			}
+			if result := c.indexes["1"]; result != tt.result {
+				t.Errorf("got %s, want %s", result, tt.result)
+			}
+		})
+	}
+}
+
+func TestDefaultIndexDay(t *testing.T) {
+	var tests = []struct {
+		id        string
+		createdAt time.Time
+		result    string
+	}{
+		{"1470000000000000000", day, "tweets-cats-2021.06.01"},
+		// the day is read from the id without created_at
+		{"1470000000000000000", time.Time{}, "tweets-cats-2021.12.12"},
+		{"20", time.Time{}, "tweets-cats-2010.11.04"},
+	}
+
+	for i, tt := range tests {
+		testName := fmt.Sprintf("TestDefaultIndexDay (%d)", i)
+		t.Run(testName, func(t *testing.T) {
+			c := givenCluster()
+			defer c.Close()
+			indexer := givenIndexer(t, c, Options{})
+
+			data := givenData(tt.id, "10", "cats")
+			data.Data.CreatedAt = tt.createdAt
+			if err := indexer.Index(context.Background(), []*tweets.StreamData{data}); err != nil {
+				t.Fatal(err)
+			}
+			if result := c.indexes[tt.id]; result != tt.result {
+				t.Errorf("got %s, want %s", result, tt.result)
+			}
+		})
+	}
+}
+
+func TestIndex(t *testing.T) {
+	var tests = []struct {
+		throttled int
+		maxTweets int
+		statuses  map[string][]int
+		indexed   string
+		failed    string
+		bulks     int
+	}{
+		{0, 0, nil, "1,2,3", "", 1},
+		// backpressure does not use attempts
+		{4, 0, nil, "1,2,3", "", 5},
+		// partial failures are sent again on their own
+		{0, 0, map[string][]int{"2": {503, 429}}, "1,2,3", "", 3},
+		{0, 0, map[string][]int{"2": {400}}, "1,3", "1", 1},
+		{0, 0, map[string][]int{"3": {500, 500, 500}}, "1,2", "2", 3},
+		// requests that are too large are split
+		{0, 2, nil, "1,2,3", "", 3},
+		{0, 1, nil, "1,2,3", "", 5},
+	}
+
+	for i, tt := range tests {
+		testName := fmt.Sprintf("TestIndex (%d)", i)
+		t.Run(testName, func(t *testing.T) {
+			c := givenCluster()
+			defer c.Close()
+			c.throttled, c.maxTweets = tt.throttled, tt.maxTweets
+			if tt.statuses != nil {
+				c.statuses = tt.statuses
+			}
+			indexer := givenIndexer(t, c, Options{Attempts: 3})
+
+			err := indexer.Index(context.Background(), []*tweets.StreamData{givenData("1", "10", "golang"), givenData("2", "10", "golang"), givenData("3", "20", "cats")})
+			var failed batch.ItemErrors
+			errors.As(err, &failed)
+			var positions []string
+			for n := range failed {
+				positions = append(positions, fmt.Sprint(n))
+			}
+			if result := strings.Join(positions, ","); result != tt.failed {
+				t.Errorf("got failed %s (%v), want %s", result, err, tt.failed)
+			}
+			if result := c.ids(); result != tt.indexed {
+				t.Errorf("got indexed %s, want %s", result, tt.indexed)
+			}
+			if c.bulks != tt.bulks {
+				t.Errorf("got %d bulk requests, want %d", c.bulks, tt.bulks)
+			}
+		})
+	}
+}
+
+func TestIndexDocument(t *testing.T) {
+	c := givenCluster()
+	defer c.Close()
+	indexer := givenIndexer(t, c, Options{Username: "elastic", Password: "secret"})
+
+	data := givenData("1", "10", "Go Jobs")
+	data.Data.Entities = &tweets.Entities{Hashtags: []tweets.Tag{{Tag: "GoLang"}}}
+	data.Data.PublicMetrics = &tweets.TweetMetrics{LikeCount: 7}
+	data.Includes.Users = []tweets.User{{ID: "10", Username: "gopher"}}
+	if err := indexer.Handle(context.Background(), stream.StreamMessage{Data: data}); err != nil {
+		t.Fatal(err)
+	}
+
+	doc := c.docs["1"]
+	if c.indexes["1"] != "tweets-go_jobs-2021.06.01" || doc.AuthorUsername != "gopher" || doc.Hashtags[0] != "golang" || doc.LikeCount != 7 || doc.Tags[0] != "Go Jobs" {
+		t.Errorf("got %s %+v", c.indexes["1"], doc)
+	}
+	if !strings.HasPrefix(c.auth, "Basic ") {
+		t.Errorf("expected basic authentication, got %q", c.auth)
+	}
+}
+
+func TestServe(t *testing.T) {
+	c := givenCluster()
+	defer c.Close()
+	c.statuses["3"] = []int{400}
+	var failed []error
+	indexer := givenIndexer(t, c, Options{BatchSize: 3, OnError: func(b batch.Batch, err error) { failed = append(failed, err) }})
+
+	raw := []byte(`{"data":{"id":"2","text":"raw"},"matching_rules":[{"id":"1","tag":"golang"}]}`)
+	s := streamtest.NewFakeStream(
+		stream.StreamMessage{Data: givenData("1", "10", "golang")},
+		stream.StreamMessage{Data: raw},
+		stream.StreamMessage{Err: errors.New("EOF")},
+		stream.StreamMessage{Data: givenData("3", "10", "golang")},
+		stream.StreamMessage{Data: 4},
+	)
+	if err := indexer.Serve(context.Background(), s); err != nil {
+		t.Fatal(err)
+	}
+
+	if result := c.ids(); result != "1,2" {
+		t.Errorf("got %s", result)
+	}
+	var itemErrors batch.ItemErrors
+	if len(failed) != 1 || !errors.As(failed[0], &itemErrors) || len(itemErrors) != 2 || itemErrors[1] != ErrNoTweet {
+		t.Fatalf("expected tweets 3 and 4 of the second batch to fail, got %v", failed)
+	}
+	var bulkErr *BulkError
+	if !errors.As(itemErrors[0], &bulkErr) || bulkErr.ID != "3" || bulkErr.Type != "mapper_parsing_exception" {
+		t.Errorf("got %v", itemErrors[0])
+	}
+	if c.bulks != 2 {
+		t.Errorf("expected a bulk request per batch, got %d", c.bulks)
+	}
+}
+
+func TestInstallTemplate(t *testing.T) {
+	c := givenCluster()
+	defer c.Close()
+	indexer := givenIndexer(t, c, Options{Prefix: "gophers"})
+
+	if err := indexer.InstallTemplate(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(c.template, `/_index_template/gophers {"index_patterns":["gophers-*"]`) || !strings.Contains(c.template, `"created_at":{"type":"date"}`) {
+		t.Errorf("got %s", c.template)
+	}
+
+	missing := httptest.NewServer(http.NotFoundHandler())
+	defer missing.Close()
+	indexer, _ = NewIndexer(Options{URL: missing.URL})
+	var statusErr *StatusError
+	if err := indexer.InstallTemplate(context.Background()); !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusNotFound {
+		t.Errorf("expected a StatusError, got %v", err)
+	}
+}
+
+func TestPurge(t *testing.T) {
+	var tests = []struct {
+		users   bool
+		ids     []string
+		removed int
+		result  string
+	}{
+		{false, []string{"1"}, 2, "3"},
+		{false, []string{"4"}, 0, "1,2,3"},
+		{true, []string{"10"}, 2, "3"},
+	}
+
+	for i, tt := range tests {
+		testName := fmt.Sprintf("TestPurge (%d)", i)
+		t.Run(testName, func(t *testing.T) {
+			c := givenCluster()
+			defer c.Close()
+			indexer := givenIndexer(t, c, Options{})
+			edit := givenData("2", "10", "golang")
+			edit.Data.EditHistoryTweetIDs = []string{"1", "2"}
+			indexer.Index(context.Background(), []*tweets.StreamData{givenData("1", "10", "golang"), edit, givenData("3", "20", "cats")})
+
+			purge := indexer.PurgeTweets
+			if tt.users {
+				purge = indexer.PurgeUsers
+			}
+			removed, err := purge(context.Background(), tt.ids)
+			if err != nil || removed != tt.removed {
+				t.Errorf("got %d removed (%v), want %d", removed, err, tt.removed)
+			}
+			if result := c.ids(); result != tt.result {
+				t.Errorf("got %s, want %s", result, tt.result)
+			}
+		})
+	}
+}
@@ -59,7 +59,7 @@ func initiateStream() {
 			// Notice we "StopStream" and then "continue" the loop instead of breaking.
 			// StopStream will close the long running GET request to Twitter's v2 Streaming endpoint by
 			// closing the `GetMessages` channel. Once it's closed, it's safe to perform a new network request
-			// with `StartStream`
+			// with `StartStream`. StopStream is safe to call even if the stream already stopped itself.
 			api.StopStream()
 			continue
 		}
@@ -71,10 +71,15 @@ func initiateStream() {
 		fmt.Println(result.Data.Text)
 	}
 
+	// Wait returns the error that stopped the stream, if any
+	if err := api.Wait(); err != nil {
+		fmt.Printf("stream stopped with error: %v\n", err)
+	}
+
 	fmt.Println("Stopped Stream")
 }
 
-func fetchTweets() stream.IStream {
+func fetchTweets() *stream.Stream {
 	// Get Bearer Token using API keys
 	tok, err := getTwitterToken()
 	if err != nil {
@@ -114,6 +119,6 @@ func getTwitterToken() (string, error) {
 	return tok.AccessToken, err
 }
 
-func getTwitterStreamApi(tok string) stream.IStream {
+func getTwitterStreamApi(tok string) *stream.Stream {
 	return twitterstream.NewTwitterStream(tok).Stream
 }
@@ -1,3 +1,8 @@
 module github.com/fallenstedt/twitter-stream
 
 go 1.16
+
+require (
+	github.com/klauspost/compress v1.13.6
+	go.etcd.io/bbolt v1.3.6
+)
@@ -1,17 +1,26 @@
 package httpclient
 
 import (
+	"context"
 	"net/http"
 	"net/url"
 )
 
 type mockHttpClient struct {
-	token               string
-	MockNewHttpRequest  func(opts *RequestOpts) (*http.Response, error)
-	MockGetSearchStream func(queryParams *url.Values) (*http.Response, error)
-	MockGetRules        func() (*http.Response, error)
-	MockAddRules        func(queryParams *url.Values, body string) (*http.Response, error)
-	MockGenerateUrl     func(name string, queryParams *url.Values) (string, error)
+	token                        string
+	MockNewHttpRequest           func(opts *RequestOpts) (*http.Response, error)
+	MockGetSearchStream          func(queryParams *url.Values) (*http.Response, error)
+	MockGetSearchRecent          func(ctx context.Context, queryParams *url.Values) (*http.Response, error)
+	MockGetSampleStream          func(queryParams *url.Values) (*http.Response, error)
+	MockGetSample10Stream        func(queryParams *url.Values) (*http.Response, error)
+	MockGetTweetComplianceStream func(queryParams *url.Values) (*http.Response, error)
+	MockGetUserComplianceStream  func(queryParams *url.Values) (*http.Response, error)
+	MockCreateComplianceJob      func(body string) (*http.Response, error)
+	MockGetComplianceJob         func(id string) (*http.Response, error)
+	MockGetComplianceJobs        func(queryParams *url.Values) (*http.Response, error)
+	MockGetRules                 func() (*http.Response, error)
+	MockAddRules                 func(queryParams *url.Values, body string) (*http.Response, error)
+	MockGenerateUrl              func(name string, queryParams *url.Values) (string, error)
 }
 
 func NewHttpClientMock(token string) *mockHttpClient {
@@ -34,6 +43,38 @@ func (t *mockHttpClient) GetSearchStream(queryParams *url.Values) (*http.Respons
 	return t.MockGetSearchStream(queryParams)
 }
 
+func (t *mockHttpClient) GetSearchRecent(ctx context.Context, queryParams *url.Values) (*http.Response, error) {
+	return t.MockGetSearchRecent(ctx, queryParams)
+}
+
+func (t *mockHttpClient) GetSampleStream(queryParams *url.Values) (*http.Response, error) {
+	return t.MockGetSampleStream(queryParams)
+}
+
+func (t *mockHttpClient) GetSample10Stream(queryParams *url.Values) (*http.Response, error) {
+	return t.MockGetSample10Stream(queryParams)
+}
+
+func (t *mockHttpClient) GetTweetComplianceStream(queryParams *url.Values) (*http.Response, error) {
+	return t.MockGetTweetComplianceStream(queryParams)
+}
+
+func (t *mockHttpClient) GetUserComplianceStream(queryParams *url.Values) (*http.Response, error) {
+	return t.MockGetUserComplianceStream(queryParams)
+}
+
+func (t *mockHttpClient) CreateComplianceJob(body string) (*http.Response, error) {
+	return t.MockCreateComplianceJob(body)
+}
+
+func (t *mockHttpClient) GetComplianceJob(id string) (*http.Response, error) {
+	return t.MockGetComplianceJob(id)
+}
+
+func (t *mockHttpClient) GetComplianceJobs(queryParams *url.Values) (*http.Response, error) {
+	return t.MockGetComplianceJobs(queryParams)
+}
+
 func (t *mockHttpClient) NewHttpRequest(opts *RequestOpts) (*http.Response, error) {
 	return t.MockNewHttpRequest(opts)
 }
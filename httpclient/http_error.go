@@ -0,0 +1,74 @@
+package httpclient
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+)
+
+// Problem types Twitter sets as the Type of a StatusError.
+const (
+	ProblemInvalidRequest  = "https://api.twitter.com/2/problems/invalid-request"
+	ProblemClientForbidden = "https://api.twitter.com/2/problems/client-forbidden"
+)
+
+// StatusError is returned when Twitter responds to a request with a status of 400 or greater.
+// Type, Title, Detail and Parameters are read from the problem Twitter sends in the body, if any.
+type StatusError struct {
+	StatusCode int
+	Type       string
+	Title      string
+	Detail     string
+	// Parameters are the names of the query parameters Twitter rejected.
+	Parameters []string
+	Body       string
+}
+
+func newStatusError(resp *http.Response) *StatusError {
+	err := &StatusError{StatusCode: resp.StatusCode}
+	if resp.Body == nil {
+		return err
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	err.Body = string(body)
+
+	var problem struct {
+		Type   string `json:"type"`
+		Title  string `json:"title"`
+		Detail string `json:"detail"`
+		Errors []struct {
+			Parameters map[string]json.RawMessage `json:"parameters"`
+		} `json:"errors"`
+	}
+	if json.Unmarshal(body, &problem) != nil {
+		return err
+	}
+	err.Type, err.Title, err.Detail = problem.Type, problem.Title, problem.Detail
+	for _, e := range problem.Errors {
+		for name := range e.Parameters {
+			err.Parameters = append(err.Parameters, name)
+		}
+	}
+	sort.Strings(err.Parameters)
+	return err
+}
+
+// HasParameter reports whether Twitter rejected the query parameter name.
+func (e *StatusError) HasParameter(name string) bool {
+	for _, parameter := range e.Parameters {
+		if parameter == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (e *StatusError) Error() string {
+	if e.Body == "" {
+		return "Network request failed with status " + fmt.Sprint(e.StatusCode)
+	}
+	return "Network request failed: " + e.Body
+}
@@ -1,7 +1,7 @@
 package httpclient
 
 import (
-	"errors"
+	"context"
 	"fmt"
 	"io/ioutil"
 	"log"
@@ -15,7 +15,7 @@ type httpResponseParser struct{}
 
 func (h httpResponseParser) handleResponse(resp *http.Response, opts *RequestOpts, fn func(opts *RequestOpts) (*http.Response, error)) (*http.Response, error) {
 	// Retry with backoff if 429
-	if resp.StatusCode == 429 {
+	if resp.StatusCode == 429 && !opts.NoRetry {
 		log.Printf("Retrying network request %s with backoff", opts.Url)
 
 		var msg string
@@ -29,7 +29,9 @@ func (h httpResponseParser) handleResponse(resp *http.Response, opts *RequestOpt
 
 		delay := h.getBackOffTime(opts.Retries)
 		log.Printf("Sleeping for %v seconds", delay)
-		time.Sleep(delay)
+		if err := sleep(opts.Context, delay); err != nil {
+			return nil, err
+		}
 
 		opts.Retries += 1
 
@@ -39,21 +41,17 @@ func (h httpResponseParser) handleResponse(resp *http.Response, opts *RequestOpt
 	// Reject if 400 or greater
 	if resp.StatusCode >= 400 {
 		log.Printf("Network Request at %s failed: %v", opts.Url, resp.StatusCode)
-
-		var msg string
-		if resp.Body != nil {
-			body, _ := ioutil.ReadAll(resp.Body)
-			msg = "Network request failed: " + string(body)
-		} else {
-			msg = "Network request failed with status" + fmt.Sprint(resp.StatusCode)
-		}
-
-		return nil, errors.New(msg)
+		return nil, newStatusError(resp)
 	}
 
 	return resp, nil
 }
 
+// RetryDelay returns how long to wait before sending a request again after its retries-th 429 response.
+func RetryDelay(retries uint8) time.Duration {
+	return httpResponseParser{}.getBackOffTime(retries)
+}
+
 func (h httpResponseParser) getBackOffTime(retries uint8) time.Duration {
 	exponentialBackoffCeilingSecs := 30
 	delaySecs := int(math.Floor((math.Pow(2, float64(retries)) - 1) * 0.5))
@@ -62,3 +60,22 @@ func (h httpResponseParser) getBackOffTime(retries uint8) time.Duration {
 	}
 	return time.Duration(delaySecs) * time.Second
 }
+
+// sleep waits for d, or returns ctx's error once ctx is done. A nil ctx is never done.
+func sleep(ctx context.Context, d time.Duration) error {
+	if ctx == nil {
+		time.Sleep(d)
+		return nil
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -1,7 +1,12 @@
 package httpclient
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
 	"net/http"
+	"strings"
 	"testing"
 )
 
@@ -55,6 +60,23 @@ func TestHandleResponseShouldRetryRequestIf429(t *testing.T) {
 	}
 }
 
+func TestHandleResponseShouldStopRetryingWhenContextIsDone(t *testing.T) {
+	instance := givenHttpResponseParserInstance()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	opts := &RequestOpts{Context: ctx}
+	resp := givenFakeHttpResponse(429)
+
+	_, err := instance.handleResponse(resp, opts, func(o *RequestOpts) (*http.Response, error) {
+		t.Errorf("Expected no retry once the context is done")
+		return givenFakeHttpResponse(200), nil
+	})
+
+	if err != context.Canceled {
+		t.Errorf("Expected %v, got %v", context.Canceled, err)
+	}
+}
+
 func TestHandleResponseShouldRejectIf400OrHigher(t *testing.T) {
 	instance := givenHttpResponseParserInstance()
 	opts := new(RequestOpts)
@@ -68,3 +90,46 @@ func TestHandleResponseShouldRejectIf400OrHigher(t *testing.T) {
 		t.Errorf("Expected error, got nil")
 	}
 }
+
+func TestHandleResponseShouldReturnStatusError(t *testing.T) {
+	var tests = []struct {
+		statusCode int
+		noRetry    bool
+		body       string
+		typ        string
+		parameters []string
+	}{
+		{401, false, `{"title":"Unauthorized","type":"about:blank","status":401,"detail":"Unauthorized"}`, "about:blank", nil},
+		{429, true, `{"title":"ConnectionException","detail":"This stream is currently at the maximum allowed connection limit.","type":"https://api.twitter.com/2/problems/streaming-connection"}`, "https://api.twitter.com/2/problems/streaming-connection", nil},
+		{400, false, `{"errors":[{"parameters":{"backfill_minutes":["6"]},"message":"The backfill_minutes query parameter value [6] is not between 0 and 5"}],"title":"Invalid Request","detail":"One or more parameters to your request was invalid.","type":"https://api.twitter.com/2/problems/invalid-request"}`, ProblemInvalidRequest, []string{"backfill_minutes"}},
+		{503, false, `Service Unavailable`, "", nil},
+	}
+
+	for i, tt := range tests {
+		testName := fmt.Sprintf("TestHandleResponseShouldReturnStatusError (%d)", i)
+
+		t.Run(testName, func(t *testing.T) {
+			instance := givenHttpResponseParserInstance()
+			opts := &RequestOpts{NoRetry: tt.noRetry}
+			resp := givenFakeHttpResponse(tt.statusCode)
+			resp.Body = ioutil.NopCloser(strings.NewReader(tt.body))
+
+			_, err := instance.handleResponse(resp, opts, func(o *RequestOpts) (*http.Response, error) {
+				t.Fatal("expected the request not to be retried")
+				return nil, nil
+			})
+
+			var statusErr *StatusError
+			if !errors.As(err, &statusErr) {
+				t.Fatalf("expected a StatusError, got %v", err)
+			}
+			if statusErr.StatusCode != tt.statusCode || statusErr.Type != tt.typ || statusErr.Body != tt.body ||
+				fmt.Sprint(statusErr.Parameters) != fmt.Sprint(tt.parameters) {
+				t.Errorf("got %+v", statusErr)
+			}
+			if err.Error() != "Network request failed: "+tt.body {
+				t.Errorf("got message %q", err.Error())
+			}
+		})
+	}
+}
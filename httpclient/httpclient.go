@@ -2,6 +2,7 @@ package httpclient
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"log"
@@ -21,6 +22,14 @@ type (
 		NewHttpRequest(opts *RequestOpts) (*http.Response, error)
 		GetRules() (*http.Response, error)
 		GetSearchStream(queryParams *url.Values) (*http.Response, error)
+		GetSearchRecent(ctx context.Context, queryParams *url.Values) (*http.Response, error)
+		GetSampleStream(queryParams *url.Values) (*http.Response, error)
+		GetSample10Stream(queryParams *url.Values) (*http.Response, error)
+		GetTweetComplianceStream(queryParams *url.Values) (*http.Response, error)
+		GetUserComplianceStream(queryParams *url.Values) (*http.Response, error)
+		CreateComplianceJob(body string) (*http.Response, error)
+		GetComplianceJob(id string) (*http.Response, error)
+		GetComplianceJobs(queryParams *url.Values) (*http.Response, error)
 		AddRules(queryParams *url.Values, body string) (*http.Response, error)
 		GenerateUrl(name string, queryParams *url.Values) (string, error)
 	}
@@ -34,6 +43,12 @@ type (
 func NewHttpClient(token string) IHttpClient {
 	Endpoints["rules"] = "https://api.twitter.com/2/tweets/search/stream/rules"
 	Endpoints["stream"] = "https://api.twitter.com/2/tweets/search/stream"
+	Endpoints["search_recent"] = "https://api.twitter.com/2/tweets/search/recent"
+	Endpoints["sample_stream"] = "https://api.twitter.com/2/tweets/sample/stream"
+	Endpoints["sample10_stream"] = "https://api.twitter.com/2/tweets/sample10/stream"
+	Endpoints["tweet_compliance_stream"] = "https://api.twitter.com/2/tweets/compliance/stream"
+	Endpoints["user_compliance_stream"] = "https://api.twitter.com/2/users/compliance/stream"
+	Endpoints["compliance_jobs"] = "https://api.twitter.com/2/compliance/jobs"
 	Endpoints["token"] = "https://api.twitter.com/oauth2/token"
 	return &httpClient{token}
 }
@@ -71,6 +86,7 @@ func (t *httpClient) AddRules(queryParams *url.Values, body string) (*http.Respo
 }
 
 // GetSearchStream will start the stream with twitter.
+// Stream connections are not retried on 429. A stream without a reconnect policy retries them after RetryDelay.
 func (t *httpClient) GetSearchStream(queryParams *url.Values) (*http.Response, error) {
 	// Make an HTTP GET request to GET /2/tweets/search/stream
 	url, err := t.GenerateUrl("stream", queryParams)
@@ -80,8 +96,9 @@ func (t *httpClient) GetSearchStream(queryParams *url.Values) (*http.Response, e
 	}
 
 	res, err := t.NewHttpRequest(&RequestOpts{
-		Method: "GET",
-		Url:    url,
+		Method:  "GET",
+		Url:     url,
+		NoRetry: true,
 	})
 
 	if err != nil {
@@ -91,6 +108,115 @@ func (t *httpClient) GetSearchStream(queryParams *url.Values) (*http.Response, e
 	return res, nil
 }
 
+// GetSearchRecent will search tweets from the last 7 days. The request, and the backoff of a 429, stop once ctx is done.
+func (t *httpClient) GetSearchRecent(ctx context.Context, queryParams *url.Values) (*http.Response, error) {
+	url, err := t.GenerateUrl("search_recent", queryParams)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return t.NewHttpRequest(&RequestOpts{
+		Context: ctx,
+		Method:  "GET",
+		Url:     url,
+	})
+}
+
+// GetSampleStream will start a stream of about 1% of all public tweets.
+func (t *httpClient) GetSampleStream(queryParams *url.Values) (*http.Response, error) {
+	url, err := t.GenerateUrl("sample_stream", queryParams)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return t.NewHttpRequest(&RequestOpts{
+		Method:  "GET",
+		Url:     url,
+		NoRetry: true,
+	})
+}
+
+// GetSample10Stream will start a stream of one partition of about 10% of all public tweets.
+// The partition query param is required.
+func (t *httpClient) GetSample10Stream(queryParams *url.Values) (*http.Response, error) {
+	url, err := t.GenerateUrl("sample10_stream", queryParams)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return t.NewHttpRequest(&RequestOpts{
+		Method:  "GET",
+		Url:     url,
+		NoRetry: true,
+	})
+}
+
+// GetTweetComplianceStream will start a stream of compliance events for tweets, such as deletes.
+// The partition query param is required.
+func (t *httpClient) GetTweetComplianceStream(queryParams *url.Values) (*http.Response, error) {
+	url, err := t.GenerateUrl("tweet_compliance_stream", queryParams)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return t.NewHttpRequest(&RequestOpts{
+		Method:  "GET",
+		Url:     url,
+		NoRetry: true,
+	})
+}
+
+// GetUserComplianceStream will start a stream of compliance events for users, such as suspensions.
+// The partition query param is required.
+func (t *httpClient) GetUserComplianceStream(queryParams *url.Values) (*http.Response, error) {
+	url, err := t.GenerateUrl("user_compliance_stream", queryParams)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return t.NewHttpRequest(&RequestOpts{
+		Method:  "GET",
+		Url:     url,
+		NoRetry: true,
+	})
+}
+
+// CreateComplianceJob will create a batch compliance job.
+func (t *httpClient) CreateComplianceJob(body string) (*http.Response, error) {
+	return t.NewHttpRequest(&RequestOpts{
+		Method: "POST",
+		Url:    Endpoints["compliance_jobs"],
+		Body:   body,
+	})
+}
+
+// GetComplianceJob will return the batch compliance job with id.
+func (t *httpClient) GetComplianceJob(id string) (*http.Response, error) {
+	return t.NewHttpRequest(&RequestOpts{
+		Method: "GET",
+		Url:    Endpoints["compliance_jobs"] + "/" + url.PathEscape(id),
+	})
+}
+
+// GetComplianceJobs will list the batch compliance jobs. The type query param is required.
+func (t *httpClient) GetComplianceJobs(queryParams *url.Values) (*http.Response, error) {
+	url, err := t.GenerateUrl("compliance_jobs", queryParams)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return t.NewHttpRequest(&RequestOpts{
+		Method: "GET",
+		Url:    url,
+	})
+}
+
 // GenerateUrl is a utility function for httpclient package to generate a valid url for api.twitter.
 func (t *httpClient) GenerateUrl(name string, queryParams *url.Values) (string, error) {
 	var url string
@@ -123,6 +249,9 @@ func (t *httpClient) NewHttpRequest(opts *RequestOpts) (*http.Response, error) {
 		log.Printf("Failed to construct http request for %s: %v", opts.Url, err)
 		return nil, err
 	}
+	if opts.Context != nil {
+		req = req.WithContext(opts.Context)
+	}
 
 	// Set Headers
 	req.Header.Set("Content-Type", "application/json")
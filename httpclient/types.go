@@ -1,7 +1,13 @@
 package httpclient
 
+import "context"
+
 type RequestOpts struct {
+	// Context, if set, cancels the request and the backoff before a retry.
+	Context context.Context
 	Retries uint8
+	// NoRetry returns a 429 response as a *StatusError instead of retrying it.
+	NoRetry bool
 	Method  string
 	Url     string
 	Body    string
@@ -0,0 +1,111 @@
+// Package fileutil provides the newline delimited JSON appender and atomic file writes shared by the sinks and stores.
+package fileutil
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+type (
+	// Appender appends values to a file as newline delimited JSON. It is safe for concurrent use.
+	Appender struct {
+		mu   sync.Mutex
+		file *os.File
+		w    *bufio.Writer
+		sync bool
+	}
+)
+
+// OpenAppender opens the file at path for appending, creating it if it does not exist.
+// When sync is true, every value is synced to disk before Append returns.
+func OpenAppender(path string, sync bool) (*Appender, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &Appender{file: file, w: bufio.NewWriter(file), sync: sync}, nil
+}
+
+// Append writes v as a line of JSON and flushes it to the file. It returns os.ErrClosed once the file is closed.
+func (a *Appender) Append(v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.file == nil {
+		return os.ErrClosed
+	}
+	a.w.Write(b)
+	a.w.WriteByte('\n')
+	if err := a.w.Flush(); err != nil {
+		return err
+	}
+	if a.sync {
+		return a.file.Sync()
+	}
+	return nil
+}
+
+// Close closes the file. It is safe to call Close more than once.
+func (a *Appender) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.file == nil {
+		return nil
+	}
+	err := a.file.Close()
+	a.file = nil
+	return err
+}
+
+// TemporaryName returns the name of the hidden temporary file WriteAtomic writes next to path.
+func TemporaryName(path string) string {
+	return filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+}
+
+// WriteAtomic calls fn with a hidden temporary file next to path, then syncs it and renames it to path,
+// so a crash never leaves a partially written file.
+func WriteAtomic(path string, fn func(w io.Writer) error) error {
+	tmp := TemporaryName(path)
+	out, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+
+	if err := fn(out); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	return SyncDir(filepath.Dir(path))
+}
+
+// SyncDir makes a rename in dir durable.
+func SyncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	if err := d.Sync(); err != nil {
+		d.Close()
+		return err
+	}
+	return d.Close()
+}
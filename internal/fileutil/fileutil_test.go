@@ -0,0 +1,68 @@
+package fileutil
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAppender(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "fileutil")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "log.ndjson")
+
+	for _, sync := range []bool{false, true} {
+		a, err := OpenAppender(path, sync)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := a.Append(map[string]bool{"sync": sync}); err != nil {
+			t.Fatal(err)
+		}
+		a.Close()
+		if err := a.Append(1); err != os.ErrClosed {
+			t.Errorf("expected os.ErrClosed after Close, got %v", err)
+		}
+		if err := a.Close(); err != nil {
+			t.Errorf("expected a second Close to succeed, got %v", err)
+		}
+	}
+
+	b, _ := ioutil.ReadFile(path)
+	if string(b) != "{\"sync\":false}\n{\"sync\":true}\n" {
+		t.Errorf("got %q", b)
+	}
+}
+
+func TestWriteAtomic(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "fileutil")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "checkpoint.json")
+
+	write := func(content string) func(w io.Writer) error {
+		return func(w io.Writer) error {
+			_, err := io.WriteString(w, content)
+			return err
+		}
+	}
+	if err := WriteAtomic(path, write("first")); err != nil {
+		t.Fatal(err)
+	}
+
+	// a failed write leaves the file as it was
+	failed := errors.New("failed")
+	if err := WriteAtomic(path, func(w io.Writer) error { return failed }); err != failed {
+		t.Errorf("expected the error of fn, got %v", err)
+	}
+
+	b, _ := ioutil.ReadFile(path)
+	if string(b) != "first" {
+		t.Errorf("got %q", b)
+	}
+	if _, err := os.Stat(TemporaryName(path)); !os.IsNotExist(err) {
+		t.Errorf("expected the temporary file to be removed, got %v", err)
+	}
+}
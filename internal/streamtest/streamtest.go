@@ -0,0 +1,28 @@
+// Package streamtest provides the fake stream used to test the packages that consume a stream.
+package streamtest
+
+import "github.com/fallenstedt/twitter-stream/stream"
+
+// FakeStream is an IStream that delivers the messages sent to Messages.
+type FakeStream struct {
+	stream.IStream
+	Messages chan stream.StreamMessage
+	// StopErr is returned by Err, as the error that stopped the stream.
+	StopErr error
+}
+
+// NewFakeStream creates a stream that delivers messages, then closes its messages channel.
+func NewFakeStream(messages ...stream.StreamMessage) *FakeStream {
+	s := &FakeStream{Messages: make(chan stream.StreamMessage, len(messages))}
+	for _, message := range messages {
+		s.Messages <- message
+	}
+	close(s.Messages)
+	return s
+}
+
+// GetMessages returns Messages.
+func (s *FakeStream) GetMessages() <-chan stream.StreamMessage { return s.Messages }
+
+// Err returns StopErr.
+func (s *FakeStream) Err() error { return s.StopErr }
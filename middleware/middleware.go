@@ -0,0 +1,159 @@
+// Package middleware provides composable stream.Handler wrappers for cross-cutting concerns such as logging,
+// panic recovery, timeouts, metrics, filtering, sampling and retries.
+package middleware
+
+import (
+	"context"
+	"log"
+	"math"
+	"sync/atomic"
+	"time"
+
+	"github.com/fallenstedt/twitter-stream/stream"
+)
+
+// Middleware wraps a handler with additional behaviour.
+type Middleware func(next stream.Handler) stream.Handler
+
+// Chain wraps handler with middlewares. The first middleware is the outermost one,
+// so it sees each message first and each result last.
+func Chain(handler stream.Handler, middlewares ...Middleware) stream.Handler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		handler = middlewares[i](handler)
+	}
+	return handler
+}
+
+// Serve passes every message of s to handler, one at a time, until its messages channel is closed or ctx is done.
+// It returns the error that stopped the stream, or ctx's error. Errors returned by handler do not stop Serve;
+// use Logging or Retry to deal with them. Serve does not stop the stream.
+func Serve(ctx context.Context, s stream.IStream, handler stream.Handler) error {
+	return stream.Serve(ctx, s, stream.HandlerFunc(func(ctx context.Context, message stream.StreamMessage) error {
+		handler.Handle(ctx, message)
+		return nil
+	}))
+}
+
+// Logging logs stream errors carried by messages and errors returned by the next handler.
+// If logger is nil, the standard logger is used.
+func Logging(logger *log.Logger) Middleware {
+	if logger == nil {
+		logger = log.Default()
+	}
+	return func(next stream.Handler) stream.Handler {
+		return stream.HandlerFunc(func(ctx context.Context, message stream.StreamMessage) error {
+			if message.Err != nil {
+				logger.Printf("stream error: %v", message.Err)
+			}
+
+			start := time.Now()
+			err := next.Handle(ctx, message)
+			if err != nil {
+				logger.Printf("handler failed after %s: %v", time.Since(start), err)
+			}
+			return err
+		})
+	}
+}
+
+// Recover turns a panic in the next handler into a *stream.PanicError.
+func Recover() Middleware {
+	return func(next stream.Handler) stream.Handler {
+		return stream.HandlerFunc(func(ctx context.Context, message stream.StreamMessage) (err error) {
+			defer func() {
+				if value := recover(); value != nil {
+					err = stream.NewPanicError(value, message.Payload())
+				}
+			}()
+			return next.Handle(ctx, message)
+		})
+	}
+}
+
+// Timeout cancels the context passed to the next handler after timeout.
+// The handler must watch its context for the timeout to have an effect.
+func Timeout(timeout time.Duration) Middleware {
+	return func(next stream.Handler) stream.Handler {
+		return stream.HandlerFunc(func(ctx context.Context, message stream.StreamMessage) error {
+			ctx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+			return next.Handle(ctx, message)
+		})
+	}
+}
+
+// Filter only passes messages for which keep returns true to the next handler. Other messages are skipped
+// as if they were handled successfully: they are acknowledged and their pooled buffer is released.
+func Filter(keep func(message stream.StreamMessage) bool) Middleware {
+	return func(next stream.Handler) stream.Handler {
+		return stream.HandlerFunc(func(ctx context.Context, message stream.StreamMessage) error {
+			if !keep(message) {
+				skip(message)
+				return nil
+			}
+			return next.Handle(ctx, message)
+		})
+	}
+}
+
+// Sample passes an evenly spread fraction of messages to the next handler, between 0 and 1.
+// Messages carrying an error are always passed on. Other messages are skipped as if they were handled successfully,
+// like with Filter.
+func Sample(rate float64) Middleware {
+	var count uint64
+	return func(next stream.Handler) stream.Handler {
+		return stream.HandlerFunc(func(ctx context.Context, message stream.StreamMessage) error {
+			if message.Err == nil {
+				n := atomic.AddUint64(&count, 1)
+				if math.Floor(float64(n)*rate) == math.Floor(float64(n-1)*rate) {
+					skip(message)
+					return nil
+				}
+			}
+			return next.Handle(ctx, message)
+		})
+	}
+}
+
+// skip acknowledges a message that is not passed to the next handler and releases its pooled buffer.
+func skip(message stream.StreamMessage) {
+	message.Ack()
+	message.Release()
+}
+
+// Retry calls the next handler up to attempts times until it succeeds. It waits backoff before the
+// first retry and doubles the wait after each one. It gives up early when the context is done.
+func Retry(attempts int, backoff time.Duration) Middleware {
+	return func(next stream.Handler) stream.Handler {
+		return stream.HandlerFunc(func(ctx context.Context, message stream.StreamMessage) error {
+			err := next.Handle(ctx, message)
+			wait := backoff
+			for attempt := 1; err != nil && attempt < attempts; attempt++ {
+				timer := time.NewTimer(wait)
+				select {
+				case <-ctx.Done():
+					timer.Stop()
+					return err
+				case <-timer.C:
+				}
+
+				err = next.Handle(ctx, message)
+				wait *= 2
+			}
+			return err
+		})
+	}
+}
+
+// Ack acknowledges messages that the next handler handled without an error. Use it when the stream has a spool.
+func Ack() Middleware {
+	return func(next stream.Handler) stream.Handler {
+		return stream.HandlerFunc(func(ctx context.Context, message stream.StreamMessage) error {
+			err := next.Handle(ctx, message)
+			if err == nil {
+				message.Ack()
+			}
+			return err
+		})
+	}
+}
@@ -0,0 +1,71 @@
+package middleware
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/fallenstedt/twitter-stream/stream"
+)
+
+type (
+	// MetricsRecorder observes every message handled by the next handler.
+	// Implement it to export metrics to Prometheus, StatsD or similar.
+	MetricsRecorder interface {
+		Observe(message stream.StreamMessage, duration time.Duration, err error)
+	}
+
+	// Counters is a MetricsRecorder that counts messages in memory.
+	Counters struct {
+		handled      uint64
+		failed       uint64
+		streamErrors uint64
+		nanos        uint64
+	}
+
+	// CounterStats is a snapshot of Counters.
+	CounterStats struct {
+		// Handled is the number of messages passed to the handler.
+		Handled uint64
+		// Failed is the number of messages the handler returned an error for.
+		Failed uint64
+		// StreamErrors is the number of messages that carried a stream error.
+		StreamErrors uint64
+		// TotalTime is the time spent in the handler.
+		TotalTime time.Duration
+	}
+)
+
+// Metrics reports every message handled by the next handler to recorder.
+func Metrics(recorder MetricsRecorder) Middleware {
+	return func(next stream.Handler) stream.Handler {
+		return stream.HandlerFunc(func(ctx context.Context, message stream.StreamMessage) error {
+			start := time.Now()
+			err := next.Handle(ctx, message)
+			recorder.Observe(message, time.Since(start), err)
+			return err
+		})
+	}
+}
+
+// Observe counts a handled message. It is safe to call concurrently.
+func (c *Counters) Observe(message stream.StreamMessage, duration time.Duration, err error) {
+	atomic.AddUint64(&c.handled, 1)
+	atomic.AddUint64(&c.nanos, uint64(duration))
+	if err != nil {
+		atomic.AddUint64(&c.failed, 1)
+	}
+	if message.Err != nil {
+		atomic.AddUint64(&c.streamErrors, 1)
+	}
+}
+
+// Stats returns a snapshot of the counters.
+func (c *Counters) Stats() CounterStats {
+	return CounterStats{
+		Handled:      atomic.LoadUint64(&c.handled),
+		Failed:       atomic.LoadUint64(&c.failed),
+		StreamErrors: atomic.LoadUint64(&c.streamErrors),
+		TotalTime:    time.Duration(atomic.LoadUint64(&c.nanos)),
+	}
+}
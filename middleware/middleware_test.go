@@ -0,0 +1,169 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fallenstedt/twitter-stream/internal/streamtest"
+	"github.com/fallenstedt/twitter-stream/stream"
+)
+
+func givenMessages(count int) []stream.StreamMessage {
+	messages := make([]stream.StreamMessage, count)
+	for i := range messages {
+		messages[i] = stream.StreamMessage{Data: i}
+	}
+	return messages
+}
+
+func TestChainOrder(t *testing.T) {
+	var calls []string
+	trace := func(name string) Middleware {
+		return func(next stream.Handler) stream.Handler {
+			return stream.HandlerFunc(func(ctx context.Context, message stream.StreamMessage) error {
+				calls = append(calls, name+" before")
+				err := next.Handle(ctx, message)
+				calls = append(calls, name+" after")
+				return err
+			})
+		}
+	}
+
+	h := Chain(stream.HandlerFunc(func(ctx context.Context, message stream.StreamMessage) error {
+		calls = append(calls, "handler")
+		return nil
+	}), trace("a"), trace("b"))
+
+	if err := Serve(context.Background(), streamtest.NewFakeStream(givenMessages(1)...), h); err != nil {
+		t.Fatalf("got err %v", err)
+	}
+
+	result := strings.Join(calls, ", ")
+	if result != "a before, b before, handler, b after, a after" {
+		t.Errorf("got %s", result)
+	}
+}
+
+func TestMiddlewares(t *testing.T) {
+	failing := errors.New("failed")
+
+	var tests = []struct {
+		middleware Middleware
+		handler    func(calls int) error
+		messages   int
+		calls      int
+		acked      int
+		err        error
+	}{
+		// Filter
+		{
+			Filter(func(message stream.StreamMessage) bool { return message.Data.(int)%2 == 0 }),
+			func(calls int) error { return nil },
+			10, 5, 5, nil,
+		},
+		// Sample
+		{
+			Sample(0.25),
+			func(calls int) error { return nil },
+			100, 25, 75, nil,
+		},
+		// Retry gives up after the last attempt
+		{
+			Retry(3, time.Millisecond),
+			func(calls int) error { return failing },
+			1, 3, 0, failing,
+		},
+		// Retry stops once the handler succeeds
+		{
+			Retry(3, time.Millisecond),
+			func(calls int) error {
+				if calls < 2 {
+					return failing
+				}
+				return nil
+			},
+			1, 2, 0, nil,
+		},
+	}
+
+	for i, tt := range tests {
+		testName := fmt.Sprintf("TestMiddlewares (%d)", i)
+		t.Run(testName, func(t *testing.T) {
+			var calls, acked int
+			var err error
+			h := tt.middleware(stream.HandlerFunc(func(ctx context.Context, message stream.StreamMessage) error {
+				calls++
+				return tt.handler(calls)
+			}))
+
+			for _, message := range givenMessages(tt.messages) {
+				err = h.Handle(context.Background(), message.WithAck(func() { acked++ }))
+			}
+
+			if calls != tt.calls {
+				t.Errorf("expected %d calls, got %d", tt.calls, calls)
+			}
+			// skipped messages are acknowledged as if they were handled
+			if acked != tt.acked {
+				t.Errorf("expected %d acknowledged, got %d", tt.acked, acked)
+			}
+			if err != tt.err {
+				t.Errorf("expected err %v, got %v", tt.err, err)
+			}
+		})
+	}
+}
+
+func TestRecover(t *testing.T) {
+	h := Chain(stream.HandlerFunc(func(ctx context.Context, message stream.StreamMessage) error {
+		panic("boom")
+	}), Recover())
+
+	err := h.Handle(context.Background(), stream.StreamMessage{})
+
+	var panicErr *stream.PanicError
+	if !errors.As(err, &panicErr) || panicErr.Value != "boom" || len(panicErr.Stack) == 0 {
+		t.Errorf("expected a *stream.PanicError, got %v", err)
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	h := Chain(stream.HandlerFunc(func(ctx context.Context, message stream.StreamMessage) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}), Timeout(time.Millisecond))
+
+	if err := h.Handle(context.Background(), stream.StreamMessage{}); err != context.DeadlineExceeded {
+		t.Errorf("expected context.DeadlineExceeded, got %v", err)
+	}
+}
+
+func TestLoggingAndMetrics(t *testing.T) {
+	var buf bytes.Buffer
+	counters := &Counters{}
+	h := Chain(stream.HandlerFunc(func(ctx context.Context, message stream.StreamMessage) error {
+		if message.Data == 1 {
+			return errors.New("bad tweet")
+		}
+		return nil
+	}), Logging(log.New(&buf, "", 0)), Metrics(counters))
+
+	messages := append(givenMessages(3), stream.StreamMessage{Err: errors.New("disconnected")})
+	Serve(context.Background(), streamtest.NewFakeStream(messages...), h)
+
+	stats := counters.Stats()
+	if stats.Handled != 4 || stats.Failed != 1 || stats.StreamErrors != 1 {
+		t.Errorf("got stats %+v", stats)
+	}
+
+	logs := buf.String()
+	if !strings.Contains(logs, "bad tweet") || !strings.Contains(logs, "stream error: disconnected") {
+		t.Errorf("got logs %q", logs)
+	}
+}
@@ -0,0 +1,200 @@
+// Package recovery fills gaps in a stream by searching the tweets that were missed during an outage.
+package recovery
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/fallenstedt/twitter-stream/httpclient"
+	"github.com/fallenstedt/twitter-stream/rules"
+	"github.com/fallenstedt/twitter-stream/stream"
+	"github.com/fallenstedt/twitter-stream/tweets"
+)
+
+const (
+	// searchWindow is how far back recent search goes.
+	searchWindow = 7 * 24 * time.Hour
+	// searchDelay is how recent end_time may be. Twitter requires it to be at least 10 seconds before the request.
+	searchDelay = 10 * time.Second
+)
+
+// copiedParams are the query params of the stream that recent search accepts too.
+var copiedParams = []string{"tweet.fields", "expansions", "user.fields", "media.fields", "place.fields", "poll.fields"}
+
+type (
+	// Options configure how gaps are searched.
+	Options struct {
+		// MaxResults is the number of tweets requested per page, between 10 and 100. Defaults to 100.
+		MaxResults int
+		// MaxPages limits the number of pages requested per rule. Defaults to 10.
+		// Every tweet found is held in memory until the rules were searched, so a gap holds at most
+		// MaxPages * MaxResults tweets per rule.
+		MaxPages int
+	}
+
+	recovery struct {
+		httpClient httpclient.IHttpClient
+		rules      rules.IRules
+		opts       Options
+		now        func() time.Time
+	}
+
+	searchResponse struct {
+		Data     []json.RawMessage `json:"data"`
+		Includes json.RawMessage   `json:"includes,omitempty"`
+		Meta     struct {
+			NextToken string `json:"next_token"`
+		} `json:"meta"`
+	}
+
+	// envelope is a recovered tweet shaped like a stream payload.
+	envelope struct {
+		id            string
+		Data          json.RawMessage       `json:"data"`
+		Includes      json.RawMessage       `json:"includes,omitempty"`
+		MatchingRules []tweets.MatchingRule `json:"matching_rules"`
+	}
+)
+
+// NewRecovery creates a stream.GapFiller that searches recent tweets for every rule returned by IRules.Get.
+// Tweets matching several rules are delivered once, with every matching rule, in the order they were created.
+// The includes of each tweet are those of the page it was found on.
+func NewRecovery(httpClient httpclient.IHttpClient, r rules.IRules, opts Options) stream.GapFiller {
+	if opts.MaxResults < 10 || opts.MaxResults > 100 {
+		opts.MaxResults = 100
+	}
+	if opts.MaxPages <= 0 {
+		opts.MaxPages = 10
+	}
+	return &recovery{httpClient: httpClient, rules: r, opts: opts, now: time.Now}
+}
+
+// Fill searches the tweets created during gap and delivers them as stream payloads.
+// A rule that cannot be searched does not stop the others; the first error is returned once the rest are delivered.
+// Searching stops with ctx's error once ctx is done.
+func (r *recovery) Fill(ctx context.Context, gap stream.Gap, deliver func(payload []byte) bool) error {
+	now := r.now()
+	start, end := gap.Start, gap.End
+	if earliest := now.Add(-searchWindow).Add(time.Minute); start.Before(earliest) {
+		start = earliest
+	}
+	if latest := now.Add(-searchDelay); end.After(latest) {
+		end = latest
+	}
+	if !end.After(start) {
+		return nil
+	}
+
+	res, err := r.rules.Get()
+	if err != nil {
+		return err
+	}
+
+	found := make(map[string]*envelope)
+	var firstErr error
+	for _, rule := range res.Data {
+		err := r.search(ctx, r.searchParams(gap, rule, start, end), tweets.MatchingRule{ID: rule.Id, Tag: rule.Tag}, found)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("rule %s: %w", rule.Id, err)
+		}
+	}
+
+	for _, e := range sorted(found) {
+		payload, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		if !deliver(payload) {
+			return nil
+		}
+	}
+	return firstErr
+}
+
+// searchParams copies the fields and expansions the stream was started with, and brackets the gap. since_id is
+// only used while the gap starts within the search window, as older ids are rejected.
+func (r *recovery) searchParams(gap stream.Gap, rule rules.DataRule, start, end time.Time) url.Values {
+	params := url.Values{}
+	if gap.QueryParams != nil {
+		for _, key := range copiedParams {
+			if values, ok := (*gap.QueryParams)[key]; ok {
+				params[key] = append([]string(nil), values...)
+			}
+		}
+	}
+
+	params.Set("query", rule.Value)
+	if gap.SinceID != "" && start.Equal(gap.Start) {
+		params.Set("since_id", gap.SinceID)
+	} else {
+		params.Set("start_time", start.UTC().Format(time.RFC3339))
+	}
+	params.Set("end_time", end.UTC().Format(time.RFC3339))
+	params.Set("max_results", strconv.Itoa(r.opts.MaxResults))
+	return params
+}
+
+// search pages through the results of params, adding rule to every tweet found.
+func (r *recovery) search(ctx context.Context, params url.Values, rule tweets.MatchingRule, found map[string]*envelope) error {
+	for page := 0; page < r.opts.MaxPages; page++ {
+		res, err := r.httpClient.GetSearchRecent(ctx, &params)
+		if err != nil {
+			return err
+		}
+
+		data := new(searchResponse)
+		err = json.NewDecoder(res.Body).Decode(data)
+		res.Body.Close()
+		if err != nil {
+			return err
+		}
+
+		for _, tweet := range data.Data {
+			id := tweetID(tweet)
+			e, ok := found[id]
+			if !ok {
+				e = &envelope{id: id, Data: tweet, Includes: data.Includes}
+				found[id] = e
+			}
+			e.MatchingRules = append(e.MatchingRules, rule)
+		}
+
+		if data.Meta.NextToken == "" {
+			return nil
+		}
+		params.Set("next_token", data.Meta.NextToken)
+	}
+	return nil
+}
+
+func tweetID(tweet json.RawMessage) string {
+	data := struct {
+		ID string `json:"id"`
+	}{}
+	json.Unmarshal(tweet, &data)
+	return data.ID
+}
+
+// sorted returns the envelopes oldest first. Tweet ids grow over time, so longer ids are newer.
+func sorted(found map[string]*envelope) []*envelope {
+	envelopes := make([]*envelope, 0, len(found))
+	for _, e := range found {
+		envelopes = append(envelopes, e)
+	}
+	sort.Slice(envelopes, func(i, j int) bool {
+		a, b := envelopes[i].id, envelopes[j].id
+		if len(a) != len(b) {
+			return len(a) < len(b)
+		}
+		return a < b
+	})
+	return envelopes
+}
@@ -0,0 +1,242 @@
+package recovery
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fallenstedt/twitter-stream/httpclient"
+	"github.com/fallenstedt/twitter-stream/rules"
+	"github.com/fallenstedt/twitter-stream/stream"
+	"github.com/fallenstedt/twitter-stream/tweets"
+)
+
+func givenResponse(body string) *http.Response {
+	return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(bytes.NewReader([]byte(body)))}
+}
+
+// givenRecovery searches three rules. "cats" has two pages of results, "dogs" shares tweet 3 with it
+// and "birds" cannot be searched.
+func givenRecovery(requests *[]url.Values) *recovery {
+	client := httpclient.NewHttpClientMock("foobar")
+	client.MockGetRules = func() (*http.Response, error) {
+		return givenResponse(`{"data":[{"value":"cat has:images","tag":"cats","id":"10"},{"value":"dog","tag":"dogs","id":"20"},{"value":"bird","tag":"birds","id":"30"}]}`), nil
+	}
+	client.MockGetSearchRecent = func(ctx context.Context, queryParams *url.Values) (*http.Response, error) {
+		params := url.Values{}
+		for key, values := range *queryParams {
+			params[key] = append([]string(nil), values...)
+		}
+		*requests = append(*requests, params)
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		switch {
+		case params.Get("query") == "bird":
+			return nil, errors.New("Network request failed: invalid query")
+		case params.Get("query") == "dog":
+			return givenResponse(`{"data":[{"id":"3","text":"cat and dog"}],"meta":{"result_count":1}}`), nil
+		case params.Get("next_token") == "":
+			return givenResponse(`{"data":[{"id":"12","text":"cat 12"},{"id":"3","text":"cat and dog"}],"includes":{"users":[{"id":"99","username":"cats"}]},"meta":{"next_token":"page2"}}`), nil
+		default:
+			return givenResponse(`{"data":[{"id":"2","text":"cat 2"}],"meta":{"result_count":1}}`), nil
+		}
+	}
+
+	r := NewRecovery(client, rules.NewRules(client), Options{}).(*recovery)
+	r.now = func() time.Time { return time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC) }
+	return r
+}
+
+func TestFill(t *testing.T) {
+	var requests []url.Values
+	r := givenRecovery(&requests)
+
+	var payloads []*tweets.StreamData
+	gap := stream.Gap{
+		Start:       time.Date(2021, 6, 1, 11, 0, 0, 0, time.UTC),
+		End:         time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC),
+		QueryParams: &url.Values{"expansions": []string{"author_id"}, "backfill_minutes": []string{"5"}, "partition": []string{"1"}},
+	}
+	err := r.Fill(context.Background(), gap, func(payload []byte) bool {
+		data, err := tweets.UnmarshalHook(payload)
+		if err != nil {
+			t.Fatalf("got err when decoding %s: %v", payload, err)
+		}
+		payloads = append(payloads, data.(*tweets.StreamData))
+		return true
+	})
+
+	if err == nil || !strings.Contains(err.Error(), "rule 30") {
+		t.Errorf("expected the error of the birds rule, got %v", err)
+	}
+
+	var results []string
+	for _, payload := range payloads {
+		results = append(results, fmt.Sprintf("%s %v", payload.Data.ID, payload.Tags()))
+	}
+	if fmt.Sprint(results) != "[2 [cats] 3 [cats dogs] 12 [cats]]" {
+		t.Errorf("got %v", results)
+	}
+	if payloads[2].Includes.User("99") == nil {
+		t.Errorf("expected tweets to carry the includes of their page")
+	}
+
+	first := requests[0]
+	for key, expected := range map[string]string{
+		"query":            "cat has:images",
+		"start_time":       "2021-06-01T11:00:00Z",
+		"end_time":         "2021-06-01T11:59:50Z",
+		"expansions":       "author_id",
+		"max_results":      "100",
+		"backfill_minutes": "",
+		"partition":        "",
+	} {
+		if first.Get(key) != expected {
+			t.Errorf("expected %s to be %q, got %q", key, expected, first.Get(key))
+		}
+	}
+	if requests[1].Get("next_token") != "page2" {
+		t.Errorf("expected the second page to be requested, got %v", requests[1])
+	}
+}
+
+func TestFillParams(t *testing.T) {
+	var tests = []struct {
+		gap      stream.Gap
+		requests int
+		result   string
+	}{
+		// since_id replaces start_time
+		{
+			stream.Gap{Start: time.Date(2021, 6, 1, 11, 0, 0, 0, time.UTC), End: time.Date(2021, 6, 1, 11, 30, 0, 0, time.UTC), SinceID: "1"},
+			4,
+			"end_time=2021-06-01T11%3A30%3A00Z&max_results=100&query=cat+has%3Aimages&since_id=1",
+		},
+		// start_time is no earlier than recent search allows
+		{
+			stream.Gap{Start: time.Date(2021, 5, 1, 11, 0, 0, 0, time.UTC), End: time.Date(2021, 6, 1, 11, 30, 0, 0, time.UTC)},
+			4,
+			"end_time=2021-06-01T11%3A30%3A00Z&max_results=100&query=cat+has%3Aimages&start_time=2021-05-25T12%3A01%3A00Z",
+		},
+		// since_id is older than recent search allows
+		{
+			stream.Gap{Start: time.Date(2021, 5, 1, 11, 0, 0, 0, time.UTC), End: time.Date(2021, 6, 1, 11, 30, 0, 0, time.UTC), SinceID: "1"},
+			4,
+			"end_time=2021-06-01T11%3A30%3A00Z&max_results=100&query=cat+has%3Aimages&start_time=2021-05-25T12%3A01%3A00Z",
+		},
+		// only fields and expansions are copied
+		{
+			stream.Gap{
+				Start:       time.Date(2021, 6, 1, 11, 0, 0, 0, time.UTC),
+				End:         time.Date(2021, 6, 1, 11, 30, 0, 0, time.UTC),
+				SinceID:     "1",
+				QueryParams: &url.Values{"tweet.fields": []string{"lang"}, "user.fields": []string{"name"}, "partition": []string{"2"}, "backup_stream": []string{"true"}},
+			},
+			4,
+			"end_time=2021-06-01T11%3A30%3A00Z&max_results=100&query=cat+has%3Aimages&since_id=1&tweet.fields=lang&user.fields=name",
+		},
+		// the gap is too recent to search
+		{
+			stream.Gap{Start: time.Date(2021, 6, 1, 11, 59, 55, 0, time.UTC), End: time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)},
+			0,
+			"",
+		},
+	}
+
+	for i, tt := range tests {
+		testName := fmt.Sprintf("TestFillParams (%d)", i)
+		t.Run(testName, func(t *testing.T) {
+			var requests []url.Values
+			r := givenRecovery(&requests)
+			r.Fill(context.Background(), tt.gap, func(payload []byte) bool { return true })
+
+			if len(requests) != tt.requests {
+				t.Fatalf("expected %d requests, got %d", tt.requests, len(requests))
+			}
+			if len(requests) > 0 && requests[0].Encode() != tt.result {
+				t.Errorf("got %s, want %s", requests[0].Encode(), tt.result)
+			}
+		})
+	}
+}
+
+func TestFillStopsWhenDeliverReturnsFalse(t *testing.T) {
+	var requests []url.Values
+	r := givenRecovery(&requests)
+
+	delivered := 0
+	gap := stream.Gap{Start: time.Date(2021, 6, 1, 11, 0, 0, 0, time.UTC), End: time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)}
+	err := r.Fill(context.Background(), gap, func(payload []byte) bool {
+		delivered++
+		return false
+	})
+
+	if err != nil || delivered != 1 {
+		t.Errorf("expected Fill to stop after the first tweet, got %d and %v", delivered, err)
+	}
+}
+
+func TestFillStopsWhenContextIsDone(t *testing.T) {
+	var requests []url.Values
+	r := givenRecovery(&requests)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	delivered := 0
+	gap := stream.Gap{Start: time.Date(2021, 6, 1, 11, 0, 0, 0, time.UTC), End: time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)}
+	err := r.Fill(ctx, gap, func(payload []byte) bool {
+		delivered++
+		return true
+	})
+
+	if err != context.Canceled || delivered != 0 || len(requests) != 1 {
+		t.Errorf("expected Fill to stop after the first request, got %d requests, %d tweets and %v", len(requests), delivered, err)
+	}
+}
+
+func TestFillLimitsPages(t *testing.T) {
+	var tests = []struct {
+		maxPages int
+		requests int
+	}{
+		{0, 10},
+		{3, 3},
+	}
+
+	for i, tt := range tests {
+		testName := fmt.Sprintf("TestFillLimitsPages (%d)", i)
+		t.Run(testName, func(t *testing.T) {
+			requests := 0
+			client := httpclient.NewHttpClientMock("foobar")
+			client.MockGetRules = func() (*http.Response, error) {
+				return givenResponse(`{"data":[{"value":"cat","tag":"cats","id":"10"}]}`), nil
+			}
+			client.MockGetSearchRecent = func(ctx context.Context, queryParams *url.Values) (*http.Response, error) {
+				requests++
+				return givenResponse(fmt.Sprintf(`{"data":[{"id":"%d"}],"meta":{"next_token":"page%d"}}`, requests, requests)), nil
+			}
+			r := NewRecovery(client, rules.NewRules(client), Options{MaxPages: tt.maxPages}).(*recovery)
+			r.now = func() time.Time { return time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC) }
+
+			delivered := 0
+			gap := stream.Gap{Start: time.Date(2021, 6, 1, 11, 0, 0, 0, time.UTC), End: time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)}
+			r.Fill(context.Background(), gap, func(payload []byte) bool {
+				delivered++
+				return true
+			})
+
+			if requests != tt.requests || delivered != tt.requests {
+				t.Errorf("expected %d pages, got %d requests and %d tweets", tt.requests, requests, delivered)
+			}
+		})
+	}
+}
@@ -0,0 +1,301 @@
+// Package router dispatches stream messages to handlers based on the rules that matched each tweet.
+package router
+
+import (
+	"context"
+	"encoding/json"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/fallenstedt/twitter-stream/stream"
+	"github.com/fallenstedt/twitter-stream/tweets"
+)
+
+type (
+	// IRouter is the interface the router struct implements. A router is itself a stream.Handler.
+	IRouter interface {
+		stream.Handler
+		HandleTag(tag string, handler stream.Handler) *Route
+		HandleTagPrefix(prefix string, handler stream.Handler) *Route
+		HandleTagGlob(pattern string, handler stream.Handler) (*Route, error)
+		HandleRuleID(id string, handler stream.Handler) *Route
+		HandleFallback(handler stream.Handler) *Route
+		HandleErrors(handler stream.Handler) *Route
+		OnHandlerError(fn func(message stream.StreamMessage, err error))
+		SetRuleExtractor(extractor RuleExtractor)
+		Serve(ctx context.Context, s stream.IStream) error
+		Wait()
+	}
+
+	// RuleExtractor returns the rules that matched the tweet carried by a message's Data.
+	RuleExtractor func(data interface{}) []tweets.MatchingRule
+
+	// Route is a handler registered on a router.
+	Route struct {
+		match   func(rule tweets.MatchingRule) bool
+		handler stream.Handler
+		slots   chan struct{}
+	}
+
+	router struct {
+		mu        sync.RWMutex
+		routes    []*Route
+		fallback  *Route
+		errors    *Route
+		onError   func(message stream.StreamMessage, err error)
+		extractor RuleExtractor
+		inFlight  sync.WaitGroup
+	}
+
+	matchingRulesGetter interface {
+		GetMatchingRules() []tweets.MatchingRule
+	}
+)
+
+// NewRouter creates a router. Register handlers with the Handle methods, then call Serve with a started stream.
+func NewRouter() IRouter {
+	return &router{extractor: DefaultRuleExtractor}
+}
+
+// SetConcurrency sets how many messages the route's handler processes at the same time. Defaults to 1,
+// which delivers messages to the handler one at a time, in order. Call it before serving.
+func (r *Route) SetConcurrency(concurrency int) *Route {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	r.slots = make(chan struct{}, concurrency)
+	return r
+}
+
+// HandleTag routes tweets that matched a rule with exactly this tag.
+func (r *router) HandleTag(tag string, handler stream.Handler) *Route {
+	return r.add(func(rule tweets.MatchingRule) bool {
+		return rule.Tag == tag
+	}, handler)
+}
+
+// HandleTagPrefix routes tweets that matched a rule whose tag starts with prefix.
+func (r *router) HandleTagPrefix(prefix string, handler stream.Handler) *Route {
+	return r.add(func(rule tweets.MatchingRule) bool {
+		return strings.HasPrefix(rule.Tag, prefix)
+	}, handler)
+}
+
+// HandleTagGlob routes tweets that matched a rule whose tag matches pattern, using the syntax of path.Match.
+// It returns path.ErrBadPattern if pattern is malformed, without registering the route.
+func (r *router) HandleTagGlob(pattern string, handler stream.Handler) (*Route, error) {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, err
+	}
+	return r.add(func(rule tweets.MatchingRule) bool {
+		matched, _ := path.Match(pattern, rule.Tag)
+		return matched
+	}, handler), nil
+}
+
+// HandleRuleID routes tweets that matched the rule with id.
+func (r *router) HandleRuleID(id string, handler stream.Handler) *Route {
+	return r.add(func(rule tweets.MatchingRule) bool {
+		return rule.ID == id
+	}, handler)
+}
+
+// HandleFallback routes tweets that did not match any other route.
+func (r *router) HandleFallback(handler stream.Handler) *Route {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.fallback = newRoute(nil, handler)
+	return r.fallback
+}
+
+// HandleErrors routes messages whose Err is set, such as disconnects and unmarshal errors.
+// Without it, these messages are discarded.
+func (r *router) HandleErrors(handler stream.Handler) *Route {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.errors = newRoute(nil, handler)
+	return r.errors
+}
+
+// OnHandlerError sets a function that is called when a handler returns an error.
+// A handler that panics is reported with a *stream.PanicError.
+func (r *router) OnHandlerError(fn func(message stream.StreamMessage, err error)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.onError = fn
+}
+
+// SetRuleExtractor sets how the router finds the matching rules of a message. Defaults to DefaultRuleExtractor.
+func (r *router) SetRuleExtractor(extractor RuleExtractor) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.extractor = extractor
+}
+
+// Handle dispatches message to every route that matches one of its rules, at most once per route.
+// It returns once every route has accepted the message, which blocks while a route is at its concurrency limit.
+// The message is acknowledged once every handler returned without an error.
+// A *stream.PooledBytes carried as Data is released once every handler returned.
+func (r *router) Handle(ctx context.Context, message stream.StreamMessage) error {
+	routes := r.match(message)
+	if len(routes) == 0 {
+		message.Ack()
+		message.Release()
+		return nil
+	}
+
+	d := &dispatch{router: r, message: message, pending: len(routes)}
+	for i, route := range routes {
+		select {
+		case route.slots <- struct{}{}:
+		case <-ctx.Done():
+			// The remaining routes never handle the message, so it is released without being acknowledged.
+			d.finish(len(routes)-i, ctx.Err())
+			return ctx.Err()
+		}
+
+		r.inFlight.Add(1)
+		go d.run(ctx, route)
+	}
+	return nil
+}
+
+// Serve dispatches every message of s until its messages channel is closed or ctx is done.
+// It waits for in-flight handlers before returning the error that stopped the stream, or ctx's error.
+// Serve does not stop the stream.
+func (r *router) Serve(ctx context.Context, s stream.IStream) error {
+	defer r.Wait()
+
+	return stream.Serve(ctx, s, r)
+}
+
+// Wait blocks until every dispatched message has been handled.
+func (r *router) Wait() {
+	r.inFlight.Wait()
+}
+
+func (r *router) add(match func(rule tweets.MatchingRule) bool, handler stream.Handler) *Route {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	route := newRoute(match, handler)
+	r.routes = append(r.routes, route)
+	return route
+}
+
+func (r *router) match(message stream.StreamMessage) []*Route {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if message.Err != nil {
+		if r.errors == nil {
+			return nil
+		}
+		return []*Route{r.errors}
+	}
+
+	var matched []*Route
+	rules := r.extractor(message.Data)
+	for _, route := range r.routes {
+		for _, rule := range rules {
+			if route.match(rule) {
+				matched = append(matched, route)
+				break
+			}
+		}
+	}
+
+	if len(matched) == 0 && r.fallback != nil {
+		matched = append(matched, r.fallback)
+	}
+	return matched
+}
+
+func (r *router) handlerError(message stream.StreamMessage, err error) {
+	r.mu.RLock()
+	onError := r.onError
+	r.mu.RUnlock()
+	if onError != nil {
+		onError(message, err)
+	}
+}
+
+// DefaultRuleExtractor finds matching rules in Data that implements GetMatchingRules, such as *tweets.StreamData,
+// or by decoding the "matching_rules" of raw []byte and *stream.PooledBytes messages.
+func DefaultRuleExtractor(data interface{}) []tweets.MatchingRule {
+	var raw []byte
+	switch d := data.(type) {
+	case matchingRulesGetter:
+		return d.GetMatchingRules()
+	case tweets.StreamData:
+		return d.MatchingRules
+	case []byte:
+		raw = d
+	case *stream.PooledBytes:
+		raw = d.Bytes()
+	default:
+		return nil
+	}
+
+	envelope := struct {
+		MatchingRules []tweets.MatchingRule `json:"matching_rules"`
+	}{}
+	if err := json.Unmarshal(raw, &envelope); err != nil {
+		return nil
+	}
+	return envelope.MatchingRules
+}
+
+func newRoute(match func(rule tweets.MatchingRule) bool, handler stream.Handler) *Route {
+	route := &Route{match: match, handler: handler}
+	return route.SetConcurrency(1)
+}
+
+// handle runs the route's handler, turning a panic into a *stream.PanicError.
+func (r *Route) handle(ctx context.Context, message stream.StreamMessage) (err error) {
+	defer func() {
+		if value := recover(); value != nil {
+			err = stream.NewPanicError(value, message.Payload())
+		}
+	}()
+	return r.handler.Handle(ctx, message)
+}
+
+// dispatch tracks a message that has been fanned out to several routes.
+type dispatch struct {
+	router  *router
+	message stream.StreamMessage
+
+	mu      sync.Mutex
+	pending int
+	failed  bool
+}
+
+func (d *dispatch) run(ctx context.Context, route *Route) {
+	defer d.router.inFlight.Done()
+
+	err := route.handle(ctx, d.message)
+	<-route.slots
+
+	if err != nil {
+		d.router.handlerError(d.message, err)
+	}
+	d.finish(1, err)
+}
+
+// finish records that n routes are done with the message, failing it if err is set. The message is acknowledged
+// once every route returned without an error, and released once every route is done.
+func (d *dispatch) finish(n int, err error) {
+	d.mu.Lock()
+	d.pending -= n
+	d.failed = d.failed || err != nil
+	done, failed := d.pending == 0, d.failed
+	d.mu.Unlock()
+
+	if done {
+		if !failed {
+			d.message.Ack()
+		}
+		d.message.Release()
+	}
+}
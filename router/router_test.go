@@ -0,0 +1,289 @@
+package router
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/fallenstedt/twitter-stream/internal/streamtest"
+	"github.com/fallenstedt/twitter-stream/stream"
+	"github.com/fallenstedt/twitter-stream/tweets"
+)
+
+func givenTweet(id string, rules ...tweets.MatchingRule) stream.StreamMessage {
+	return stream.StreamMessage{Data: &tweets.StreamData{Data: tweets.Tweet{ID: id}, MatchingRules: rules}}
+}
+
+// recorder is a handler that records the ids of the tweets it handled.
+type recorder struct {
+	mu  sync.Mutex
+	ids []string
+}
+
+func (r *recorder) Handle(ctx context.Context, message stream.StreamMessage) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if message.Err != nil {
+		r.ids = append(r.ids, message.Err.Error())
+		return nil
+	}
+	r.ids = append(r.ids, message.Data.(*tweets.StreamData).Data.ID)
+	return nil
+}
+
+func (r *recorder) got() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ids := append([]string(nil), r.ids...)
+	sort.Strings(ids)
+	return fmt.Sprint(ids)
+}
+
+func TestRouterMatchesRules(t *testing.T) {
+	var tests = []struct {
+		register func(r IRouter, h stream.Handler)
+		result   string
+	}{
+		{
+			func(r IRouter, h stream.Handler) { r.HandleTag("cats", h) },
+			"[1 4]",
+		},
+		{
+			func(r IRouter, h stream.Handler) { r.HandleTagPrefix("team-a/", h) },
+			"[2 3 4]",
+		},
+		{
+			func(r IRouter, h stream.Handler) { r.HandleTagGlob("team-*/dogs", h) },
+			"[2]",
+		},
+		{
+			func(r IRouter, h stream.Handler) { r.HandleRuleID("30", h) },
+			"[3 4]",
+		},
+	}
+
+	for i, tt := range tests {
+		testName := fmt.Sprintf("TestRouterMatchesRules (%d)", i)
+		t.Run(testName, func(t *testing.T) {
+			s := streamtest.NewFakeStream(
+				givenTweet("1", tweets.MatchingRule{ID: "10", Tag: "cats"}),
+				givenTweet("2", tweets.MatchingRule{ID: "20", Tag: "team-a/dogs"}),
+				givenTweet("3", tweets.MatchingRule{ID: "30", Tag: "team-a/birds"}),
+				givenTweet("4", tweets.MatchingRule{ID: "10", Tag: "cats"}, tweets.MatchingRule{ID: "30", Tag: "team-a/birds"}),
+			)
+			h := &recorder{}
+			r := NewRouter()
+			tt.register(r, h)
+
+			if err := r.Serve(context.Background(), s); err != nil {
+				t.Fatalf("got err %v", err)
+			}
+			if h.got() != tt.result {
+				t.Errorf("got %s, want %s", h.got(), tt.result)
+			}
+		})
+	}
+}
+
+func TestRouterFansOutAndFallsBack(t *testing.T) {
+	s := streamtest.NewFakeStream(
+		givenTweet("1", tweets.MatchingRule{ID: "10", Tag: "cats"}, tweets.MatchingRule{ID: "20", Tag: "dogs"}),
+		givenTweet("2", tweets.MatchingRule{ID: "30", Tag: "birds"}),
+		stream.StreamMessage{Err: errors.New("disconnected")},
+	)
+	cats, dogs, pets, fallback, errs := &recorder{}, &recorder{}, &recorder{}, &recorder{}, &recorder{}
+
+	r := NewRouter()
+	r.HandleTag("cats", cats)
+	r.HandleTag("dogs", dogs)
+	// A route that matches several rules of a tweet only handles it once.
+	r.HandleTagGlob("*s", pets)
+	r.HandleFallback(fallback)
+	r.HandleErrors(errs)
+
+	if err := r.Serve(context.Background(), s); err != nil {
+		t.Fatalf("got err %v", err)
+	}
+
+	for name, tt := range map[string]struct {
+		handler *recorder
+		result  string
+	}{
+		"cats":     {cats, "[1]"},
+		"dogs":     {dogs, "[1]"},
+		"pets":     {pets, "[1 2]"},
+		"fallback": {fallback, "[]"},
+		"errors":   {errs, "[disconnected]"},
+	} {
+		if tt.handler.got() != tt.result {
+			t.Errorf("%s got %s, want %s", name, tt.handler.got(), tt.result)
+		}
+	}
+
+	fallback = &recorder{}
+	r = NewRouter()
+	r.HandleTag("cats", cats)
+	r.HandleFallback(fallback)
+	r.Serve(context.Background(), streamtest.NewFakeStream(givenTweet("3", tweets.MatchingRule{ID: "30", Tag: "birds"})))
+	if fallback.got() != "[3]" {
+		t.Errorf("expected the fallback to handle tweet 3, got %s", fallback.got())
+	}
+}
+
+func TestRouterConcurrency(t *testing.T) {
+	var tests = []struct {
+		concurrency int
+		result      int32
+	}{
+		{1, 1},
+		{3, 3},
+	}
+
+	for i, tt := range tests {
+		testName := fmt.Sprintf("TestRouterConcurrency (%d)", i)
+		t.Run(testName, func(t *testing.T) {
+			var messages []stream.StreamMessage
+			for n := 0; n < 9; n++ {
+				messages = append(messages, givenTweet(fmt.Sprint(n), tweets.MatchingRule{ID: "10", Tag: "cats"}))
+			}
+
+			var running, max int32
+			r := NewRouter()
+			r.HandleTag("cats", stream.HandlerFunc(func(ctx context.Context, message stream.StreamMessage) error {
+				n := atomic.AddInt32(&running, 1)
+				for {
+					m := atomic.LoadInt32(&max)
+					if n <= m || atomic.CompareAndSwapInt32(&max, m, n) {
+						break
+					}
+				}
+				time.Sleep(5 * time.Millisecond)
+				atomic.AddInt32(&running, -1)
+				return nil
+			})).SetConcurrency(tt.concurrency)
+
+			r.Serve(context.Background(), streamtest.NewFakeStream(messages...))
+			if max != tt.result {
+				t.Errorf("expected %d concurrent handlers, got %d", tt.result, max)
+			}
+		})
+	}
+}
+
+func TestRouterServe(t *testing.T) {
+	streamErr := errors.New("stream failed")
+	handlerErr := errors.New("handler failed")
+
+	var reported []error
+	r := NewRouter()
+	r.HandleTag("cats", stream.HandlerFunc(func(ctx context.Context, message stream.StreamMessage) error {
+		return handlerErr
+	}))
+	r.OnHandlerError(func(message stream.StreamMessage, err error) {
+		reported = append(reported, err)
+	})
+
+	s := streamtest.NewFakeStream(givenTweet("1", tweets.MatchingRule{ID: "10", Tag: "cats"}))
+	s.StopErr = streamErr
+	err := r.Serve(context.Background(), s)
+	if err != streamErr {
+		t.Errorf("expected Serve to return the stream's error, got %v", err)
+	}
+	if len(reported) != 1 || reported[0] != handlerErr {
+		t.Errorf("expected the handler error to be reported, got %v", reported)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	s = &streamtest.FakeStream{Messages: make(chan stream.StreamMessage)}
+	if err := r.Serve(ctx, s); err != context.Canceled {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+}
+
+func TestRouterHandleCanceledDuringFanOut(t *testing.T) {
+	blocked, unblock := make(chan struct{}), make(chan struct{})
+	r := NewRouter()
+	r.HandleTag("cats", &recorder{})
+	r.HandleTag("dogs", stream.HandlerFunc(func(ctx context.Context, message stream.StreamMessage) error {
+		blocked <- struct{}{}
+		<-unblock
+		return nil
+	}))
+
+	// The first tweet holds the only slot of the dogs route.
+	r.Handle(context.Background(), givenTweet("1", tweets.MatchingRule{ID: "20", Tag: "dogs"}))
+	<-blocked
+
+	var acked int32
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+	message := givenTweet("2", tweets.MatchingRule{ID: "10", Tag: "cats"}, tweets.MatchingRule{ID: "20", Tag: "dogs"})
+	if err := r.Handle(ctx, message.WithAck(func() { atomic.AddInt32(&acked, 1) })); err != context.Canceled {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+	close(unblock)
+	r.Wait()
+
+	if atomic.LoadInt32(&acked) != 0 {
+		t.Errorf("expected a tweet that was not handled by every route not to be acknowledged")
+	}
+}
+
+func TestRouterRejectsBadGlob(t *testing.T) {
+	r := NewRouter()
+	if _, err := r.HandleTagGlob("[cats", &recorder{}); err != path.ErrBadPattern {
+		t.Errorf("expected path.ErrBadPattern, got %v", err)
+	}
+	if route, err := r.HandleTagGlob("cat?", &recorder{}); route == nil || err != nil {
+		t.Errorf("expected a route, got %v", err)
+	}
+}
+
+func TestDefaultRuleExtractor(t *testing.T) {
+	raw := []byte(`{"data":{"id":"1","text":"hello"},"matching_rules":[{"id":"10","tag":"cats"}]}`)
+	var tests = []struct {
+		data   interface{}
+		result string
+	}{
+		{&tweets.StreamData{MatchingRules: []tweets.MatchingRule{{ID: "10", Tag: "cats"}}}, "[{10 cats}]"},
+		{tweets.StreamData{MatchingRules: []tweets.MatchingRule{{ID: "10", Tag: "cats"}}}, "[{10 cats}]"},
+		{raw, "[{10 cats}]"},
+		{[]byte("not json"), "[]"},
+		{"unknown", "[]"},
+	}
+
+	for i, tt := range tests {
+		testName := fmt.Sprintf("TestDefaultRuleExtractor (%d)", i)
+		t.Run(testName, func(t *testing.T) {
+			result := fmt.Sprint(DefaultRuleExtractor(tt.data))
+			if result != tt.result {
+				t.Errorf("got %s, want %s", result, tt.result)
+			}
+		})
+	}
+}
+
+func TestRouterRecoversHandlerPanics(t *testing.T) {
+	var reported error
+	r := NewRouter()
+	r.HandleTag("cats", stream.HandlerFunc(func(ctx context.Context, message stream.StreamMessage) error {
+		panic("boom")
+	}))
+	r.OnHandlerError(func(message stream.StreamMessage, err error) {
+		reported = err
+	})
+
+	r.Serve(context.Background(), streamtest.NewFakeStream(givenTweet("1", tweets.MatchingRule{ID: "10", Tag: "cats"})))
+
+	var panicErr *stream.PanicError
+	if !errors.As(reported, &panicErr) || panicErr.Value != "boom" {
+		t.Errorf("expected a *stream.PanicError, got %v", reported)
+	}
+}
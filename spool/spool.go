@@ -0,0 +1,571 @@
+// Package spool provides an on-disk FIFO queue used to buffer tweets between Twitter and slow consumers.
+package spool
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SyncPolicy decides how often the spool calls fsync on the segment it is writing.
+type SyncPolicy int
+
+const (
+	// SyncNever leaves flushing to the operating system. Records may be lost if the machine crashes.
+	SyncNever SyncPolicy = iota
+	// SyncInterval calls fsync at most once per Options.SyncInterval, and when the spool is closed.
+	SyncInterval
+	// SyncAlways calls fsync after every record and acknowledgement.
+	SyncAlways
+)
+
+const (
+	segmentExtension   = ".seg"
+	ackFileName        = "ack"
+	recordHeaderSize   = 8
+	defaultSegmentSize = 64 << 20
+	maxRecordSize      = 16 << 20
+)
+
+var (
+	// ErrClosed is returned when using a spool that has been closed.
+	ErrClosed = errors.New("spool is closed")
+	// ErrFull is returned by Append when the record would make the spool exceed Options.MaxSize.
+	ErrFull = errors.New("spool is full")
+)
+
+type (
+	// ISpool is the interface the spool struct implements.
+	ISpool interface {
+		Append(data []byte) error
+		Next(done <-chan struct{}) (Record, error)
+		Ack(id uint64) error
+		Rewind() error
+		Pending() uint64
+		Close() error
+	}
+
+	// Record is a single message read from the spool. Its ID is used to acknowledge it.
+	Record struct {
+		ID   uint64
+		Data []byte
+	}
+
+	// Options configures a spool.
+	Options struct {
+		// Dir is the directory the segment files are written to. It is created if it does not exist.
+		Dir string
+		// SegmentSize is the size in bytes after which a new segment file is started. Defaults to 64MB.
+		SegmentSize int64
+		// MaxSize is the most bytes the spool keeps on disk before Append returns ErrFull. Zero means unlimited.
+		MaxSize int64
+		// Sync decides how often records are flushed to disk.
+		Sync SyncPolicy
+		// SyncInterval is used with SyncInterval. Defaults to one second.
+		SyncInterval time.Duration
+	}
+
+	// segment is a file of records. Records in a segment have consecutive ids starting at firstID.
+	segment struct {
+		firstID uint64
+		lastID  uint64
+		path    string
+		size    int64
+	}
+
+	spool struct {
+		mu       sync.Mutex
+		opts     Options
+		segments []*segment
+		size     int64
+		nextID   uint64
+		writer   *os.File
+		lastSync time.Time
+
+		readSegment *segment
+		readFile    *os.File
+		readOffset  int64
+		readID      uint64
+
+		watermark uint64
+		acked     map[uint64]struct{}
+		ackFile   *os.File
+
+		notify chan struct{}
+		closed chan struct{}
+	}
+)
+
+// NewSpool opens the spool in opts.Dir, recovering any records left by a previous process.
+// Records that were not acknowledged before the process stopped are read again.
+func NewSpool(opts Options) (ISpool, error) {
+	if opts.SegmentSize <= 0 {
+		opts.SegmentSize = defaultSegmentSize
+	}
+	if opts.SyncInterval <= 0 {
+		opts.SyncInterval = time.Second
+	}
+	if err := os.MkdirAll(opts.Dir, 0755); err != nil {
+		return nil, err
+	}
+
+	s := &spool{
+		opts:   opts,
+		acked:  make(map[uint64]struct{}),
+		notify: make(chan struct{}, 1),
+		closed: make(chan struct{}),
+	}
+
+	if err := s.recover(); err != nil {
+		s.closeFiles()
+		return nil, err
+	}
+	return s, nil
+}
+
+// Append writes a record to the end of the spool.
+func (s *spool) Append(data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.isClosed() {
+		return ErrClosed
+	}
+
+	if len(data) > maxRecordSize {
+		return fmt.Errorf("spool: record of %d bytes is too large", len(data))
+	}
+
+	recordSize := int64(recordHeaderSize + len(data))
+	if s.opts.MaxSize > 0 && s.size+recordSize > s.opts.MaxSize {
+		return ErrFull
+	}
+
+	active := s.segments[len(s.segments)-1]
+	if active.size > 0 && active.size+recordSize > s.opts.SegmentSize {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+		active = s.segments[len(s.segments)-1]
+	}
+
+	record := make([]byte, recordSize)
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(data)))
+	binary.BigEndian.PutUint32(record[4:8], crc32.ChecksumIEEE(data))
+	copy(record[recordHeaderSize:], data)
+
+	// A single write keeps a crash from leaving anything but a torn tail, which recover truncates.
+	if _, err := s.writer.Write(record); err != nil {
+		return err
+	}
+
+	active.size += recordSize
+	active.lastID = s.nextID
+	s.size += recordSize
+	s.nextID++
+
+	if err := s.maybeSync(s.writer); err != nil {
+		return err
+	}
+
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Next returns the oldest record that has not been read yet. It blocks until a record is appended,
+// done is closed, or the spool is closed. It returns nil data and a nil error when done is closed.
+func (s *spool) Next(done <-chan struct{}) (Record, error) {
+	for {
+		s.mu.Lock()
+		if s.isClosed() {
+			s.mu.Unlock()
+			return Record{}, ErrClosed
+		}
+		if s.readID < s.nextID {
+			record, err := s.read()
+			s.mu.Unlock()
+			return record, err
+		}
+		s.mu.Unlock()
+
+		select {
+		case <-s.notify:
+		case <-s.closed:
+		case <-done:
+			return Record{}, nil
+		}
+	}
+}
+
+// Ack acknowledges that the record with id has been processed. Segments are deleted once every
+// record in them has been acknowledged. Records can be acknowledged in any order.
+func (s *spool) Ack(id uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.isClosed() {
+		return ErrClosed
+	}
+	if id <= s.watermark || id >= s.nextID {
+		return nil
+	}
+
+	s.acked[id] = struct{}{}
+	if !s.advanceWatermark() {
+		return nil
+	}
+
+	if err := s.writeWatermark(); err != nil {
+		return err
+	}
+	return s.removeAcknowledgedSegments()
+}
+
+// Rewind makes Next return every record that has not been acknowledged again, starting with the oldest.
+func (s *spool) Rewind() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.isClosed() {
+		return ErrClosed
+	}
+	s.acked = make(map[uint64]struct{})
+	return s.seek(s.watermark + 1)
+}
+
+// Pending returns the number of records that have not been acknowledged.
+func (s *spool) Pending() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.nextID - 1 - s.watermark - uint64(len(s.acked))
+}
+
+// Close flushes the spool to disk and closes its files. Blocked calls to Next return ErrClosed.
+func (s *spool) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.isClosed() {
+		return nil
+	}
+	close(s.closed)
+
+	var err error
+	if s.opts.Sync != SyncNever {
+		err = s.writer.Sync()
+		if ackErr := s.ackFile.Sync(); err == nil {
+			err = ackErr
+		}
+	}
+	if closeErr := s.closeFiles(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (s *spool) isClosed() bool {
+	select {
+	case <-s.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// recover loads the segments and watermark left in the directory, truncating any torn record at the end of a segment.
+func (s *spool) recover() error {
+	files, err := ioutil.ReadDir(s.opts.Dir)
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		name := file.Name()
+		if file.IsDir() || !strings.HasSuffix(name, segmentExtension) {
+			continue
+		}
+		firstID, err := strconv.ParseUint(strings.TrimSuffix(name, segmentExtension), 10, 64)
+		if err != nil {
+			continue
+		}
+		seg := &segment{firstID: firstID, lastID: firstID - 1, path: filepath.Join(s.opts.Dir, name)}
+		if err := seg.scan(); err != nil {
+			return err
+		}
+		s.segments = append(s.segments, seg)
+		s.size += seg.size
+	}
+	sort.Slice(s.segments, func(i, j int) bool {
+		return s.segments[i].firstID < s.segments[j].firstID
+	})
+
+	s.ackFile, err = os.OpenFile(filepath.Join(s.opts.Dir, ackFileName), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	watermark := make([]byte, 8)
+	if n, _ := s.ackFile.ReadAt(watermark, 0); n == len(watermark) {
+		s.watermark = binary.BigEndian.Uint64(watermark)
+	}
+
+	s.nextID = s.watermark + 1
+	if len(s.segments) > 0 {
+		if last := s.segments[len(s.segments)-1]; last.lastID+1 > s.nextID {
+			s.nextID = last.lastID + 1
+		}
+	}
+
+	// Records lost to corruption can never be acknowledged, treat them as acknowledged so the watermark moves past them.
+	for i := 0; i+1 < len(s.segments); i++ {
+		for id := s.segments[i].lastID + 1; id < s.segments[i+1].firstID; id++ {
+			if id > s.watermark {
+				s.acked[id] = struct{}{}
+			}
+		}
+	}
+	s.advanceWatermark()
+
+	if err := s.removeAcknowledgedSegments(); err != nil {
+		return err
+	}
+	if len(s.segments) == 0 || s.segments[len(s.segments)-1].lastID+1 != s.nextID {
+		if err := s.createSegment(); err != nil {
+			return err
+		}
+	} else {
+		s.writer, err = os.OpenFile(s.segments[len(s.segments)-1].path, os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+	}
+
+	return s.seek(s.watermark + 1)
+}
+
+// rotate closes the segment being written and starts a new one.
+func (s *spool) rotate() error {
+	if s.opts.Sync != SyncNever {
+		if err := s.writer.Sync(); err != nil {
+			return err
+		}
+	}
+	if err := s.writer.Close(); err != nil {
+		return err
+	}
+	return s.createSegment()
+}
+
+func (s *spool) createSegment() error {
+	seg := &segment{
+		firstID: s.nextID,
+		lastID:  s.nextID - 1,
+		path:    filepath.Join(s.opts.Dir, fmt.Sprintf("%020d%s", s.nextID, segmentExtension)),
+	}
+	writer, err := os.OpenFile(seg.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	s.writer = writer
+	s.segments = append(s.segments, seg)
+	return nil
+}
+
+// read reads the record at the read position and moves the read position forward. s.mu must be held.
+func (s *spool) read() (Record, error) {
+	for s.readSegment == nil || s.readID > s.readSegment.lastID {
+		if err := s.seek(s.readID); err != nil {
+			return Record{}, err
+		}
+	}
+
+	data, err := readRecord(s.readFile, s.readOffset)
+	if err != nil {
+		return Record{}, err
+	}
+
+	record := Record{ID: s.readID, Data: data}
+	s.readOffset += int64(recordHeaderSize + len(data))
+	s.readID++
+	return record, nil
+}
+
+// seek moves the read position to the record with id. s.mu must be held.
+func (s *spool) seek(id uint64) error {
+	s.readID = id
+
+	index := -1
+	for i, candidate := range s.segments {
+		if candidate.firstID <= id {
+			index = i
+		}
+	}
+	if index < 0 {
+		return fmt.Errorf("spool: no segment contains record %d", id)
+	}
+	seg := s.segments[index]
+	if id > seg.lastID && index+1 < len(s.segments) {
+		// Records lost to corruption leave a gap between segments, skip to the next one.
+		seg = s.segments[index+1]
+		id = seg.firstID
+		s.readID = id
+	}
+
+	if seg != s.readSegment {
+		if s.readFile != nil {
+			s.readFile.Close()
+		}
+		file, err := os.Open(seg.path)
+		if err != nil {
+			return err
+		}
+		s.readSegment = seg
+		s.readFile = file
+	}
+
+	s.readOffset = 0
+	for current := seg.firstID; current < id && current <= seg.lastID; current++ {
+		length, err := readRecordLength(s.readFile, s.readOffset)
+		if err != nil {
+			return err
+		}
+		s.readOffset += int64(recordHeaderSize + length)
+	}
+	return nil
+}
+
+// removeAcknowledgedSegments deletes segments whose records have all been acknowledged,
+// except for the segment being written. s.mu must be held.
+func (s *spool) removeAcknowledgedSegments() error {
+	for len(s.segments) > 1 && s.segments[0].lastID <= s.watermark {
+		seg := s.segments[0]
+		if seg == s.readSegment {
+			s.readFile.Close()
+			s.readFile = nil
+			s.readSegment = nil
+		}
+		if err := os.Remove(seg.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		s.size -= seg.size
+		s.segments = s.segments[1:]
+	}
+	return nil
+}
+
+// advanceWatermark moves the watermark past every consecutive acknowledged record. s.mu must be held.
+func (s *spool) advanceWatermark() bool {
+	advanced := false
+	for {
+		if _, ok := s.acked[s.watermark+1]; !ok {
+			return advanced
+		}
+		delete(s.acked, s.watermark+1)
+		s.watermark++
+		advanced = true
+	}
+}
+
+func (s *spool) writeWatermark() error {
+	watermark := make([]byte, 8)
+	binary.BigEndian.PutUint64(watermark, s.watermark)
+	if _, err := s.ackFile.WriteAt(watermark, 0); err != nil {
+		return err
+	}
+	if s.opts.Sync == SyncAlways {
+		return s.ackFile.Sync()
+	}
+	return nil
+}
+
+func (s *spool) maybeSync(file *os.File) error {
+	switch s.opts.Sync {
+	case SyncAlways:
+		return file.Sync()
+	case SyncInterval:
+		if time.Since(s.lastSync) >= s.opts.SyncInterval {
+			s.lastSync = time.Now()
+			return file.Sync()
+		}
+	}
+	return nil
+}
+
+func (s *spool) closeFiles() error {
+	var err error
+	for _, file := range []*os.File{s.writer, s.readFile, s.ackFile} {
+		if file == nil {
+			continue
+		}
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// scan validates every record in the segment and truncates the segment after the last valid record.
+func (seg *segment) scan() error {
+	file, err := os.OpenFile(seg.path, os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var offset int64
+	for {
+		data, err := readRecord(file, offset)
+		if err != nil {
+			break
+		}
+		offset += int64(recordHeaderSize + len(data))
+		seg.lastID++
+	}
+
+	seg.size = offset
+	return file.Truncate(offset)
+}
+
+func readRecordLength(file *os.File, offset int64) (int, error) {
+	header := make([]byte, recordHeaderSize)
+	if _, err := file.ReadAt(header, offset); err != nil {
+		return 0, err
+	}
+	return int(binary.BigEndian.Uint32(header[0:4])), nil
+}
+
+func readRecord(file *os.File, offset int64) ([]byte, error) {
+	header := make([]byte, recordHeaderSize)
+	if _, err := file.ReadAt(header, offset); err != nil {
+		return nil, err
+	}
+
+	length := binary.BigEndian.Uint32(header[0:4])
+	if length > maxRecordSize {
+		return nil, fmt.Errorf("spool: corrupt record at offset %d in %s", offset, file.Name())
+	}
+
+	data := make([]byte, length)
+	if _, err := file.ReadAt(data, offset+recordHeaderSize); err != nil {
+		if err == io.EOF {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	if crc32.ChecksumIEEE(data) != binary.BigEndian.Uint32(header[4:8]) {
+		return nil, fmt.Errorf("spool: corrupt record at offset %d in %s", offset, file.Name())
+	}
+	return data, nil
+}
@@ -0,0 +1,200 @@
+package spool
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func givenSpool(t *testing.T, dir string, segmentSize int64) ISpool {
+	s, err := NewSpool(Options{Dir: dir, SegmentSize: segmentSize, Sync: SyncAlways})
+	if err != nil {
+		t.Fatalf("got err when opening spool %v", err)
+	}
+	return s
+}
+
+func givenRecords(t *testing.T, s ISpool, count int) {
+	for i := 0; i < count; i++ {
+		if err := s.Append([]byte(fmt.Sprintf("tweet %d", i))); err != nil {
+			t.Fatalf("got err when appending %v", err)
+		}
+	}
+}
+
+func countSegments(t *testing.T, dir string) int {
+	matches, err := filepath.Glob(filepath.Join(dir, "*"+segmentExtension))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(matches)
+}
+
+func TestSpoolDeliversRecordsInOrder(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "spool")
+	defer os.RemoveAll(dir)
+
+	s := givenSpool(t, dir, 0)
+	defer s.Close()
+	givenRecords(t, s, 3)
+
+	for i := 0; i < 3; i++ {
+		record, err := s.Next(nil)
+		if err != nil {
+			t.Fatalf("got err %v", err)
+		}
+		if record.ID != uint64(i+1) || string(record.Data) != fmt.Sprintf("tweet %d", i) {
+			t.Errorf("got record %d %s", record.ID, record.Data)
+		}
+	}
+
+	if s.Pending() != 3 {
+		t.Errorf("expected 3 pending records, got %d", s.Pending())
+	}
+
+	done := make(chan struct{})
+	close(done)
+	record, err := s.Next(done)
+	if err != nil || record.Data != nil {
+		t.Errorf("expected an empty record when done is closed, got %v %v", record, err)
+	}
+}
+
+func TestSpoolNextBlocksUntilAppend(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "spool")
+	defer os.RemoveAll(dir)
+
+	s := givenSpool(t, dir, 0)
+	defer s.Close()
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		s.Append([]byte("late tweet"))
+	}()
+
+	record, err := s.Next(nil)
+	if err != nil || string(record.Data) != "late tweet" {
+		t.Errorf("got record %s, err %v", record.Data, err)
+	}
+}
+
+func TestSpoolRemovesAcknowledgedSegments(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "spool")
+	defer os.RemoveAll(dir)
+
+	// Every record is 15 bytes, so each segment holds two records.
+	s := givenSpool(t, dir, 30)
+	defer s.Close()
+	givenRecords(t, s, 6)
+
+	if countSegments(t, dir) != 3 {
+		t.Fatalf("expected 3 segments, got %d", countSegments(t, dir))
+	}
+
+	for i := 0; i < 6; i++ {
+		s.Next(nil)
+	}
+
+	// Out of order acknowledgements only remove segments once every earlier record is acknowledged.
+	s.Ack(3)
+	s.Ack(4)
+	if countSegments(t, dir) != 3 {
+		t.Errorf("expected 3 segments, got %d", countSegments(t, dir))
+	}
+
+	s.Ack(1)
+	s.Ack(2)
+	if countSegments(t, dir) != 1 {
+		t.Errorf("expected 1 segment, got %d", countSegments(t, dir))
+	}
+	if s.Pending() != 2 {
+		t.Errorf("expected 2 pending records, got %d", s.Pending())
+	}
+}
+
+func TestSpoolRecoversUnacknowledgedRecords(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "spool")
+	defer os.RemoveAll(dir)
+
+	s := givenSpool(t, dir, 30)
+	givenRecords(t, s, 5)
+	s.Next(nil)
+	s.Next(nil)
+	s.Next(nil)
+	s.Ack(1)
+	s.Ack(2)
+	s.Close()
+
+	// Simulate a crash in the middle of writing a record.
+	last := filepath.Join(dir, fmt.Sprintf("%020d%s", 5, segmentExtension))
+	file, err := os.OpenFile(last, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Write([]byte{0, 0, 0, 42, 1, 2})
+	file.Close()
+
+	s = givenSpool(t, dir, 30)
+	defer s.Close()
+
+	var ids []uint64
+	for s.Pending() > uint64(len(ids)) {
+		record, err := s.Next(nil)
+		if err != nil {
+			t.Fatalf("got err %v", err)
+		}
+		ids = append(ids, record.ID)
+	}
+	if fmt.Sprint(ids) != "[3 4 5]" {
+		t.Errorf("expected records 3, 4 and 5 to be read again, got %v", ids)
+	}
+
+	givenRecords(t, s, 1)
+	record, err := s.Next(nil)
+	if err != nil || record.ID != 6 {
+		t.Errorf("expected record 6 after recovering, got %d %v", record.ID, err)
+	}
+}
+
+func TestSpoolRewind(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "spool")
+	defer os.RemoveAll(dir)
+
+	s := givenSpool(t, dir, 30)
+	defer s.Close()
+	givenRecords(t, s, 4)
+	for i := 0; i < 4; i++ {
+		s.Next(nil)
+	}
+	s.Ack(1)
+	s.Ack(2)
+
+	if err := s.Rewind(); err != nil {
+		t.Fatalf("got err %v", err)
+	}
+	record, _ := s.Next(nil)
+	if record.ID != 3 {
+		t.Errorf("expected to read record 3 after rewinding, got %d", record.ID)
+	}
+}
+
+func TestSpoolMaxSize(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "spool")
+	defer os.RemoveAll(dir)
+
+	s, err := NewSpool(Options{Dir: dir, MaxSize: 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if err := s.Append([]byte("tweet 0")); err != nil {
+		t.Errorf("got err %v", err)
+	}
+	if err := s.Append([]byte("tweet 1")); err != ErrFull {
+		t.Errorf("expected ErrFull, got %v", err)
+	}
+}
@@ -0,0 +1,10 @@
+module github.com/fallenstedt/twitter-stream/store
+
+replace github.com/fallenstedt/twitter-stream => ../
+
+go 1.16
+
+require (
+	github.com/fallenstedt/twitter-stream v0.3.3
+	modernc.org/sqlite v1.14.6
+)
@@ -0,0 +1,267 @@
+// Package store keeps decoded tweets, their authors, media and matching rules in a SQLite database, with
+// full-text search over the text of tweets. It uses a pure Go SQLite driver, so it does not need cgo.
+package store
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/fallenstedt/twitter-stream/batch"
+	"github.com/fallenstedt/twitter-stream/compliance"
+	"github.com/fallenstedt/twitter-stream/stream"
+	"github.com/fallenstedt/twitter-stream/tweets"
+	_ "modernc.org/sqlite"
+)
+
+var (
+	// ErrNotFound is returned when a tweet or user is not in the store.
+	ErrNotFound = errors.New("not found in the store")
+	// ErrNoTweet is returned for messages that are neither decoded with tweets.UnmarshalHook nor carry their raw payload.
+	ErrNoTweet = tweets.ErrNoTweet
+)
+
+type (
+	// IStore is the interface the store struct implements.
+	IStore interface {
+		stream.Handler
+		batch.Handler
+		compliance.Purger
+		Serve(ctx context.Context, s stream.IStream) error
+		Save(ctx context.Context, data *tweets.StreamData, receivedAt time.Time) error
+		Tweets(ctx context.Context, query Query) ([]tweets.Tweet, error)
+		Tweet(ctx context.Context, id string) (*tweets.Tweet, error)
+		User(ctx context.Context, id string) (*tweets.User, error)
+		Media(ctx context.Context, tweetID string) ([]tweets.Media, error)
+		DB() *sql.DB
+		Close() error
+	}
+
+	store struct {
+		db *sql.DB
+	}
+)
+
+// NewStore opens the SQLite database at path, creating it if needed, and migrates it to the latest schema.
+// Use ":memory:" for a database that is kept in memory.
+//
+// Tweets are upserted, so a tweet that is received again replaces the stored one. An edited tweet is stored
+// next to its previous versions, which are marked as superseded and left out of queries by default.
+func NewStore(path string) (IStore, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, err
+	}
+	// SQLite allows a single writer, and every connection to ":memory:" is a different database.
+	db.SetMaxOpenConns(1)
+
+	// busy_timeout and synchronous only apply to the connection they are run on. They hold because the pool keeps
+	// a single connection; run them on every new connection if SetMaxOpenConns is raised.
+	pragmas := `PRAGMA busy_timeout = 5000; PRAGMA synchronous = NORMAL;`
+	if path != ":memory:" {
+		pragmas += ` PRAGMA journal_mode = WAL;`
+	}
+	if _, err := db.Exec(pragmas); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err := migrate(context.Background(), db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &store{db: db}, nil
+}
+
+// Handle saves the tweet of message. Stream errors are ignored.
+func (s *store) Handle(ctx context.Context, message stream.StreamMessage) error {
+	if message.Err != nil {
+		return nil
+	}
+	data, err := tweets.FromMessage(message)
+	if err != nil {
+		return err
+	}
+	return s.Save(ctx, data, message.ReceivedAt)
+}
+
+// HandleBatch saves the tweets of b in a single transaction. It returns a batch.ItemErrors for the
+// messages that could not be decoded. Stream errors are ignored.
+func (s *store) HandleBatch(ctx context.Context, b batch.Batch) error {
+	failed := batch.ItemErrors{}
+	err := inTx(ctx, s.db, func(tx *sql.Tx) error {
+		for i, message := range b {
+			if message.Err != nil {
+				continue
+			}
+			data, err := tweets.FromMessage(message)
+			if err != nil {
+				failed[i] = err
+				continue
+			}
+			if err := save(ctx, tx, data, message.ReceivedAt); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(failed) > 0 {
+		return failed
+	}
+	return nil
+}
+
+// Serve saves the tweets of s until its messages channel is closed or ctx is done. Every message is acknowledged
+// once it was saved. Serve does not close the store.
+func (s *store) Serve(ctx context.Context, st stream.IStream) error {
+	return stream.Serve(ctx, st, stream.HandlerFunc(func(ctx context.Context, message stream.StreamMessage) error {
+		err := s.Handle(ctx, message)
+		message.Release()
+		if err == nil {
+			message.Ack()
+		}
+		return err
+	}))
+}
+
+// Save saves the tweet of data, with the tweets, users and media it includes and the rules it matched.
+// receivedAt is used as the creation time of tweets without one.
+func (s *store) Save(ctx context.Context, data *tweets.StreamData, receivedAt time.Time) error {
+	return inTx(ctx, s.db, func(tx *sql.Tx) error {
+		return save(ctx, tx, data, receivedAt)
+	})
+}
+
+// DB returns the database, for queries the store has no helper for.
+func (s *store) DB() *sql.DB {
+	return s.db
+}
+
+// Close closes the database.
+func (s *store) Close() error {
+	return s.db.Close()
+}
+
+func save(ctx context.Context, tx *sql.Tx, data *tweets.StreamData, receivedAt time.Time) error {
+	if receivedAt.IsZero() {
+		receivedAt = time.Now()
+	}
+	for _, user := range data.Includes.Users {
+		if err := saveUser(ctx, tx, user); err != nil {
+			return err
+		}
+	}
+	for _, media := range data.Includes.Media {
+		if err := saveMedia(ctx, tx, media); err != nil {
+			return err
+		}
+	}
+	for _, tweet := range data.Includes.Tweets {
+		if err := saveTweet(ctx, tx, tweet, receivedAt); err != nil {
+			return err
+		}
+	}
+	if data.Data.ID == "" {
+		return nil
+	}
+	if err := saveTweet(ctx, tx, data.Data, receivedAt); err != nil {
+		return err
+	}
+
+	for _, rule := range data.MatchingRules {
+		_, err := tx.ExecContext(ctx, `INSERT OR REPLACE INTO rule_matches (tweet_id, rule_id, tag) VALUES (?, ?, ?)`, data.Data.ID, rule.ID, rule.Tag)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func saveTweet(ctx context.Context, tx *sql.Tx, tweet tweets.Tweet, receivedAt time.Time) error {
+	b, err := json.Marshal(tweet)
+	if err != nil {
+		return err
+	}
+	editGroup, version := tweet.ID, 1
+	if len(tweet.EditHistoryTweetIDs) > 0 {
+		editGroup, version = tweet.EditHistoryTweetIDs[0], len(tweet.EditHistoryTweetIDs)
+	}
+	createdAt := tweet.CreatedAt
+	if createdAt.IsZero() {
+		createdAt = receivedAt
+	}
+	var metrics tweets.TweetMetrics
+	if tweet.PublicMetrics != nil {
+		metrics = *tweet.PublicMetrics
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO tweets (id, edit_group, version, author_id, conversation_id, text, lang,
+			retweet_count, reply_count, like_count, quote_count, created_at, received_at, data)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET
+			edit_group = excluded.edit_group, version = excluded.version, author_id = excluded.author_id,
+			conversation_id = excluded.conversation_id, text = excluded.text, lang = excluded.lang,
+			retweet_count = excluded.retweet_count, reply_count = excluded.reply_count,
+			like_count = excluded.like_count, quote_count = excluded.quote_count,
+			created_at = excluded.created_at, received_at = excluded.received_at, data = excluded.data`,
+		tweet.ID, editGroup, version, tweet.AuthorID, tweet.ConversationID, tweet.Text, tweet.Lang,
+		metrics.RetweetCount, metrics.ReplyCount, metrics.LikeCount, metrics.QuoteCount,
+		millis(createdAt), millis(receivedAt), string(b))
+	if err != nil {
+		return err
+	}
+
+	// Only the latest version of an edited tweet is not superseded, whatever order the versions arrive in.
+	_, err = tx.ExecContext(ctx, `
+		UPDATE tweets SET superseded = EXISTS (
+			SELECT 1 FROM tweets newer WHERE newer.edit_group = tweets.edit_group AND newer.version > tweets.version
+		) WHERE edit_group = ?`, editGroup)
+	if err != nil {
+		return err
+	}
+
+	if tweet.Attachments != nil {
+		for i, key := range tweet.Attachments.MediaKeys {
+			_, err := tx.ExecContext(ctx, `INSERT OR REPLACE INTO tweet_media (tweet_id, media_key, position) VALUES (?, ?, ?)`, tweet.ID, key, i)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func saveUser(ctx context.Context, tx *sql.Tx, user tweets.User) error {
+	b, err := json.Marshal(user)
+	if err != nil {
+		return err
+	}
+	followers := 0
+	if user.PublicMetrics != nil {
+		followers = user.PublicMetrics.FollowersCount
+	}
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO users (id, username, name, followers_count, updated_at, data) VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET
+			username = excluded.username, name = excluded.name, followers_count = excluded.followers_count,
+			updated_at = excluded.updated_at, data = excluded.data`,
+		user.ID, user.Username, user.Name, followers, millis(time.Now()), string(b))
+	return err
+}
+
+func saveMedia(ctx context.Context, tx *sql.Tx, media tweets.Media) error {
+	_, err := tx.ExecContext(ctx, `
+		INSERT OR REPLACE INTO media (media_key, type, url, preview_image_url, duration_ms, height, width, alt_text)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		media.MediaKey, media.Type, media.URL, media.PreviewImageURL, media.DurationMs, media.Height, media.Width, media.AltText)
+	return err
+}
+
+func millis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
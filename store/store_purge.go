@@ -0,0 +1,89 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+)
+
+// PurgeTweets removes the tweets with ids, with every version of them if they were edited.
+func (s *store) PurgeTweets(ctx context.Context, ids []string) (int, error) {
+	return s.purge(ctx, `edit_group IN (%s) OR edit_group IN (SELECT edit_group FROM tweets WHERE id IN (%s))`, ids, nil)
+}
+
+// PurgeUsers removes the users with ids and the tweets they authored.
+func (s *store) PurgeUsers(ctx context.Context, ids []string) (int, error) {
+	return s.purge(ctx, `author_id IN (%s)`, ids, func(tx *sql.Tx, in string, args []interface{}) error {
+		_, err := tx.ExecContext(ctx, `DELETE FROM users WHERE id IN (`+in+`)`, args...)
+		return err
+	})
+}
+
+// purgeChunk is how many ids are deleted per statement, as SQLite limits the number of placeholders.
+const purgeChunk = 500
+
+// purge removes the tweets selected by where, whose every %s is replaced by placeholders for ids, with their
+// rule matches and the media no other tweet is attached to. then is called in the same transaction. The ids are
+// deleted in chunks of purgeChunk.
+func (s *store) purge(ctx context.Context, where string, ids []string, then func(tx *sql.Tx, in string, args []interface{}) error) (int, error) {
+	if len(ids) == 0 {
+		return 0, nil
+	}
+
+	var removed int64
+	err := inTx(ctx, s.db, func(tx *sql.Tx) error {
+		for start := 0; start < len(ids); start += purgeChunk {
+			end := start + purgeChunk
+			if end > len(ids) {
+				end = len(ids)
+			}
+			n, err := purgeIDs(ctx, tx, where, ids[start:end], then)
+			if err != nil {
+				return err
+			}
+			removed += n
+		}
+		_, err := tx.ExecContext(ctx, `DELETE FROM media WHERE media_key NOT IN (SELECT media_key FROM tweet_media)`)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return int(removed), nil
+}
+
+// purgeIDs removes the tweets selected by where for one chunk of ids, and returns how many were removed.
+func purgeIDs(ctx context.Context, tx *sql.Tx, where string, ids []string, then func(tx *sql.Tx, in string, args []interface{}) error) (int64, error) {
+	in := strings.TrimSuffix(strings.Repeat("?,", len(ids)), ",")
+	args := make([]interface{}, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+	var whereArgs []interface{}
+	for i := strings.Count(where, "%s"); i > 0; i-- {
+		whereArgs = append(whereArgs, args...)
+	}
+	where = strings.Replace(where, "%s", in, -1)
+
+	statements := []string{
+		`DELETE FROM rule_matches WHERE tweet_id IN (SELECT id FROM tweets WHERE ` + where + `)`,
+		`DELETE FROM tweet_media WHERE tweet_id IN (SELECT id FROM tweets WHERE ` + where + `)`,
+	}
+	for _, statement := range statements {
+		if _, err := tx.ExecContext(ctx, statement, whereArgs...); err != nil {
+			return 0, err
+		}
+	}
+	result, err := tx.ExecContext(ctx, `DELETE FROM tweets WHERE `+where, whereArgs...)
+	if err != nil {
+		return 0, err
+	}
+	removed, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	if then != nil {
+		return removed, then(tx, in, args)
+	}
+	return removed, nil
+}
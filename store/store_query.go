@@ -0,0 +1,139 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/fallenstedt/twitter-stream/tweets"
+)
+
+// Query selects tweets. Its fields are combined, and the zero value selects the latest tweets.
+type Query struct {
+	// Tag selects the tweets that matched a rule with this tag.
+	Tag      string
+	AuthorID string
+	// From and To select the tweets created in [From, To). They are ignored if zero.
+	From time.Time
+	To   time.Time
+	// Text is a full-text search, using the syntax of SQLite FTS5, such as `gopher AND (go OR golang)`.
+	Text string
+	// AllVersions includes the previous versions of edited tweets.
+	AllVersions bool
+	// Limit is the most tweets returned. It is 100 if 0.
+	Limit int
+}
+
+// Tweets returns the tweets selected by query, the most recently created first.
+func (s *store) Tweets(ctx context.Context, query Query) ([]tweets.Tweet, error) {
+	var where []string
+	var args []interface{}
+	if !query.AllVersions {
+		where = append(where, `NOT t.superseded`)
+	}
+	if query.Tag != "" {
+		where = append(where, `t.id IN (SELECT tweet_id FROM rule_matches WHERE tag = ?)`)
+		args = append(args, query.Tag)
+	}
+	if query.AuthorID != "" {
+		where = append(where, `t.author_id = ?`)
+		args = append(args, query.AuthorID)
+	}
+	if !query.From.IsZero() {
+		where = append(where, `t.created_at >= ?`)
+		args = append(args, millis(query.From))
+	}
+	if !query.To.IsZero() {
+		where = append(where, `t.created_at < ?`)
+		args = append(args, millis(query.To))
+	}
+	if query.Text != "" {
+		where = append(where, `t.rowid IN (SELECT rowid FROM tweets_fts WHERE tweets_fts MATCH ?)`)
+		args = append(args, query.Text)
+	}
+	if query.Limit <= 0 {
+		query.Limit = 100
+	}
+
+	q := `SELECT t.data FROM tweets t`
+	if len(where) > 0 {
+		q += ` WHERE ` + strings.Join(where, ` AND `)
+	}
+	q += ` ORDER BY t.created_at DESC, t.id DESC LIMIT ?`
+	args = append(args, query.Limit)
+
+	rows, err := s.db.QueryContext(ctx, q, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []tweets.Tweet
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		var tweet tweets.Tweet
+		if err := json.Unmarshal([]byte(data), &tweet); err != nil {
+			return nil, err
+		}
+		result = append(result, tweet)
+	}
+	return result, rows.Err()
+}
+
+// Tweet returns the tweet with id, or ErrNotFound.
+func (s *store) Tweet(ctx context.Context, id string) (*tweets.Tweet, error) {
+	tweet := new(tweets.Tweet)
+	if err := s.get(ctx, tweet, `SELECT data FROM tweets WHERE id = ?`, id); err != nil {
+		return nil, err
+	}
+	return tweet, nil
+}
+
+// User returns the user with id, or ErrNotFound.
+func (s *store) User(ctx context.Context, id string) (*tweets.User, error) {
+	user := new(tweets.User)
+	if err := s.get(ctx, user, `SELECT data FROM users WHERE id = ?`, id); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// Media returns the media attached to the tweet with tweetID, in the order they are attached.
+func (s *store) Media(ctx context.Context, tweetID string) ([]tweets.Media, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT m.media_key, m.type, m.url, m.preview_image_url, m.duration_ms, m.height, m.width, m.alt_text
+		FROM tweet_media tm JOIN media m ON m.media_key = tm.media_key
+		WHERE tm.tweet_id = ? ORDER BY tm.position`, tweetID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []tweets.Media
+	for rows.Next() {
+		var m tweets.Media
+		if err := rows.Scan(&m.MediaKey, &m.Type, &m.URL, &m.PreviewImageURL, &m.DurationMs, &m.Height, &m.Width, &m.AltText); err != nil {
+			return nil, err
+		}
+		result = append(result, m)
+	}
+	return result, rows.Err()
+}
+
+// get decodes the data column of the row selected by query into v.
+func (s *store) get(ctx context.Context, v interface{}, query string, args ...interface{}) error {
+	var data string
+	err := s.db.QueryRowContext(ctx, query, args...).Scan(&data)
+	if err == sql.ErrNoRows {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal([]byte(data), v)
+}
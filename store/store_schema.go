@@ -0,0 +1,127 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// migrations are applied in order, once each. Append new migrations, never change the ones that were released.
+var migrations = []string{
+	// 1: tweets, users, media and rule matches, with full-text search over the text of tweets.
+	`
+	CREATE TABLE users (
+		id                TEXT PRIMARY KEY,
+		username          TEXT NOT NULL,
+		name              TEXT NOT NULL,
+		followers_count   INTEGER NOT NULL DEFAULT 0,
+		updated_at        INTEGER NOT NULL,
+		data              TEXT NOT NULL
+	);
+	CREATE INDEX users_username ON users(username);
+
+	CREATE TABLE tweets (
+		id                  TEXT PRIMARY KEY,
+		edit_group          TEXT NOT NULL,
+		version             INTEGER NOT NULL,
+		superseded          INTEGER NOT NULL DEFAULT 0,
+		author_id           TEXT NOT NULL,
+		conversation_id     TEXT NOT NULL,
+		text                TEXT NOT NULL,
+		lang                TEXT NOT NULL,
+		retweet_count       INTEGER NOT NULL DEFAULT 0,
+		reply_count         INTEGER NOT NULL DEFAULT 0,
+		like_count          INTEGER NOT NULL DEFAULT 0,
+		quote_count         INTEGER NOT NULL DEFAULT 0,
+		created_at          INTEGER NOT NULL,
+		received_at         INTEGER NOT NULL,
+		data                TEXT NOT NULL
+	);
+	CREATE INDEX tweets_created_at ON tweets(created_at);
+	CREATE INDEX tweets_author_id ON tweets(author_id, created_at);
+	CREATE INDEX tweets_edit_group ON tweets(edit_group);
+
+	CREATE TABLE media (
+		media_key         TEXT PRIMARY KEY,
+		type              TEXT NOT NULL,
+		url               TEXT NOT NULL,
+		preview_image_url TEXT NOT NULL,
+		duration_ms       INTEGER NOT NULL DEFAULT 0,
+		height            INTEGER NOT NULL DEFAULT 0,
+		width             INTEGER NOT NULL DEFAULT 0,
+		alt_text          TEXT NOT NULL
+	);
+
+	CREATE TABLE tweet_media (
+		tweet_id          TEXT NOT NULL,
+		media_key         TEXT NOT NULL,
+		position          INTEGER NOT NULL,
+		PRIMARY KEY (tweet_id, media_key)
+	);
+	CREATE INDEX tweet_media_media_key ON tweet_media(media_key);
+
+	CREATE TABLE rule_matches (
+		tweet_id          TEXT NOT NULL,
+		rule_id           TEXT NOT NULL,
+		tag               TEXT NOT NULL,
+		PRIMARY KEY (tweet_id, rule_id)
+	);
+	CREATE INDEX rule_matches_tag ON rule_matches(tag, tweet_id);
+
+	CREATE VIRTUAL TABLE tweets_fts USING fts5(text, content='tweets', content_rowid='rowid');
+	CREATE TRIGGER tweets_fts_insert AFTER INSERT ON tweets BEGIN
+		INSERT INTO tweets_fts(rowid, text) VALUES (new.rowid, new.text);
+	END;
+	CREATE TRIGGER tweets_fts_delete AFTER DELETE ON tweets BEGIN
+		INSERT INTO tweets_fts(tweets_fts, rowid, text) VALUES ('delete', old.rowid, old.text);
+	END;
+	CREATE TRIGGER tweets_fts_update AFTER UPDATE OF text ON tweets BEGIN
+		INSERT INTO tweets_fts(tweets_fts, rowid, text) VALUES ('delete', old.rowid, old.text);
+		INSERT INTO tweets_fts(rowid, text) VALUES (new.rowid, new.text);
+	END;
+	`,
+}
+
+// migrate applies the migrations the database does not have yet, each in its own transaction.
+func migrate(ctx context.Context, db *sql.DB) error {
+	_, err := db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER PRIMARY KEY, applied_at INTEGER NOT NULL)`)
+	if err != nil {
+		return err
+	}
+
+	var version int
+	if err := db.QueryRowContext(ctx, `SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&version); err != nil {
+		return err
+	}
+	if version > len(migrations) {
+		return fmt.Errorf("database schema version %d is newer than this package, which knows %d", version, len(migrations))
+	}
+
+	for i := version; i < len(migrations); i++ {
+		err := inTx(ctx, db, func(tx *sql.Tx) error {
+			if _, err := tx.ExecContext(ctx, migrations[i]); err != nil {
+				return err
+			}
+			_, err := tx.ExecContext(ctx, `INSERT INTO schema_migrations (version, applied_at) VALUES (?, ?)`, i+1, time.Now().UnixNano()/int64(time.Millisecond))
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("could not apply migration %d: %w", i+1, err)
+		}
+	}
+	return nil
+}
+
+// inTx calls fn in a transaction, which is committed if fn succeeds and rolled back otherwise.
+func inTx(ctx context.Context, db *sql.DB, fn func(tx *sql.Tx) error) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
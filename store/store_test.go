@@ -0,0 +1,277 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fallenstedt/twitter-stream/batch"
+	"github.com/fallenstedt/twitter-stream/stream"
+	"github.com/fallenstedt/twitter-stream/tweets"
+)
+
+var day = time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC)
+
+func givenStore(t *testing.T) IStore {
+	s, err := NewStore(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func givenData(id, authorID, text, tag string, hour int) *tweets.StreamData {
+	return &tweets.StreamData{
+		Data:          tweets.Tweet{ID: id, AuthorID: authorID, Text: text, CreatedAt: day.Add(time.Duration(hour) * time.Hour)},
+		Includes:      tweets.Includes{Users: []tweets.User{{ID: authorID, Username: "user" + authorID, Name: "User " + authorID}}},
+		MatchingRules: []tweets.MatchingRule{{ID: "rule-" + tag, Tag: tag}},
+	}
+}
+
+// givenTweets saves five tweets by two authors, created an hour apart.
+func givenTweets(t *testing.T, s IStore) {
+	data := []*tweets.StreamData{
+		givenData("1", "10", "gophers love go", "golang", 0),
+		givenData("2", "10", "rust and go", "golang", 1),
+		givenData("3", "20", "cats are great", "cats", 2),
+		givenData("4", "20", "cats like gophers", "cats", 3),
+		givenData("5", "10", "go generics", "golang", 4),
+	}
+	for _, d := range data {
+		if err := s.Save(context.Background(), d, time.Time{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func ids(result []tweets.Tweet) string {
+	var ids []string
+	for _, tweet := range result {
+		ids = append(ids, tweet.ID)
+	}
+	return strings.Join(ids, ",")
+}
+
+func TestStoreTweets(t *testing.T) {
+	var tests = []struct {
+		query  Query
+		result string
+	}{
+		{Query{}, "5,4,3,2,1"},
+		{Query{Limit: 2}, "5,4"},
+		{Query{Tag: "golang"}, "5,2,1"},
+		{Query{AuthorID: "20"}, "4,3"},
+		{Query{From: day.Add(time.Hour), To: day.Add(3 * time.Hour)}, "3,2"},
+		{Query{Tag: "golang", From: day.Add(time.Hour)}, "5,2"},
+		{Query{Text: "gophers"}, "4,1"},
+		{Query{Text: "go NOT rust"}, "5,1"},
+		{Query{Text: "cats", Tag: "golang"}, ""},
+	}
+
+	s := givenStore(t)
+	givenTweets(t, s)
+	for i, tt := range tests {
+		testName := fmt.Sprintf("TestStoreTweets (%d)", i)
+		t.Run(testName, func(t *testing.T) {
+			result, err := s.Tweets(context.Background(), tt.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ids(result) != tt.result {
+				t.Errorf("got %s, want %s", ids(result), tt.result)
+			}
+		})
+	}
+}
+
+func TestStoreUpsert(t *testing.T) {
+	s := givenStore(t)
+	ctx := context.Background()
+
+	// the same tweet received again replaces the stored one
+	data := givenData("1", "10", "gophers", "golang", 0)
+	s.Save(ctx, data, time.Time{})
+	data.Data.PublicMetrics = &tweets.TweetMetrics{LikeCount: 3}
+	s.Save(ctx, data, time.Time{})
+	if tweet, err := s.Tweet(ctx, "1"); err != nil || tweet.PublicMetrics.LikeCount != 3 {
+		t.Errorf("expected the tweet to be updated, got %v %v", tweet, err)
+	}
+
+	// edits arrive out of order, and only the latest is returned by default
+	edit := func(id, text string, history ...string) *tweets.StreamData {
+		d := givenData(id, "10", text, "golang", 1)
+		d.Data.EditHistoryTweetIDs = history
+		return d
+	}
+	s.Save(ctx, edit("3", "gophers!!", "1", "2", "3"), time.Time{})
+	s.Save(ctx, edit("2", "gophers!", "1", "2"), time.Time{})
+
+	result, _ := s.Tweets(ctx, Query{})
+	if ids(result) != "3" {
+		t.Errorf("expected the latest version, got %s", ids(result))
+	}
+	result, _ = s.Tweets(ctx, Query{AllVersions: true})
+	if ids(result) != "3,2,1" {
+		t.Errorf("expected every version, got %s", ids(result))
+	}
+	if result, _ := s.Tweets(ctx, Query{Text: "gophers"}); ids(result) != "3" {
+		t.Errorf("expected the edited text to be searchable, got %s", ids(result))
+	}
+
+	if _, err := s.Tweet(ctx, "4"); err != ErrNotFound {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+	if user, err := s.User(ctx, "10"); err != nil || user.Username != "user10" {
+		t.Errorf("got user %v %v", user, err)
+	}
+}
+
+func TestStoreMedia(t *testing.T) {
+	s := givenStore(t)
+	ctx := context.Background()
+	data := givenData("1", "10", "photos", "cats", 0)
+	data.Data.Attachments = &tweets.Attachments{MediaKeys: []string{"3_2", "3_1"}}
+	data.Includes.Media = []tweets.Media{{MediaKey: "3_1", Type: "photo", URL: "https://pbs.twimg.com/media/1.jpg"}, {MediaKey: "3_2", Type: "video"}}
+	s.Save(ctx, data, time.Time{})
+
+	media, err := s.Media(ctx, "1")
+	if err != nil || len(media) != 2 || media[0].Type != "video" || media[1].URL != "https://pbs.twimg.com/media/1.jpg" {
+		t.Errorf("got %v %v", media, err)
+	}
+}
+
+func TestStorePurge(t *testing.T) {
+	var tests = []struct {
+		users   bool
+		ids     []string
+		removed int
+		result  string
+	}{
+		{false, []string{"2", "4"}, 2, "5,3,1"},
+		{false, []string{"6"}, 0, "5,4,3,2,1"},
+		{true, []string{"20"}, 2, "5,2,1"},
+		// more ids than SQLite allows in one statement
+		{false, append(manyIDs(20000), "4"), 1, "5,3,2,1"},
+	}
+
+	for i, tt := range tests {
+		testName := fmt.Sprintf("TestStorePurge (%d)", i)
+		t.Run(testName, func(t *testing.T) {
+			s := givenStore(t)
+			givenTweets(t, s)
+			ctx := context.Background()
+
+			purge := s.PurgeTweets
+			if tt.users {
+				purge = s.PurgeUsers
+			}
+			removed, err := purge(ctx, tt.ids)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if removed != tt.removed {
+				t.Errorf("got %d removed, want %d", removed, tt.removed)
+			}
+			if result, _ := s.Tweets(ctx, Query{}); ids(result) != tt.result {
+				t.Errorf("got %s, want %s", ids(result), tt.result)
+			}
+			if result, _ := s.Tweets(ctx, Query{Text: "cats"}); tt.users && len(result) != 0 {
+				t.Errorf("expected purged tweets to be removed from the search index, got %s", ids(result))
+			}
+			if _, err := s.User(ctx, "20"); tt.users && err != ErrNotFound {
+				t.Errorf("expected the user to be removed, got %v", err)
+			}
+		})
+	}
+}
+
+func manyIDs(n int) []string {
+	ids := make([]string, n)
+	for i := range ids {
+		ids[i] = fmt.Sprint(1000 + i)
+	}
+	return ids
+}
+
+func TestStorePurgeEdits(t *testing.T) {
+	s := givenStore(t)
+	ctx := context.Background()
+	history := map[string][]string{"2": {"1", "2"}, "3": {"1", "2", "3"}}
+	for id, ids := range history {
+		d := givenData(id, "10", "edited", "golang", 0)
+		d.Data.EditHistoryTweetIDs = ids
+		s.Save(ctx, d, time.Time{})
+	}
+
+	// the original version was never stored
+	if removed, err := s.PurgeTweets(ctx, []string{"1"}); err != nil || removed != 2 {
+		t.Errorf("expected every version to be removed, got %d %v", removed, err)
+	}
+}
+
+func TestStoreHandle(t *testing.T) {
+	s := givenStore(t)
+	ctx := context.Background()
+	raw := []byte(`{"data":{"id":"1","text":"raw gophers","author_id":"10"},"matching_rules":[{"id":"1","tag":"golang"}]}`)
+
+	messages := []stream.StreamMessage{
+		{Data: givenData("2", "10", "decoded gophers", "golang", 0)},
+		{Data: raw},
+		{Err: errors.New("EOF")},
+	}
+	for _, message := range messages {
+		if err := s.Handle(ctx, message); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Handle(ctx, stream.StreamMessage{Data: struct{}{}}); err != ErrNoTweet {
+		t.Errorf("expected ErrNoTweet, got %v", err)
+	}
+
+	err := s.HandleBatch(ctx, batch.Batch{{Data: givenData("3", "10", "batched gophers", "golang", 0)}, {Data: 3}})
+	var failed batch.ItemErrors
+	if !errors.As(err, &failed) || len(failed) != 1 || failed[1] != ErrNoTweet {
+		t.Errorf("expected the second message to fail, got %v", err)
+	}
+
+	if result, _ := s.Tweets(ctx, Query{Tag: "golang", Text: "gophers"}); len(result) != 3 {
+		t.Errorf("got %s", ids(result))
+	}
+}
+
+func TestStoreMigrate(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "store")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "tweets.db")
+
+	s, err := NewStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	givenTweets(t, s)
+	s.Close()
+
+	// migrations are not applied twice
+	s, err = NewStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	var version int
+	s.DB().QueryRow(`SELECT MAX(version) FROM schema_migrations`).Scan(&version)
+	if result, _ := s.Tweets(context.Background(), Query{}); len(result) != 5 || version != len(migrations) {
+		t.Errorf("got %d tweets at version %d", len(result), version)
+	}
+
+	s.DB().Exec(`INSERT INTO schema_migrations (version, applied_at) VALUES (?, 0)`, len(migrations)+1)
+	if _, err := NewStore(path); err == nil {
+		t.Errorf("expected an error for a newer schema")
+	}
+}
@@ -0,0 +1,39 @@
+package stream
+
+import "context"
+
+type (
+	// Handler processes a single message from the messages channel.
+	// It is implemented by routers, middlewares and sinks that consume a stream.
+	Handler interface {
+		Handle(ctx context.Context, message StreamMessage) error
+	}
+
+	// HandlerFunc allows an ordinary function to be used as a Handler.
+	HandlerFunc func(ctx context.Context, message StreamMessage) error
+)
+
+// Handle calls f(ctx, message).
+func (f HandlerFunc) Handle(ctx context.Context, message StreamMessage) error {
+	return f(ctx, message)
+}
+
+// Serve passes every message of s to handler, one at a time, until its messages channel is closed, ctx is done,
+// or handler returns an error. It returns the error of handler, the error that stopped the stream, or ctx's error.
+// Serve does not stop the stream.
+func Serve(ctx context.Context, s IStream, handler Handler) error {
+	messages := s.GetMessages()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case message, ok := <-messages:
+			if !ok {
+				return ErrOf(s)
+			}
+			if err := handler.Handle(ctx, message); err != nil {
+				return err
+			}
+		}
+	}
+}
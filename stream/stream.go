@@ -1,9 +1,16 @@
 package stream
 
 import (
+	"errors"
 	"github.com/fallenstedt/twitter-stream/httpclient"
+	"github.com/fallenstedt/twitter-stream/spool"
+	"io"
+	"math"
 	"net/http"
 	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type (
@@ -11,6 +18,7 @@ type (
 	UnmarshalHook func([]byte) (interface{}, error)
 
 	// IStream is the interface that the stream struct implements.
+	// Streams are configured with the setters of *Stream before they are started.
 	IStream interface {
 		StartStream(queryParams *url.Values) error
 		StopStream()
@@ -18,97 +26,565 @@ type (
 		SetUnmarshalHook(hook UnmarshalHook)
 	}
 
+	// IStreamStatus is implemented by streams that report their lifecycle, such as *Stream and connection groups.
+	IStreamStatus interface {
+		Stats() StreamStats
+		State() StreamState
+		Done() <-chan struct{}
+		Wait() error
+		Err() error
+	}
+
 	// StreamMessage is the message that is sent from the messages channel.
 	StreamMessage struct {
 		Data interface{}
 		Err  error
+		// Raw is a copy of the payload received from Twitter. It is only set when SetIncludeRaw is enabled.
+		Raw []byte
+		// ReceivedAt is when the payload was read from the connection, or from the spool if one is set.
+		ReceivedAt time.Time
+		// Seq increases by one for every message sent to the messages channel, across restarts.
+		// A gap means messages were dropped by the overflow policy.
+		Seq uint64
+		// ConnectionID identifies the connection the payload or error came from. It is 0 for messages read from a spool.
+		ConnectionID uint64
+		// Recovered is set on tweets recovered by a GapFiller after an outage.
+		Recovered bool
+
+		ack func()
+		// forget makes the deduplicator forget the tweet when it is not delivered.
+		forget func()
 	}
 
 	// Stream is the struct that manages a long running TCP connection with Twitter.
 	// It accepts an 'unamarshalHook' which allows you to unmarshal json in a thread-safe manner.
 	// It is highly encouraged to set a unmarshal hook before starting a stream. Unmarshaling json
 	// in a separate goroutine is not recommended because the Go bytes.Buffer is not goroutine safe.
+	//
+	// A Stream moves from idle, to connecting, to streaming, to stopping and finally to stopped.
+	// A stopped stream can be started again with StartStream, which creates a new messages channel.
 	Stream struct {
-		unmarshalHook UnmarshalHook
-		messages      chan StreamMessage
-		httpClient    httpclient.IHttpClient
-		done          chan struct{}
-		reader        IStreamResponseBodyReader
+		// counters is accessed atomically and must stay the first field for 64-bit alignment.
+		counters         streamCounters
+		unmarshalHook    UnmarshalHook
+		reconnectPolicy  ReconnectPolicy
+		messages         chan StreamMessage
+		httpClient       httpclient.IHttpClient
+		endpoint         func(queryParams *url.Values) (*http.Response, error)
+		done             chan struct{}
+		reader           IStreamResponseBodyReader
+		bufferSize       int
+		overflowPolicy   OverflowPolicy
+		spool            spool.ISpool
+		decodeWorkers    int
+		pooledBuffers    bool
+		fatalPanics      bool
+		includeRaw       bool
+		deadLetters      DeadLetterSink
+		deduplicator     Deduplicator
+		autoBackfill     bool
+		backfillRejected bool
+		lastReceived     time.Time
+		lastTweetID      string
+		gapFiller        GapFiller
+		gapFills         sync.WaitGroup
+		checkpoints      *checkpointer
+		connectionID     uint64
+		pool             *decodePool
+
+		// sendMu serializes the senders of the messages channel.
+		sendMu sync.Mutex
+
+		mu       sync.Mutex
+		state    StreamState
+		finished chan struct{}
+		body     io.Closer
+		err      error
 	}
 )
 
 // NewStream creates an instance of `Stream`. This is used to manage the stream with Twitter.
-func NewStream(httpClient httpclient.IHttpClient, reader IStreamResponseBodyReader) IStream {
+func NewStream(httpClient httpclient.IHttpClient, reader IStreamResponseBodyReader) *Stream {
 	return &Stream{
-		unmarshalHook: func(bytes []byte) (interface{}, error) {
-			return bytes, nil
-		},
 		messages:   make(chan StreamMessage),
 		done:       make(chan struct{}),
+		finished:   make(chan struct{}),
 		reader:     reader,
 		httpClient: httpClient,
+		endpoint:   httpClient.GetSearchStream,
 	}
 }
 
 // SetUnmarshalHook sets the function that unmarshals json. It is highly encouraged
 // that you unmarshal json with this hook to promote thread-safety. Go's bytes.Buffer is not
 // thread safe and can result in panics when a bytes.Buffer is shared across goroutines.
+// The bytes passed to the hook are reused once it returns, so copy them if you need to keep them.
+// Without a hook, messages carry a copy of the raw bytes as Data.
+// While a GapFiller delivers recovered tweets, the hook is called from its goroutine too, so it must be safe
+// for concurrent use when SetGapFiller or SetDecodeWorkers is used.
 func (s *Stream) SetUnmarshalHook(hook UnmarshalHook) {
 	s.unmarshalHook = hook
 }
 
-// GetMessages returns the read-only messages channel
+// SetIncludeRaw sets whether messages carry a copy of the payload received from Twitter as Raw,
+// even when the UnmarshalHook fails. Call SetIncludeRaw before StartStream.
+func (s *Stream) SetIncludeRaw(enabled bool) {
+	s.includeRaw = enabled
+}
+
+// SetReconnectPolicy sets the policy used to reconnect when the connection with Twitter ends.
+// Errors and disconnects are still sent to the messages channel, but the stream keeps running
+// until the policy gives up or StopStream is called. By default the stream does not reconnect.
+// Use DefaultReconnectPolicy to follow Twitter's guidance on handling disconnections.
+func (s *Stream) SetReconnectPolicy(policy ReconnectPolicy) {
+	s.reconnectPolicy = policy
+}
+
+// GetMessages returns the read-only messages channel of the current run of the stream.
+// The channel is closed once the stream stops.
 func (s *Stream) GetMessages() <-chan StreamMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	return s.messages
 }
 
+// State returns the current lifecycle state of the stream.
+func (s *Stream) State() StreamState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.state
+}
+
+// Done returns a channel that is closed once the current run of the stream has stopped,
+// its goroutine has exited and its connection with Twitter has been closed.
+func (s *Stream) Done() <-chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.finished == nil {
+		s.finished = make(chan struct{})
+	}
+	return s.finished
+}
+
+// Wait blocks until the stream has stopped and returns the error that stopped it.
+func (s *Stream) Wait() error {
+	<-s.Done()
+	return s.Err()
+}
+
+// Err returns the error that stopped the stream. It is nil while the stream is running,
+// or when the stream was stopped with StopStream.
+func (s *Stream) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
 // StopStream sends a close signal to stop the stream of tweets.
+// It closes the connection with Twitter, which interrupts any pending read.
+// It is safe to call StopStream more than once.
 func (s *Stream) StopStream() {
-	close(s.done)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch s.state {
+	case StateStopping, StateStopped:
+		return
+	case StateIdle:
+		s.finishLocked(nil)
+		return
+	}
+
+	s.stopLocked()
 }
 
 // StartStream makes an HTTP GET request to twitter and starts streaming tweets to the Messages channel.
 // Accepts query params described in GET /2/tweets/search/stream to expand the payload that is returned. Query params string must begin with a ?.
 // See available query params here https://developer.twitter.com/en/docs/twitter-api/tweets/filtered-stream/api-reference/get-tweets-search-stream.
 // See an example here: https://developer.twitter.com/en/docs/twitter-api/expansions.
+// A stopped stream can be started again. Call GetMessages after starting it to receive from the new messages channel.
 func (s *Stream) StartStream(optionalQueryParams *url.Values) error {
-	res, err := s.httpClient.GetSearchStream(optionalQueryParams)
+	s.mu.Lock()
+	switch s.state {
+	case StateConnecting, StateStreaming, StateStopping:
+		s.mu.Unlock()
+		return ErrStreamRunning
+	case StateStopped:
+		s.messages = make(chan StreamMessage, s.bufferSize)
+		s.done = make(chan struct{})
+		s.finished = make(chan struct{})
+	}
+	if s.finished == nil {
+		s.finished = make(chan struct{})
+	}
+	s.state = StateConnecting
+	s.err = nil
+	s.mu.Unlock()
+
+	if s.spool != nil {
+		// Deliver messages that were read but never acknowledged again.
+		if err := s.spool.Rewind(); err != nil {
+			s.mu.Lock()
+			s.abortStartLocked()
+			s.mu.Unlock()
+			return err
+		}
+		atomic.StoreUint64(&s.counters.unspilled, s.spool.Pending())
+	}
+
+	// Recover the time since the last checkpoint like an outage.
+	var outageStart time.Time
+	var sinceID string
+	if s.checkpoints != nil {
+		if err := s.loadCheckpoint(); err != nil {
+			s.mu.Lock()
+			s.abortStartLocked()
+			s.mu.Unlock()
+			return err
+		}
+		outageStart, sinceID = s.lastReceived, s.lastTweetID
+	}
+
+	var res *http.Response
+	var err error
+	if outageStart.IsZero() {
+		res, err = s.open(optionalQueryParams)
+	} else {
+		res, err = s.connect(optionalQueryParams)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
 	if err != nil {
+		s.abortStartLocked()
 		return err
 	}
 
+	if s.state == StateStopping {
+		res.Body.Close()
+		s.finishLocked(nil)
+		return nil
+	}
+
 	s.reader.setStreamResponseBody(res.Body)
+	s.body = res.Body
+	s.state = StateStreaming
+	s.connectionID = atomic.AddUint64(&s.counters.connections, 1)
+	s.lastReceived = time.Now()
 
-	go s.streamMessages(res)
+	go s.streamMessages(optionalQueryParams, outageStart, sinceID)
 
 	return nil
 }
 
-func (s *Stream) streamMessages(res *http.Response) {
-	defer res.Body.Close()
-	defer close(s.messages)
+func (s *Stream) streamMessages(queryParams *url.Values, outageStart time.Time, sinceID string) {
+	s.pool = nil
+	if s.decodeWorkers > 1 {
+		s.pool = newDecodePool(s, s.decodeWorkers)
+	}
+
+	var drained chan struct{}
+	if s.spool != nil {
+		drained = make(chan struct{})
+		go s.drainSpool(drained)
+	}
+
+	var stopCheckpoints, checkpointsSaved chan struct{}
+	if s.checkpoints != nil {
+		stopCheckpoints, checkpointsSaved = s.startCheckpoints()
+	}
+
+	s.fillGap(outageStart, s.lastReceived, sinceID, queryParams)
+
+	var err error
+	defer func() {
+		if drained != nil {
+			s.mu.Lock()
+			s.stopLocked()
+			s.mu.Unlock()
+			<-drained
+		}
+		s.gapFills.Wait()
+		if s.pool != nil {
+			s.pool.close()
+		}
+		if stopCheckpoints != nil {
+			close(stopCheckpoints)
+			<-checkpointsSaved
+		}
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.finishLocked(err)
+	}()
+
+	attempt := 0
+	for {
+		received, readErr := s.consume()
+		s.closeBody()
+		if readErr == nil {
+			return
+		}
+
+		if !s.emit(StreamMessage{Data: nil, Err: readErr, ConnectionID: s.connectionID}) {
+			return
+		}
+
+		if s.reconnectPolicy == nil {
+			err = readErr
+			return
+		}
+		if received {
+			attempt = 0
+		}
+
+		var connected bool
+		connected, err = s.reconnect(&attempt, readErr, queryParams)
+		if !connected {
+			return
+		}
+	}
+}
+
+// open connects to the endpoint of the stream. Without a reconnect policy, a connection rejected with 429 is
+// attempted again after httpclient.RetryDelay, until it succeeds or the stream is stopped.
+func (s *Stream) open(queryParams *url.Values) (*http.Response, error) {
+	for retries := uint8(0); ; {
+		res, err := s.endpoint(queryParams)
+		var statusErr *httpclient.StatusError
+		if s.reconnectPolicy != nil || !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusTooManyRequests {
+			return res, err
+		}
+		select {
+		case <-s.done:
+			return nil, err
+		case <-time.After(httpclient.RetryDelay(retries)):
+		}
+		if retries < math.MaxUint8 {
+			retries++
+		}
+	}
+}
 
+// reconnect waits for the reconnect policy and opens a new connection with Twitter.
+// It returns false with the last error when the policy gives up, or false with a nil error
+// when the stream has been stopped.
+func (s *Stream) reconnect(attempt *int, err error, queryParams *url.Values) (bool, error) {
+	outageStart, sinceID := s.lastReceived, s.lastTweetID
+	for {
+		*attempt++
+		delay, ok, panicErr := s.nextDelay(*attempt, err)
+		if panicErr != nil {
+			s.emit(StreamMessage{Data: nil, Err: panicErr})
+			return false, panicErr
+		}
+		if !ok {
+			return false, err
+		}
+
+		if !s.setState(StateConnecting) {
+			return false, nil
+		}
+
+		select {
+		case <-s.done:
+			return false, nil
+		case <-time.After(delay):
+		}
+
+		res, connectErr := s.connect(queryParams)
+		if connectErr == nil {
+			if !s.setBody(res.Body) {
+				return false, nil
+			}
+			s.fillGap(outageStart, time.Now(), sinceID, queryParams)
+			return true, nil
+		}
+
+		err = connectErr
+		if !s.emit(StreamMessage{Data: nil, Err: err}) {
+			return false, nil
+		}
+	}
+}
+
+// consume reads messages from the response body until the stream is stopped or the connection ends.
+// It returns the error that ended the connection, or nil if the stream was stopped,
+// and whether a tweet was received on this connection.
+func (s *Stream) consume() (bool, error) {
+	received := false
 	for !stopped(s.done) {
 		b, err := s.reader.readNext()
 		if err != nil {
-			s.messages <- StreamMessage{
-				Data: nil,
-				Err:  err,
+			if stopped(s.done) {
+				return received, nil
 			}
-			s.StopStream()
-			break
+			return received, err
 		}
-		if len(b) == 0 {
+		s.lastReceived = time.Now()
+		if len(b.Bytes()) == 0 {
 			// empty keep-alive
+			b.Release()
 			continue
 		}
+		message := StreamMessage{ReceivedAt: s.lastReceived, ConnectionID: s.connectionID}
+		if event := parseControlEvent(b.Bytes()); event != nil {
+			b.Release()
+			if event.IsDisconnect() {
+				return received, event
+			}
+			message.Err = event
+			if !s.emit(message) {
+				return received, nil
+			}
+			continue
+		}
+
+		received = true
+		id := s.trackedTweetID(b.Bytes())
+		if s.duplicate(id) {
+			b.Release()
+			continue
+		}
+		if id != "" {
+			s.lastTweetID = id
+		}
+
+		if s.spool != nil && s.spills() {
+			err := s.spill(b.Bytes())
+			b.Release()
+			if err != nil && !s.emit(StreamMessage{Data: nil, Err: err}) {
+				return received, nil
+			}
+			continue
+		}
+
+		message.ack = s.checkpointAck(id, message.ReceivedAt, nil)
+		message.forget = s.forgetter(id)
+		if !s.deliver(b, message) {
+			return received, nil
+		}
+	}
+	return received, nil
+}
+
+// deliver decodes raw into message and sends it to the messages channel. deliver takes ownership of raw.
+// It returns false if the stream was stopped.
+func (s *Stream) deliver(raw *PooledBytes, message StreamMessage) bool {
+	if s.pool != nil {
+		return s.pool.submit(raw, message)
+	}
+	return s.send(s.decode(raw, message))
+}
+
+// emit sends a message that does not need decoding, after any message delivered before it.
+func (s *Stream) emit(message StreamMessage) bool {
+	if s.pool != nil {
+		return s.pool.submitMessage(message)
+	}
+	return s.send(message)
+}
 
-		data, err := s.unmarshalHook(b)
+// decode runs the UnmarshalHook on raw and sets the result on message. It releases raw,
+// unless raw itself is handed out as the message.
+func (s *Stream) decode(raw *PooledBytes, message StreamMessage) StreamMessage {
+	if s.includeRaw {
+		message.Raw = append([]byte(nil), raw.Bytes()...)
+	}
 
-		s.messages <- StreamMessage{
-			Data: data,
-			Err:  err,
+	if s.unmarshalHook == nil {
+		if s.pooledBuffers {
+			message.Data = raw
+			return message
 		}
+		message.Data = append([]byte(nil), raw.Bytes()...)
+		raw.Release()
+		return message
+	}
+
+	message.Data, message.Err = s.unmarshal(raw.Bytes())
+	if message.Err != nil && s.deadLetters != nil {
+		s.deadLetter(raw.Bytes(), message)
+	}
+	raw.Release()
+	return message
+}
+
+// setState moves a running stream to state. It returns false if the stream is stopping.
+func (s *Stream) setState(state StreamState) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.state == StateStopping {
+		return false
+	}
+	s.state = state
+	return true
+}
+
+// setBody sets the response body of a new connection. It returns false, and closes body, if the stream is stopping.
+func (s *Stream) setBody(body io.ReadCloser) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.state == StateStopping {
+		body.Close()
+		return false
+	}
+	s.reader.setStreamResponseBody(body)
+	s.body = body
+	s.state = StateStreaming
+	s.connectionID = atomic.AddUint64(&s.counters.connections, 1)
+	s.lastReceived = time.Now()
+	return true
+}
+
+func (s *Stream) closeBody() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.body != nil {
+		s.body.Close()
+		s.body = nil
+	}
+}
+
+// stopLocked moves a running stream to stopping, signals its goroutines to stop and closes its connection.
+// s.mu must be held.
+func (s *Stream) stopLocked() {
+	if s.state == StateStopping || s.state == StateStopped {
+		return
+	}
+	s.state = StateStopping
+	close(s.done)
+	if s.body != nil {
+		s.body.Close()
+	}
+}
+
+// abortStartLocked moves a stream that failed to start back to idle, or to stopped if StopStream was called
+// while it was connecting. s.mu must be held.
+func (s *Stream) abortStartLocked() {
+	if s.state == StateStopping {
+		s.finishLocked(nil)
+	} else {
+		s.state = StateIdle
+	}
+}
+
+// finishLocked moves the stream to stopped and closes its channels. s.mu must be held.
+func (s *Stream) finishLocked(err error) {
+	if s.body != nil {
+		s.body.Close()
+		s.body = nil
+	}
+	if !stopped(s.done) {
+		close(s.done)
+	}
+	if s.messages != nil {
+		close(s.messages)
+	}
+	if s.finished != nil {
+		close(s.finished)
 	}
+	s.err = err
+	s.state = StateStopped
 }
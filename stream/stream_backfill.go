@@ -0,0 +1,76 @@
+package stream
+
+import (
+	"errors"
+	"github.com/fallenstedt/twitter-stream/httpclient"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// maxBackfillMinutes is the most Twitter lets a stream backfill.
+const maxBackfillMinutes = 5
+
+// SetAutoBackfill makes the stream request the tweets it missed while reconnecting. Each reconnect sets
+// backfill_minutes to the time since the last message was received, rounded up and capped at 5 minutes.
+// Backfill is only available to some product tracks. If Twitter rejects the parameter, the stream reconnects
+// without it and stops requesting backfill. Use a deduplicator to suppress tweets that are delivered twice.
+// Call SetAutoBackfill before StartStream.
+func (s *Stream) SetAutoBackfill(enabled bool) {
+	s.autoBackfill = enabled
+	s.backfillRejected = false
+}
+
+// connect opens a new connection with Twitter after a disconnect, requesting backfill if enabled.
+func (s *Stream) connect(queryParams *url.Values) (*http.Response, error) {
+	params := s.backfillParams(queryParams)
+	res, err := s.open(params)
+	if err != nil && params != queryParams && isBackfillRejected(err) {
+		s.backfillRejected = true
+		return s.open(queryParams)
+	}
+	return res, err
+}
+
+// backfillParams returns a copy of queryParams with backfill_minutes covering the time since the last
+// message was received, or queryParams itself if backfill is not requested.
+func (s *Stream) backfillParams(queryParams *url.Values) *url.Values {
+	if !s.autoBackfill || s.backfillRejected || s.lastReceived.IsZero() {
+		return queryParams
+	}
+
+	minutes := int(math.Ceil(time.Since(s.lastReceived).Minutes()))
+	if minutes < 1 {
+		minutes = 1
+	}
+	if minutes > maxBackfillMinutes {
+		minutes = maxBackfillMinutes
+	}
+
+	params := url.Values{}
+	if queryParams != nil {
+		for key, values := range *queryParams {
+			params[key] = append([]string(nil), values...)
+		}
+	}
+	params.Set("backfill_minutes", strconv.Itoa(minutes))
+	return &params
+}
+
+// isBackfillRejected reports whether Twitter refused a connection because of the backfill_minutes parameter,
+// either as an invalid parameter or because the product track does not allow it.
+func isBackfillRejected(err error) bool {
+	var statusErr *httpclient.StatusError
+	if !errors.As(err, &statusErr) {
+		return false
+	}
+	switch statusErr.StatusCode {
+	case http.StatusBadRequest:
+		return statusErr.HasParameter("backfill_minutes")
+	case http.StatusForbidden:
+		return statusErr.Type == httpclient.ProblemClientForbidden
+	}
+	return false
+}
@@ -0,0 +1,96 @@
+package stream
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/fallenstedt/twitter-stream/httpclient"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestBackfillParams(t *testing.T) {
+	var tests = []struct {
+		autoBackfill bool
+		rejected     bool
+		gap          time.Duration
+		result       string
+	}{
+		{true, false, 10 * time.Second, "backfill_minutes=1&expansions=author_id"},
+		{true, false, 2*time.Minute + 10*time.Second, "backfill_minutes=3&expansions=author_id"},
+		{true, false, time.Hour, "backfill_minutes=5&expansions=author_id"},
+		{false, false, time.Minute, "expansions=author_id"},
+		{true, true, time.Minute, "expansions=author_id"},
+	}
+
+	for i, tt := range tests {
+		testName := fmt.Sprintf("TestBackfillParams (%d)", i)
+		t.Run(testName, func(t *testing.T) {
+			queryParams := &url.Values{"expansions": []string{"author_id"}}
+			s := &Stream{autoBackfill: tt.autoBackfill, backfillRejected: tt.rejected, lastReceived: time.Now().Add(-tt.gap)}
+
+			result := s.backfillParams(queryParams).Encode()
+			if result != tt.result {
+				t.Errorf("got %s, want %s", result, tt.result)
+			}
+			if queryParams.Encode() != "expansions=author_id" {
+				t.Errorf("expected the query params to not be modified, got %s", queryParams.Encode())
+			}
+		})
+	}
+}
+
+func TestAutoBackfillFallsBackWhenRejected(t *testing.T) {
+	var tests = []struct {
+		err      error
+		expected string
+	}{
+		{
+			&httpclient.StatusError{StatusCode: http.StatusBadRequest, Type: httpclient.ProblemInvalidRequest, Parameters: []string{"backfill_minutes"}},
+			"[expansions=author_id backfill_minutes=1&expansions=author_id expansions=author_id expansions=author_id]",
+		},
+		{
+			&httpclient.StatusError{StatusCode: http.StatusForbidden, Type: httpclient.ProblemClientForbidden},
+			"[expansions=author_id backfill_minutes=1&expansions=author_id expansions=author_id expansions=author_id]",
+		},
+		// not rejected
+		{
+			&httpclient.StatusError{StatusCode: http.StatusBadRequest, Type: httpclient.ProblemInvalidRequest, Parameters: []string{"expansions"}},
+			"[expansions=author_id backfill_minutes=1&expansions=author_id backfill_minutes=1&expansions=author_id backfill_minutes=1&expansions=author_id]",
+		},
+		{
+			&httpclient.StatusError{StatusCode: http.StatusServiceUnavailable},
+			"[expansions=author_id backfill_minutes=1&expansions=author_id backfill_minutes=1&expansions=author_id backfill_minutes=1&expansions=author_id]",
+		},
+	}
+
+	for i, tt := range tests {
+		testName := fmt.Sprintf("TestAutoBackfillFallsBackWhenRejected (%d)", i)
+		t.Run(testName, func(t *testing.T) {
+			var requests []string
+			client := httpclient.NewHttpClientMock("foobar")
+			client.MockGetSearchStream = func(queryParams *url.Values) (*http.Response, error) {
+				requests = append(requests, queryParams.Encode())
+				if queryParams.Get("backfill_minutes") != "" {
+					return nil, tt.err
+				}
+				return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(bytes.NewReader([]byte("tweet\r\n")))}, nil
+			}
+
+			api := NewStream(client, NewStreamResponseBodyReader())
+			api.SetAutoBackfill(true)
+			api.SetReconnectPolicy(func(attempt int, err error) (time.Duration, bool) {
+				return 0, len(requests) < 4
+			})
+			api.StartStream(&url.Values{"expansions": []string{"author_id"}})
+			for range api.GetMessages() {
+			}
+
+			if result := fmt.Sprint(requests); result != tt.expected {
+				t.Errorf("got %s, want %s", result, tt.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,197 @@
+package stream
+
+import "sync/atomic"
+
+// OverflowPolicy decides what the stream does with a tweet when the messages channel is full.
+type OverflowPolicy int
+
+const (
+	// OverflowBlock waits for the consumer to make room. A slow consumer stalls reading from Twitter,
+	// which may make Twitter disconnect the stream for excessive client-side lag.
+	OverflowBlock OverflowPolicy = iota
+	// OverflowDropNewest discards the tweet that does not fit in the buffer.
+	OverflowDropNewest
+	// OverflowDropOldest discards the oldest buffered tweet to make room for the tweet. Errors and control
+	// events are never discarded. If the buffer only holds errors, the tweet that does not fit is discarded.
+	OverflowDropOldest
+	// OverflowSpill writes the tweets that do not fit in the buffer to the spool set with SetSpool, and delivers
+	// them once the consumer catches up. Tweets stay in order. Without a spool it behaves like OverflowBlock.
+	OverflowSpill
+)
+
+type (
+	// StreamStats are counters describing how messages flowed through the messages channel.
+	StreamStats struct {
+		// Delivered is the number of messages sent to the messages channel, less the tweets OverflowDropOldest
+		// discarded from the buffer.
+		Delivered uint64
+		// Dropped is the number of messages discarded by the overflow policy.
+		Dropped uint64
+		// Spilled is the number of tweets OverflowSpill wrote to the spool because the buffer was full.
+		Spilled uint64
+		// HighWaterMark is the largest number of messages that have been waiting in the buffer at once.
+		HighWaterMark uint64
+		// Buffered is the number of messages currently waiting in the buffer.
+		Buffered int
+		// BufferSize is the capacity of the messages channel.
+		BufferSize int
+		// DeadLettered is the number of payloads written to the dead letter sink.
+		DeadLettered uint64
+		// DeadLetterErrors is the number of payloads the dead letter sink failed to write.
+		DeadLetterErrors uint64
+		// Suppressed is the number of duplicate tweets discarded by the deduplicator.
+		Suppressed uint64
+		// CheckpointErrors is the number of times the checkpoint store failed to save the checkpoint.
+		CheckpointErrors uint64
+	}
+
+	// streamCounters are updated atomically by the stream goroutine.
+	streamCounters struct {
+		delivered        uint64
+		dropped          uint64
+		highWaterMark    uint64
+		seq              uint64
+		connections      uint64
+		deadLettered     uint64
+		deadLetterErrors uint64
+		suppressed       uint64
+		checkpointErrors uint64
+		spilled          uint64
+		// unspilled is the number of spilled tweets that have not been delivered yet.
+		unspilled uint64
+	}
+)
+
+// SetBuffer sets the capacity of the messages channel and the policy used when it is full.
+// It takes effect the next time the stream is started, so call it before GetMessages and StartStream.
+// By default the messages channel is unbuffered and the policy is OverflowBlock.
+// OverflowDropOldest behaves like OverflowDropNewest on an unbuffered channel.
+// Errors and control events are always sent as if the policy was OverflowBlock.
+// Tweets discarded by the overflow policy are released and acknowledged.
+func (s *Stream) SetBuffer(size int, policy OverflowPolicy) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.bufferSize = size
+	s.overflowPolicy = policy
+	if s.state == StateIdle {
+		s.messages = make(chan StreamMessage, size)
+	}
+}
+
+// Stats returns counters for messages sent through the messages channel since the stream was created.
+func (s *Stream) Stats() StreamStats {
+	messages := s.GetMessages()
+	return StreamStats{
+		Delivered:        atomic.LoadUint64(&s.counters.delivered),
+		Dropped:          atomic.LoadUint64(&s.counters.dropped),
+		Spilled:          atomic.LoadUint64(&s.counters.spilled),
+		HighWaterMark:    atomic.LoadUint64(&s.counters.highWaterMark),
+		Buffered:         len(messages),
+		BufferSize:       cap(messages),
+		DeadLettered:     atomic.LoadUint64(&s.counters.deadLettered),
+		DeadLetterErrors: atomic.LoadUint64(&s.counters.deadLetterErrors),
+		Suppressed:       atomic.LoadUint64(&s.counters.suppressed),
+		CheckpointErrors: atomic.LoadUint64(&s.counters.checkpointErrors),
+	}
+}
+
+// send delivers a message to the messages channel following the overflow policy. It returns false if the stream
+// was stopped before the message could be delivered. A message dropped by the overflow policy still returns true.
+// Senders are serialized, so dropOldest can put messages back without another sender taking their room.
+func (s *Stream) send(message StreamMessage) bool {
+	s.sendMu.Lock()
+	defer s.sendMu.Unlock()
+	message.Seq = atomic.AddUint64(&s.counters.seq, 1)
+
+	if message.Err != nil || s.overflowPolicy == OverflowBlock || s.overflowPolicy == OverflowSpill {
+		select {
+		case s.messages <- message:
+			s.delivered()
+			return true
+		case <-s.done:
+			message.undelivered()
+			return false
+		}
+	}
+
+	for {
+		select {
+		case s.messages <- message:
+			s.delivered()
+			return true
+		case <-s.done:
+			message.undelivered()
+			return false
+		default:
+		}
+
+		if s.overflowPolicy == OverflowDropNewest || cap(s.messages) == 0 || !s.dropOldest() {
+			s.discard(message)
+			return true
+		}
+	}
+}
+
+// dropOldest discards the oldest tweet in the buffer. Errors and control events taken from the buffer on the way
+// are put back in order, with the messages behind them. The consumer may have emptied the buffer in the meantime,
+// in which case nothing is discarded. It returns false if the buffer only holds errors. s.sendMu must be held,
+// so there is room to put the messages back.
+func (s *Stream) dropOldest() bool {
+	var kept []StreamMessage
+	dropped := false
+drain:
+	for {
+		select {
+		case message := <-s.messages:
+			if !dropped && message.Err == nil {
+				s.discard(message)
+				atomic.AddUint64(&s.counters.delivered, ^uint64(0))
+				dropped = true
+				if len(kept) == 0 {
+					return true
+				}
+				continue
+			}
+			kept = append(kept, message)
+		default:
+			break drain
+		}
+	}
+
+	for _, message := range kept {
+		select {
+		case s.messages <- message:
+		case <-s.done:
+			return true
+		}
+	}
+	return dropped || len(kept) == 0
+}
+
+// discard drops a message for the overflow policy. Its pooled buffer is released and it is acknowledged,
+// so a spool or checkpoint does not wait for it.
+func (s *Stream) discard(message StreamMessage) {
+	atomic.AddUint64(&s.counters.dropped, 1)
+	message.undelivered()
+	message.Release()
+	message.Ack()
+}
+
+// undelivered makes the deduplicator forget a tweet that is not sent to the messages channel.
+func (m StreamMessage) undelivered() {
+	if m.forget != nil {
+		m.forget()
+	}
+}
+
+func (s *Stream) delivered() {
+	atomic.AddUint64(&s.counters.delivered, 1)
+
+	buffered := uint64(len(s.messages))
+	for {
+		highWaterMark := atomic.LoadUint64(&s.counters.highWaterMark)
+		if buffered <= highWaterMark || atomic.CompareAndSwapUint64(&s.counters.highWaterMark, highWaterMark, buffered) {
+			return
+		}
+	}
+}
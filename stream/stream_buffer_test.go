@@ -0,0 +1,150 @@
+package stream
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/fallenstedt/twitter-stream/httpclient"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSetBufferOverflowPolicy(t *testing.T) {
+	var tests = []struct {
+		policy            OverflowPolicy
+		body              string
+		expectedData      []string
+		expectedDelivered uint64
+	}{
+		{OverflowDropNewest, "1\r\n2\r\n3\r\n4\r\n5\r\n", []string{"1", "2"}, 3},
+		{OverflowDropOldest, "1\r\n2\r\n3\r\n4\r\n5\r\n", []string{"4", "5"}, 3},
+		// errors are kept in order while older tweets are dropped
+		{OverflowDropOldest, "1\r\n{\"errors\":[{\"title\":\"Not Found Error\"}]}\r\n2\r\n3\r\n4\r\n", []string{"error", "4"}, 3},
+	}
+
+	for i, tt := range tests {
+		testName := fmt.Sprintf("TestSetBufferOverflowPolicy (%d)", i)
+
+		t.Run(testName, func(t *testing.T) {
+			client := httpclient.NewHttpClientMock("foobar")
+			client.MockGetSearchStream = func(queryParams *url.Values) (*http.Response, error) {
+				return &http.Response{
+					StatusCode: http.StatusOK,
+					Body:       ioutil.NopCloser(bytes.NewReader([]byte(tt.body))),
+				}, nil
+			}
+			// Copy each message so the reader's buffer can be reused while messages wait in the channel.
+			instance := NewStream(client, NewStreamResponseBodyReader())
+			instance.SetUnmarshalHook(func(b []byte) (interface{}, error) {
+				return string(b), nil
+			})
+			instance.SetBuffer(2, tt.policy)
+
+			if err := instance.StartStream(nil); err != nil {
+				t.Fatalf("got err when starting stream %v", err)
+			}
+
+			// The EOF error is never dropped, so the stream stops once every tweet has been read
+			// and the error is waiting to be delivered.
+			for instance.Stats().Dropped < 3 {
+				time.Sleep(time.Millisecond)
+			}
+
+			var data []string
+			for message := range instance.GetMessages() {
+				var event *ControlEvent
+				if errors.As(message.Err, &event) {
+					data = append(data, "error")
+					continue
+				}
+				if message.Err != nil {
+					if message.Err != io.EOF {
+						t.Errorf("expected io.EOF, got %v", message.Err)
+					}
+					continue
+				}
+				data = append(data, message.Data.(string))
+			}
+
+			if fmt.Sprint(data) != fmt.Sprint(tt.expectedData) {
+				t.Errorf("got %v, want %v", data, tt.expectedData)
+			}
+
+			stats := instance.Stats()
+			if stats.Dropped != 3 {
+				t.Errorf("got %d dropped, want 3", stats.Dropped)
+			}
+			if stats.HighWaterMark != 2 {
+				t.Errorf("got high water mark %d, want 2", stats.HighWaterMark)
+			}
+			if stats.Delivered != tt.expectedDelivered {
+				t.Errorf("got %d delivered, want %d", stats.Delivered, tt.expectedDelivered)
+			}
+		})
+	}
+}
+
+func TestDropOldestReleasesAndAcknowledges(t *testing.T) {
+	instance := NewStream(httpclient.NewHttpClientMock("foobar"), NewStreamResponseBodyReader())
+	instance.SetBuffer(1, OverflowDropOldest)
+	instance.done = make(chan struct{})
+
+	acked := 0
+	instance.send(StreamMessage{Data: getPooledBytes(), ack: func() { acked++ }})
+	instance.send(StreamMessage{Data: getPooledBytes()})
+
+	if acked != 1 {
+		t.Errorf("expected the dropped tweet to be acknowledged, got %d", acked)
+	}
+	if stats := instance.Stats(); stats.Dropped != 1 || stats.Delivered != 1 || stats.Buffered != 1 {
+		t.Errorf("got %+v", stats)
+	}
+}
+
+func TestDropOldestWithConcurrentSenders(t *testing.T) {
+	instance := NewStream(httpclient.NewHttpClientMock("foobar"), NewStreamResponseBodyReader())
+	instance.SetBuffer(4, OverflowDropOldest)
+	instance.done = make(chan struct{})
+
+	var senders sync.WaitGroup
+	for sender := 0; sender < 4; sender++ {
+		senders.Add(1)
+		go func(sender int) {
+			defer senders.Done()
+			for i := 0; i < 200; i++ {
+				message := StreamMessage{Data: [2]int{sender, i}}
+				if i%50 == 0 {
+					message.Err = errors.New("rule error")
+				}
+				instance.send(message)
+			}
+		}(sender)
+	}
+	sent := make(chan struct{})
+	go func() {
+		senders.Wait()
+		close(sent)
+	}()
+
+	last := map[int]int{}
+	for {
+		select {
+		case message := <-instance.GetMessages():
+			data := message.Data.([2]int)
+			if i, ok := last[data[0]]; ok && data[1] <= i {
+				t.Fatalf("got message %d of sender %d after message %d", data[1], data[0], i)
+			}
+			last[data[0]] = data[1]
+			time.Sleep(50 * time.Microsecond)
+		case <-sent:
+			return
+		case <-time.After(time.Second):
+			t.Fatal("expected senders not to block")
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package stream
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type (
+	// Checkpoint is the newest tweet the consumer has acknowledged.
+	Checkpoint struct {
+		TweetID    string    `json:"tweet_id"`
+		ReceivedAt time.Time `json:"received_at"`
+	}
+
+	// CheckpointStore persists the checkpoint of a stream so it survives process restarts.
+	// Implementations are found in the checkpoint package.
+	CheckpointStore interface {
+		// Load returns the saved checkpoint, or a zero Checkpoint if none was saved.
+		Load() (Checkpoint, error)
+		Save(checkpoint Checkpoint) error
+	}
+
+	// checkpointer keeps the newest acknowledged checkpoint and saves it to the store.
+	checkpointer struct {
+		mu       sync.Mutex
+		store    CheckpointStore
+		interval time.Duration
+		latest   Checkpoint
+		dirty    bool
+		// running is the number of streams saving the checkpoint every interval.
+		running int
+	}
+)
+
+// SetCheckpointStore records the newest tweet acknowledged with StreamMessage.Ack in store, and uses it when
+// the stream is started to find out how long the process was down. The downtime is then recovered like a
+// disconnect, with backfill if SetAutoBackfill is enabled and with the GapFiller if one is set.
+// The checkpoint is saved at most once per interval and when the stream stops, or on every Ack if interval is 0.
+// Save errors are counted in StreamStats. Call SetCheckpointStore before StartStream.
+func (s *Stream) SetCheckpointStore(store CheckpointStore, interval time.Duration) {
+	s.checkpoints = &checkpointer{store: store, interval: interval}
+}
+
+// loadCheckpoint makes the saved checkpoint the last received tweet, so the time since is treated as an outage.
+func (s *Stream) loadCheckpoint() error {
+	if s.checkpoints == nil {
+		return nil
+	}
+	checkpoint, err := s.checkpoints.store.Load()
+	if err != nil {
+		return err
+	}
+
+	s.checkpoints.mu.Lock()
+	if newerTweet(checkpoint.TweetID, s.checkpoints.latest.TweetID) {
+		s.checkpoints.latest = checkpoint
+	}
+	s.checkpoints.mu.Unlock()
+
+	s.lastReceived, s.lastTweetID = checkpoint.ReceivedAt, checkpoint.TweetID
+	return nil
+}
+
+// checkpointAck returns the function that acknowledges the tweet with id, followed by ack.
+func (s *Stream) checkpointAck(id string, receivedAt time.Time, ack func()) func() {
+	if s.checkpoints == nil || id == "" {
+		return ack
+	}
+	return func() {
+		if ack != nil {
+			ack()
+		}
+		s.acknowledge(Checkpoint{TweetID: id, ReceivedAt: receivedAt})
+	}
+}
+
+// acknowledge advances the checkpoint to checkpoint if it is newer. Tweets acknowledged out of order,
+// or recovered after newer tweets, never move it back.
+func (s *Stream) acknowledge(checkpoint Checkpoint) {
+	c := s.checkpoints
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !newerTweet(checkpoint.TweetID, c.latest.TweetID) {
+		return
+	}
+	if checkpoint.ReceivedAt.Before(c.latest.ReceivedAt) {
+		checkpoint.ReceivedAt = c.latest.ReceivedAt
+	}
+	c.latest = checkpoint
+	c.dirty = true
+	if c.interval <= 0 || c.running == 0 {
+		s.saveCheckpointLocked()
+	}
+}
+
+// startCheckpoints saves the checkpoint in the background until stop is closed. finished is closed after the last save.
+func (s *Stream) startCheckpoints() (stop, finished chan struct{}) {
+	c := s.checkpoints
+	c.mu.Lock()
+	c.running++
+	c.mu.Unlock()
+
+	stop, finished = make(chan struct{}), make(chan struct{})
+	go s.saveCheckpoints(stop, finished)
+	return stop, finished
+}
+
+// saveCheckpoints saves the checkpoint every interval until stop is closed, then saves it one last time.
+// Tweets acknowledged after that are saved right away.
+func (s *Stream) saveCheckpoints(stop, finished chan struct{}) {
+	defer close(finished)
+	c := s.checkpoints
+
+	if c.interval > 0 {
+		ticker := time.NewTicker(c.interval)
+		defer ticker.Stop()
+
+	loop:
+		for {
+			select {
+			case <-ticker.C:
+				c.mu.Lock()
+				s.saveCheckpointLocked()
+				c.mu.Unlock()
+			case <-stop:
+				break loop
+			}
+		}
+	} else {
+		<-stop
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.running--
+	s.saveCheckpointLocked()
+}
+
+func (s *Stream) saveCheckpointLocked() {
+	c := s.checkpoints
+	if !c.dirty {
+		return
+	}
+	if err := s.protect(func() error { return c.store.Save(c.latest) }); err != nil {
+		atomic.AddUint64(&s.counters.checkpointErrors, 1)
+		return
+	}
+	c.dirty = false
+}
+
+// newerTweet reports whether tweet id a was created after b. Tweet ids grow over time, so longer ids are newer.
+func newerTweet(a, b string) bool {
+	if len(a) != len(b) {
+		return len(a) > len(b)
+	}
+	return a > b
+}
@@ -0,0 +1,146 @@
+package stream
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/fallenstedt/twitter-stream/httpclient"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakeCheckpointStore struct {
+	mu    sync.Mutex
+	saved []Checkpoint
+}
+
+func (f *fakeCheckpointStore) Load() (Checkpoint, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.saved) == 0 {
+		return Checkpoint{}, nil
+	}
+	return f.saved[len(f.saved)-1], nil
+}
+
+func (f *fakeCheckpointStore) Save(checkpoint Checkpoint) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.saved = append(f.saved, checkpoint)
+	return nil
+}
+
+func (f *fakeCheckpointStore) ids() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var ids []string
+	for _, checkpoint := range f.saved {
+		ids = append(ids, checkpoint.TweetID)
+	}
+	return ids
+}
+
+func TestNewerTweet(t *testing.T) {
+	var tests = []struct {
+		a, b   string
+		result bool
+	}{
+		{"2", "1", true},
+		{"1", "2", false},
+		{"10", "9", true},
+		{"9", "10", false},
+		{"1", "", true},
+		{"1", "1", false},
+	}
+
+	for i, tt := range tests {
+		testName := fmt.Sprintf("TestNewerTweet (%d)", i)
+		t.Run(testName, func(t *testing.T) {
+			if result := newerTweet(tt.a, tt.b); result != tt.result {
+				t.Errorf("got %v, want %v", result, tt.result)
+			}
+		})
+	}
+}
+
+func TestCheckpointAck(t *testing.T) {
+	var tests = []struct {
+		interval time.Duration
+		ackOrder []int
+		result   string
+	}{
+		// every ack is saved, but an older ack does not move the checkpoint back
+		{0, []int{0, 2, 1}, "[1 3]"},
+		// acks are only saved when the stream stops
+		{time.Hour, []int{0, 2, 1}, "[3]"},
+	}
+
+	for i, tt := range tests {
+		testName := fmt.Sprintf("TestCheckpointAck (%d)", i)
+		t.Run(testName, func(t *testing.T) {
+			client := httpclient.NewHttpClientMock("foobar")
+			client.MockGetSearchStream = func(queryParams *url.Values) (*http.Response, error) {
+				body := `{"data":{"id":"1"}}` + "\r\n" + `{"data":{"id":"2"}}` + "\r\n" + `{"data":{"id":"3"}}` + "\r\n"
+				return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(bytes.NewReader([]byte(body)))}, nil
+			}
+
+			store := &fakeCheckpointStore{}
+			api := NewStream(client, NewStreamResponseBodyReader())
+			api.SetCheckpointStore(store, tt.interval)
+			api.StartStream(nil)
+
+			var messages []StreamMessage
+			for message := range api.GetMessages() {
+				if message.Err == nil {
+					messages = append(messages, message)
+				}
+				if len(messages) == 3 {
+					for _, i := range tt.ackOrder {
+						messages[i].Ack()
+					}
+					api.StopStream()
+				}
+			}
+
+			result := fmt.Sprint(store.ids())
+			if result != tt.result {
+				t.Errorf("got %s, want %s", result, tt.result)
+			}
+		})
+	}
+}
+
+func TestCheckpointRecoversDowntime(t *testing.T) {
+	var requests []string
+	client := httpclient.NewHttpClientMock("foobar")
+	client.MockGetSearchStream = func(queryParams *url.Values) (*http.Response, error) {
+		requests = append(requests, queryParams.Encode())
+		return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(bytes.NewReader([]byte(`{"data":{"id":"9"}}` + "\r\n")))}, nil
+	}
+
+	stoppedAt := time.Now().Add(-time.Hour)
+	store := &fakeCheckpointStore{saved: []Checkpoint{{TweetID: "8", ReceivedAt: stoppedAt}}}
+	filler := &fakeGapFiller{gaps: make(chan Gap, 1)}
+
+	api := NewStream(client, NewStreamResponseBodyReader())
+	api.SetAutoBackfill(true)
+	api.SetGapFiller(filler)
+	api.SetCheckpointStore(store, 0)
+	api.StartStream(&url.Values{"expansions": []string{"author_id"}})
+	for range api.GetMessages() {
+	}
+
+	result := fmt.Sprint(requests)
+	expected := "[backfill_minutes=5&expansions=author_id]"
+	if result != expected {
+		t.Errorf("got %s, want %s", result, expected)
+	}
+
+	gap := <-filler.gaps
+	if gap.SinceID != "8" || !gap.Start.Equal(stoppedAt) {
+		t.Errorf("expected the gap to start at the checkpoint, got %+v", gap)
+	}
+}
@@ -0,0 +1,24 @@
+package stream
+
+import (
+	"github.com/fallenstedt/twitter-stream/httpclient"
+)
+
+// NewTweetComplianceStream creates a stream of compliance events for tweets, such as deletes and withheld tweets,
+// from GET /2/tweets/compliance/stream. Choose a partition from 1 to 4 with `AddPartition` on the StreamQueryParamsBuilder.
+// The compliance package unmarshals the events into typed structs.
+// Read more at https://developer.twitter.com/en/docs/twitter-api/compliance/streams/api-reference/get-tweets-compliance-stream.
+func NewTweetComplianceStream(httpClient httpclient.IHttpClient, reader IStreamResponseBodyReader) *Stream {
+	s := NewStream(httpClient, reader)
+	s.endpoint = httpClient.GetTweetComplianceStream
+	return s
+}
+
+// NewUserComplianceStream creates a stream of compliance events for users, such as suspensions and deleted accounts,
+// from GET /2/users/compliance/stream. Choose a partition from 1 to 4 with `AddPartition` on the StreamQueryParamsBuilder.
+// Read more at https://developer.twitter.com/en/docs/twitter-api/compliance/streams/api-reference/get-users-compliance-stream.
+func NewUserComplianceStream(httpClient httpclient.IHttpClient, reader IStreamResponseBodyReader) *Stream {
+	s := NewStream(httpClient, reader)
+	s.endpoint = httpClient.GetUserComplianceStream
+	return s
+}
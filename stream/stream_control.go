@@ -0,0 +1,155 @@
+package stream
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/fallenstedt/twitter-stream/httpclient"
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+// ControlKind describes what kind of in-band message Twitter sent on the stream.
+type ControlKind int
+
+const (
+	// ControlError is an in-band error that does not end the connection, such as a rule-level error.
+	ControlError ControlKind = iota
+	// ControlDisconnect means Twitter is closing the connection, such as an operational disconnect.
+	ControlDisconnect
+	// ControlConnectionIssue means Twitter refused the connection, such as exceeding the connection limit.
+	ControlConnectionIssue
+)
+
+type (
+	// TwitterError is a single problem object that Twitter sends in the "errors" array of a stream payload.
+	// Read more at https://developer.twitter.com/en/support/twitter-api/error-troubleshooting.
+	TwitterError struct {
+		Title           string `json:"title"`
+		Detail          string `json:"detail"`
+		Type            string `json:"type"`
+		DisconnectType  string `json:"disconnect_type,omitempty"`
+		ConnectionIssue string `json:"connection_issue,omitempty"`
+		Value           string `json:"value,omitempty"`
+		Section         string `json:"section,omitempty"`
+		Parameter       string `json:"parameter,omitempty"`
+	}
+
+	// ControlEvent is sent as the Err of a StreamMessage when Twitter delivers a payload
+	// that only contains errors instead of a tweet. The stream does not pass these payloads to the UnmarshalHook.
+	ControlEvent struct {
+		Kind   ControlKind
+		Title  string
+		Detail string
+		// Reason is the disconnect type or connection issue reported by Twitter, if any.
+		Reason string
+		Errors []TwitterError
+	}
+
+	// ReconnectPolicy decides if the stream should reconnect after it ended with err.
+	// attempt starts at 1 and is reset once a reconnected stream delivers a message.
+	// Return false to stop the stream.
+	ReconnectPolicy func(attempt int, err error) (time.Duration, bool)
+
+	controlEnvelope struct {
+		Data   json.RawMessage `json:"data"`
+		Errors []TwitterError  `json:"errors"`
+	}
+)
+
+var errorsKey = []byte(`"errors"`)
+
+// Error implements the error interface.
+func (c *ControlEvent) Error() string {
+	if c.Reason != "" {
+		return fmt.Sprintf("twitter stream %s (%s): %s", c.Title, c.Reason, c.Detail)
+	}
+	return fmt.Sprintf("twitter stream %s: %s", c.Title, c.Detail)
+}
+
+// IsDisconnect returns true if Twitter has ended, or refused, the connection.
+func (c *ControlEvent) IsDisconnect() bool {
+	return c.Kind == ControlDisconnect || c.Kind == ControlConnectionIssue
+}
+
+// parseControlEvent returns a ControlEvent if b is a payload that only contains errors, otherwise nil.
+func parseControlEvent(b []byte) *ControlEvent {
+	// Avoid decoding every tweet twice, only payloads mentioning errors can be control events.
+	if !bytes.Contains(b, errorsKey) {
+		return nil
+	}
+
+	envelope := controlEnvelope{}
+	if err := json.Unmarshal(b, &envelope); err != nil {
+		return nil
+	}
+	if len(envelope.Data) > 0 || len(envelope.Errors) == 0 {
+		return nil
+	}
+
+	first := envelope.Errors[0]
+	event := &ControlEvent{
+		Kind:   ControlError,
+		Title:  first.Title,
+		Detail: first.Detail,
+		Errors: envelope.Errors,
+	}
+
+	for _, e := range envelope.Errors {
+		switch {
+		case e.ConnectionIssue != "" || e.Title == "ConnectionException":
+			event.Kind = ControlConnectionIssue
+			event.Reason = e.ConnectionIssue
+		case e.DisconnectType != "" || e.Title == "operational-disconnect":
+			if event.Kind != ControlConnectionIssue {
+				event.Kind = ControlDisconnect
+				event.Reason = e.DisconnectType
+			}
+		default:
+			continue
+		}
+		event.Title = e.Title
+		event.Detail = e.Detail
+	}
+
+	return event
+}
+
+// DefaultReconnectPolicy reconnects following Twitter's guidance on handling disconnections.
+// Network errors and disconnects back off linearly by 250ms up to 16 seconds,
+// connection issues and rate limited connects (420 and 429) back off exponentially from 1 minute up to 16 minutes,
+// and any other error backs off exponentially from 5 seconds up to 320 seconds.
+// https://developer.twitter.com/en/docs/twitter-api/tweets/filtered-stream/integrate/handling-disconnections
+func DefaultReconnectPolicy(attempt int, err error) (time.Duration, bool) {
+	var event *ControlEvent
+	var statusErr *httpclient.StatusError
+	if errors.As(err, &event) && event.Kind == ControlConnectionIssue ||
+		errors.As(err, &statusErr) && (statusErr.StatusCode == 420 || statusErr.StatusCode == http.StatusTooManyRequests) {
+		return exponentialBackoff(time.Minute, attempt, 16*time.Minute), true
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) || errors.As(err, &event) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		delay := time.Duration(attempt) * 250 * time.Millisecond
+		if delay > 16*time.Second {
+			delay = 16 * time.Second
+		}
+		return delay, true
+	}
+
+	return exponentialBackoff(5*time.Second, attempt, 320*time.Second), true
+}
+
+func exponentialBackoff(base time.Duration, attempt int, ceiling time.Duration) time.Duration {
+	delay := base
+	for i := 1; i < attempt; i++ {
+		delay *= 2
+		if delay >= ceiling {
+			return ceiling
+		}
+	}
+	return delay
+}
@@ -0,0 +1,148 @@
+package stream
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/fallenstedt/twitter-stream/httpclient"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestParseControlEvent(t *testing.T) {
+	var tests = []struct {
+		payload string
+		isNil   bool
+		kind    ControlKind
+		reason  string
+	}{
+		{`{"data":{"id":"1","text":"hello"},"matching_rules":[{"id":"2","tag":"cats"}]}`, true, ControlError, ""},
+		{`{"data":{"id":"1","text":"hello"},"errors":[{"title":"Not Found Error"}]}`, true, ControlError, ""},
+		{`{"errors":[{"title":"operational-disconnect","disconnect_type":"UpstreamOperationalDisconnect","detail":"This stream has been disconnected upstream for operational reasons.","type":"https://api.twitter.com/2/problems/operational-disconnect"}]}`, false, ControlDisconnect, "UpstreamOperationalDisconnect"},
+		{`{"errors":[{"title":"ConnectionException","connection_issue":"TooManyConnections","detail":"This stream is currently at the maximum allowed connection limit.","type":"https://api.twitter.com/2/problems/streaming-connection"}]}`, false, ControlConnectionIssue, "TooManyConnections"},
+		{`{"errors":[{"title":"Invalid Request","detail":"One or more parameters to your request was invalid.","type":"https://api.twitter.com/2/problems/invalid-request"}]}`, false, ControlError, ""},
+	}
+
+	for i, tt := range tests {
+		testName := fmt.Sprintf("TestParseControlEvent (%d)", i)
+
+		t.Run(testName, func(t *testing.T) {
+			result := parseControlEvent([]byte(tt.payload))
+
+			if tt.isNil {
+				if result != nil {
+					t.Errorf("expected nil, got %v", result)
+				}
+				return
+			}
+
+			if result == nil {
+				t.Fatalf("expected a control event, got nil")
+			}
+			if result.Kind != tt.kind {
+				t.Errorf("got kind %v, want %v", result.Kind, tt.kind)
+			}
+			if result.Reason != tt.reason {
+				t.Errorf("got reason %s, want %s", result.Reason, tt.reason)
+			}
+		})
+	}
+}
+
+func TestDefaultReconnectPolicy(t *testing.T) {
+	var tests = []struct {
+		attempt int
+		err     error
+		result  time.Duration
+	}{
+		{1, io.EOF, 250 * time.Millisecond},
+		{100, io.EOF, 16 * time.Second},
+		{2, &ControlEvent{Kind: ControlDisconnect}, 500 * time.Millisecond},
+		{2, &ControlEvent{Kind: ControlConnectionIssue}, 2 * time.Minute},
+		{1, errors.New("Network request failed: 503"), 5 * time.Second},
+		{3, errors.New("Network request failed: 503"), 20 * time.Second},
+		{100, errors.New("Network request failed: 503"), 320 * time.Second},
+		{1, &httpclient.StatusError{StatusCode: 429}, time.Minute},
+		{2, fmt.Errorf("connect: %w", &httpclient.StatusError{StatusCode: 420}), 2 * time.Minute},
+		{1, &httpclient.StatusError{StatusCode: 503}, 5 * time.Second},
+	}
+
+	for i, tt := range tests {
+		testName := fmt.Sprintf("TestDefaultReconnectPolicy (%d)", i)
+
+		t.Run(testName, func(t *testing.T) {
+			result, ok := DefaultReconnectPolicy(tt.attempt, tt.err)
+			if !ok {
+				t.Errorf("expected policy to reconnect")
+			}
+			if result != tt.result {
+				t.Errorf("got %v, want %v", result, tt.result)
+			}
+		})
+	}
+}
+
+func TestStreamDeliversControlEventsAndReconnects(t *testing.T) {
+	connections := 0
+	client := httpclient.NewHttpClientMock("foobar")
+	client.MockGetSearchStream = func(queryParams *url.Values) (*http.Response, error) {
+		connections++
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Body:       ioutil.NopCloser(bytes.NewReader(nil)),
+		}, nil
+	}
+
+	payloads := [][]byte{
+		[]byte(`{"errors":[{"title":"operational-disconnect","disconnect_type":"UpstreamOperationalDisconnect","detail":"bye"}]}`),
+		[]byte(`{"data":{"id":"1"}}`),
+	}
+	reader := mockStreamResponseBodyReader{}
+	reader.MockSetStreamResponseBody = func(body io.Reader) {}
+	reader.MockReadNext = func() ([]byte, error) {
+		if len(payloads) == 0 {
+			return nil, io.EOF
+		}
+		b := payloads[0]
+		payloads = payloads[1:]
+		return b, nil
+	}
+
+	instance := NewStream(client, reader)
+	instance.SetReconnectPolicy(func(attempt int, err error) (time.Duration, bool) {
+		return 0, connections < 2
+	})
+
+	err := instance.StartStream(nil)
+	if err != nil {
+		t.Fatalf("got err when starting stream %v", err)
+	}
+
+	messages := instance.GetMessages()
+
+	first := <-messages
+	var event *ControlEvent
+	if !errors.As(first.Err, &event) || !event.IsDisconnect() {
+		t.Fatalf("expected a disconnect control event, got %v", first.Err)
+	}
+
+	second := <-messages
+	if string(second.Data.([]byte)) != `{"data":{"id":"1"}}` {
+		t.Errorf("expected tweet after reconnecting, got %v", second)
+	}
+
+	third := <-messages
+	if third.Err != io.EOF {
+		t.Errorf("expected io.EOF, got %v", third.Err)
+	}
+
+	for range messages {
+	}
+	if connections != 2 {
+		t.Errorf("expected 2 connections, got %d", connections)
+	}
+}
@@ -0,0 +1,45 @@
+package stream
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+type (
+	// DeadLetter is a payload the UnmarshalHook returned an error for, or panicked on.
+	DeadLetter struct {
+		Raw          []byte
+		Err          error
+		ReceivedAt   time.Time
+		ConnectionID uint64
+	}
+
+	// DeadLetterSink stores payloads that could not be decoded. Write is called from the goroutines that run
+	// the UnmarshalHook, so it must be safe for concurrent use when SetDecodeWorkers or SetGapFiller is used.
+	// Write owns letter and may keep it.
+	DeadLetterSink interface {
+		Write(letter DeadLetter) error
+	}
+)
+
+// SetDeadLetterSink sets a sink that receives every payload the UnmarshalHook returned an error for,
+// or panicked on. The message is still sent to the messages channel with the error. Sink errors are
+// counted in StreamStats. Call SetDeadLetterSink before StartStream.
+func (s *Stream) SetDeadLetterSink(sink DeadLetterSink) {
+	s.deadLetters = sink
+}
+
+// deadLetter writes raw and the error of message to the dead letter sink. raw is copied.
+func (s *Stream) deadLetter(raw []byte, message StreamMessage) {
+	letter := DeadLetter{
+		Raw:          append([]byte(nil), raw...),
+		Err:          message.Err,
+		ReceivedAt:   message.ReceivedAt,
+		ConnectionID: message.ConnectionID,
+	}
+	if err := s.protect(func() error { return s.deadLetters.Write(letter) }); err != nil {
+		atomic.AddUint64(&s.counters.deadLetterErrors, 1)
+		return
+	}
+	atomic.AddUint64(&s.counters.deadLettered, 1)
+}
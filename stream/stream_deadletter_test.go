@@ -0,0 +1,80 @@
+package stream
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+type fakeDeadLetterSink struct {
+	mu      sync.Mutex
+	letters []DeadLetter
+	err     error
+}
+
+func (f *fakeDeadLetterSink) Write(letter DeadLetter) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.err != nil {
+		return f.err
+	}
+	f.letters = append(f.letters, letter)
+	return nil
+}
+
+func TestDeadLetterSink(t *testing.T) {
+	var tests = []struct {
+		sinkErr error
+		letters string
+		stats   string
+	}{
+		{nil, "[bad tweet: cannot decode panicking tweet: panic: boom]", "2/0"},
+		{errors.New("disk full"), "[]", "0/2"},
+	}
+
+	for i, tt := range tests {
+		testName := fmt.Sprintf("TestDeadLetterSink (%d)", i)
+		t.Run(testName, func(t *testing.T) {
+			sink := &fakeDeadLetterSink{err: tt.sinkErr}
+			api := givenStreamWithBody([]byte("tweet 0\r\nbad tweet\r\npanicking tweet\r\n"))
+			api.SetDeadLetterSink(sink)
+			api.SetUnmarshalHook(func(b []byte) (interface{}, error) {
+				switch string(b) {
+				case "bad tweet":
+					return nil, errors.New("cannot decode")
+				case "panicking tweet":
+					panic("boom")
+				}
+				return string(b), nil
+			})
+			api.StartStream(nil)
+
+			errs := 0
+			for message := range api.GetMessages() {
+				if message.Err != nil {
+					errs++
+				}
+			}
+			if errs != 3 {
+				t.Errorf("expected the undecodable tweets and EOF to still be sent, got %d errors", errs)
+			}
+
+			var letters []string
+			for _, letter := range sink.letters {
+				if letter.ReceivedAt.IsZero() || letter.ConnectionID != 1 {
+					t.Errorf("expected receive metadata on %+v", letter)
+				}
+				letters = append(letters, fmt.Sprintf("%s: %v", letter.Raw, letter.Err))
+			}
+			if fmt.Sprint(letters) != tt.letters {
+				t.Errorf("got letters %v, want %v", letters, tt.letters)
+			}
+
+			stats := api.Stats()
+			if fmt.Sprintf("%d/%d", stats.DeadLettered, stats.DeadLetterErrors) != tt.stats {
+				t.Errorf("got stats %+v", stats)
+			}
+		})
+	}
+}
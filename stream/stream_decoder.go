@@ -0,0 +1,96 @@
+package stream
+
+type (
+	// decodePool runs the UnmarshalHook on several goroutines and delivers the results in the order they were submitted.
+	decodePool struct {
+		stream   *Stream
+		jobs     chan *decodeJob
+		pending  chan *decodeJob
+		finished chan struct{}
+	}
+
+	// decodeJob is a single message waiting to be decoded. Messages that do not need decoding,
+	// such as errors, have their result ready when they are submitted.
+	decodeJob struct {
+		raw     *PooledBytes
+		message StreamMessage
+		result  chan StreamMessage
+	}
+)
+
+// SetDecodeWorkers sets the number of goroutines that run the UnmarshalHook. Messages are still delivered
+// in the order they were received. Use more than one worker when decoding limits how fast tweets are read.
+// Your UnmarshalHook must be safe to call from multiple goroutines. Call SetDecodeWorkers before StartStream.
+func (s *Stream) SetDecodeWorkers(workers int) {
+	s.decodeWorkers = workers
+}
+
+func newDecodePool(s *Stream, workers int) *decodePool {
+	p := &decodePool{
+		stream:   s,
+		jobs:     make(chan *decodeJob, workers),
+		pending:  make(chan *decodeJob, workers*2),
+		finished: make(chan struct{}),
+	}
+
+	for i := 0; i < workers; i++ {
+		go p.work()
+	}
+	go p.emit()
+
+	return p
+}
+
+// submit queues raw to be decoded and takes ownership of it. It returns false if the stream was stopped.
+func (p *decodePool) submit(raw *PooledBytes, message StreamMessage) bool {
+	job := &decodeJob{raw: raw, message: message, result: make(chan StreamMessage, 1)}
+	if !p.enqueue(p.pending, job) {
+		return false
+	}
+	return p.enqueue(p.jobs, job)
+}
+
+// submitMessage queues a message that does not need decoding behind the messages submitted before it.
+func (p *decodePool) submitMessage(message StreamMessage) bool {
+	job := &decodeJob{result: make(chan StreamMessage, 1)}
+	job.result <- message
+	return p.enqueue(p.pending, job)
+}
+
+// close stops the workers once every submitted message has been decoded and waits for them to be delivered,
+// or for the stream to be stopped. Nothing may be submitted after close.
+func (p *decodePool) close() {
+	close(p.jobs)
+	close(p.pending)
+	<-p.finished
+}
+
+func (p *decodePool) enqueue(queue chan *decodeJob, job *decodeJob) bool {
+	select {
+	case queue <- job:
+		return true
+	case <-p.stream.done:
+		return false
+	}
+}
+
+func (p *decodePool) work() {
+	for job := range p.jobs {
+		job.result <- p.stream.decode(job.raw, job.message)
+	}
+}
+
+func (p *decodePool) emit() {
+	defer close(p.finished)
+
+	for job := range p.pending {
+		select {
+		case message := <-job.result:
+			if !p.stream.send(message) {
+				return
+			}
+		case <-p.stream.done:
+			return
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package stream
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/fallenstedt/twitter-stream/httpclient"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+)
+
+type benchmarkTweet struct {
+	Data struct {
+		ID            string    `json:"id"`
+		Text          string    `json:"text"`
+		AuthorID      string    `json:"author_id"`
+		CreatedAt     time.Time `json:"created_at"`
+		PublicMetrics struct {
+			RetweetCount int `json:"retweet_count"`
+			ReplyCount   int `json:"reply_count"`
+			LikeCount    int `json:"like_count"`
+			QuoteCount   int `json:"quote_count"`
+		} `json:"public_metrics"`
+		Entities struct {
+			Hashtags []struct {
+				Start int    `json:"start"`
+				End   int    `json:"end"`
+				Tag   string `json:"tag"`
+			} `json:"hashtags"`
+		} `json:"entities"`
+	} `json:"data"`
+	Includes struct {
+		Users []struct {
+			ID          string `json:"id"`
+			Name        string `json:"name"`
+			Username    string `json:"username"`
+			Description string `json:"description"`
+		} `json:"users"`
+	} `json:"includes"`
+	MatchingRules []struct {
+		ID  string `json:"id"`
+		Tag string `json:"tag"`
+	} `json:"matching_rules"`
+}
+
+func givenStreamWithBody(body []byte) *Stream {
+	client := httpclient.NewHttpClientMock("foobar")
+	client.MockGetSearchStream = func(queryParams *url.Values) (*http.Response, error) {
+		return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(bytes.NewReader(body))}, nil
+	}
+	return NewStream(client, NewStreamResponseBodyReader())
+}
+
+func TestDecodeWorkersPreserveOrder(t *testing.T) {
+	var body bytes.Buffer
+	for i := 0; i < 200; i++ {
+		body.WriteString(strconv.Itoa(i) + "\r\n")
+	}
+
+	instance := givenStreamWithBody(body.Bytes())
+	instance.SetDecodeWorkers(8)
+	instance.SetUnmarshalHook(func(b []byte) (interface{}, error) {
+		// Finish decoding in a random order.
+		time.Sleep(time.Duration(rand.Intn(200)) * time.Microsecond)
+		return strconv.Atoi(string(b))
+	})
+
+	if err := instance.StartStream(nil); err != nil {
+		t.Fatalf("got err when starting stream %v", err)
+	}
+
+	expected := 0
+	for message := range instance.GetMessages() {
+		if message.Err != nil {
+			if expected != 200 {
+				t.Errorf("got err %v before every message was delivered", message.Err)
+			}
+			continue
+		}
+		if message.Data.(int) != expected {
+			t.Fatalf("got message %v, want %d", message.Data, expected)
+		}
+		expected++
+	}
+
+	if expected != 200 {
+		t.Errorf("expected 200 messages, got %d", expected)
+	}
+}
+
+func benchmarkDecodeWorkers(b *testing.B, workers int) {
+	payloads, err := ioutil.ReadFile("testdata/search_stream.txt")
+	if err != nil {
+		b.Fatal(err)
+	}
+	tweets := bytes.Count(payloads, []byte("\r\n")) - bytes.Count(payloads, []byte("\r\n\r\n"))
+
+	body := bytes.Repeat(payloads, b.N/tweets+1)
+	instance := givenStreamWithBody(body)
+	instance.SetDecodeWorkers(workers)
+	instance.SetUnmarshalHook(func(b []byte) (interface{}, error) {
+		data := benchmarkTweet{}
+		err := json.Unmarshal(b, &data)
+		return data, err
+	})
+
+	b.SetBytes(int64(len(payloads) / tweets))
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	if err := instance.StartStream(nil); err != nil {
+		b.Fatal(err)
+	}
+	messages := instance.GetMessages()
+	for i := 0; i < b.N; i++ {
+		if message := <-messages; message.Err != nil {
+			b.Fatal(message.Err)
+		}
+	}
+
+	b.StopTimer()
+	instance.StopStream()
+	instance.Wait()
+}
+
+func BenchmarkDecodeWorkers(b *testing.B) {
+	for _, workers := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			benchmarkDecodeWorkers(b, workers)
+		})
+	}
+}
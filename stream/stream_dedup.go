@@ -0,0 +1,213 @@
+package stream
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// defaultRecentIDs is how many ids the deduplicator of a redundant connection group remembers.
+const defaultRecentIDs = 100000
+
+// recentIDs is a Deduplicator that remembers the last size ids it saw.
+type recentIDs struct {
+	mu sync.Mutex
+	// ids holds the position of every remembered id in ring.
+	ids  map[string]int
+	ring []string
+	next int
+}
+
+func newRecentIDs(size int) *recentIDs {
+	return &recentIDs{ids: make(map[string]int, size), ring: make([]string, size)}
+}
+
+func (r *recentIDs) Seen(id string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.ids[id]; ok {
+		return true
+	}
+	if oldest := r.ring[r.next]; oldest != "" {
+		delete(r.ids, oldest)
+	}
+	r.ring[r.next] = id
+	r.ids[id] = r.next
+	r.next = (r.next + 1) % len(r.ring)
+	return false
+}
+
+func (r *recentIDs) Forget(id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if i, ok := r.ids[id]; ok {
+		delete(r.ids, id)
+		r.ring[i] = ""
+	}
+}
+
+// Deduplicator remembers the ids of tweets that have been delivered.
+// Implementations are found in the dedup package.
+//
+// A deduplicator that also has a Forget(id string) method is told when a tweet it has seen was not delivered,
+// because the overflow policy dropped it or the stream stopped, so the tweet is not suppressed when Twitter or a
+// GapFiller delivers it again.
+type Deduplicator interface {
+	// Seen reports whether id was seen before, and remembers it. It must be safe for concurrent use
+	// when a GapFiller is set.
+	Seen(id string) bool
+}
+
+// SetDeduplicator suppresses tweets whose id the deduplicator has already seen, such as tweets redelivered
+// by backfill_minutes after a reconnect. Suppressed tweets are counted in StreamStats and never reach the spool
+// or the messages channel. Call SetDeduplicator before StartStream.
+func (s *Stream) SetDeduplicator(d Deduplicator) {
+	s.deduplicator = d
+}
+
+// duplicate reports whether the tweet with id has been delivered before. An empty id is never a duplicate.
+func (s *Stream) duplicate(id string) bool {
+	if s.deduplicator == nil || id == "" {
+		return false
+	}
+	var seen bool
+	if err := s.protect(func() error { seen = s.deduplicator.Seen(id); return nil }); err != nil {
+		// Delivering the tweet twice is better than losing it.
+		s.emit(StreamMessage{Data: nil, Err: err})
+		return false
+	}
+	if !seen {
+		return false
+	}
+	atomic.AddUint64(&s.counters.suppressed, 1)
+	return true
+}
+
+// forgetter returns the function that makes the deduplicator forget id when its tweet is not delivered.
+func (s *Stream) forgetter(id string) func() {
+	d, ok := s.deduplicator.(interface{ Forget(id string) })
+	if !ok || id == "" {
+		return nil
+	}
+	return func() { d.Forget(id) }
+}
+
+// trackedTweetID returns the id of the tweet in b if a deduplicator, gap filler or checkpoint store needs it.
+func (s *Stream) trackedTweetID(b []byte) string {
+	if s.deduplicator == nil && s.gapFiller == nil && s.checkpoints == nil {
+		return ""
+	}
+	return tweetID(b)
+}
+
+// tweetID returns the id of the tweet in a stream payload, or an empty string. It only scans the payload up to
+// the id, as it runs on the goroutine reading from Twitter.
+func tweetID(b []byte) string {
+	scanner := jsonScanner{b: b}
+	if !scanner.member("data") || !scanner.member("id") {
+		return ""
+	}
+	id, ok := scanner.str()
+	if !ok {
+		return ""
+	}
+	return string(id)
+}
+
+// jsonScanner walks a JSON document without decoding it.
+type jsonScanner struct {
+	b []byte
+	i int
+}
+
+// member moves to the value of key in the object that starts at the scanner. It returns false if the object
+// has no such key.
+func (s *jsonScanner) member(key string) bool {
+	if !s.next('{') {
+		return false
+	}
+	for {
+		name, ok := s.str()
+		if !ok || !s.next(':') {
+			return false
+		}
+		if string(name) == key {
+			return true
+		}
+		if !s.skip() || !s.next(',') {
+			return false
+		}
+	}
+}
+
+// next skips whitespace and c. It returns false if the next character is not c.
+func (s *jsonScanner) next(c byte) bool {
+	s.space()
+	if s.i >= len(s.b) || s.b[s.i] != c {
+		return false
+	}
+	s.i++
+	return true
+}
+
+func (s *jsonScanner) space() {
+	for s.i < len(s.b) && (s.b[s.i] == ' ' || s.b[s.i] == '\t' || s.b[s.i] == '\r' || s.b[s.i] == '\n') {
+		s.i++
+	}
+}
+
+// str returns the contents of the string at the scanner, still escaped.
+func (s *jsonScanner) str() ([]byte, bool) {
+	if !s.next('"') {
+		return nil, false
+	}
+	start := s.i
+	for ; s.i < len(s.b); s.i++ {
+		switch s.b[s.i] {
+		case '\\':
+			s.i++
+		case '"':
+			s.i++
+			return s.b[start : s.i-1], true
+		}
+	}
+	return nil, false
+}
+
+// skip moves past the value at the scanner.
+func (s *jsonScanner) skip() bool {
+	s.space()
+	if s.i >= len(s.b) {
+		return false
+	}
+	switch s.b[s.i] {
+	case '"':
+		_, ok := s.str()
+		return ok
+	case '{', '[':
+		depth := 0
+		for ; s.i < len(s.b); s.i++ {
+			switch s.b[s.i] {
+			case '{', '[':
+				depth++
+			case '}', ']':
+				if depth--; depth == 0 {
+					s.i++
+					return true
+				}
+			case '"':
+				if _, ok := s.str(); !ok {
+					return false
+				}
+				s.i--
+			}
+		}
+		return false
+	}
+	for ; s.i < len(s.b); s.i++ {
+		switch s.b[s.i] {
+		case ',', '}', ']', ' ', '\t', '\r', '\n':
+			return true
+		}
+	}
+	return true
+}
@@ -0,0 +1,133 @@
+package stream
+
+import (
+	"fmt"
+	"github.com/fallenstedt/twitter-stream/httpclient"
+	"strings"
+	"sync"
+	"testing"
+)
+
+type fakeDeduplicator struct {
+	mu   sync.Mutex
+	seen map[string]bool
+}
+
+func newFakeDeduplicator() *fakeDeduplicator {
+	return &fakeDeduplicator{seen: make(map[string]bool)}
+}
+
+func (f *fakeDeduplicator) Seen(id string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	seen := f.seen[id]
+	f.seen[id] = true
+	return seen
+}
+
+func TestDeduplicator(t *testing.T) {
+	var tests = []struct {
+		payload string
+		id      string
+	}{
+		{`{"data":{"id":"1","text":"hello"}}`, "1"},
+		{`{"data":{"author_id":"2","referenced_tweets":[{"type":"quoted","id":"3"}],"id":"4"}}`, "4"},
+		{`{"data":{"text":"no id"}}`, ""},
+		{`not json`, ""},
+		{`{ "matching_rules" : [{"id":"9","tag":"{\"id\":\"8\"}"}], "data" : { "edit_history_tweet_ids" : ["5"], "public_metrics":{"like_count":3,"id":7}, "id" : "6" } }`, "6"},
+		{`{"data":{"text":"\"id\":\"7\"","id":"8"}}`, "8"},
+		{`{"includes":{"tweets":[{"id":"1"}]}}`, ""},
+		{`{"data":{"delete":{"tweet":{"id":"1"}}}}`, ""},
+		{`{"data":{"id":1}}`, ""},
+		{`{"data":{"id":"1"`, "1"},
+	}
+
+	for i, tt := range tests {
+		testName := fmt.Sprintf("TestDeduplicator (%d)", i)
+		t.Run(testName, func(t *testing.T) {
+			if id := tweetID([]byte(tt.payload)); id != tt.id {
+				t.Errorf("got id %q, want %q", id, tt.id)
+			}
+		})
+	}
+
+	api := givenStreamWithBody([]byte(`{"data":{"id":"1"}}` + "\r\n" + `{"data":{"id":"2"}}` + "\r\n" + `{"data":{"id":"1"}}` + "\r\n"))
+	api.SetDeduplicator(newFakeDeduplicator())
+	api.StartStream(nil)
+
+	var results []string
+	for message := range api.GetMessages() {
+		if message.Err == nil {
+			results = append(results, string(message.Data.([]byte)))
+		}
+	}
+
+	if len(results) != 2 || api.Stats().Suppressed != 1 {
+		t.Errorf("expected the second tweet 1 to be suppressed, got %v and %+v", results, api.Stats())
+	}
+}
+
+func TestRecentIDs(t *testing.T) {
+	var tests = []struct {
+		ids    []string
+		result string
+	}{
+		{[]string{"1", "2", "1"}, "[false false true]"},
+		// 1 is forgotten once 3 more ids were seen
+		{[]string{"1", "2", "3", "4", "1", "4"}, "[false false false false false true]"},
+		// "-1" forgets 1, and the slot it was in does not forget it again
+		{[]string{"1", "-1", "2", "1", "3", "4", "1"}, "[false false false false false true]"},
+	}
+
+	for i, tt := range tests {
+		testName := fmt.Sprintf("TestRecentIDs (%d)", i)
+		t.Run(testName, func(t *testing.T) {
+			r := newRecentIDs(3)
+			var results []bool
+			for _, id := range tt.ids {
+				if strings.HasPrefix(id, "-") {
+					r.Forget(id[1:])
+					continue
+				}
+				results = append(results, r.Seen(id))
+			}
+			if fmt.Sprint(results) != tt.result {
+				t.Errorf("got %v, want %s", results, tt.result)
+			}
+		})
+	}
+}
+
+func TestDroppedTweetIsForgotten(t *testing.T) {
+	var tests = []struct {
+		policy OverflowPolicy
+		stop   bool
+	}{
+		{OverflowDropNewest, false},
+		{OverflowBlock, true},
+	}
+
+	for i, tt := range tests {
+		testName := fmt.Sprintf("TestDroppedTweetIsForgotten (%d)", i)
+		t.Run(testName, func(t *testing.T) {
+			instance := NewStream(httpclient.NewHttpClientMock("foobar"), NewStreamResponseBodyReader())
+			instance.SetBuffer(1, tt.policy)
+			instance.done = make(chan struct{})
+			ids := newRecentIDs(10)
+			instance.SetDeduplicator(ids)
+
+			instance.send(StreamMessage{Data: []byte("1")})
+			if tt.stop {
+				close(instance.done)
+			}
+			if instance.duplicate("2") {
+				t.Fatal("expected tweet 2 not to be a duplicate")
+			}
+			instance.send(StreamMessage{Data: []byte("2"), forget: instance.forgetter("2")})
+
+			if ids.Seen("2") {
+				t.Error("expected the tweet that was not delivered to be forgotten")
+			}
+		})
+	}
+}
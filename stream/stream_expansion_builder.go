@@ -13,6 +13,7 @@ type (
 		AddBackFillMinutes(minutes uint) *StreamQueryParamBuilder
 		AddExpansion(expansion string) *StreamQueryParamBuilder
 		AddMediaField(mediaField string) *StreamQueryParamBuilder
+		AddPartition(partition uint) *StreamQueryParamBuilder
 		AddPlaceField(placeField string) *StreamQueryParamBuilder
 		AddPollField(pollField string) *StreamQueryParamBuilder
 		AddTweetField(tweetField string) *StreamQueryParamBuilder
@@ -24,6 +25,7 @@ type (
 	// Read more at https://developer.twitter.com/en/docs/twitter-api/tweets/filtered-stream/api-reference/get-tweets-search-stream.
 	StreamQueryParamBuilder struct {
 		backFillMinutes uint
+		partition uint
 		expansions []*string
 		mediaFields []*string
 		placeFields []*string
@@ -40,6 +42,7 @@ type (
 func NewStreamQueryParamsBuilder() IStreamQueryParamsBuilder {
 	return &StreamQueryParamBuilder{
 		backFillMinutes: 0,
+		partition: 0,
 		expansions: []*string{},
 		mediaFields: []*string{},
 		placeFields: []*string{},
@@ -64,6 +67,10 @@ func (s *StreamQueryParamBuilder) Build() *url.Values {
 		query.Add("backfill_minutes", strconv.Itoa(int(s.backFillMinutes)))
 	}
 
+	if s.partition > 0 {
+		query.Add("partition", strconv.Itoa(int(s.partition)))
+	}
+
 	return &query
 }
 
@@ -135,6 +142,14 @@ func (s *StreamQueryParamBuilder) AddBackFillMinutes(backFillMinutes uint) *Stre
 	return s
 }
 
+// AddPartition selects the partition of the stream to connect to, from 1 to 20 for the 10% sampled stream
+// and from 1 to 4 for compliance streams. It is required by `NewSample10Stream` and the compliance streams.
+// Learn more about partitions on twitter docs https://developer.twitter.com/en/docs/twitter-api/tweets/volume-streams/api-reference/get-tweets-sample10-stream.
+func (s *StreamQueryParamBuilder) AddPartition(partition uint) *StreamQueryParamBuilder {
+	s.partition = partition
+	return s
+}
+
 func (s StreamQueryParamBuilder) addQuery(qb *url.Values, fields *[]*string, param string) {
 	if len(*fields) > 0 {
 		var sb strings.Builder
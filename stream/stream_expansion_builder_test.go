@@ -25,4 +25,14 @@ func TestStreamQueryParamsBuilderBuildsQueryParams(t *testing.T) {
 		t.Errorf("ahh")
 	}
 
-}
\ No newline at end of file
+}
+func TestStreamQueryParamsBuilderBuildsPartition(t *testing.T) {
+	result := NewStreamQueryParamsBuilder().
+		AddTweetField("created_at").
+		AddPartition(3).
+		Build().Encode()
+	expected := "partition=3&tweet.fields=created_at"
+	if result != expected {
+		t.Errorf("got %s, want %s", result, expected)
+	}
+}
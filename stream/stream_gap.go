@@ -0,0 +1,101 @@
+package stream
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"time"
+)
+
+type (
+	// Gap is a period during which the stream was disconnected and tweets were missed.
+	Gap struct {
+		// Start is when the last message was received before the disconnect.
+		Start time.Time
+		// End is when the stream reconnected, or the start of the backfilled period if backfill was requested.
+		End time.Time
+		// SinceID is the id of the last tweet received before the disconnect, if known.
+		SinceID string
+		// QueryParams are the query params the stream was started with.
+		QueryParams *url.Values
+	}
+
+	// GapFiller fetches the tweets missed during a gap, such as by searching recent tweets.
+	// Implementations are found in the recovery package.
+	GapFiller interface {
+		// Fill calls deliver with every recovered tweet, as a stream payload with matching_rules set.
+		// It must stop and return nil once deliver returns false. ctx is done once the stream is stopped.
+		Fill(ctx context.Context, gap Gap, deliver func(payload []byte) bool) error
+	}
+
+	// GapError is sent as the Err of a message when a gap could not be filled.
+	GapError struct {
+		Gap Gap
+		Err error
+	}
+)
+
+// SetGapFiller sets a filler used to recover the tweets missed while reconnecting. Once the stream has reconnected,
+// the part of the outage not covered by backfill is filled in the background. Recovered tweets are delivered with
+// Recovered set, after going through the deduplicator, and do not go through the spool. Stopping the stream cancels
+// the context of an in-progress fill and waits for it to return. Recovered tweets are decoded on the goroutine of
+// the fill while the stream keeps decoding new tweets, so the UnmarshalHook, the DeadLetterSink and the
+// deduplicator must be safe for concurrent use. Call SetGapFiller before StartStream.
+func (s *Stream) SetGapFiller(filler GapFiller) {
+	s.gapFiller = filler
+}
+
+func (e *GapError) Error() string {
+	return fmt.Sprintf("could not recover tweets from %s to %s: %v", e.Gap.Start.Format(time.RFC3339), e.Gap.End.Format(time.RFC3339), e.Err)
+}
+
+func (e *GapError) Unwrap() error {
+	return e.Err
+}
+
+// fillGap recovers the tweets missed between start and reconnectedAt in the background.
+func (s *Stream) fillGap(start, reconnectedAt time.Time, sinceID string, queryParams *url.Values) {
+	if s.gapFiller == nil || start.IsZero() {
+		return
+	}
+
+	end := reconnectedAt
+	if s.autoBackfill && !s.backfillRejected {
+		end = end.Add(-maxBackfillMinutes * time.Minute)
+	}
+	if !end.After(start) {
+		return
+	}
+
+	gap := Gap{Start: start, End: end, SinceID: sinceID, QueryParams: queryParams}
+	s.gapFills.Add(1)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := s.done
+	go func() {
+		select {
+		case <-done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	go func() {
+		defer s.gapFills.Done()
+		defer cancel()
+
+		deliver := func(payload []byte) bool {
+			if stopped(s.done) {
+				return false
+			}
+			id, receivedAt := tweetID(payload), time.Now()
+			if s.duplicate(id) {
+				return true
+			}
+			raw := getPooledBytes()
+			raw.b = append(raw.b, payload...)
+			return s.deliver(raw, StreamMessage{ReceivedAt: receivedAt, Recovered: true, ack: s.checkpointAck(id, receivedAt, nil), forget: s.forgetter(id)})
+		}
+		if err := s.protect(func() error { return s.gapFiller.Fill(ctx, gap, deliver) }); err != nil {
+			s.emit(StreamMessage{Data: nil, Err: &GapError{Gap: gap, Err: err}})
+		}
+	}()
+}
@@ -0,0 +1,164 @@
+package stream
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/fallenstedt/twitter-stream/httpclient"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+type fakeGapFiller struct {
+	gaps     chan Gap
+	payloads []string
+	err      error
+}
+
+func (f *fakeGapFiller) Fill(ctx context.Context, gap Gap, deliver func(payload []byte) bool) error {
+	f.gaps <- gap
+	for _, payload := range f.payloads {
+		if !deliver([]byte(payload)) {
+			return nil
+		}
+	}
+	return f.err
+}
+
+func TestGapFiller(t *testing.T) {
+	var tests = []struct {
+		autoBackfill bool
+		outage       time.Duration
+		filled       bool
+	}{
+		{false, 50 * time.Millisecond, true},
+		// backfill covers the outage
+		{true, 50 * time.Millisecond, false},
+	}
+
+	for i, tt := range tests {
+		testName := fmt.Sprintf("TestGapFiller (%d)", i)
+		t.Run(testName, func(t *testing.T) {
+			connections := 0
+			client := httpclient.NewHttpClientMock("foobar")
+			client.MockGetSearchStream = func(queryParams *url.Values) (*http.Response, error) {
+				connections++
+				if connections == 1 {
+					return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(bytes.NewReader([]byte(`{"data":{"id":"1"}}` + "\r\n")))}, nil
+				}
+				return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(bytes.NewReader([]byte(`{"data":{"id":"3"}}` + "\r\n")))}, nil
+			}
+
+			filler := &fakeGapFiller{
+				gaps:     make(chan Gap, 1),
+				payloads: []string{`{"data":{"id":"1"}}`, `{"data":{"id":"2"}}`},
+				err:      errors.New("rate limited"),
+			}
+			api := NewStream(client, NewStreamResponseBodyReader())
+			api.SetAutoBackfill(tt.autoBackfill)
+			api.SetGapFiller(filler)
+			api.SetDeduplicator(newFakeDeduplicator())
+			api.SetReconnectPolicy(func(attempt int, err error) (time.Duration, bool) {
+				return tt.outage, connections < 2
+			})
+			api.StartStream(nil)
+
+			var results []string
+			for message := range api.GetMessages() {
+				var gapErr *GapError
+				switch {
+				case errors.As(message.Err, &gapErr):
+					results = append(results, "gap error")
+				case message.Err != nil:
+				case message.Recovered:
+					results = append(results, "recovered "+string(message.Data.([]byte)))
+				default:
+					results = append(results, string(message.Data.([]byte)))
+				}
+			}
+
+			if !tt.filled {
+				if len(filler.gaps) != 0 {
+					t.Errorf("expected no gap to be filled, got %v", <-filler.gaps)
+				}
+				return
+			}
+
+			gap := <-filler.gaps
+			if gap.SinceID != "1" || gap.End.Sub(gap.Start) < tt.outage {
+				t.Errorf("got gap %+v", gap)
+			}
+
+			// The stream's own tweets and the recovered ones are delivered concurrently, so only check what was delivered.
+			delivered := make(map[string]bool)
+			for _, result := range results {
+				delivered[result] = true
+			}
+			for _, expected := range []string{`{"data":{"id":"1"}}`, `recovered {"data":{"id":"2"}}`, `{"data":{"id":"3"}}`, "gap error"} {
+				if !delivered[expected] {
+					t.Errorf("expected %s to be delivered, got %v", expected, results)
+				}
+			}
+			if len(results) != 4 {
+				t.Errorf("expected tweet 1 to be delivered once, got %v", results)
+			}
+		})
+	}
+}
+
+type blockingGapFiller struct {
+	started chan struct{}
+}
+
+func (f *blockingGapFiller) Fill(ctx context.Context, gap Gap, deliver func(payload []byte) bool) error {
+	close(f.started)
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestStopStreamCancelsGapFill(t *testing.T) {
+	connections := 0
+	client := httpclient.NewHttpClientMock("foobar")
+	client.MockGetSearchStream = func(queryParams *url.Values) (*http.Response, error) {
+		connections++
+		if connections == 1 {
+			return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(bytes.NewReader([]byte(`{"data":{"id":"1"}}` + "\r\n")))}, nil
+		}
+		body, _ := io.Pipe()
+		return &http.Response{StatusCode: http.StatusOK, Body: body}, nil
+	}
+
+	filler := &blockingGapFiller{started: make(chan struct{})}
+	api := NewStream(client, NewStreamResponseBodyReader())
+	api.SetGapFiller(filler)
+	api.SetReconnectPolicy(func(attempt int, err error) (time.Duration, bool) {
+		return 10 * time.Millisecond, connections < 2
+	})
+	api.StartStream(nil)
+	go func() {
+		for range api.GetMessages() {
+		}
+	}()
+
+	select {
+	case <-filler.started:
+	case <-time.After(time.Second):
+		t.Fatal("expected the gap to be filled")
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		api.StopStream()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("expected StopStream to cancel the gap fill")
+	}
+}
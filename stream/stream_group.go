@@ -0,0 +1,401 @@
+package stream
+
+import (
+	"net/url"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fallenstedt/twitter-stream/httpclient"
+)
+
+type (
+	// IConnectionGroup is the interface the ConnectionGroup struct implements.
+	IConnectionGroup interface {
+		IStream
+		IStreamStatus
+		Health() []ConnectionHealth
+	}
+
+	// ConnectionHealth describes one connection of a connection group.
+	ConnectionHealth struct {
+		// Partition is the partition the connection streams, or 0 for redundant connections.
+		Partition int
+		State     StreamState
+		// ConnectionID is the ConnectionID of the messages sent from the current connection.
+		ConnectionID uint64
+		// Connects is the number of times the connection was opened, including reconnects.
+		Connects uint64
+		// Messages is the number of messages the connection sent to the messages channel.
+		Messages uint64
+		// LastMessageAt is when the connection last sent a message.
+		LastMessageAt time.Time
+		// LastErr is the last error the connection sent, and LastErrAt when it was sent.
+		LastErr   error
+		LastErrAt time.Time
+	}
+
+	// ConnectionGroup merges several connections with Twitter into one stream.
+	// Its setters apply to every connection, like the setters of Stream.
+	ConnectionGroup struct {
+		// seq and connections are accessed atomically and must stay the first fields for 64-bit alignment.
+		seq         uint64
+		connections uint64
+		streams     []*Stream
+		partitioned bool
+
+		mu       sync.Mutex
+		state    StreamState
+		messages chan StreamMessage
+		done     chan struct{}
+		finished chan struct{}
+		running  int
+		err      error
+		health   []ConnectionHealth
+	}
+)
+
+// NewConnectionGroup creates a stream that opens the given number of connections to GET /2/tweets/search/stream
+// and merges their messages into one messages channel. Every connection reconnects on its own with the
+// reconnect policy, so a dropped connection does not stop the others.
+//
+// When partitioned is true, each connection streams its own partition, set as the partition query param from 1 to
+// connections. Otherwise the connections are redundant and receive the same tweets. Either way, each tweet is only
+// delivered once by a deduplicator that remembers the last 100000 ids, until SetDeduplicator replaces it, as the
+// GapFiller of every partition searches the tweets of every rule. Settings apply to every connection, and the
+// Deduplicator, GapFiller and CheckpointStore are shared by them. Seq and ConnectionID are unique across the group.
+// Connection groups do not support spools.
+func NewConnectionGroup(httpClient httpclient.IHttpClient, connections int, partitioned bool) *ConnectionGroup {
+	g := &ConnectionGroup{
+		partitioned: partitioned,
+		messages:    make(chan StreamMessage),
+		done:        make(chan struct{}),
+		finished:    make(chan struct{}),
+		health:      make([]ConnectionHealth, connections),
+	}
+	for i := 0; i < connections; i++ {
+		g.streams = append(g.streams, NewStream(httpClient, NewStreamResponseBodyReader()))
+		if partitioned {
+			g.health[i].Partition = i + 1
+		}
+	}
+	if connections > 1 {
+		g.SetDeduplicator(newRecentIDs(defaultRecentIDs))
+	}
+	return g
+}
+
+// StartStream opens every connection. If one of them cannot be opened, the others are stopped and the error is returned.
+func (g *ConnectionGroup) StartStream(queryParams *url.Values) error {
+	g.mu.Lock()
+	switch g.state {
+	case StateConnecting, StateStreaming, StateStopping:
+		g.mu.Unlock()
+		return ErrStreamRunning
+	case StateStopped:
+		g.messages = make(chan StreamMessage)
+		g.done = make(chan struct{})
+		g.finished = make(chan struct{})
+	}
+	g.state = StateConnecting
+	g.err = nil
+	g.mu.Unlock()
+
+	for i, s := range g.streams {
+		if err := s.StartStream(g.params(i, queryParams)); err != nil {
+			for _, started := range g.streams[:i] {
+				started.StopStream()
+				started.Wait()
+			}
+			g.mu.Lock()
+			if g.state == StateStopping {
+				g.finishLocked()
+			} else {
+				g.state = StateIdle
+			}
+			g.mu.Unlock()
+			return err
+		}
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.state == StateStopping {
+		// StopStream was called while connecting, before every connection was started.
+		for _, s := range g.streams {
+			s.StopStream()
+		}
+	} else {
+		g.state = StateStreaming
+	}
+	g.running = len(g.streams)
+	if g.running == 0 {
+		g.finishLocked()
+	}
+	for i, s := range g.streams {
+		go g.forward(i, s.GetMessages())
+	}
+	return nil
+}
+
+// params returns the query params of connection i.
+func (g *ConnectionGroup) params(i int, queryParams *url.Values) *url.Values {
+	if !g.partitioned {
+		return queryParams
+	}
+	params := url.Values{}
+	if queryParams != nil {
+		for key, values := range *queryParams {
+			params[key] = append([]string(nil), values...)
+		}
+	}
+	params.Set("partition", strconv.Itoa(i+1))
+	return &params
+}
+
+// forward sends the messages of connection i to the messages channel until the connection stops.
+func (g *ConnectionGroup) forward(i int, messages <-chan StreamMessage) {
+	defer g.stopped()
+
+	var memberID, groupID uint64
+	for message := range messages {
+		if message.ConnectionID != 0 {
+			if message.ConnectionID != memberID {
+				memberID, groupID = message.ConnectionID, atomic.AddUint64(&g.connections, 1)
+			}
+			message.ConnectionID = groupID
+		}
+		message.Seq = atomic.AddUint64(&g.seq, 1)
+
+		g.mu.Lock()
+		health := &g.health[i]
+		health.Messages++
+		health.LastMessageAt = time.Now()
+		health.ConnectionID = groupID
+		if message.Err != nil {
+			health.LastErr, health.LastErrAt = message.Err, health.LastMessageAt
+		}
+		done := g.done
+		g.mu.Unlock()
+
+		select {
+		case g.messages <- message:
+		case <-done:
+			message.Release()
+		}
+	}
+}
+
+// stopped is called when a connection has stopped. The group stops with the last one.
+func (g *ConnectionGroup) stopped() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.running--
+	if g.running == 0 {
+		g.finishLocked()
+	}
+}
+
+// finishLocked moves the group to stopped and closes its channels. g.mu must be held.
+func (g *ConnectionGroup) finishLocked() {
+	if g.state != StateStopping {
+		for _, s := range g.streams {
+			if err := s.Err(); err != nil {
+				g.err = err
+				break
+			}
+		}
+	}
+	if !stopped(g.done) {
+		close(g.done)
+	}
+	close(g.messages)
+	close(g.finished)
+	g.state = StateStopped
+}
+
+// StopStream stops every connection. It is safe to call StopStream more than once.
+func (g *ConnectionGroup) StopStream() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	switch g.state {
+	case StateStopping, StateStopped:
+		return
+	case StateIdle:
+		g.finishLocked()
+		return
+	}
+
+	g.state = StateStopping
+	close(g.done)
+	for _, s := range g.streams {
+		s.StopStream()
+	}
+}
+
+// GetMessages returns the read-only messages channel of the current run of the group.
+func (g *ConnectionGroup) GetMessages() <-chan StreamMessage {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.messages
+}
+
+// Health returns the health of every connection, in the order they were opened.
+func (g *ConnectionGroup) Health() []ConnectionHealth {
+	g.mu.Lock()
+	health := append([]ConnectionHealth(nil), g.health...)
+	g.mu.Unlock()
+
+	for i, s := range g.streams {
+		health[i].State = s.State()
+		health[i].Connects = atomic.LoadUint64(&s.counters.connections)
+	}
+	return health
+}
+
+// State returns streaming while at least one connection is streaming.
+func (g *ConnectionGroup) State() StreamState {
+	g.mu.Lock()
+	state := g.state
+	g.mu.Unlock()
+
+	if state != StateStreaming {
+		return state
+	}
+	for _, s := range g.streams {
+		if s.State() == StateStreaming {
+			return StateStreaming
+		}
+	}
+	return StateConnecting
+}
+
+// Done returns a channel that is closed once every connection has stopped.
+func (g *ConnectionGroup) Done() <-chan struct{} {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.finished
+}
+
+// Wait blocks until every connection has stopped and returns the error that stopped the group.
+func (g *ConnectionGroup) Wait() error {
+	<-g.Done()
+	return g.Err()
+}
+
+// Err returns the error that stopped the first connection to fail, once every connection has stopped
+// on its own. It is nil while the group is running, or when it was stopped with StopStream.
+func (g *ConnectionGroup) Err() error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.err
+}
+
+// Stats returns the counters of every connection added up.
+func (g *ConnectionGroup) Stats() StreamStats {
+	var stats StreamStats
+	for _, s := range g.streams {
+		member := s.Stats()
+		stats.Delivered += member.Delivered
+		stats.Dropped += member.Dropped
+		stats.Spilled += member.Spilled
+		if member.HighWaterMark > stats.HighWaterMark {
+			stats.HighWaterMark = member.HighWaterMark
+		}
+		stats.Buffered += member.Buffered
+		stats.BufferSize += member.BufferSize
+		stats.DeadLettered += member.DeadLettered
+		stats.DeadLetterErrors += member.DeadLetterErrors
+		stats.Suppressed += member.Suppressed
+		stats.CheckpointErrors += member.CheckpointErrors
+	}
+	return stats
+}
+
+// SetCheckpointStore records the newest tweet acknowledged across every connection in store.
+func (g *ConnectionGroup) SetCheckpointStore(store CheckpointStore, interval time.Duration) {
+	checkpoints := &checkpointer{store: store, interval: interval}
+	for _, s := range g.streams {
+		s.checkpoints = checkpoints
+	}
+}
+
+// SetUnmarshalHook sets the UnmarshalHook of every connection.
+func (g *ConnectionGroup) SetUnmarshalHook(hook UnmarshalHook) {
+	for _, s := range g.streams {
+		s.SetUnmarshalHook(hook)
+	}
+}
+
+// SetReconnectPolicy sets the reconnect policy of every connection.
+func (g *ConnectionGroup) SetReconnectPolicy(policy ReconnectPolicy) {
+	for _, s := range g.streams {
+		s.SetReconnectPolicy(policy)
+	}
+}
+
+// SetBuffer sets the buffer of every connection. The merged messages channel is unbuffered.
+func (g *ConnectionGroup) SetBuffer(size int, policy OverflowPolicy) {
+	for _, s := range g.streams {
+		s.SetBuffer(size, policy)
+	}
+}
+
+// SetDecodeWorkers sets the decode workers of every connection.
+func (g *ConnectionGroup) SetDecodeWorkers(workers int) {
+	for _, s := range g.streams {
+		s.SetDecodeWorkers(workers)
+	}
+}
+
+// SetPooledBuffers sets whether every connection delivers pooled buffers.
+func (g *ConnectionGroup) SetPooledBuffers(enabled bool) {
+	for _, s := range g.streams {
+		s.SetPooledBuffers(enabled)
+	}
+}
+
+// SetFatalPanics sets whether panics in the hooks of every connection are fatal.
+func (g *ConnectionGroup) SetFatalPanics(enabled bool) {
+	for _, s := range g.streams {
+		s.SetFatalPanics(enabled)
+	}
+}
+
+// SetIncludeRaw sets whether the messages of every connection carry Raw.
+func (g *ConnectionGroup) SetIncludeRaw(enabled bool) {
+	for _, s := range g.streams {
+		s.SetIncludeRaw(enabled)
+	}
+}
+
+// SetDeadLetterSink sets a dead letter sink shared by every connection. It must be safe for concurrent use.
+func (g *ConnectionGroup) SetDeadLetterSink(sink DeadLetterSink) {
+	for _, s := range g.streams {
+		s.SetDeadLetterSink(sink)
+	}
+}
+
+// SetDeduplicator sets a deduplicator shared by every connection, replacing the default.
+// It must be safe for concurrent use. A nil deduplicator delivers every tweet.
+func (g *ConnectionGroup) SetDeduplicator(d Deduplicator) {
+	for _, s := range g.streams {
+		s.SetDeduplicator(d)
+	}
+}
+
+// SetAutoBackfill sets whether every connection requests backfill when reconnecting.
+func (g *ConnectionGroup) SetAutoBackfill(enabled bool) {
+	for _, s := range g.streams {
+		s.SetAutoBackfill(enabled)
+	}
+}
+
+// SetGapFiller sets a gap filler shared by every connection. It must be safe for concurrent use.
+func (g *ConnectionGroup) SetGapFiller(filler GapFiller) {
+	for _, s := range g.streams {
+		s.SetGapFiller(filler)
+	}
+}
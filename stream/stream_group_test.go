@@ -0,0 +1,206 @@
+package stream
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/fallenstedt/twitter-stream/httpclient"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// scriptedStream returns a mock client that answers the nth connection with the tweet ids in bodies[n].
+func scriptedStream(bodies ...string) (*sync.Mutex, *[]string, func(queryParams *url.Values) (*http.Response, error)) {
+	var mu sync.Mutex
+	var requests []string
+	return &mu, &requests, func(queryParams *url.Values) (*http.Response, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		n := len(requests)
+		if queryParams == nil {
+			queryParams = &url.Values{}
+		}
+		requests = append(requests, queryParams.Encode())
+		if n >= len(bodies) || bodies[n] == "error" {
+			return nil, errors.New("too many connections")
+		}
+		var body strings.Builder
+		for _, id := range strings.Split(bodies[n], ",") {
+			body.WriteString(`{"data":{"id":"` + id + `"}}` + "\r\n")
+		}
+		return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(bytes.NewReader([]byte(body.String())))}, nil
+	}
+}
+
+func TestConnectionGroupRedundant(t *testing.T) {
+	var tests = []struct {
+		deduplicator Deduplicator
+	}{
+		{newFakeDeduplicator()},
+		// the default deduplicator
+		{nil},
+	}
+
+	for i, tt := range tests {
+		testName := fmt.Sprintf("TestConnectionGroupRedundant (%d)", i)
+		t.Run(testName, func(t *testing.T) {
+			mu, requests, getSearchStream := scriptedStream("1,2", "1,2,3", "3,4", "2,4")
+			client := httpclient.NewHttpClientMock("foobar")
+			client.MockGetSearchStream = getSearchStream
+
+			group := NewConnectionGroup(client, 2, false)
+			if tt.deduplicator != nil {
+				group.SetDeduplicator(tt.deduplicator)
+			}
+			group.SetReconnectPolicy(func(attempt int, err error) (time.Duration, bool) {
+				mu.Lock()
+				defer mu.Unlock()
+				return 0, len(*requests) < 4
+			})
+			if err := group.StartStream(nil); err != nil {
+				t.Fatalf("got err %v", err)
+			}
+
+			var ids []string
+			var seqs []uint64
+			for message := range group.GetMessages() {
+				seqs = append(seqs, message.Seq)
+				if message.Err == nil {
+					ids = append(ids, string(message.Data.([]byte)))
+				}
+			}
+			sort.Strings(ids)
+
+			result := fmt.Sprint(ids)
+			expected := `[{"data":{"id":"1"}} {"data":{"id":"2"}} {"data":{"id":"3"}} {"data":{"id":"4"}}]`
+			if result != expected {
+				t.Errorf("got %s, want %s", result, expected)
+			}
+			for i, seq := range seqs {
+				if seq != uint64(i+1) {
+					t.Errorf("got seq %d at %d, want %d", seq, i, i+1)
+				}
+			}
+			if group.Wait() == nil {
+				t.Errorf("expected the group to stop with the error of the last connection")
+			}
+
+			var connects uint64
+			for _, health := range group.Health() {
+				connects += health.Connects
+				if health.State != StateStopped || health.LastErr == nil || health.Partition != 0 {
+					t.Errorf("got health %+v", health)
+				}
+			}
+			if connects != 4 {
+				t.Errorf("got %d connects, want 4", connects)
+			}
+			if stats := group.Stats(); stats.Suppressed != 5 {
+				t.Errorf("got %d suppressed, want 5", stats.Suppressed)
+			}
+		})
+	}
+}
+
+func TestConnectionGroupPartitions(t *testing.T) {
+	_, requests, getSearchStream := scriptedStream("1", "2", "3")
+	client := httpclient.NewHttpClientMock("foobar")
+	client.MockGetSearchStream = getSearchStream
+
+	group := NewConnectionGroup(client, 3, true)
+	if err := group.StartStream(&url.Values{"expansions": []string{"author_id"}}); err != nil {
+		t.Fatalf("got err %v", err)
+	}
+	tweets := 0
+	for message := range group.GetMessages() {
+		if message.Err == nil {
+			tweets++
+		}
+	}
+
+	result := fmt.Sprint(*requests)
+	expected := "[expansions=author_id&partition=1 expansions=author_id&partition=2 expansions=author_id&partition=3]"
+	if result != expected {
+		t.Errorf("got %s, want %s", result, expected)
+	}
+	if tweets != 3 {
+		t.Errorf("got %d tweets, want 3", tweets)
+	}
+	for i, health := range group.Health() {
+		if health.Partition != i+1 || health.Messages != 2 {
+			t.Errorf("got health %+v for partition %d", health, i+1)
+		}
+	}
+}
+
+func TestConnectionGroupPartitionsRecoverOnce(t *testing.T) {
+	errDone := errors.New("done")
+	var mu sync.Mutex
+	connects := map[string]int{}
+	client := httpclient.NewHttpClientMock("foobar")
+	client.MockGetSearchStream = func(queryParams *url.Values) (*http.Response, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		partition := queryParams.Get("partition")
+		n := connects[partition]
+		connects[partition]++
+		if n >= 2 {
+			return nil, errDone
+		}
+		body := fmt.Sprintf(`{"data":{"id":"%s%d"}}`+"\r\n", partition, n)
+		return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(bytes.NewReader([]byte(body)))}, nil
+	}
+
+	filler := &fakeGapFiller{gaps: make(chan Gap, 2), payloads: []string{`{"data":{"id":"9"}}`}}
+	group := NewConnectionGroup(client, 2, true)
+	group.SetGapFiller(filler)
+	group.SetReconnectPolicy(func(attempt int, err error) (time.Duration, bool) {
+		return 50 * time.Millisecond, err != errDone
+	})
+	if err := group.StartStream(nil); err != nil {
+		t.Fatalf("got err %v", err)
+	}
+
+	recovered := 0
+	for message := range group.GetMessages() {
+		if message.Recovered {
+			recovered++
+		}
+	}
+	if len(filler.gaps) != 2 || recovered != 1 {
+		t.Errorf("expected both partitions to fill the gap and the tweet to be recovered once, got %d fills and %d tweets", len(filler.gaps), recovered)
+	}
+}
+
+func TestConnectionGroupStartError(t *testing.T) {
+	_, requests, getSearchStream := scriptedStream("1", "error", "2", "3")
+	client := httpclient.NewHttpClientMock("foobar")
+	client.MockGetSearchStream = getSearchStream
+
+	group := NewConnectionGroup(client, 2, false)
+	if err := group.StartStream(nil); err == nil {
+		t.Fatalf("expected an error when a connection cannot be opened")
+	}
+	if state := group.State(); state != StateIdle {
+		t.Errorf("got state %v, want idle", state)
+	}
+
+	if err := group.StartStream(nil); err != nil {
+		t.Fatalf("got err %v when starting again", err)
+	}
+	group.StopStream()
+	for range group.GetMessages() {
+	}
+	if err := group.Wait(); err != nil {
+		t.Errorf("expected no error after StopStream, got %v", err)
+	}
+	if len(*requests) != 4 {
+		t.Errorf("got %d requests, want 4", len(*requests))
+	}
+}
@@ -0,0 +1,80 @@
+package stream
+
+import (
+	"fmt"
+	"runtime/debug"
+	"time"
+)
+
+// PanicError is sent as the Err of a message when a hook or handler panicked.
+type PanicError struct {
+	// Value is the value passed to panic.
+	Value interface{}
+	// Stack is the stack trace of the goroutine that panicked.
+	Stack []byte
+	// Raw is a copy of the payload that was being processed, if any.
+	Raw []byte
+}
+
+// SetFatalPanics controls what happens when the UnmarshalHook or ReconnectPolicy panics.
+// By default the panic is recovered: a panicking UnmarshalHook produces a message with a *PanicError
+// and the stream keeps going, while a panicking ReconnectPolicy stops the stream with a *PanicError.
+// Panics in the DeadLetterSink and CheckpointStore are counted like their errors, a panicking GapFiller
+// is reported with a *GapError and a panicking Deduplicator produces a message with a *PanicError
+// and lets the tweet through.
+// Enable fatal panics to let them crash the process instead. Call SetFatalPanics before StartStream.
+func (s *Stream) SetFatalPanics(enabled bool) {
+	s.fatalPanics = enabled
+}
+
+// NewPanicError creates a *PanicError for value, capturing the current stack and a copy of raw.
+// It is meant to be called from a deferred recover.
+func NewPanicError(value interface{}, raw []byte) *PanicError {
+	var copied []byte
+	if raw != nil {
+		copied = append([]byte(nil), raw...)
+	}
+	return &PanicError{Value: value, Stack: debug.Stack(), Raw: copied}
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("panic: %v", e.Value)
+}
+
+// unmarshal runs the UnmarshalHook on raw, turning a panic into a *PanicError unless panics are fatal.
+func (s *Stream) unmarshal(raw []byte) (data interface{}, err error) {
+	if !s.fatalPanics {
+		defer func() {
+			if value := recover(); value != nil {
+				data, err = nil, NewPanicError(value, raw)
+			}
+		}()
+	}
+	return s.unmarshalHook(raw)
+}
+
+// nextDelay runs the ReconnectPolicy, turning a panic into a *PanicError unless panics are fatal.
+func (s *Stream) nextDelay(attempt int, err error) (delay time.Duration, ok bool, panicErr error) {
+	if !s.fatalPanics {
+		defer func() {
+			if value := recover(); value != nil {
+				delay, ok, panicErr = 0, false, NewPanicError(value, nil)
+			}
+		}()
+	}
+	delay, ok = s.reconnectPolicy(attempt, err)
+	return delay, ok, nil
+}
+
+// protect runs fn, turning a panic into a *PanicError unless panics are fatal. It guards the calls to the
+// DeadLetterSink, Deduplicator, GapFiller and CheckpointStore.
+func (s *Stream) protect(fn func() error) (err error) {
+	if !s.fatalPanics {
+		defer func() {
+			if value := recover(); value != nil {
+				err = NewPanicError(value, nil)
+			}
+		}()
+	}
+	return fn()
+}
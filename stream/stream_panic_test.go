@@ -0,0 +1,151 @@
+package stream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestUnmarshalHookPanicsAreRecovered(t *testing.T) {
+	var tests = []struct {
+		workers int
+	}{
+		{1},
+		{4},
+	}
+
+	for i, tt := range tests {
+		testName := fmt.Sprintf("TestUnmarshalHookPanicsAreRecovered (%d)", i)
+		t.Run(testName, func(t *testing.T) {
+			api := givenStreamWithBody([]byte("tweet 0\r\nbad tweet\r\ntweet 2\r\n"))
+			api.SetDecodeWorkers(tt.workers)
+			api.SetUnmarshalHook(func(b []byte) (interface{}, error) {
+				if string(b) == "bad tweet" {
+					panic("cannot decode")
+				}
+				return string(b), nil
+			})
+			api.StartStream(nil)
+
+			var results []string
+			for message := range api.GetMessages() {
+				var panicErr *PanicError
+				switch {
+				case errors.As(message.Err, &panicErr):
+					if len(panicErr.Stack) == 0 {
+						t.Errorf("expected the panic to carry a stack trace")
+					}
+					results = append(results, fmt.Sprintf("panic %v %s", panicErr.Value, panicErr.Raw))
+				case message.Err != nil:
+					results = append(results, message.Err.Error())
+				default:
+					results = append(results, message.Data.(string))
+				}
+			}
+
+			result := fmt.Sprint(results)
+			if result != "[tweet 0 panic cannot decode bad tweet tweet 2 EOF]" {
+				t.Errorf("got %s", result)
+			}
+		})
+	}
+}
+
+func TestReconnectPolicyPanicStopsStream(t *testing.T) {
+	api := givenStreamWithBody([]byte("tweet 0\r\n"))
+	api.SetReconnectPolicy(func(attempt int, err error) (time.Duration, bool) {
+		panic("bad policy")
+	})
+	api.StartStream(nil)
+
+	for range api.GetMessages() {
+	}
+
+	var panicErr *PanicError
+	if err := api.Wait(); !errors.As(err, &panicErr) || panicErr.Value != "bad policy" {
+		t.Errorf("expected the stream to stop with a *PanicError, got %v", err)
+	}
+}
+
+// panicking is a dead letter sink, deduplicator, gap filler and checkpoint store that panics,
+// except when loading a checkpoint from an hour ago.
+type panicking struct{}
+
+func (panicking) Write(letter DeadLetter) error { panic("sink") }
+func (panicking) Seen(id string) bool           { panic("deduplicator") }
+func (panicking) Save(checkpoint Checkpoint) error {
+	panic("checkpoint store")
+}
+func (panicking) Fill(ctx context.Context, gap Gap, deliver func(payload []byte) bool) error {
+	panic("gap filler")
+}
+func (panicking) Load() (Checkpoint, error) {
+	return Checkpoint{TweetID: "1", ReceivedAt: time.Now().Add(-time.Hour)}, nil
+}
+
+func TestDependencyPanicsAreRecovered(t *testing.T) {
+	var tests = []struct {
+		setup   func(api *Stream)
+		results []string
+		stats   func(stats StreamStats) bool
+	}{
+		{
+			func(api *Stream) {
+				api.SetDeadLetterSink(panicking{})
+				api.SetUnmarshalHook(func(b []byte) (interface{}, error) { return nil, errors.New("cannot decode") })
+			},
+			[]string{"cannot decode", "EOF"},
+			func(stats StreamStats) bool { return stats.DeadLetterErrors == 1 },
+		},
+		{
+			func(api *Stream) { api.SetDeduplicator(panicking{}) },
+			[]string{"panic: deduplicator", `{"data":{"id":"2"}}`, "EOF"},
+			func(stats StreamStats) bool { return stats.Suppressed == 0 },
+		},
+		{
+			func(api *Stream) {
+				api.SetCheckpointStore(panicking{}, 0)
+				api.SetGapFiller(panicking{})
+			},
+			[]string{`{"data":{"id":"2"}}`, "EOF", "panic: gap filler"},
+			func(stats StreamStats) bool { return stats.CheckpointErrors > 0 },
+		},
+	}
+
+	for i, tt := range tests {
+		testName := fmt.Sprintf("TestDependencyPanicsAreRecovered (%d)", i)
+		t.Run(testName, func(t *testing.T) {
+			api := givenStreamWithBody([]byte(`{"data":{"id":"2"}}` + "\r\n"))
+			tt.setup(api)
+			if err := api.StartStream(nil); err != nil {
+				t.Fatalf("got err when starting stream %v", err)
+			}
+
+			var results []string
+			for message := range api.GetMessages() {
+				var gapErr *GapError
+				switch {
+				case errors.As(message.Err, &gapErr):
+					results = append(results, gapErr.Err.Error())
+				case message.Err != nil:
+					results = append(results, message.Err.Error())
+				default:
+					results = append(results, string(message.Data.([]byte)))
+				}
+				message.Ack()
+			}
+
+			sort.Strings(results)
+			sort.Strings(tt.results)
+			if fmt.Sprint(results) != fmt.Sprint(tt.results) {
+				t.Errorf("got %q, want %q", results, tt.results)
+			}
+			if stats := api.Stats(); !tt.stats(stats) {
+				t.Errorf("got stats %+v", stats)
+			}
+		})
+	}
+}
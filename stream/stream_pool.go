@@ -0,0 +1,78 @@
+package stream
+
+import (
+	"errors"
+	"sync"
+)
+
+// maxPooledBytes is the largest buffer kept in the pool, so one huge message does not stay in memory forever.
+const maxPooledBytes = 1 << 20
+
+var (
+	crlf = []byte("\r\n")
+
+	bytesPool = sync.Pool{
+		New: func() interface{} {
+			return &PooledBytes{b: make([]byte, 0, 4096)}
+		},
+	}
+)
+
+// PooledBytes is a raw message read from Twitter in a buffer borrowed from a pool.
+// It is valid until Release is called, after which the buffer is reused for another message.
+type PooledBytes struct {
+	b []byte
+}
+
+func getPooledBytes() *PooledBytes {
+	p := bytesPool.Get().(*PooledBytes)
+	p.b = p.b[:0]
+	return p
+}
+
+// Bytes returns the raw message. The slice must not be used after Release is called.
+func (p *PooledBytes) Bytes() []byte {
+	return p.b
+}
+
+// Release returns the buffer to the pool. It must be called exactly once, and the buffer must not be used afterwards.
+func (p *PooledBytes) Release() {
+	if p == nil || cap(p.b) > maxPooledBytes {
+		return
+	}
+	bytesPool.Put(p)
+}
+
+// Release releases the *PooledBytes carried as Data, if any. Call it once a message has been processed
+// when it may carry a pooled buffer.
+func (m StreamMessage) Release() {
+	if raw, ok := m.Data.(*PooledBytes); ok {
+		raw.Release()
+	}
+}
+
+// ErrNoRaw is returned by sinks for messages without a Payload. Use SetIncludeRaw when the stream has an
+// UnmarshalHook.
+var ErrNoRaw = errors.New("raw payload of the message is not available")
+
+// Payload returns the raw payload of the message: Raw if it is set, or Data if it is a []byte or a *PooledBytes.
+// It returns nil otherwise. The payload of a *PooledBytes must not be used after Release.
+func (m StreamMessage) Payload() []byte {
+	if m.Raw != nil {
+		return m.Raw
+	}
+	switch d := m.Data.(type) {
+	case []byte:
+		return d
+	case *PooledBytes:
+		return d.Bytes()
+	}
+	return nil
+}
+
+// SetPooledBuffers decides what messages carry as Data when no UnmarshalHook is set.
+// By default Data is a []byte copy of the raw message that you own.
+// When enabled, Data is a *PooledBytes that avoids the copy and must be released with Release once processed.
+func (s *Stream) SetPooledBuffers(enabled bool) {
+	s.pooledBuffers = enabled
+}
@@ -0,0 +1,25 @@
+package stream
+
+import (
+	"github.com/fallenstedt/twitter-stream/httpclient"
+)
+
+// NewSampleStream creates a stream of about 1% of all public tweets, from GET /2/tweets/sample/stream.
+// It does not use rules, so messages have no matching_rules. Use the StreamQueryParamsBuilder to request
+// fields and expansions like with the filtered stream.
+// Read more at https://developer.twitter.com/en/docs/twitter-api/tweets/volume-streams/api-reference/get-tweets-sample-stream.
+func NewSampleStream(httpClient httpclient.IHttpClient, reader IStreamResponseBodyReader) *Stream {
+	s := NewStream(httpClient, reader)
+	s.endpoint = httpClient.GetSampleStream
+	return s
+}
+
+// NewSample10Stream creates a stream of about 10% of all public tweets, from GET /2/tweets/sample10/stream.
+// The volume is split in partitions, so choose one with `AddPartition` on the StreamQueryParamsBuilder.
+// Run one stream per partition to consume all of them.
+// Read more at https://developer.twitter.com/en/docs/twitter-api/tweets/volume-streams/api-reference/get-tweets-sample10-stream.
+func NewSample10Stream(httpClient httpclient.IHttpClient, reader IStreamResponseBodyReader) *Stream {
+	s := NewStream(httpClient, reader)
+	s.endpoint = httpClient.GetSample10Stream
+	return s
+}
@@ -0,0 +1,64 @@
+package stream
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/fallenstedt/twitter-stream/httpclient"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestSampleStreams(t *testing.T) {
+	var tests = []struct {
+		newStream   func(httpClient httpclient.IHttpClient, reader IStreamResponseBodyReader) *Stream
+		queryParams *url.Values
+		result      string
+	}{
+		{NewSampleStream, NewStreamQueryParamsBuilder().AddTweetField("lang").Build(), "[sample tweet.fields=lang sample tweet.fields=lang]"},
+		{NewSample10Stream, NewStreamQueryParamsBuilder().AddPartition(2).Build(), "[sample10 partition=2 sample10 partition=2]"},
+	}
+
+	for i, tt := range tests {
+		testName := fmt.Sprintf("TestSampleStreams (%d)", i)
+		t.Run(testName, func(t *testing.T) {
+			var requests []string
+			respond := func(endpoint string) func(queryParams *url.Values) (*http.Response, error) {
+				return func(queryParams *url.Values) (*http.Response, error) {
+					requests = append(requests, endpoint, queryParams.Encode())
+					return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(bytes.NewReader([]byte(`{"data":{"id":"1"}}` + "\r\n")))}, nil
+				}
+			}
+			client := httpclient.NewHttpClientMock("foobar")
+			client.MockGetSearchStream = func(queryParams *url.Values) (*http.Response, error) {
+				return nil, errors.New("expected a sampled stream")
+			}
+			client.MockGetSampleStream = respond("sample")
+			client.MockGetSample10Stream = respond("sample10")
+
+			api := tt.newStream(client, NewStreamResponseBodyReader())
+			api.SetReconnectPolicy(func(attempt int, err error) (time.Duration, bool) {
+				return 0, len(requests) < 4
+			})
+			api.StartStream(tt.queryParams)
+
+			var tweets int
+			for message := range api.GetMessages() {
+				if message.Err == nil {
+					tweets++
+				}
+			}
+
+			result := fmt.Sprint(requests)
+			if result != tt.result {
+				t.Errorf("got %s, want %s", result, tt.result)
+			}
+			if tweets != 2 {
+				t.Errorf("got %d tweets, want 2", tweets)
+			}
+		})
+	}
+}
@@ -0,0 +1,88 @@
+package stream
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/fallenstedt/twitter-stream/spool"
+)
+
+// SetSpool places an on-disk spool between Twitter and the messages channel. Tweets are written to the spool
+// as soon as they are read, so the connection keeps draining at line rate while consumers catch up.
+// Every message read from the spool must be acknowledged with StreamMessage.Ack, otherwise it is delivered
+// again when the stream is restarted or the spool is reopened by a new process.
+// With the OverflowSpill policy, tweets are only written to the spool while the buffer is full.
+// Call SetSpool before StartStream. The spool is not closed when the stream stops.
+func (s *Stream) SetSpool(sp spool.ISpool) {
+	s.spool = sp
+}
+
+// Ack acknowledges that the message has been processed. It is a no-op for messages that were not read from a spool.
+func (m StreamMessage) Ack() {
+	if m.ack != nil {
+		m.ack()
+	}
+}
+
+// WithAck returns a copy of the message that also calls ack when it is acknowledged.
+// It lets handlers that build their own messages, and their tests, observe acknowledgements.
+func (m StreamMessage) WithAck(ack func()) StreamMessage {
+	previous := m.ack
+	m.ack = func() {
+		if previous != nil {
+			previous()
+		}
+		ack()
+	}
+	return m
+}
+
+// drainSpool decodes records from the spool and sends them to the messages channel until the stream is stopped.
+func (s *Stream) drainSpool(drained chan struct{}) {
+	defer close(drained)
+
+	for {
+		record, err := s.spool.Next(s.done)
+		if err != nil {
+			s.emit(StreamMessage{Data: nil, Err: err})
+			return
+		}
+		if record.Data == nil {
+			return
+		}
+
+		id := record.ID
+		receivedAt := time.Now()
+		ack := s.checkpointAck(s.trackedTweetID(record.Data), receivedAt, func() { s.spool.Ack(id) })
+		message := StreamMessage{ReceivedAt: receivedAt, ack: ack}
+		if !s.deliver(&PooledBytes{b: record.Data}, message) {
+			return
+		}
+		if s.overflowPolicy == OverflowSpill {
+			atomic.AddUint64(&s.counters.unspilled, ^uint64(0))
+		}
+	}
+}
+
+// spills reports whether a tweet goes to the spool. With OverflowSpill, tweets are only spilled while the buffer
+// is full, or while tweets spilled before them have not been delivered, so they stay in order.
+func (s *Stream) spills() bool {
+	if s.overflowPolicy != OverflowSpill {
+		return true
+	}
+	return atomic.LoadUint64(&s.counters.unspilled) > 0 || len(s.messages) >= cap(s.messages)
+}
+
+// spill appends a tweet to the spool. Spilled tweets are counted before they can be delivered.
+func (s *Stream) spill(b []byte) error {
+	if s.overflowPolicy != OverflowSpill {
+		return s.spool.Append(b)
+	}
+	atomic.AddUint64(&s.counters.unspilled, 1)
+	if err := s.spool.Append(b); err != nil {
+		atomic.AddUint64(&s.counters.unspilled, ^uint64(0))
+		return err
+	}
+	atomic.AddUint64(&s.counters.spilled, 1)
+	return nil
+}
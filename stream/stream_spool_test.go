@@ -0,0 +1,186 @@
+package stream
+
+import (
+	"errors"
+	"fmt"
+	"github.com/fallenstedt/twitter-stream/httpclient"
+	"github.com/fallenstedt/twitter-stream/spool"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStreamDeliversSpooledMessagesUntilAcknowledged(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "spool")
+	defer os.RemoveAll(dir)
+
+	sp, err := spool.NewSpool(spool.Options{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sp.Close()
+
+	body, writer := io.Pipe()
+	client := httpclient.NewHttpClientMock("foobar")
+	client.MockGetSearchStream = func(queryParams *url.Values) (*http.Response, error) {
+		return &http.Response{StatusCode: http.StatusOK, Body: body}, nil
+	}
+	instance := NewStream(client, NewStreamResponseBodyReader())
+	instance.SetSpool(sp)
+
+	if err := instance.StartStream(nil); err != nil {
+		t.Fatalf("got err when starting stream %v", err)
+	}
+	writer.Write([]byte("1\r\n2\r\n"))
+
+	messages := instance.GetMessages()
+	first := <-messages
+	second := <-messages
+	if string(first.Data.([]byte)) != "1" || string(second.Data.([]byte)) != "2" {
+		t.Fatalf("unexpected messages %v %v", first, second)
+	}
+	first.Ack()
+
+	instance.StopStream()
+	instance.Wait()
+
+	// The second message was never acknowledged, so it is delivered again after restarting.
+	idle, _ := io.Pipe()
+	client.MockGetSearchStream = func(queryParams *url.Values) (*http.Response, error) {
+		return &http.Response{StatusCode: http.StatusOK, Body: idle}, nil
+	}
+	if err := instance.StartStream(nil); err != nil {
+		t.Fatalf("got err when restarting stream %v", err)
+	}
+
+	redelivered := <-instance.GetMessages()
+	if redelivered.Err != nil || string(redelivered.Data.([]byte)) != "2" {
+		t.Errorf("expected the unacknowledged message again, got %v", redelivered)
+	}
+	redelivered.Ack()
+	instance.StopStream()
+	instance.Wait()
+
+	if sp.Pending() != 0 {
+		t.Errorf("expected no pending messages, got %d", sp.Pending())
+	}
+}
+
+func TestStreamSpillsTweetsThatDoNotFit(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "spool")
+	defer os.RemoveAll(dir)
+
+	sp, err := spool.NewSpool(spool.Options{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sp.Close()
+
+	body, writer := io.Pipe()
+	client := httpclient.NewHttpClientMock("foobar")
+	client.MockGetSearchStream = func(queryParams *url.Values) (*http.Response, error) {
+		return &http.Response{StatusCode: http.StatusOK, Body: body}, nil
+	}
+	instance := NewStream(client, NewStreamResponseBodyReader())
+	instance.SetSpool(sp)
+	instance.SetBuffer(1, OverflowSpill)
+
+	if err := instance.StartStream(nil); err != nil {
+		t.Fatalf("got err when starting stream %v", err)
+	}
+	writer.Write([]byte("1\r\n2\r\n3\r\n4\r\n"))
+	// The first tweet fills the buffer, so the others are spilled until it is received.
+	for instance.Stats().Spilled < 3 {
+		time.Sleep(time.Millisecond)
+	}
+
+	var data []string
+	messages := instance.GetMessages()
+	for len(data) < 4 {
+		message := <-messages
+		data = append(data, string(message.Data.([]byte)))
+		message.Ack()
+	}
+	instance.StopStream()
+	instance.Wait()
+
+	if fmt.Sprint(data) != "[1 2 3 4]" {
+		t.Errorf("expected tweets in order, got %v", data)
+	}
+	if stats := instance.Stats(); stats.Spilled != 3 || stats.Dropped != 0 {
+		t.Errorf("expected 3 spilled tweets, got %+v", stats)
+	}
+	if sp.Pending() != 0 {
+		t.Errorf("expected every spilled tweet to be acknowledged, got %d pending", sp.Pending())
+	}
+}
+
+// rewindingSpool blocks its first Rewind until release is closed, then fails it.
+type rewindingSpool struct {
+	spool.ISpool
+	rewinds int
+	started chan struct{}
+	release chan struct{}
+}
+
+func (s *rewindingSpool) Rewind() error {
+	if s.rewinds++; s.rewinds > 1 {
+		return s.ISpool.Rewind()
+	}
+	close(s.started)
+	<-s.release
+	return errors.New("disk is full")
+}
+
+func TestStopStreamDuringFailingRewind(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "spool")
+	defer os.RemoveAll(dir)
+	sp, err := spool.NewSpool(spool.Options{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sp.Close()
+
+	client := httpclient.NewHttpClientMock("foobar")
+	client.MockGetSearchStream = func(queryParams *url.Values) (*http.Response, error) {
+		return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(strings.NewReader(""))}, nil
+	}
+	rewinding := &rewindingSpool{ISpool: sp, started: make(chan struct{}), release: make(chan struct{})}
+	api := NewStream(client, NewStreamResponseBodyReader())
+	api.SetSpool(rewinding)
+
+	started := make(chan error, 1)
+	go func() { started <- api.StartStream(nil) }()
+	<-rewinding.started
+	api.StopStream()
+	close(rewinding.release)
+	if err := <-started; err == nil {
+		t.Fatal("expected the failed rewind to be returned")
+	}
+
+	waited := make(chan error, 1)
+	go func() { waited <- api.Wait() }()
+	select {
+	case err := <-waited:
+		if err != nil {
+			t.Errorf("expected a stopped stream without error, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected Wait to return once the stream was stopped")
+	}
+
+	// the stream starts again with a new done channel, and stops with the error of its connection
+	if err := api.StartStream(nil); err != nil {
+		t.Fatal(err)
+	}
+	for range api.GetMessages() {
+	}
+	if err := api.Wait(); err != io.EOF {
+		t.Errorf("expected the restarted stream to stop with io.EOF, got %v", err)
+	}
+}
@@ -0,0 +1,48 @@
+package stream
+
+import "errors"
+
+// StreamState is the lifecycle state of a Stream.
+type StreamState int
+
+const (
+	// StateIdle is a stream that has not been started yet.
+	StateIdle StreamState = iota
+	// StateConnecting is a stream that is connecting, or reconnecting, to Twitter.
+	StateConnecting
+	// StateStreaming is a stream that is connected and reading tweets.
+	StateStreaming
+	// StateStopping is a stream that has been asked to stop and is closing its connection.
+	StateStopping
+	// StateStopped is a stream that has stopped. It can be started again with StartStream.
+	StateStopped
+)
+
+// ErrStreamRunning is returned by StartStream when the stream has already been started and has not stopped yet.
+var ErrStreamRunning = errors.New("stream is already running")
+
+// String returns the name of the state.
+func (s StreamState) String() string {
+	switch s {
+	case StateIdle:
+		return "idle"
+	case StateConnecting:
+		return "connecting"
+	case StateStreaming:
+		return "streaming"
+	case StateStopping:
+		return "stopping"
+	case StateStopped:
+		return "stopped"
+	default:
+		return "unknown"
+	}
+}
+
+// ErrOf returns the error that stopped s, if s reports one with an Err method like *Stream does.
+func ErrOf(s IStream) error {
+	if status, ok := s.(interface{ Err() error }); ok {
+		return status.Err()
+	}
+	return nil
+}
@@ -2,13 +2,17 @@ package stream
 
 import (
 	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/fallenstedt/twitter-stream/httpclient"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestGetMessages(t *testing.T) {
@@ -102,9 +106,168 @@ func TestStartStream(t *testing.T) {
 			res, _ := r.Data.([]byte)
 
 			if string(expected) != string(res) {
-				t.Errorf("got %v, want %s", result, tt.result)
+				t.Errorf("got %v, want %v", result, tt.result)
 			}
 		})
 
 	}
 }
+
+func TestStartStreamRetriesRateLimitedConnects(t *testing.T) {
+	var tests = []struct {
+		policy      ReconnectPolicy
+		connections int
+		status      int
+	}{
+		// without a reconnect policy, 429 is retried like the http client used to
+		{nil, 2, 0},
+		{func(attempt int, err error) (time.Duration, bool) { return 0, false }, 1, http.StatusTooManyRequests},
+	}
+
+	for i, tt := range tests {
+		testName := fmt.Sprintf("TestStartStreamRetriesRateLimitedConnects (%d)", i)
+		t.Run(testName, func(t *testing.T) {
+			connections := 0
+			client := httpclient.NewHttpClientMock("foobar")
+			client.MockGetSearchStream = func(queryParams *url.Values) (*http.Response, error) {
+				connections++
+				if connections == 1 {
+					return nil, &httpclient.StatusError{StatusCode: http.StatusTooManyRequests}
+				}
+				return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(strings.NewReader(""))}, nil
+			}
+			instance := NewStream(client, NewStreamResponseBodyReader())
+			instance.SetReconnectPolicy(tt.policy)
+
+			err := instance.StartStream(nil)
+			var statusErr *httpclient.StatusError
+			if errors.As(err, &statusErr) && statusErr.StatusCode != tt.status || statusErr == nil && tt.status != 0 {
+				t.Errorf("got err %v, want status %d", err, tt.status)
+			}
+			if connections != tt.connections {
+				t.Errorf("got %d connections, want %d", connections, tt.connections)
+			}
+			instance.StopStream()
+		})
+	}
+}
+
+func TestStopStreamIsIdempotentAndInterruptsReads(t *testing.T) {
+	body, writer := io.Pipe()
+	client := httpclient.NewHttpClientMock("foobar")
+	client.MockGetSearchStream = func(queryParams *url.Values) (*http.Response, error) {
+		return &http.Response{StatusCode: http.StatusOK, Body: body}, nil
+	}
+	instance := NewStream(client, NewStreamResponseBodyReader())
+
+	if err := instance.StartStream(nil); err != nil {
+		t.Fatalf("got err when starting stream %v", err)
+	}
+	if instance.State() != StateStreaming {
+		t.Errorf("got state %v, want %v", instance.State(), StateStreaming)
+	}
+
+	// The stream goroutine is now blocked reading from a connection that never sends anything.
+	instance.StopStream()
+	instance.StopStream()
+
+	if err := instance.Wait(); err != nil {
+		t.Errorf("expected no error after StopStream, got %v", err)
+	}
+	if instance.State() != StateStopped {
+		t.Errorf("got state %v, want %v", instance.State(), StateStopped)
+	}
+	if _, err := writer.Write([]byte("hello\r\n")); err == nil {
+		t.Errorf("expected the response body to be closed")
+	}
+}
+
+func TestStopStreamInterruptsUnconsumedSend(t *testing.T) {
+	client := httpclient.NewHttpClientMock("foobar")
+	client.MockGetSearchStream = func(queryParams *url.Values) (*http.Response, error) {
+		return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(bytes.NewReader(nil))}, nil
+	}
+	reader := mockStreamResponseBodyReader{}
+	reader.MockSetStreamResponseBody = func(body io.Reader) {}
+	reader.MockReadNext = func() ([]byte, error) {
+		return []byte("hello"), nil
+	}
+	instance := NewStream(client, reader)
+
+	if err := instance.StartStream(nil); err != nil {
+		t.Fatalf("got err when starting stream %v", err)
+	}
+
+	// Nobody reads from the messages channel.
+	instance.StopStream()
+
+	select {
+	case <-instance.Done():
+	case <-time.After(time.Second):
+		t.Fatal("expected stream goroutine to exit")
+	}
+}
+
+func TestStreamCanBeRestarted(t *testing.T) {
+	client := httpclient.NewHttpClientMock("foobar")
+	client.MockGetSearchStream = func(queryParams *url.Values) (*http.Response, error) {
+		return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(bytes.NewReader([]byte("hello\r\n")))}, nil
+	}
+	instance := NewStream(client, NewStreamResponseBodyReader())
+
+	for i := 0; i < 2; i++ {
+		if err := instance.StartStream(nil); err != nil {
+			t.Fatalf("got err when starting stream %v", err)
+		}
+		if err := instance.StartStream(nil); err != ErrStreamRunning {
+			t.Errorf("expected ErrStreamRunning, got %v", err)
+		}
+
+		var messages []StreamMessage
+		for message := range instance.GetMessages() {
+			messages = append(messages, message)
+		}
+
+		if len(messages) != 2 || string(messages[0].Data.([]byte)) != "hello" || messages[1].Err != io.EOF {
+			t.Errorf("unexpected messages %v", messages)
+		}
+		if err := instance.Wait(); err != io.EOF {
+			t.Errorf("expected io.EOF, got %v", err)
+		}
+
+		// Stopping a stream that already stopped itself is a no-op.
+		instance.StopStream()
+	}
+}
+
+func TestStreamMessageMetadata(t *testing.T) {
+	api := givenStreamWithBody([]byte("{\"data\":{}}\r\nnot json\r\n"))
+	api.SetIncludeRaw(true)
+	api.SetUnmarshalHook(func(b []byte) (interface{}, error) {
+		var data interface{}
+		err := json.Unmarshal(b, &data)
+		return data, err
+	})
+
+	var results []string
+	for run := 0; run < 2; run++ {
+		before := time.Now()
+		api.StartStream(nil)
+		for message := range api.GetMessages() {
+			if message.Err == io.EOF {
+				results = append(results, fmt.Sprintf("%d/%d EOF", message.ConnectionID, message.Seq))
+				continue
+			}
+			if message.ReceivedAt.Before(before) {
+				t.Errorf("expected ReceivedAt to be set, got %v", message.ReceivedAt)
+			}
+			results = append(results, fmt.Sprintf("%d/%d %s", message.ConnectionID, message.Seq, message.Raw))
+		}
+	}
+
+	result := strings.Join(results, ", ")
+	expected := "1/1 {\"data\":{}}, 1/2 not json, 1/3 EOF, 2/4 {\"data\":{}}, 2/5 not json, 2/6 EOF"
+	if result != expected {
+		t.Errorf("got %s, want %s", result, expected)
+	}
+}
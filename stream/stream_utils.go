@@ -24,7 +24,7 @@ func stopped(done <-chan struct{}) bool {
 type (
 	// IStreamResponseBodyReader is the interface the streamResponseBodyReader implements.
 	IStreamResponseBodyReader interface {
-		readNext() ([]byte, error)
+		readNext() (*PooledBytes, error)
 		setStreamResponseBody(body io.Reader)
 	}
 
@@ -32,7 +32,6 @@ type (
 	// body. It can scan the arbitrary length of response body unlike bufio.Scanner.
 	streamResponseBodyReader struct {
 		reader *bufio.Reader
-		buf    bytes.Buffer
 	}
 )
 
@@ -51,49 +50,51 @@ func (r *streamResponseBodyReader) setStreamResponseBody(body io.Reader) {
 // readNext reads Twitter stream response body and returns the next stream
 // content if exists. Returns io.EOF error if we reached the end of the stream
 // and there's no more message to read.
-func (r *streamResponseBodyReader) readNext() ([]byte, error) {
-	// Discard all the bytes from buf and continue to use the allocated memory
-	// space for reading the next message.
-	r.buf.Truncate(0)
+// The returned buffer is owned by the caller, who should Release it once it is no longer used.
+func (r *streamResponseBodyReader) readNext() (*PooledBytes, error) {
+	message := getPooledBytes()
 	for {
 		// Twitter stream messages are separated with "\r\n", and a valid
 		// message may sometimes contain '\n' in the middle.
-		// bufio.Reader.Read() can accept one byte delimiter only, so we need to
+		// bufio.Reader.ReadSlice() can accept one byte delimiter only, so we need to
 		// first break out each line on '\n' and then check whether the line ends
 		// with "\r\n" to find message boundaries.
 		// https://dev.twitter.com/streaming/overview/processing
-		line, err := r.reader.ReadBytes('\n')
+		// ReadSlice does not allocate, but its result is only valid until the next read,
+		// so every line is appended to the message before reading again.
+		line, err := r.reader.ReadSlice('\n')
+		message.b = append(message.b, line...)
+		// The line is longer than bufio's buffer, keep reading the rest of it.
+		if err == bufio.ErrBufferFull {
+			continue
+		}
 		// Non-EOF error should be propagated to callers immediately.
 		if err != nil && err != io.EOF {
+			message.Release()
 			return nil, err
 		}
 		// EOF error means that we reached the end of the stream body before finding
 		// delimiter '\n'. If "line" is empty, it means the reader didn't read any
-		// data from the stream before reaching EOF and there's nothing to append to
-		// buf.
+		// data from the stream before reaching EOF and there's nothing to append.
 		if err == io.EOF && len(line) == 0 {
-			// if buf has no data, propagate io.EOF to callers and let them know that
+			// if the message has no data, propagate io.EOF to callers and let them know that
 			// we've finished processing the stream.
-			if r.buf.Len() == 0 {
+			if len(message.b) == 0 {
+				message.Release()
 				return nil, err
 			}
 			// Otherwise, we still have a remaining stream message to return.
 			break
 		}
-		// If the line ends with "\r\n", it's the end of one stream message data.
-		if bytes.HasSuffix(line, []byte("\r\n")) {
-			// reader.ReadBytes() returns a slice including the delimiter itself, so
-			// we need to trim '\n' as well as '\r' from the end of the slice.
-			r.buf.Write(bytes.TrimRight(line, "\r\n"))
+		// If the message ends with "\r\n", it's the end of one stream message data.
+		// We need to trim '\n' as well as '\r' from the end of the message.
+		if bytes.HasSuffix(message.b, crlf) {
+			message.b = bytes.TrimRight(message.b, "\r\n")
 			break
 		}
-		// Otherwise, the line is not the end of a stream message, so we append
-		// the line to buf and continue to scan lines.
-		r.buf.Write(line)
+		// Otherwise, the line is not the end of a stream message, so we
+		// continue to scan lines.
 	}
 
-	// Get the stream message bytes from buf. Not that Bytes() won't mark the
-	// returned data as "read", and we need to explicitly call Truncate(0) to
-	// discard from buf before writing the next stream message to buf.
-	return r.buf.Bytes(), nil
+	return message, nil
 }
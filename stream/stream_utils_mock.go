@@ -9,8 +9,12 @@ type mockStreamResponseBodyReader struct {
 	MockSetStreamResponseBody func(body io.Reader)
 }
 
-func (m mockStreamResponseBodyReader) readNext() ([]byte, error) {
-	return m.MockReadNext()
+func (m mockStreamResponseBodyReader) readNext() (*PooledBytes, error) {
+	b, err := m.MockReadNext()
+	if b == nil {
+		return nil, err
+	}
+	return &PooledBytes{b: b}, err
 }
 
 func (m mockStreamResponseBodyReader) setStreamResponseBody(body io.Reader) {
@@ -0,0 +1,174 @@
+package stream
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestReadNext(t *testing.T) {
+	var tests = []struct {
+		body   string
+		result []string
+	}{
+		{"hello\r\nworld\r\n", []string{"hello", "world"}},
+		{"multi\nline\r\n\r\nafter keep-alive", []string{"multi\nline", "", "after keep-alive"}},
+		{strings.Repeat("a", 10000) + "\r\n", []string{strings.Repeat("a", 10000)}},
+	}
+
+	for i, tt := range tests {
+		testName := fmt.Sprintf("TestReadNext (%d)", i)
+
+		t.Run(testName, func(t *testing.T) {
+			reader := NewStreamResponseBodyReader()
+			reader.setStreamResponseBody(strings.NewReader(tt.body))
+
+			var result []string
+			for {
+				b, err := reader.readNext()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatalf("got err %v", err)
+				}
+				result = append(result, string(b.Bytes()))
+				b.Release()
+			}
+
+			if fmt.Sprintf("%q", result) != fmt.Sprintf("%q", tt.result) {
+				t.Errorf("got %q, want %q", result, tt.result)
+			}
+		})
+	}
+}
+
+func TestReadNextSplitsCarriageReturnAcrossBuffers(t *testing.T) {
+	reader := &streamResponseBodyReader{}
+	// The smallest bufio buffer is 16 bytes, so "\r" and "\n" end up in different reads.
+	reader.reader = bufio.NewReaderSize(strings.NewReader("0123456789abcde\r\nnext\r\n"), 16)
+
+	b, err := reader.readNext()
+	if err != nil || string(b.Bytes()) != "0123456789abcde" {
+		t.Errorf("got %q, err %v", b.Bytes(), err)
+	}
+}
+
+func TestMessagesOwnTheirBytes(t *testing.T) {
+	instance := givenStreamWithBody([]byte("first\r\nsecond\r\n"))
+	instance.SetBuffer(2, OverflowBlock)
+
+	if err := instance.StartStream(nil); err != nil {
+		t.Fatalf("got err when starting stream %v", err)
+	}
+
+	first := <-instance.GetMessages()
+	second := <-instance.GetMessages()
+	if string(first.Data.([]byte)) != "first" || string(second.Data.([]byte)) != "second" {
+		t.Errorf("expected messages to keep their bytes, got %q and %q", first.Data, second.Data)
+	}
+}
+
+func TestPooledBuffers(t *testing.T) {
+	instance := givenStreamWithBody([]byte("first\r\n"))
+	instance.SetPooledBuffers(true)
+
+	if err := instance.StartStream(nil); err != nil {
+		t.Fatalf("got err when starting stream %v", err)
+	}
+
+	message := <-instance.GetMessages()
+	raw, ok := message.Data.(*PooledBytes)
+	if !ok || string(raw.Bytes()) != "first" {
+		t.Errorf("expected pooled bytes, got %v", message.Data)
+	}
+	raw.Release()
+}
+
+func TestMessagePayload(t *testing.T) {
+	pooled := getPooledBytes()
+	pooled.b = append(pooled.b, "pooled"...)
+	defer pooled.Release()
+
+	var tests = []struct {
+		message StreamMessage
+		result  string
+	}{
+		{StreamMessage{Data: []byte("bytes")}, "bytes"},
+		{StreamMessage{Data: pooled}, "pooled"},
+		{StreamMessage{Data: struct{}{}, Raw: []byte("raw")}, "raw"},
+		{StreamMessage{Data: []byte("bytes"), Raw: []byte("raw")}, "raw"},
+		{StreamMessage{Data: struct{}{}}, ""},
+	}
+
+	for i, tt := range tests {
+		testName := fmt.Sprintf("TestMessagePayload (%d)", i)
+		t.Run(testName, func(t *testing.T) {
+			if result := string(tt.message.Payload()); result != tt.result {
+				t.Errorf("got %q, want %q", result, tt.result)
+			}
+		})
+	}
+}
+
+func BenchmarkReadNext(b *testing.B) {
+	payloads, err := ioutil.ReadFile("testdata/search_stream.txt")
+	if err != nil {
+		b.Fatal(err)
+	}
+	body := bytes.NewReader(payloads)
+	reader := NewStreamResponseBodyReader()
+	reader.setStreamResponseBody(body)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		message, err := reader.readNext()
+		if err == io.EOF {
+			body.Reset(payloads)
+			continue
+		}
+		message.Release()
+	}
+}
+
+func benchmarkRawMessages(b *testing.B, pooled bool) {
+	payloads, err := ioutil.ReadFile("testdata/search_stream.txt")
+	if err != nil {
+		b.Fatal(err)
+	}
+	instance := givenStreamWithBody(bytes.Repeat(payloads, b.N/64+1))
+	instance.SetPooledBuffers(pooled)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	if err := instance.StartStream(nil); err != nil {
+		b.Fatal(err)
+	}
+	messages := instance.GetMessages()
+	for i := 0; i < b.N; i++ {
+		message := <-messages
+		if raw, ok := message.Data.(*PooledBytes); ok {
+			raw.Release()
+		}
+	}
+
+	b.StopTimer()
+	instance.StopStream()
+	instance.Wait()
+}
+
+func BenchmarkRawMessages(b *testing.B) {
+	b.Run("copy", func(b *testing.B) {
+		benchmarkRawMessages(b, false)
+	})
+	b.Run("pooled", func(b *testing.B) {
+		benchmarkRawMessages(b, true)
+	})
+}
@@ -0,0 +1,282 @@
+// Package tweets provides typed structs for the payloads sent by Twitter's v2 streaming and search endpoints.
+package tweets
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/fallenstedt/twitter-stream/stream"
+)
+
+// ErrNoTweet is returned by FromMessage for messages that are neither decoded with UnmarshalHook nor carry their
+// raw payload.
+var ErrNoTweet = errors.New("messages must be decoded with tweets.UnmarshalHook, or carry their raw payload")
+
+type (
+	// StreamData is a single payload from a v2 tweet stream. Use UnmarshalHook to decode into it.
+	StreamData struct {
+		Data          Tweet          `json:"data"`
+		Includes      Includes       `json:"includes,omitempty"`
+		MatchingRules []MatchingRule `json:"matching_rules,omitempty"`
+		Errors        []Error        `json:"errors,omitempty"`
+	}
+
+	// MatchingRule is a filtered stream rule that matched the tweet.
+	MatchingRule struct {
+		ID  string `json:"id"`
+		Tag string `json:"tag"`
+	}
+
+	// Tweet is a v2 tweet object.
+	// https://developer.twitter.com/en/docs/twitter-api/data-dictionary/object-model/tweet
+	Tweet struct {
+		ID                  string            `json:"id"`
+		Text                string            `json:"text"`
+		AuthorID            string            `json:"author_id,omitempty"`
+		ConversationID      string            `json:"conversation_id,omitempty"`
+		CreatedAt           time.Time         `json:"created_at"`
+		InReplyToUserID     string            `json:"in_reply_to_user_id,omitempty"`
+		Lang                string            `json:"lang,omitempty"`
+		PossiblySensitive   bool              `json:"possibly_sensitive,omitempty"`
+		ReplySettings       string            `json:"reply_settings,omitempty"`
+		Source              string            `json:"source,omitempty"`
+		EditHistoryTweetIDs []string          `json:"edit_history_tweet_ids,omitempty"`
+		ReferencedTweets    []ReferencedTweet `json:"referenced_tweets,omitempty"`
+		Attachments         *Attachments      `json:"attachments,omitempty"`
+		Geo                 *TweetGeo         `json:"geo,omitempty"`
+		Entities            *Entities         `json:"entities,omitempty"`
+		PublicMetrics       *TweetMetrics     `json:"public_metrics,omitempty"`
+		Withheld            *Withheld         `json:"withheld,omitempty"`
+		ContextAnnotations  []json.RawMessage `json:"context_annotations,omitempty"`
+	}
+
+	// ReferencedTweet is a tweet that this tweet retweets, quotes or replies to.
+	ReferencedTweet struct {
+		Type string `json:"type"`
+		ID   string `json:"id"`
+	}
+
+	// Attachments references media and polls found in Includes.
+	Attachments struct {
+		MediaKeys []string `json:"media_keys,omitempty"`
+		PollIDs   []string `json:"poll_ids,omitempty"`
+	}
+
+	// TweetGeo references the place a tweet was tagged with.
+	TweetGeo struct {
+		PlaceID     string       `json:"place_id,omitempty"`
+		Coordinates *Coordinates `json:"coordinates,omitempty"`
+	}
+
+	// Coordinates is a GeoJSON point.
+	Coordinates struct {
+		Type        string    `json:"type"`
+		Coordinates []float64 `json:"coordinates"`
+	}
+
+	// Entities are the hashtags, mentions, urls and cashtags parsed out of a tweet's text.
+	Entities struct {
+		Hashtags []Tag     `json:"hashtags,omitempty"`
+		Cashtags []Tag     `json:"cashtags,omitempty"`
+		Mentions []Mention `json:"mentions,omitempty"`
+		URLs     []URL     `json:"urls,omitempty"`
+	}
+
+	// Tag is a hashtag or cashtag entity.
+	Tag struct {
+		Start int    `json:"start"`
+		End   int    `json:"end"`
+		Tag   string `json:"tag"`
+	}
+
+	// Mention is a user mentioned in a tweet.
+	Mention struct {
+		Start    int    `json:"start"`
+		End      int    `json:"end"`
+		Username string `json:"username"`
+		ID       string `json:"id,omitempty"`
+	}
+
+	// URL is a link found in a tweet.
+	URL struct {
+		Start       int    `json:"start"`
+		End         int    `json:"end"`
+		URL         string `json:"url"`
+		ExpandedURL string `json:"expanded_url,omitempty"`
+		DisplayURL  string `json:"display_url,omitempty"`
+	}
+
+	// TweetMetrics are the public engagement counts of a tweet.
+	TweetMetrics struct {
+		RetweetCount int `json:"retweet_count"`
+		ReplyCount   int `json:"reply_count"`
+		LikeCount    int `json:"like_count"`
+		QuoteCount   int `json:"quote_count"`
+	}
+
+	// Withheld describes where content has been withheld.
+	Withheld struct {
+		Copyright    bool     `json:"copyright,omitempty"`
+		CountryCodes []string `json:"country_codes,omitempty"`
+		Scope        string   `json:"scope,omitempty"`
+	}
+
+	// Includes are the objects expanded with the expansions query param.
+	Includes struct {
+		Tweets []Tweet `json:"tweets,omitempty"`
+		Users  []User  `json:"users,omitempty"`
+		Media  []Media `json:"media,omitempty"`
+		Places []Place `json:"places,omitempty"`
+		Polls  []Poll  `json:"polls,omitempty"`
+	}
+
+	// User is a v2 user object.
+	// https://developer.twitter.com/en/docs/twitter-api/data-dictionary/object-model/user
+	User struct {
+		ID              string       `json:"id"`
+		Name            string       `json:"name"`
+		Username        string       `json:"username"`
+		CreatedAt       time.Time    `json:"created_at"`
+		Description     string       `json:"description,omitempty"`
+		Location        string       `json:"location,omitempty"`
+		PinnedTweetID   string       `json:"pinned_tweet_id,omitempty"`
+		ProfileImageURL string       `json:"profile_image_url,omitempty"`
+		Protected       bool         `json:"protected,omitempty"`
+		URL             string       `json:"url,omitempty"`
+		Verified        bool         `json:"verified,omitempty"`
+		PublicMetrics   *UserMetrics `json:"public_metrics,omitempty"`
+		Withheld        *Withheld    `json:"withheld,omitempty"`
+	}
+
+	// UserMetrics are the public counts of a user.
+	UserMetrics struct {
+		FollowersCount int `json:"followers_count"`
+		FollowingCount int `json:"following_count"`
+		TweetCount     int `json:"tweet_count"`
+		ListedCount    int `json:"listed_count"`
+	}
+
+	// Media is a v2 media object.
+	// https://developer.twitter.com/en/docs/twitter-api/data-dictionary/object-model/media
+	Media struct {
+		MediaKey        string `json:"media_key"`
+		Type            string `json:"type"`
+		URL             string `json:"url,omitempty"`
+		PreviewImageURL string `json:"preview_image_url,omitempty"`
+		DurationMs      int    `json:"duration_ms,omitempty"`
+		Height          int    `json:"height,omitempty"`
+		Width           int    `json:"width,omitempty"`
+		AltText         string `json:"alt_text,omitempty"`
+	}
+
+	// Place is a v2 place object.
+	// https://developer.twitter.com/en/docs/twitter-api/data-dictionary/object-model/place
+	Place struct {
+		ID          string `json:"id"`
+		FullName    string `json:"full_name"`
+		Name        string `json:"name,omitempty"`
+		Country     string `json:"country,omitempty"`
+		CountryCode string `json:"country_code,omitempty"`
+		PlaceType   string `json:"place_type,omitempty"`
+	}
+
+	// Poll is a v2 poll object.
+	// https://developer.twitter.com/en/docs/twitter-api/data-dictionary/object-model/poll
+	Poll struct {
+		ID              string       `json:"id"`
+		Options         []PollOption `json:"options"`
+		DurationMinutes int          `json:"duration_minutes,omitempty"`
+		EndDatetime     time.Time    `json:"end_datetime"`
+		VotingStatus    string       `json:"voting_status,omitempty"`
+	}
+
+	// PollOption is a single choice of a poll.
+	PollOption struct {
+		Position int    `json:"position"`
+		Label    string `json:"label"`
+		Votes    int    `json:"votes"`
+	}
+
+	// Error is a partial error Twitter sends alongside data, such as an expansion that could not be found.
+	Error struct {
+		Title        string `json:"title"`
+		Detail       string `json:"detail"`
+		Type         string `json:"type"`
+		Value        string `json:"value,omitempty"`
+		ResourceType string `json:"resource_type,omitempty"`
+		Parameter    string `json:"parameter,omitempty"`
+	}
+)
+
+// UnmarshalHook decodes a stream payload into a *StreamData. It can be passed to `stream.SetUnmarshalHook`.
+func UnmarshalHook(b []byte) (interface{}, error) {
+	data := new(StreamData)
+	err := json.Unmarshal(b, data)
+	return data, err
+}
+
+// FromMessage returns the tweet of message: its Data if it was decoded with UnmarshalHook, or its decoded Payload.
+func FromMessage(message stream.StreamMessage) (*StreamData, error) {
+	if data, ok := message.Data.(*StreamData); ok {
+		return data, nil
+	}
+	raw := message.Payload()
+	if raw == nil {
+		return nil, ErrNoTweet
+	}
+	data := new(StreamData)
+	if err := json.Unmarshal(raw, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// GetMatchingRules returns the rules that matched the tweet.
+func (d *StreamData) GetMatchingRules() []MatchingRule {
+	return d.MatchingRules
+}
+
+// Tags returns the tags of the rules that matched the tweet.
+func (d *StreamData) Tags() []string {
+	tags := make([]string, 0, len(d.MatchingRules))
+	for _, rule := range d.MatchingRules {
+		tags = append(tags, rule.Tag)
+	}
+	return tags
+}
+
+// Author returns the author of the tweet if it was expanded with the "author_id" expansion.
+func (d *StreamData) Author() *User {
+	return d.Includes.User(d.Data.AuthorID)
+}
+
+// User returns the included user with id, or nil.
+func (i *Includes) User(id string) *User {
+	for n := range i.Users {
+		if i.Users[n].ID == id {
+			return &i.Users[n]
+		}
+	}
+	return nil
+}
+
+// Tweet returns the included tweet with id, or nil.
+func (i *Includes) Tweet(id string) *Tweet {
+	for n := range i.Tweets {
+		if i.Tweets[n].ID == id {
+			return &i.Tweets[n]
+		}
+	}
+	return nil
+}
+
+// MediaByKey returns the included media with key, or nil.
+func (i *Includes) MediaByKey(key string) *Media {
+	for n := range i.Media {
+		if i.Media[n].MediaKey == key {
+			return &i.Media[n]
+		}
+	}
+	return nil
+}
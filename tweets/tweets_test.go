@@ -0,0 +1,75 @@
+package tweets
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/fallenstedt/twitter-stream/stream"
+)
+
+func TestUnmarshalHook(t *testing.T) {
+	payload := `{
+		"data": {
+			"id": "1470000000000000000",
+			"text": "gophers at work #golang",
+			"author_id": "2244994945",
+			"created_at": "2021-12-02T17:54:08.000Z",
+			"attachments": {"media_keys": ["3_1"]},
+			"entities": {"hashtags": [{"start": 16, "end": 23, "tag": "golang"}]}
+		},
+		"includes": {
+			"users": [{"id": "2244994945", "name": "Gopher", "username": "gopher"}],
+			"media": [{"media_key": "3_1", "type": "photo", "url": "https://pbs.twimg.com/media/1.jpg"}]
+		},
+		"matching_rules": [{"id": "1", "tag": "golang jobs"}, {"id": "2", "tag": "gophers"}]
+	}`
+
+	result, err := UnmarshalHook([]byte(payload))
+	if err != nil {
+		t.Fatalf("got err %v", err)
+	}
+
+	data := result.(*StreamData)
+	if data.Data.ID != "1470000000000000000" || data.Data.CreatedAt.Year() != 2021 {
+		t.Errorf("unexpected tweet %v", data.Data)
+	}
+	if data.Data.Entities.Hashtags[0].Tag != "golang" {
+		t.Errorf("unexpected entities %v", data.Data.Entities)
+	}
+	if author := data.Author(); author == nil || author.Username != "gopher" {
+		t.Errorf("expected author gopher, got %v", author)
+	}
+	if media := data.Includes.MediaByKey(data.Data.Attachments.MediaKeys[0]); media == nil || media.Type != "photo" {
+		t.Errorf("expected photo, got %v", media)
+	}
+	if tags := data.Tags(); len(tags) != 2 || tags[0] != "golang jobs" || tags[1] != "gophers" {
+		t.Errorf("unexpected tags %v", tags)
+	}
+}
+
+func TestFromMessage(t *testing.T) {
+	decoded := &StreamData{Data: Tweet{ID: "1"}}
+	var tests = []struct {
+		message stream.StreamMessage
+		id      string
+		err     error
+	}{
+		{stream.StreamMessage{Data: decoded}, "1", nil},
+		{stream.StreamMessage{Data: []byte(`{"data":{"id":"2"}}`)}, "2", nil},
+		{stream.StreamMessage{Data: struct{}{}, Raw: []byte(`{"data":{"id":"3"}}`)}, "3", nil},
+		{stream.StreamMessage{Data: struct{}{}}, "", ErrNoTweet},
+	}
+
+	for i, tt := range tests {
+		testName := fmt.Sprintf("TestFromMessage (%d)", i)
+		t.Run(testName, func(t *testing.T) {
+			data, err := FromMessage(tt.message)
+			if err != tt.err {
+				t.Fatalf("got err %v, want %v", err, tt.err)
+			}
+			if data != nil && data.Data.ID != tt.id {
+				t.Errorf("got id %s, want %s", data.Data.ID, tt.id)
+			}
+		})
+	}
+}
@@ -10,7 +10,7 @@ import (
 
 type TwitterApi struct {
 	Rules  rules.IRules
-	Stream stream.IStream
+	Stream *stream.Stream
 }
 
 // NewTokenGenerator creates a TokenGenerator which can request a Bearer token using a twitter api key and secret.
@@ -47,3 +47,18 @@ func NewTwitterStream(token string) *TwitterApi {
 	stream := stream.NewStream(client, stream.NewStreamResponseBodyReader())
 	return &TwitterApi{Rules: rules, Stream: stream}
 }
+
+// NewSampleStream consumes a twitter Bearer token.
+// It is used to stream about 1% of all public tweets with Twitter's v2 sampled stream API.
+func NewSampleStream(token string) *stream.Stream {
+	client := httpclient.NewHttpClient(token)
+	return stream.NewSampleStream(client, stream.NewStreamResponseBodyReader())
+}
+
+// NewSample10Stream consumes a twitter Bearer token.
+// It is used to stream a partition of about 10% of all public tweets. Choose the partition with
+// `NewStreamQueryParamsBuilder().AddPartition()`.
+func NewSample10Stream(token string) *stream.Stream {
+	client := httpclient.NewHttpClient(token)
+	return stream.NewSample10Stream(client, stream.NewStreamResponseBodyReader())
+}
@@ -0,0 +1,328 @@
+// Package webhook forwards tweets to HTTP endpoints, so they can be consumed without running Go code.
+package webhook
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fallenstedt/twitter-stream/stream"
+)
+
+const (
+	// SignatureHeader holds the HMAC-SHA256 signature of a request, such as sha256=5257a869...
+	SignatureHeader = "X-Webhook-Signature"
+	// TimestampHeader holds the unix time a request was signed at. It is part of the signature.
+	TimestampHeader = "X-Webhook-Timestamp"
+)
+
+var (
+	// ErrClosed is returned when using a forwarder that has been closed.
+	ErrClosed = errors.New("webhook forwarder is closed")
+	// ErrCircuitOpen is returned for tweets that were not sent because their endpoint kept failing,
+	// and could not be spooled because Options.SpoolDir is not set.
+	ErrCircuitOpen = errors.New("webhook endpoint is unavailable")
+	// ErrNoRaw is stream.ErrNoRaw, returned for messages whose raw payload is not available.
+	ErrNoRaw = stream.ErrNoRaw
+)
+
+type (
+	// IForwarder is the interface the forwarder struct implements.
+	IForwarder interface {
+		stream.Handler
+		Serve(ctx context.Context, s stream.IStream) error
+		Stats() []EndpointStats
+		Close() error
+	}
+
+	// Endpoint is an HTTP endpoint tweets are POSTed to.
+	Endpoint struct {
+		// Name identifies the endpoint in stats and errors, and names its spool directory. It must be unique.
+		Name string
+		URL  string
+		// Tags selects the tweets that matched a rule with one of these tags. Every tweet is sent if empty.
+		Tags []string
+		// Secret signs requests with HMAC-SHA256. Requests are not signed if empty.
+		Secret string
+		// Header is added to every request.
+		Header http.Header
+		// Concurrency is how many requests can be in flight at once. It is 4 if 0. Tweets are not
+		// delivered in order, as requests are sent concurrently and spooled requests are sent alongside
+		// new ones.
+		Concurrency int
+		// BatchSize sends up to this many tweets per request, as newline delimited JSON. A request
+		// holds a single JSON tweet if 0 or 1.
+		BatchSize int
+		// BatchWait is how long to wait for a batch to fill up before sending it. It is 1 second if 0.
+		BatchWait time.Duration
+	}
+
+	// Options configures a forwarder.
+	Options struct {
+		Endpoints []Endpoint
+		// Client sends the requests. A client with a 10 second timeout is used if nil.
+		Client *http.Client
+		// Attempts is how many times a request is sent before giving up. It is 5 if 0.
+		Attempts int
+		// Backoff is the delay before the second attempt. It doubles on every attempt after that,
+		// up to MaxBackoff. It is 500 milliseconds and 30 seconds if 0.
+		Backoff    time.Duration
+		MaxBackoff time.Duration
+		// FailureThreshold opens the circuit of an endpoint after this many failed requests in a row.
+		// It is 5 if 0.
+		FailureThreshold int
+		// OpenFor is how long an open circuit stops requests before one is let through to probe the
+		// endpoint. It is 30 seconds if 0.
+		OpenFor time.Duration
+		// SpoolDir is where requests that could not be sent are spooled, in a directory per endpoint.
+		// Spooled requests are sent again in the background once the endpoint recovers. Nothing is
+		// spooled if empty.
+		SpoolDir string
+		// OnError is called by Serve for tweets that could not be sent nor spooled.
+		OnError func(endpoint string, err error)
+	}
+
+	// EndpointStats counts the tweets sent to an endpoint.
+	EndpointStats struct {
+		Name      string
+		Delivered uint64
+		Failed    uint64
+		Spooled   uint64
+		// Pending is the number of spooled requests that were not sent yet.
+		Pending uint64
+		// Open is true when the circuit of the endpoint is open.
+		Open bool
+	}
+
+	// StatusError is returned when an endpoint responds with a status that is not 2xx.
+	StatusError struct {
+		Endpoint   string
+		StatusCode int
+	}
+
+	// payload holds the fields of a tweet the forwarder needs.
+	payload struct {
+		MatchingRules []struct {
+			Tag string `json:"tag"`
+		} `json:"matching_rules"`
+	}
+
+	forwarder struct {
+		opts      Options
+		endpoints []*endpoint
+
+		mu     sync.RWMutex
+		closed bool
+	}
+)
+
+// NewForwarder starts the workers of every endpoint, and sends the requests spooled by a previous process.
+func NewForwarder(opts Options) (IForwarder, error) {
+	if opts.Client == nil {
+		opts.Client = &http.Client{Timeout: 10 * time.Second}
+	}
+	if opts.Attempts <= 0 {
+		opts.Attempts = 5
+	}
+	if opts.Backoff <= 0 {
+		opts.Backoff = 500 * time.Millisecond
+	}
+	if opts.MaxBackoff <= 0 {
+		opts.MaxBackoff = 30 * time.Second
+	}
+	if opts.FailureThreshold <= 0 {
+		opts.FailureThreshold = 5
+	}
+	if opts.OpenFor <= 0 {
+		opts.OpenFor = 30 * time.Second
+	}
+
+	f := &forwarder{opts: opts}
+	names := map[string]bool{}
+	for _, e := range opts.Endpoints {
+		if e.Name == "" || names[e.Name] {
+			f.Close()
+			return nil, fmt.Errorf("webhook endpoint names must be unique and not empty, got %q", e.Name)
+		}
+		names[e.Name] = true
+
+		endpoint, err := newEndpoint(e, opts)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		f.endpoints = append(f.endpoints, endpoint)
+	}
+	return f, nil
+}
+
+// Handle sends message to the endpoints its tags select, and waits until it was sent or spooled. Stream errors are ignored.
+func (f *forwarder) Handle(ctx context.Context, message stream.StreamMessage) error {
+	if message.Err != nil {
+		return nil
+	}
+	endpoints, body, err := f.route(message)
+	if err != nil || len(endpoints) == 0 {
+		return err
+	}
+
+	results := make(chan error, len(endpoints))
+	for _, e := range endpoints {
+		if err := f.enqueue(ctx, e, delivery{body: body, done: func(err error) { results <- err }}); err != nil {
+			return err
+		}
+	}
+
+	var firstErr error
+	for range endpoints {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case err := <-results:
+			if err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
+
+// Serve forwards the messages of s until its messages channel is closed or ctx is done. Messages are sent
+// concurrently, and each one is acknowledged once every endpoint it was sent to received or spooled it.
+// Serve does not close the forwarder.
+func (f *forwarder) Serve(ctx context.Context, s stream.IStream) error {
+	return stream.Serve(ctx, s, stream.HandlerFunc(func(ctx context.Context, message stream.StreamMessage) error {
+		if message.Err != nil {
+			return nil
+		}
+		return f.forward(ctx, message)
+	}))
+}
+
+// Stats returns the stats of every endpoint, in the order of Options.Endpoints.
+func (f *forwarder) Stats() []EndpointStats {
+	stats := make([]EndpointStats, len(f.endpoints))
+	for i, e := range f.endpoints {
+		stats[i] = e.stats()
+	}
+	return stats
+}
+
+// Close sends the tweets that were queued and stops the workers. Requests are not retried once Close is called,
+// and the ones that fail are spooled if SpoolDir is set. Spooled requests that were not sent yet are kept on disk, and are sent by
+// the next forwarder using the same SpoolDir.
+func (f *forwarder) Close() error {
+	f.mu.Lock()
+	if f.closed {
+		f.mu.Unlock()
+		return nil
+	}
+	f.closed = true
+	f.mu.Unlock()
+
+	var firstErr error
+	for _, e := range f.endpoints {
+		if err := e.close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func (f *forwarder) forward(ctx context.Context, message stream.StreamMessage) error {
+	endpoints, body, err := f.route(message)
+	message.Release()
+	if err != nil {
+		return err
+	}
+	if len(endpoints) == 0 {
+		message.Ack()
+		return nil
+	}
+
+	remaining, failed := int32(len(endpoints)), int32(0)
+	for _, e := range endpoints {
+		name := e.Name
+		done := func(err error) {
+			if err != nil {
+				atomic.StoreInt32(&failed, 1)
+				if f.opts.OnError != nil {
+					f.opts.OnError(name, err)
+				}
+			}
+			if atomic.AddInt32(&remaining, -1) == 0 && atomic.LoadInt32(&failed) == 0 {
+				message.Ack()
+			}
+		}
+		if err := f.enqueue(ctx, e, delivery{body: body, done: done}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// route returns the endpoints message is sent to, and a copy of its raw payload.
+func (f *forwarder) route(message stream.StreamMessage) ([]*endpoint, []byte, error) {
+	raw := message.Payload()
+	if raw == nil {
+		return nil, nil, ErrNoRaw
+	}
+	var p payload
+	json.Unmarshal(raw, &p)
+	tags := make(map[string]bool, len(p.MatchingRules))
+	for _, rule := range p.MatchingRules {
+		tags[rule.Tag] = true
+	}
+
+	var endpoints []*endpoint
+	for _, e := range f.endpoints {
+		if e.matches(tags) {
+			endpoints = append(endpoints, e)
+		}
+	}
+	if len(endpoints) == 0 {
+		return nil, nil, nil
+	}
+	return endpoints, append([]byte(nil), raw...), nil
+}
+
+func (f *forwarder) enqueue(ctx context.Context, e *endpoint, d delivery) error {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	if f.closed {
+		return ErrClosed
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case e.queue <- d:
+		return nil
+	}
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("webhook endpoint %s responded with status %d", e.Endpoint, e.StatusCode)
+}
+
+// Sign returns the value of the SignatureHeader of a request with body, signed at timestamp.
+func Sign(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify reports whether signature is the signature of a request with body, signed at timestamp.
+// Receivers should also reject timestamps that are too old, so requests cannot be replayed.
+func Verify(secret, timestamp string, body []byte, signature string) bool {
+	return hmac.Equal([]byte(Sign(secret, timestamp, body)), []byte(signature))
+}
@@ -0,0 +1,60 @@
+package webhook
+
+import (
+	"sync"
+	"time"
+)
+
+// breaker is a circuit breaker. It opens after threshold failures in a row, and stops requests for openFor.
+// Then it lets a single request through to probe the endpoint, and closes if it succeeds.
+type breaker struct {
+	mu        sync.Mutex
+	threshold int
+	openFor   time.Duration
+	failures  int
+	openUntil time.Time
+	probing   bool
+	now       func() time.Time
+}
+
+func newBreaker(threshold int, openFor time.Duration) *breaker {
+	return &breaker{threshold: threshold, openFor: openFor, now: time.Now}
+}
+
+// allow reports whether a request can be sent. Callers must report its outcome with success or failure.
+func (b *breaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.failures < b.threshold {
+		return true
+	}
+	if b.probing || b.now().Before(b.openUntil) {
+		return false
+	}
+	b.probing = true
+	return true
+}
+
+func (b *breaker) success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures = 0
+	b.probing = false
+}
+
+func (b *breaker) failure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	b.probing = false
+	if b.failures >= b.threshold {
+		b.openUntil = b.now().Add(b.openFor)
+	}
+}
+
+// open reports whether requests are being stopped.
+func (b *breaker) open() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.failures >= b.threshold
+}
@@ -0,0 +1,308 @@
+package webhook
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fallenstedt/twitter-stream/spool"
+)
+
+type (
+	// delivery is a tweet queued for an endpoint. done is called once it was sent, spooled, or failed.
+	delivery struct {
+		body []byte
+		done func(err error)
+	}
+
+	endpoint struct {
+		// The counters are first so they are 64-bit aligned for atomic operations.
+		delivered uint64
+		failed    uint64
+		spooled   uint64
+
+		Endpoint
+		opts    Options
+		tags    map[string]bool
+		queue   chan delivery
+		breaker *breaker
+		spool   spool.ISpool
+		workers sync.WaitGroup
+		stop    chan struct{}
+		drained chan struct{}
+	}
+)
+
+func newEndpoint(e Endpoint, opts Options) (*endpoint, error) {
+	if e.Concurrency <= 0 {
+		e.Concurrency = 4
+	}
+	if e.BatchSize <= 0 {
+		e.BatchSize = 1
+	}
+	if e.BatchWait <= 0 {
+		e.BatchWait = time.Second
+	}
+
+	ep := &endpoint{
+		Endpoint: e,
+		opts:     opts,
+		tags:     map[string]bool{},
+		queue:    make(chan delivery, e.Concurrency*e.BatchSize),
+		breaker:  newBreaker(opts.FailureThreshold, opts.OpenFor),
+		stop:     make(chan struct{}),
+		drained:  make(chan struct{}),
+	}
+	for _, tag := range e.Tags {
+		ep.tags[tag] = true
+	}
+
+	if opts.SpoolDir != "" {
+		sp, err := spool.NewSpool(spool.Options{Dir: filepath.Join(opts.SpoolDir, e.Name), Sync: spool.SyncAlways})
+		if err != nil {
+			return nil, err
+		}
+		ep.spool = sp
+		go ep.drain()
+	} else {
+		close(ep.drained)
+	}
+
+	for i := 0; i < e.Concurrency; i++ {
+		ep.workers.Add(1)
+		go ep.work()
+	}
+	return ep, nil
+}
+
+// matches reports whether a tweet that matched rules with tags is sent to the endpoint.
+func (e *endpoint) matches(tags map[string]bool) bool {
+	if len(e.tags) == 0 {
+		return true
+	}
+	for tag := range tags {
+		if e.tags[tag] {
+			return true
+		}
+	}
+	return false
+}
+
+// work sends the queued tweets until the queue is closed.
+func (e *endpoint) work() {
+	defer e.workers.Done()
+	for d := range e.queue {
+		batch := []delivery{d}
+		if e.BatchSize > 1 {
+			batch = e.fill(batch)
+		}
+		e.send(batch)
+	}
+}
+
+// fill adds queued tweets to batch until it is full, BatchWait elapsed, or the queue is closed.
+func (e *endpoint) fill(batch []delivery) []delivery {
+	timer := time.NewTimer(e.BatchWait)
+	defer timer.Stop()
+	for len(batch) < e.BatchSize {
+		select {
+		case <-timer.C:
+			return batch
+		case d, ok := <-e.queue:
+			if !ok {
+				return batch
+			}
+			batch = append(batch, d)
+		}
+	}
+	return batch
+}
+
+// send posts batch, and spools it if the endpoint is unavailable.
+func (e *endpoint) send(batch []delivery) {
+	body := batch[0].body
+	if e.BatchSize > 1 {
+		var b bytes.Buffer
+		for _, d := range batch {
+			b.Write(d.body)
+			b.WriteByte('\n')
+		}
+		body = b.Bytes()
+	}
+
+	err := e.deliver(body)
+	counter := &e.delivered
+	if err != nil && !permanent(err) && e.spool != nil {
+		if err = e.spool.Append(body); err == nil {
+			counter = &e.spooled
+		}
+	}
+	if err != nil {
+		counter = &e.failed
+	}
+	atomic.AddUint64(counter, uint64(len(batch)))
+
+	for _, d := range batch {
+		d.done(err)
+	}
+}
+
+// deliver posts body until it succeeds, fails permanently, runs out of attempts, the circuit opens, or the
+// endpoint is closed while waiting to retry.
+func (e *endpoint) deliver(body []byte) error {
+	var err error
+	backoff := e.opts.Backoff
+	for attempt := 0; attempt < e.opts.Attempts; attempt++ {
+		if attempt > 0 {
+			if !wait(e.stop, backoff) {
+				return err
+			}
+			if backoff *= 2; backoff > e.opts.MaxBackoff {
+				backoff = e.opts.MaxBackoff
+			}
+		}
+		if err = e.try(body); err == nil || permanent(err) || err == ErrCircuitOpen {
+			return err
+		}
+	}
+	return err
+}
+
+// try posts body once if the circuit allows it, and records the outcome in the circuit.
+func (e *endpoint) try(body []byte) error {
+	if !e.breaker.allow() {
+		return ErrCircuitOpen
+	}
+	err := e.post(body)
+	// A permanent failure is a problem with the request, so the endpoint is up.
+	if err == nil || permanent(err) {
+		e.breaker.success()
+	} else {
+		e.breaker.failure()
+	}
+	return err
+}
+
+func (e *endpoint) post(body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, e.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for key, values := range e.Header {
+		req.Header[key] = values
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if e.BatchSize > 1 {
+		req.Header.Set("Content-Type", "application/x-ndjson")
+	}
+	if e.Secret != "" {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set(TimestampHeader, timestamp)
+		req.Header.Set(SignatureHeader, Sign(e.Secret, timestamp, body))
+	}
+
+	resp, err := e.opts.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return &StatusError{Endpoint: e.Name, StatusCode: resp.StatusCode}
+	}
+	return nil
+}
+
+// drain sends the spooled requests in the background until the endpoint is closed.
+func (e *endpoint) drain() {
+	defer close(e.drained)
+	for {
+		record, err := e.spool.Next(e.stop)
+		if err != nil || record.Data == nil {
+			return
+		}
+
+		backoff := e.opts.Backoff
+		for {
+			err := e.try(record.Data)
+			if err == nil || permanent(err) {
+				counter := &e.delivered
+				if err != nil {
+					counter = &e.failed
+				}
+				atomic.AddUint64(counter, uint64(e.count(record.Data)))
+				e.spool.Ack(record.ID)
+				break
+			}
+			if !wait(e.stop, backoff) {
+				return
+			}
+			if backoff *= 2; backoff > e.opts.MaxBackoff {
+				backoff = e.opts.MaxBackoff
+			}
+		}
+	}
+}
+
+// count returns the number of tweets in a request body.
+func (e *endpoint) count(body []byte) int {
+	if e.BatchSize > 1 {
+		return bytes.Count(body, []byte("\n"))
+	}
+	return 1
+}
+
+func (e *endpoint) stats() EndpointStats {
+	stats := EndpointStats{
+		Name:      e.Name,
+		Delivered: atomic.LoadUint64(&e.delivered),
+		Failed:    atomic.LoadUint64(&e.failed),
+		Spooled:   atomic.LoadUint64(&e.spooled),
+		Open:      e.breaker.open(),
+	}
+	if e.spool != nil {
+		stats.Pending = e.spool.Pending()
+	}
+	return stats
+}
+
+// close sends the queued tweets without retrying them, then stops the workers and the spool.
+func (e *endpoint) close() error {
+	close(e.stop)
+	close(e.queue)
+	e.workers.Wait()
+	<-e.drained
+	if e.spool != nil {
+		return e.spool.Close()
+	}
+	return nil
+}
+
+// permanent reports whether err will not go away by sending the request again.
+func permanent(err error) bool {
+	var statusErr *StatusError
+	if !errors.As(err, &statusErr) {
+		return false
+	}
+	code := statusErr.StatusCode
+	return code < 500 && code != http.StatusRequestTimeout && code != http.StatusTooManyRequests
+}
+
+// wait waits for d. It returns false if stop is closed first.
+func wait(stop <-chan struct{}, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-stop:
+		return false
+	case <-timer.C:
+		return true
+	}
+}
@@ -0,0 +1,343 @@
+package webhook
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fallenstedt/twitter-stream/internal/streamtest"
+	"github.com/fallenstedt/twitter-stream/stream"
+)
+
+// receiver is an endpoint that responds with statuses in order, then with 200.
+type receiver struct {
+	*httptest.Server
+	mu       sync.Mutex
+	statuses []int
+	bodies   []string
+	headers  []http.Header
+	inFlight int
+	maxed    int
+	delay    time.Duration
+}
+
+func givenReceiver(statuses ...int) *receiver {
+	r := &receiver{statuses: statuses}
+	r.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		r.mu.Lock()
+		status := http.StatusOK
+		if len(r.statuses) > 0 {
+			status, r.statuses = r.statuses[0], r.statuses[1:]
+		}
+		if status == http.StatusOK {
+			r.bodies = append(r.bodies, string(body))
+			r.headers = append(r.headers, req.Header)
+		}
+		r.inFlight++
+		if r.inFlight > r.maxed {
+			r.maxed = r.inFlight
+		}
+		r.mu.Unlock()
+
+		time.Sleep(r.delay)
+		r.mu.Lock()
+		r.inFlight--
+		r.mu.Unlock()
+		w.WriteHeader(status)
+	}))
+	return r
+}
+
+func (r *receiver) received() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.bodies...)
+}
+
+func givenTweet(id, tag string) stream.StreamMessage {
+	raw := fmt.Sprintf(`{"data":{"id":%q},"matching_rules":[{"id":"1","tag":%q}]}`, id, tag)
+	return stream.StreamMessage{Data: []byte(raw)}
+}
+
+func givenForwarder(t *testing.T, opts Options) IForwarder {
+	if opts.Backoff == 0 {
+		opts.Backoff = time.Millisecond
+	}
+	f, err := NewForwarder(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+	return f
+}
+
+func TestSign(t *testing.T) {
+	var tests = []struct {
+		secret    string
+		timestamp string
+		body      string
+		valid     bool
+	}{
+		{"secret", "1622552400", `{"data":{"id":"1"}}`, true},
+		{"other", "1622552400", `{"data":{"id":"1"}}`, false},
+		{"secret", "1622552401", `{"data":{"id":"1"}}`, false},
+		{"secret", "1622552400", `{"data":{"id":"2"}}`, false},
+	}
+
+	signature := Sign("secret", "1622552400", []byte(`{"data":{"id":"1"}}`))
+	if !strings.HasPrefix(signature, "sha256=") || len(signature) != 71 {
+		t.Fatalf("got signature %s", signature)
+	}
+	for i, tt := range tests {
+		testName := fmt.Sprintf("TestSign (%d)", i)
+		t.Run(testName, func(t *testing.T) {
+			if valid := Verify(tt.secret, tt.timestamp, []byte(tt.body), signature); valid != tt.valid {
+				t.Errorf("got %v, want %v", valid, tt.valid)
+			}
+		})
+	}
+}
+
+func TestForwarderRouting(t *testing.T) {
+	cats, all := givenReceiver(), givenReceiver()
+	defer cats.Close()
+	defer all.Close()
+	f := givenForwarder(t, Options{Endpoints: []Endpoint{
+		{Name: "cats", URL: cats.URL, Tags: []string{"cats"}, Secret: "secret", Header: http.Header{"Authorization": {"Bearer token"}}},
+		{Name: "all", URL: all.URL},
+	}})
+
+	for _, message := range []stream.StreamMessage{givenTweet("1", "cats"), givenTweet("2", "dogs"), {Err: errors.New("EOF")}} {
+		if err := f.Handle(context.Background(), message); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if result := len(cats.received()); result != 1 {
+		t.Errorf("expected cats to receive 1 tweet, got %d", result)
+	}
+	if result := len(all.received()); result != 2 {
+		t.Errorf("expected all to receive 2 tweets, got %d", result)
+	}
+	header := cats.headers[0]
+	if !Verify("secret", header.Get(TimestampHeader), []byte(cats.bodies[0]), header.Get(SignatureHeader)) {
+		t.Errorf("expected a valid signature, got %v", header)
+	}
+	if header.Get("Authorization") != "Bearer token" || header.Get("Content-Type") != "application/json" {
+		t.Errorf("got headers %v", header)
+	}
+	if all.headers[0].Get(SignatureHeader) != "" {
+		t.Errorf("expected requests without a secret not to be signed")
+	}
+
+	if err := f.Handle(context.Background(), stream.StreamMessage{Data: struct{}{}}); err != ErrNoRaw {
+		t.Errorf("expected ErrNoRaw, got %v", err)
+	}
+}
+
+func TestForwarderRetry(t *testing.T) {
+	var tests = []struct {
+		statuses []int
+		attempts int
+		status   int
+		stats    string
+	}{
+		{[]int{500, 503}, 3, 0, "1/0/0"},
+		{[]int{500, 500, 500}, 3, 500, "0/1/0"},
+		// not retried
+		{[]int{400}, 3, 400, "0/1/0"},
+		{[]int{429}, 3, 0, "1/0/0"},
+	}
+
+	for i, tt := range tests {
+		testName := fmt.Sprintf("TestForwarderRetry (%d)", i)
+		t.Run(testName, func(t *testing.T) {
+			r := givenReceiver(tt.statuses...)
+			defer r.Close()
+			f := givenForwarder(t, Options{Attempts: tt.attempts, Endpoints: []Endpoint{{Name: "a", URL: r.URL}}})
+
+			err := f.Handle(context.Background(), givenTweet("1", "cats"))
+			var statusErr *StatusError
+			if errors.As(err, &statusErr) && statusErr.StatusCode != tt.status || statusErr == nil && tt.status != 0 {
+				t.Errorf("got err %v, want status %d", err, tt.status)
+			}
+			stats := f.Stats()[0]
+			if result := fmt.Sprintf("%d/%d/%d", stats.Delivered, stats.Failed, stats.Spooled); result != tt.stats {
+				t.Errorf("got stats %s, want %s", result, tt.stats)
+			}
+		})
+	}
+}
+
+func TestForwarderCloseStopsRetries(t *testing.T) {
+	r := givenReceiver(503, 503, 503)
+	defer r.Close()
+	f := givenForwarder(t, Options{Attempts: 3, Backoff: time.Hour, Endpoints: []Endpoint{{Name: "a", URL: r.URL}}})
+
+	handled := make(chan error, 1)
+	go func() { handled <- f.Handle(context.Background(), givenTweet("1", "cats")) }()
+	deadline := time.Now().Add(time.Second)
+	for {
+		r.mu.Lock()
+		sent := len(r.statuses) < 3
+		r.mu.Unlock()
+		if sent || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	closed := make(chan struct{})
+	go func() {
+		f.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("expected Close not to wait for the backoff")
+	}
+	var statusErr *StatusError
+	if err := <-handled; !errors.As(err, &statusErr) || statusErr.StatusCode != 503 {
+		t.Errorf("expected the 503 of the first attempt, got %v", err)
+	}
+}
+
+func TestForwarderBatch(t *testing.T) {
+	r := givenReceiver()
+	defer r.Close()
+	f := givenForwarder(t, Options{Endpoints: []Endpoint{{Name: "a", URL: r.URL, Concurrency: 1, BatchSize: 3, BatchWait: 50 * time.Millisecond}}})
+
+	var messages []stream.StreamMessage
+	for i := 1; i <= 4; i++ {
+		messages = append(messages, givenTweet(fmt.Sprint(i), "cats"))
+	}
+	if err := f.Serve(context.Background(), streamtest.NewFakeStream(messages...)); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	bodies := r.received()
+	if len(bodies) != 2 || strings.Count(bodies[0], "\n") != 3 || strings.Count(bodies[1], "\n") != 1 {
+		t.Errorf("got %q", bodies)
+	}
+	if r.headers[0].Get("Content-Type") != "application/x-ndjson" {
+		t.Errorf("got headers %v", r.headers[0])
+	}
+	if err := f.Handle(context.Background(), givenTweet("5", "cats")); err != ErrClosed {
+		t.Errorf("expected ErrClosed after Close, got %v", err)
+	}
+}
+
+func TestForwarderConcurrency(t *testing.T) {
+	r := givenReceiver()
+	r.delay = 20 * time.Millisecond
+	defer r.Close()
+	f := givenForwarder(t, Options{Endpoints: []Endpoint{{Name: "a", URL: r.URL, Concurrency: 2}}})
+
+	var messages []stream.StreamMessage
+	for i := 0; i < 6; i++ {
+		messages = append(messages, givenTweet(fmt.Sprint(i), "cats"))
+	}
+	f.Serve(context.Background(), streamtest.NewFakeStream(messages...))
+	f.Close()
+
+	if len(r.received()) != 6 || r.maxed != 2 {
+		t.Errorf("got %d tweets with at most %d requests in flight", len(r.received()), r.maxed)
+	}
+}
+
+func TestForwarderSpool(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "webhook")
+	defer os.RemoveAll(dir)
+	r := givenReceiver(503, 503, 503)
+	defer r.Close()
+	opts := Options{
+		Attempts:         1,
+		FailureThreshold: 2,
+		OpenFor:          20 * time.Millisecond,
+		SpoolDir:         dir,
+		Endpoints:        []Endpoint{{Name: "a", URL: r.URL, Concurrency: 1}},
+	}
+	f := givenForwarder(t, opts)
+
+	for i := 1; i <= 3; i++ {
+		if err := f.Handle(context.Background(), givenTweet(fmt.Sprint(i), "cats")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if stats := f.Stats()[0]; stats.Spooled != 3 || !stats.Open {
+		t.Errorf("expected 3 spooled tweets and an open circuit, got %+v", stats)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(r.received()) < 3 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if stats := f.Stats()[0]; len(r.received()) != 3 || stats.Delivered != 3 || stats.Pending != 0 || stats.Open {
+		t.Errorf("expected the spooled tweets to be sent, got %d and %+v", len(r.received()), stats)
+	}
+
+	// without a spool, tweets fail while the circuit is open
+	r.mu.Lock()
+	r.statuses = []int{503, 503}
+	r.mu.Unlock()
+	opts.SpoolDir = ""
+	opts.Endpoints[0].Name = "b"
+	f = givenForwarder(t, opts)
+	f.Handle(context.Background(), givenTweet("1", "cats"))
+	f.Handle(context.Background(), givenTweet("2", "cats"))
+	if err := f.Handle(context.Background(), givenTweet("3", "cats")); err != ErrCircuitOpen {
+		t.Errorf("expected ErrCircuitOpen, got %v", err)
+	}
+}
+
+func TestBreaker(t *testing.T) {
+	var tests = []struct {
+		outcomes string
+		elapsed  time.Duration
+		result   string
+	}{
+		{"ff", 0, "ok"},
+		{"fff", 0, "open"},
+		{"fff", time.Minute, "probe"},
+		{"ffs", 0, "ok"},
+	}
+
+	for i, tt := range tests {
+		testName := fmt.Sprintf("TestBreaker (%d)", i)
+		t.Run(testName, func(t *testing.T) {
+			now := time.Now()
+			b := newBreaker(3, time.Minute)
+			b.now = func() time.Time { return now }
+			for _, outcome := range tt.outcomes {
+				if outcome == 'f' {
+					b.failure()
+				} else {
+					b.success()
+				}
+			}
+			now = now.Add(tt.elapsed)
+
+			result := "open"
+			if b.allow() {
+				result = "ok"
+				if !b.allow() {
+					result = "probe"
+				}
+			}
+			if result != tt.result {
+				t.Errorf("got %s, want %s", result, tt.result)
+			}
+		})
+	}
+}